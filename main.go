@@ -2,6 +2,7 @@ package main
 
 import (
 	"log"
+	"os"
 	"runtime"
 
 	"github.com/stenstromen/s3dbdump/mydump"
@@ -12,6 +13,14 @@ func main() {
 	runtime.SetDefaultGOMAXPROCS()
 
 	mydump.InitConfig()
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		mydump.HandleRestore(mydump.Config, os.Args[2:])
+		return
+	}
 	mydump.TestConnections()
+	if os.Getenv("DB_BINLOG_STREAM") == "1" {
+		mydump.HandleBinlogStream(mydump.Config)
+		return
+	}
 	mydump.HandleDbDump(mydump.Config)
 }
@@ -0,0 +1,409 @@
+// Package mybinlog implements the part of the MySQL client/server protocol a
+// replica uses to stream binary logs: connecting, authenticating,
+// registering and COM_BINLOG_DUMP. database/sql has no access to the
+// replication commands, hence the separate client. It also reads binary log
+// files and decodes the events a point-in-time restore replays.
+package mybinlog
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	clientLongPassword         = 0x00000001
+	clientLongFlag             = 0x00000004
+	clientProtocol41           = 0x00000200
+	clientTransactions         = 0x00002000
+	clientSecureConnection     = 0x00008000
+	clientPluginAuth           = 0x00080000
+	clientPluginAuthLenencData = 0x00200000
+
+	clientCapabilities = clientLongPassword | clientLongFlag | clientProtocol41 | clientTransactions |
+		clientSecureConnection | clientPluginAuth | clientPluginAuthLenencData
+
+	comQuery           = 0x03
+	comBinlogDump      = 0x12
+	comRegisterSlave   = 0x15
+	maxPacketSize      = 1<<24 - 1
+	utf8mb4GeneralCI   = 45
+	nativePassword     = "mysql_native_password"
+	cachingSHA2        = "caching_sha2_password"
+	fastAuthSuccess    = 3
+	performFullAuth    = 4
+	requestPublicKey   = 2
+	defaultReadTimeout = time.Minute
+)
+
+// ServerError is an error packet sent by the server.
+type ServerError struct {
+	Code    uint16
+	State   string
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("Error %d (%s): %s", e.Code, e.State, e.Message)
+}
+
+// Conn is a connection to a MySQL or MariaDB server speaking the replication
+// protocol.
+type Conn struct {
+	conn          net.Conn
+	r             *bufio.Reader
+	seq           byte
+	ServerVersion string
+	// ReadTimeout bounds the wait for the next packet, so a dead
+	// connection is noticed. It must exceed the heartbeat period.
+	ReadTimeout time.Duration
+}
+
+// Dial connects to addr and authenticates as user with
+// mysql_native_password or caching_sha2_password. The connection is not
+// encrypted; caching_sha2_password then exchanges the password encrypted
+// with the server's RSA key.
+func Dial(addr, user, password string) (*Conn, error) {
+	nc, err := net.DialTimeout("tcp", addr, 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	c := &Conn{
+		conn:        nc,
+		r:           bufio.NewReaderSize(nc, 64*1024),
+		ReadTimeout: defaultReadTimeout,
+	}
+	if err := c.handshake(user, password); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// readPacket returns the next payload, joining payloads that were split at
+// the maximum packet size.
+func (c *Conn) readPacket() ([]byte, error) {
+	var payload []byte
+	for {
+		if c.ReadTimeout > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(c.ReadTimeout))
+		}
+		var header [4]byte
+		if _, err := io.ReadFull(c.r, header[:]); err != nil {
+			return nil, err
+		}
+		length := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+		c.seq = header[3] + 1
+
+		start := len(payload)
+		payload = append(payload, make([]byte, length)...)
+		if _, err := io.ReadFull(c.r, payload[start:]); err != nil {
+			return nil, err
+		}
+		if length < maxPacketSize {
+			if len(payload) == 0 {
+				return nil, fmt.Errorf("empty packet")
+			}
+			return payload, nil
+		}
+	}
+}
+
+// writePacket sends payload, split into packets of the maximum size.
+func (c *Conn) writePacket(payload []byte) error {
+	for {
+		n := min(len(payload), maxPacketSize)
+		packet := make([]byte, 4, 4+n)
+		packet[0], packet[1], packet[2] = byte(n), byte(n>>8), byte(n>>16)
+		packet[3] = c.seq
+		c.seq++
+		if _, err := c.conn.Write(append(packet, payload[:n]...)); err != nil {
+			return err
+		}
+		payload = payload[n:]
+		// A payload of exactly the maximum size is followed by an empty
+		// packet to mark its end.
+		if n < maxPacketSize {
+			return nil
+		}
+	}
+}
+
+// command starts a new command, which resets the sequence number.
+func (c *Conn) command(payload []byte) error {
+	c.seq = 0
+	return c.writePacket(payload)
+}
+
+// readOK reads the response to a command that returns no result set.
+func (c *Conn) readOK() error {
+	data, err := c.readPacket()
+	if err != nil {
+		return err
+	}
+	switch data[0] {
+	case 0x00:
+		return nil
+	case 0xff:
+		return parseError(data)
+	default:
+		return fmt.Errorf("unexpected response 0x%02x", data[0])
+	}
+}
+
+func parseError(data []byte) error {
+	e := &ServerError{}
+	if len(data) >= 3 {
+		e.Code = binary.LittleEndian.Uint16(data[1:])
+		data = data[3:]
+	}
+	if len(data) >= 6 && data[0] == '#' {
+		e.State = string(data[1:6])
+		data = data[6:]
+	}
+	e.Message = string(data)
+	return e
+}
+
+func (c *Conn) handshake(user, password string) error {
+	data, err := c.readPacket()
+	if err != nil {
+		return fmt.Errorf("error reading handshake: %w", err)
+	}
+	if data[0] == 0xff {
+		return parseError(data)
+	}
+	if data[0] != 10 {
+		return fmt.Errorf("unsupported protocol version %d", data[0])
+	}
+
+	pos := 1
+	end := bytes.IndexByte(data[pos:], 0)
+	if end < 0 || len(data) < pos+end+1+4+8+1+2 {
+		return fmt.Errorf("malformed handshake")
+	}
+	c.ServerVersion = string(data[pos : pos+end])
+	pos += end + 1 + 4 // connection id
+	scramble := append([]byte(nil), data[pos:pos+8]...)
+	pos += 8 + 1
+	capabilities := uint32(binary.LittleEndian.Uint16(data[pos:]))
+	pos += 2
+
+	plugin := nativePassword
+	if len(data) >= pos+16 {
+		pos += 1 + 2 // character set, status
+		capabilities |= uint32(binary.LittleEndian.Uint16(data[pos:])) << 16
+		pos += 2
+		authLength := int(data[pos])
+		pos += 1 + 10
+		if capabilities&clientSecureConnection != 0 {
+			n := min(max(13, authLength-8), len(data)-pos)
+			part := data[pos : pos+n]
+			scramble = append(scramble, bytes.TrimRight(part, "\x00")...)
+			pos += n
+		}
+		if capabilities&clientPluginAuth != 0 && pos < len(data) {
+			plugin = string(bytes.TrimRight(data[pos:], "\x00"))
+		}
+	}
+	if capabilities&clientProtocol41 == 0 {
+		return fmt.Errorf("server %s does not support protocol 4.1", c.ServerVersion)
+	}
+
+	auth, err := authResponse(plugin, password, scramble)
+	if err != nil {
+		return err
+	}
+	response := binary.LittleEndian.AppendUint32(nil, clientCapabilities)
+	response = binary.LittleEndian.AppendUint32(response, maxPacketSize)
+	response = append(response, utf8mb4GeneralCI)
+	response = append(response, make([]byte, 23)...)
+	response = append(response, user...)
+	response = append(response, 0)
+	response = appendLengthEncoded(response, auth)
+	response = append(response, plugin...)
+	response = append(response, 0)
+	if err := c.writePacket(response); err != nil {
+		return err
+	}
+
+	return c.authenticate(plugin, password, scramble)
+}
+
+// authenticate follows the server through auth switches and the extra
+// rounds of caching_sha2_password until it accepts or rejects the login.
+func (c *Conn) authenticate(plugin, password string, scramble []byte) error {
+	for {
+		data, err := c.readPacket()
+		if err != nil {
+			return fmt.Errorf("error authenticating: %w", err)
+		}
+		switch {
+		case data[0] == 0x00:
+			return nil
+		case data[0] == 0xff:
+			return parseError(data)
+		case data[0] == 0xfe:
+			// Auth switch: the server asks for another plugin with a
+			// fresh scramble.
+			rest := data[1:]
+			end := bytes.IndexByte(rest, 0)
+			if end < 0 {
+				return fmt.Errorf("malformed auth switch request")
+			}
+			plugin = string(rest[:end])
+			scramble = bytes.TrimRight(rest[end+1:], "\x00")
+			auth, err := authResponse(plugin, password, scramble)
+			if err != nil {
+				return err
+			}
+			if err := c.writePacket(auth); err != nil {
+				return err
+			}
+		case data[0] == 0x01 && plugin == cachingSHA2 && len(data) == 2:
+			switch data[1] {
+			case fastAuthSuccess:
+				// An OK packet follows.
+			case performFullAuth:
+				if err := c.fullAuth(password, scramble); err != nil {
+					return err
+				}
+			default:
+				return fmt.Errorf("unexpected caching_sha2_password state %d", data[1])
+			}
+		default:
+			return fmt.Errorf("unexpected authentication packet 0x%02x", data[0])
+		}
+	}
+}
+
+// fullAuth sends the password encrypted with the RSA public key of the
+// server, which caching_sha2_password asks for when the password is not in
+// its cache.
+func (c *Conn) fullAuth(password string, scramble []byte) error {
+	if password == "" {
+		return c.writePacket([]byte{0})
+	}
+	if err := c.writePacket([]byte{requestPublicKey}); err != nil {
+		return err
+	}
+	data, err := c.readPacket()
+	if err != nil {
+		return err
+	}
+	if data[0] == 0xff {
+		return parseError(data)
+	}
+	if data[0] != 0x01 {
+		return fmt.Errorf("unexpected public key response 0x%02x", data[0])
+	}
+	encrypted, err := encryptPassword(password, scramble, data[1:])
+	if err != nil {
+		return err
+	}
+	return c.writePacket(encrypted)
+}
+
+func authResponse(plugin, password string, scramble []byte) ([]byte, error) {
+	if password == "" {
+		return nil, nil
+	}
+	switch plugin {
+	case nativePassword:
+		return scrambleNative(password, scramble), nil
+	case cachingSHA2:
+		return scrambleSHA256(password, scramble), nil
+	default:
+		return nil, fmt.Errorf("unsupported authentication plugin %s", plugin)
+	}
+}
+
+// scrambleNative computes SHA1(password) XOR SHA1(scramble + SHA1(SHA1(password))).
+func scrambleNative(password string, scramble []byte) []byte {
+	stage1 := sha1.Sum([]byte(password))
+	stage2 := sha1.Sum(stage1[:])
+	h := sha1.New()
+	h.Write(scramble[:min(len(scramble), 20)])
+	h.Write(stage2[:])
+	result := h.Sum(nil)
+	for i := range result {
+		result[i] ^= stage1[i]
+	}
+	return result
+}
+
+// scrambleSHA256 computes SHA256(password) XOR
+// SHA256(SHA256(SHA256(password)) + scramble).
+func scrambleSHA256(password string, scramble []byte) []byte {
+	stage1 := sha256.Sum256([]byte(password))
+	stage2 := sha256.Sum256(stage1[:])
+	h := sha256.New()
+	h.Write(stage2[:])
+	h.Write(scramble[:min(len(scramble), 20)])
+	result := h.Sum(nil)
+	for i := range result {
+		result[i] ^= stage1[i]
+	}
+	return result
+}
+
+func encryptPassword(password string, scramble, publicKey []byte) ([]byte, error) {
+	block, _ := pem.Decode(publicKey)
+	if block == nil {
+		return nil, fmt.Errorf("malformed public key from server")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing public key from server: %w", err)
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key from server is not an RSA key")
+	}
+
+	plain := append([]byte(password), 0)
+	for i := range plain {
+		plain[i] ^= scramble[i%len(scramble)]
+	}
+	return rsa.EncryptOAEP(sha1.New(), rand.Reader, rsaKey, plain, nil)
+}
+
+func appendLengthEncoded(b, data []byte) []byte {
+	switch n := len(data); {
+	case n < 251:
+		b = append(b, byte(n))
+	case n < 1<<16:
+		b = append(b, 0xfc, byte(n), byte(n>>8))
+	case n < 1<<24:
+		b = append(b, 0xfd, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		b = append(b, 0xfe)
+		b = binary.LittleEndian.AppendUint64(b, uint64(n))
+	}
+	return append(b, data...)
+}
+
+// Exec runs a statement that returns no result set, such as SET.
+func (c *Conn) Exec(query string) error {
+	if err := c.command(append([]byte{comQuery}, query...)); err != nil {
+		return err
+	}
+	if err := c.readOK(); err != nil {
+		return fmt.Errorf("error running %q: %w", query, err)
+	}
+	return nil
+}
@@ -0,0 +1,283 @@
+package mybinlog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Event types a restore decodes or knowingly skips.
+const (
+	QueryEvent             = 2
+	StopEvent              = 3
+	IntvarEvent            = 5
+	RandEvent              = 13
+	UserVarEvent           = 14
+	XIDEvent               = 16
+	TableMapEvent          = 19
+	WriteRowsEventV1       = 23
+	UpdateRowsEventV1      = 24
+	DeleteRowsEventV1      = 25
+	IgnorableEvent         = 28
+	RowsQueryEvent         = 29
+	WriteRowsEvent         = 30
+	UpdateRowsEvent        = 31
+	DeleteRowsEvent        = 32
+	GTIDEvent              = 33
+	AnonymousGTIDEvent     = 34
+	PreviousGTIDsEvent     = 35
+	TransactionContext     = 36
+	PartialUpdateRowsEvent = 39
+
+	// MariaDB only.
+	AnnotateRowsEvent     = 160
+	BinlogCheckpointEvent = 161
+	MariaDBGTIDEvent      = 162
+	GTIDListEvent         = 163
+)
+
+var errShortEvent = errors.New("binlog event is too short")
+
+// Query is a decoded query event.
+type Query struct {
+	Database string
+	SQL      string
+	// Session holds the session variables the statement ran with, as
+	// assignments for a SET statement that precedes it on replay.
+	Session []string
+}
+
+// Query flags carried in the flags2 status variable.
+const (
+	optionAutoIsNull          = 1 << 14
+	optionNotAutocommit       = 1 << 19
+	optionNoForeignKeyChecks  = 1 << 26
+	optionRelaxedUniqueChecks = 1 << 27
+)
+
+// Query decodes a query event. Session covers the status variables that
+// change what a statement does; the rest are skipped, and decoding stops at
+// the first one it does not know, as their sizes are not recorded.
+func (e Event) Query() (Query, error) {
+	body := e.Body()
+	if len(body) < 13 {
+		return Query{}, errShortEvent
+	}
+	dbLen := int(body[8])
+	varsLen := int(binary.LittleEndian.Uint16(body[11:]))
+	if len(body) < 13+varsLen+dbLen+1 {
+		return Query{}, errShortEvent
+	}
+	vars := body[13 : 13+varsLen]
+	rest := body[13+varsLen:]
+
+	q := Query{
+		Database: string(rest[:dbLen]),
+		SQL:      string(rest[dbLen+1:]),
+		Session:  []string{fmt.Sprintf("@@session.timestamp=%d", e.Timestamp)},
+	}
+	for len(vars) > 0 {
+		code, n := vars[0], 0
+		vars = vars[1:]
+		switch code {
+		case 0: // flags2
+			if len(vars) < 4 {
+				return q, errShortEvent
+			}
+			flags := binary.LittleEndian.Uint32(vars)
+			q.Session = append(q.Session,
+				fmt.Sprintf("@@session.foreign_key_checks=%d", boolInt(flags&optionNoForeignKeyChecks == 0)),
+				fmt.Sprintf("@@session.sql_auto_is_null=%d", boolInt(flags&optionAutoIsNull != 0)),
+				fmt.Sprintf("@@session.unique_checks=%d", boolInt(flags&optionRelaxedUniqueChecks == 0)),
+				fmt.Sprintf("@@session.autocommit=%d", boolInt(flags&optionNotAutocommit == 0)),
+			)
+			n = 4
+		case 1: // sql_mode
+			if len(vars) < 8 {
+				return q, errShortEvent
+			}
+			q.Session = append(q.Session, fmt.Sprintf("@@session.sql_mode=%d", binary.LittleEndian.Uint64(vars)))
+			n = 8
+		case 2: // catalog, with a terminating NUL
+			if len(vars) < 1 {
+				return q, errShortEvent
+			}
+			n = 1 + int(vars[0]) + 1
+		case 3: // auto_increment_increment and auto_increment_offset
+			if len(vars) < 4 {
+				return q, errShortEvent
+			}
+			q.Session = append(q.Session,
+				fmt.Sprintf("@@session.auto_increment_increment=%d", binary.LittleEndian.Uint16(vars)),
+				fmt.Sprintf("@@session.auto_increment_offset=%d", binary.LittleEndian.Uint16(vars[2:])),
+			)
+			n = 4
+		case 4: // character set of the client, connection and server
+			if len(vars) < 6 {
+				return q, errShortEvent
+			}
+			q.Session = append(q.Session,
+				fmt.Sprintf("@@session.character_set_client=%d", binary.LittleEndian.Uint16(vars)),
+				fmt.Sprintf("@@session.collation_connection=%d", binary.LittleEndian.Uint16(vars[2:])),
+				fmt.Sprintf("@@session.collation_server=%d", binary.LittleEndian.Uint16(vars[4:])),
+			)
+			n = 6
+		case 5: // time_zone
+			if len(vars) < 1 || len(vars) < 1+int(vars[0]) {
+				return q, errShortEvent
+			}
+			zone := string(vars[1 : 1+int(vars[0])])
+			q.Session = append(q.Session, "@@session.time_zone='"+strings.ReplaceAll(zone, "'", "''")+"'")
+			n = 1 + int(vars[0])
+		case 6: // catalog
+			if len(vars) < 1 {
+				return q, errShortEvent
+			}
+			n = 1 + int(vars[0])
+		case 7: // lc_time_names
+			if len(vars) < 2 {
+				return q, errShortEvent
+			}
+			q.Session = append(q.Session, fmt.Sprintf("@@session.lc_time_names=%d", binary.LittleEndian.Uint16(vars)))
+			n = 2
+		case 8: // collation_database
+			if len(vars) < 2 {
+				return q, errShortEvent
+			}
+			q.Session = append(q.Session, fmt.Sprintf("@@session.collation_database=%d", binary.LittleEndian.Uint16(vars)))
+			n = 2
+		default:
+			return q, nil
+		}
+		if len(vars) < n {
+			return q, errShortEvent
+		}
+		vars = vars[n:]
+	}
+	return q, nil
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Variables returns the assignments an intvar or rand event makes before
+// the statement that follows it, for a SET statement.
+func (e Event) Variables() (string, error) {
+	body := e.Body()
+	switch e.Type {
+	case IntvarEvent:
+		if len(body) < 9 {
+			return "", errShortEvent
+		}
+		value := binary.LittleEndian.Uint64(body[1:])
+		switch body[0] {
+		case 1:
+			return fmt.Sprintf("LAST_INSERT_ID=%d", value), nil
+		case 2:
+			return fmt.Sprintf("INSERT_ID=%d", value), nil
+		}
+		return "", fmt.Errorf("unknown intvar type %d", body[0])
+	case RandEvent:
+		if len(body) < 16 {
+			return "", errShortEvent
+		}
+		return fmt.Sprintf("@@RAND_SEED1=%d, @@RAND_SEED2=%d", binary.LittleEndian.Uint64(body), binary.LittleEndian.Uint64(body[8:])), nil
+	}
+	return "", fmt.Errorf("event type %d sets no variables", e.Type)
+}
+
+// TableMap decodes a table map event, which assigns the table ID the rows
+// events that follow it refer to.
+func (e Event) TableMap() (tableID uint64, database, table string, err error) {
+	body := e.Body()
+	if len(body) < 9 {
+		return 0, "", "", errShortEvent
+	}
+	tableID = uint48(body)
+	rest := body[8:]
+	dbLen := int(rest[0])
+	if len(rest) < 1+dbLen+2 {
+		return 0, "", "", errShortEvent
+	}
+	database = string(rest[1 : 1+dbLen])
+	rest = rest[1+dbLen+1:]
+	tableLen := int(rest[0])
+	if len(rest) < 1+tableLen {
+		return 0, "", "", errShortEvent
+	}
+	return tableID, database, string(rest[1 : 1+tableLen]), nil
+}
+
+// rowsStatementEnd flags the last rows event of a statement.
+const rowsStatementEnd = 1
+
+// IsRows reports whether the event holds row changes.
+func (e Event) IsRows() bool {
+	switch e.Type {
+	case WriteRowsEventV1, UpdateRowsEventV1, DeleteRowsEventV1,
+		WriteRowsEvent, UpdateRowsEvent, DeleteRowsEvent, PartialUpdateRowsEvent:
+		return true
+	}
+	return false
+}
+
+// Rows decodes the header of a rows event: the table it changes and whether
+// it is the last event of its statement.
+func (e Event) Rows() (tableID uint64, statementEnd bool, err error) {
+	body := e.Body()
+	if len(body) < 8 {
+		return 0, false, errShortEvent
+	}
+	return uint48(body), binary.LittleEndian.Uint16(body[6:])&rowsStatementEnd != 0, nil
+}
+
+func uint48(b []byte) uint64 {
+	return uint64(binary.LittleEndian.Uint32(b)) | uint64(binary.LittleEndian.Uint16(b[4:]))<<32
+}
+
+// mariadbStandalone marks a MariaDB GTID event of a statement that runs
+// outside of a transaction, such as DDL.
+const mariadbStandalone = 1
+
+// GTID decodes a MySQL or MariaDB GTID event. MariaDB starts a transaction
+// with its GTID event instead of a BEGIN query, which implicitBegin
+// reports.
+func (e Event) GTID() (gtid GTID, implicitBegin bool, err error) {
+	body := e.Body()
+	switch e.Type {
+	case GTIDEvent:
+		if len(body) < 25 {
+			return GTID{}, false, errShortEvent
+		}
+		return GTID{Source: formatUUID(body[1:17]), Seq: binary.LittleEndian.Uint64(body[17:])}, false, nil
+	case MariaDBGTIDEvent:
+		if len(body) < 13 {
+			return GTID{}, false, errShortEvent
+		}
+		gtid = GTID{
+			MariaDB:  true,
+			Domain:   binary.LittleEndian.Uint32(body[8:]),
+			ServerID: e.ServerID,
+			Seq:      binary.LittleEndian.Uint64(body),
+		}
+		return gtid, body[12]&mariadbStandalone == 0, nil
+	}
+	return GTID{}, false, fmt.Errorf("event type %d is not a GTID event", e.Type)
+}
+
+func formatUUID(b []byte) string {
+	var s bytes.Buffer
+	for i, c := range b {
+		if i == 4 || i == 6 || i == 8 || i == 10 {
+			s.WriteByte('-')
+		}
+		fmt.Fprintf(&s, "%02x", c)
+	}
+	return s.String()
+}
@@ -0,0 +1,32 @@
+package mybinlog
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SplitFileName splits a binary log file name such as mysql-bin.000042 into
+// its base name and sequence number.
+func SplitFileName(name string) (base string, seq int, ok bool) {
+	dot := strings.LastIndexByte(name, '.')
+	if dot < 0 {
+		return "", 0, false
+	}
+	seq, err := strconv.Atoi(name[dot+1:])
+	if err != nil || seq < 0 {
+		return "", 0, false
+	}
+	return name[:dot], seq, true
+}
+
+// NextFileName returns the name of the binary log file the server writes
+// after name.
+func NextFileName(name string) (string, error) {
+	base, seq, ok := SplitFileName(name)
+	if !ok {
+		return "", fmt.Errorf("%q is not a binary log file name", name)
+	}
+	width := len(name) - len(base) - 1
+	return fmt.Sprintf("%s.%0*d", base, width, seq+1), nil
+}
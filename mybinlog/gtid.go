@@ -0,0 +1,117 @@
+package mybinlog
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// GTID identifies a transaction: source:seq on MySQL, where the source is
+// the UUID of the server that ran it, optionally followed by a tag, or
+// domain-server-seq on MariaDB.
+type GTID struct {
+	MariaDB  bool
+	Source   string
+	Domain   uint32
+	ServerID uint32
+	Seq      uint64
+}
+
+// ParseGTID parses a single MySQL or MariaDB GTID.
+func ParseGTID(s string) (GTID, error) {
+	s = strings.TrimSpace(s)
+	if i := strings.LastIndexByte(s, ':'); i >= 0 {
+		seq, err := strconv.ParseUint(s[i+1:], 10, 64)
+		if err != nil || seq == 0 || i == 0 {
+			return GTID{}, fmt.Errorf("invalid GTID %q", s)
+		}
+		return GTID{Source: strings.ToLower(s[:i]), Seq: seq}, nil
+	}
+
+	parts := strings.Split(s, "-")
+	if len(parts) != 3 {
+		return GTID{}, fmt.Errorf("invalid GTID %q: must be source:seq or domain-server-seq", s)
+	}
+	domain, err1 := strconv.ParseUint(parts[0], 10, 32)
+	serverID, err2 := strconv.ParseUint(parts[1], 10, 32)
+	seq, err3 := strconv.ParseUint(parts[2], 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return GTID{}, fmt.Errorf("invalid GTID %q", s)
+	}
+	return GTID{MariaDB: true, Domain: uint32(domain), ServerID: uint32(serverID), Seq: seq}, nil
+}
+
+func (g GTID) String() string {
+	if g.MariaDB {
+		return fmt.Sprintf("%d-%d-%d", g.Domain, g.ServerID, g.Seq)
+	}
+	return fmt.Sprintf("%s:%d", g.Source, g.Seq)
+}
+
+// GTIDSet is a set of executed transactions: gtid_executed on MySQL, or
+// gtid_binlog_pos on MariaDB.
+type GTIDSet struct {
+	// intervals holds the inclusive sequence number ranges of every MySQL
+	// source.
+	intervals map[string][][2]uint64
+	// domains holds the last sequence number of every MariaDB domain. They
+	// are applied in order, so it covers all sequence numbers before it.
+	domains map[uint32]uint64
+}
+
+// ParseGTIDSet parses a MySQL GTID set such as
+// "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5:7" or a MariaDB GTID position
+// such as "0-1-100,1-2-7".
+func ParseGTIDSet(s string) (GTIDSet, error) {
+	set := GTIDSet{intervals: make(map[string][][2]uint64), domains: make(map[uint32]uint64)}
+	for _, element := range strings.Split(s, ",") {
+		element = strings.TrimSpace(element)
+		if element == "" {
+			continue
+		}
+
+		if !strings.Contains(element, ":") {
+			gtid, err := ParseGTID(element)
+			if err != nil {
+				return GTIDSet{}, fmt.Errorf("invalid GTID set %q: %w", s, err)
+			}
+			set.domains[gtid.Domain] = max(set.domains[gtid.Domain], gtid.Seq)
+			continue
+		}
+
+		parts := strings.Split(element, ":")
+		source := strings.ToLower(parts[0])
+		for _, part := range parts[1:] {
+			lower, upper, isRange := strings.Cut(part, "-")
+			first, err := strconv.ParseUint(lower, 10, 64)
+			if err != nil {
+				// Not a number, so a tag: the ranges that follow belong
+				// to source:tag.
+				source = strings.ToLower(parts[0] + ":" + part)
+				continue
+			}
+			last := first
+			if isRange {
+				if last, err = strconv.ParseUint(upper, 10, 64); err != nil || last < first {
+					return GTIDSet{}, fmt.Errorf("invalid GTID set %q: bad range %q", s, part)
+				}
+			}
+			set.intervals[source] = append(set.intervals[source], [2]uint64{first, last})
+		}
+	}
+	return set, nil
+}
+
+// Contains reports whether the transaction gtid is in the set.
+func (s GTIDSet) Contains(gtid GTID) bool {
+	if gtid.MariaDB {
+		last, ok := s.domains[gtid.Domain]
+		return ok && gtid.Seq <= last
+	}
+	for _, interval := range s.intervals[gtid.Source] {
+		if interval[0] <= gtid.Seq && gtid.Seq <= interval[1] {
+			return true
+		}
+	}
+	return false
+}
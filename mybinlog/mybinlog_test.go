@@ -0,0 +1,524 @@
+package mybinlog
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"hash/crc32"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// fakeServer plays the server side of one connection.
+type fakeServer struct {
+	conn     net.Conn
+	seq      byte
+	scramble []byte
+}
+
+// startFakeServer listens on a local port and runs serve for the first
+// connection. It returns the address to dial.
+func startFakeServer(t *testing.T, serve func(s *fakeServer)) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	done := make(chan struct{})
+	t.Cleanup(func() { <-done })
+	go func() {
+		defer close(done)
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		serve(&fakeServer{conn: conn, scramble: []byte("abcdefghijklmnopqrst")})
+	}()
+	return listener.Addr().String()
+}
+
+func (s *fakeServer) write(payload []byte) {
+	header := []byte{byte(len(payload)), byte(len(payload) >> 8), byte(len(payload) >> 16), s.seq}
+	s.seq++
+	s.conn.Write(append(header, payload...))
+}
+
+func (s *fakeServer) read() []byte {
+	var header [4]byte
+	if _, err := io.ReadFull(s.conn, header[:]); err != nil {
+		return nil
+	}
+	s.seq = header[3] + 1
+	payload := make([]byte, int(header[0])|int(header[1])<<8|int(header[2])<<16)
+	io.ReadFull(s.conn, payload)
+	return payload
+}
+
+func (s *fakeServer) ok() {
+	s.write([]byte{0x00, 0, 0, 2, 0, 0, 0})
+}
+
+func (s *fakeServer) fail(code uint16, message string) {
+	payload := binary.LittleEndian.AppendUint16([]byte{0xff}, code)
+	payload = append(payload, "#HY000"...)
+	s.write(append(payload, message...))
+}
+
+// handshake sends the initial handshake and returns the user and auth data
+// of the client's response.
+func (s *fakeServer) handshake(plugin string) (user string, auth []byte) {
+	s.seq = 0
+	payload := []byte{10}
+	payload = append(payload, "8.0.36\x00"...)
+	payload = append(payload, 1, 0, 0, 0)
+	payload = append(payload, s.scramble[:8]...)
+	payload = append(payload, 0)
+	capabilities := uint32(clientCapabilities)
+	payload = binary.LittleEndian.AppendUint16(payload, uint16(capabilities))
+	payload = append(payload, utf8mb4GeneralCI, 2, 0)
+	payload = binary.LittleEndian.AppendUint16(payload, uint16(capabilities>>16))
+	payload = append(payload, 21)
+	payload = append(payload, make([]byte, 10)...)
+	payload = append(payload, s.scramble[8:]...)
+	payload = append(payload, 0)
+	payload = append(payload, plugin...)
+	payload = append(payload, 0)
+	s.write(payload)
+
+	response := s.read()
+	rest := response[32:]
+	end := bytes.IndexByte(rest, 0)
+	user = string(rest[:end])
+	rest = rest[end+1:]
+	auth = rest[1 : 1+int(rest[0])]
+	return user, auth
+}
+
+func TestDial_NativePassword(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		password string
+		wantErr  bool
+	}{
+		{name: "correct password", password: "secret"},
+		{name: "wrong password", password: "guess", wantErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := startFakeServer(t, func(s *fakeServer) {
+				user, auth := s.handshake(nativePassword)
+				if user != "repl" || !bytes.Equal(auth, scrambleNative("secret", s.scramble)) {
+					s.fail(1045, "Access denied for user 'repl'")
+					return
+				}
+				s.ok()
+			})
+
+			conn, err := Dial(addr, "repl", tt.password)
+			if tt.wantErr {
+				var serverErr *ServerError
+				if !errors.As(err, &serverErr) || serverErr.Code != 1045 {
+					t.Fatalf("Expected access denied error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Dial returned error: %v", err)
+			}
+			defer conn.Close()
+			if conn.ServerVersion != "8.0.36" {
+				t.Errorf("ServerVersion = %q", conn.ServerVersion)
+			}
+		})
+	}
+}
+
+func TestDial_CachingSHA2FullAuth(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+	addr := startFakeServer(t, func(s *fakeServer) {
+		_, auth := s.handshake(cachingSHA2)
+		if !bytes.Equal(auth, scrambleSHA256("secret", s.scramble)) {
+			s.fail(1045, "Access denied")
+			return
+		}
+		// Pretend the password is not cached, so the client has to
+		// send it in full.
+		s.write([]byte{0x01, performFullAuth})
+		if request := s.read(); !bytes.Equal(request, []byte{requestPublicKey}) {
+			s.fail(1045, "expected public key request")
+			return
+		}
+		s.write(append([]byte{0x01}, publicKey...))
+
+		plain, err := rsa.DecryptOAEP(sha1.New(), nil, key, s.read(), nil)
+		if err != nil {
+			s.fail(1045, err.Error())
+			return
+		}
+		for i := range plain {
+			plain[i] ^= s.scramble[i%len(s.scramble)]
+		}
+		if string(plain) != "secret\x00" {
+			s.fail(1045, "Access denied")
+			return
+		}
+		s.ok()
+	})
+
+	conn, err := Dial(addr, "repl", "secret")
+	if err != nil {
+		t.Fatalf("Dial returned error: %v", err)
+	}
+	conn.Close()
+}
+
+// event builds a binlog event, with a CRC32 checksum when checksum is set.
+func event(eventType byte, flags uint16, logPos uint32, body []byte, checksum bool) []byte {
+	size := HeaderSize + len(body)
+	if checksum {
+		size += 4
+	}
+	raw := binary.LittleEndian.AppendUint32(nil, 1700000000)
+	raw = append(raw, eventType)
+	raw = binary.LittleEndian.AppendUint32(raw, 1)
+	raw = binary.LittleEndian.AppendUint32(raw, uint32(size))
+	raw = binary.LittleEndian.AppendUint32(raw, logPos)
+	raw = binary.LittleEndian.AppendUint16(raw, flags)
+	raw = append(raw, body...)
+	if checksum {
+		raw = binary.LittleEndian.AppendUint32(raw, crc32.ChecksumIEEE(raw))
+	}
+	return raw
+}
+
+func rotateBody(file string) []byte {
+	return append(binary.LittleEndian.AppendUint64(nil, 4), file...)
+}
+
+func TestDump(t *testing.T) {
+	events := [][]byte{
+		event(RotateEvent, artificialFlag, 0, rotateBody("mysql-bin.000007"), false),
+		event(FormatDescriptionEvent, 0, 125, make([]byte, 98), true),
+		event(HeartbeatEvent, 0, 125, []byte("mysql-bin.000007"), true),
+		event(RotateEvent, 0, 177, rotateBody("mysql-bin.000008"), true),
+	}
+
+	addr := startFakeServer(t, func(s *fakeServer) {
+		s.handshake(nativePassword)
+		s.ok()
+		for {
+			command := s.read()
+			if command == nil {
+				return
+			}
+			switch command[0] {
+			case comQuery, comRegisterSlave:
+				s.ok()
+			case comBinlogDump:
+				if pos := binary.LittleEndian.Uint32(command[1:]); pos != 4 || string(command[11:]) != "mysql-bin.000007" {
+					s.fail(1236, "Could not find first log file name in binary log index file")
+					return
+				}
+				for _, e := range events {
+					s.write(append([]byte{0x00}, e...))
+				}
+				s.write([]byte{0xfe, 0, 0, 2, 0})
+			}
+		}
+	})
+
+	conn, err := Dial(addr, "repl", "")
+	if err != nil {
+		t.Fatalf("Dial returned error: %v", err)
+	}
+	defer conn.Close()
+
+	if err := conn.Exec("SET @master_binlog_checksum = @@global.binlog_checksum"); err != nil {
+		t.Fatalf("Exec returned error: %v", err)
+	}
+	if err := conn.RegisterReplica(4294967040); err != nil {
+		t.Fatalf("RegisterReplica returned error: %v", err)
+	}
+	if err := conn.Dump(4294967040, "mysql-bin.000007", 4); err != nil {
+		t.Fatalf("Dump returned error: %v", err)
+	}
+
+	var got []Event
+	for {
+		e, err := conn.ReadEvent()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("ReadEvent returned error: %v", err)
+		}
+		got = append(got, e)
+	}
+	if len(got) != len(events) {
+		t.Fatalf("Expected %d events, got %d", len(events), len(got))
+	}
+	for i, e := range got {
+		if !bytes.Equal(e.Raw, events[i]) {
+			t.Errorf("Event %d differs from what was sent", i)
+		}
+	}
+
+	for i, want := range []bool{true, false, true, false} {
+		if got[i].Artificial() != want {
+			t.Errorf("Event %d: Artificial() = %v, want %v", i, got[i].Artificial(), want)
+		}
+	}
+	if file, ok := got[0].NextFile(); !ok || file != "mysql-bin.000007" {
+		t.Errorf("NextFile() of rotate without checksum = %q, %v", file, ok)
+	}
+	if file, ok := got[3].NextFile(); !ok || file != "mysql-bin.000008" {
+		t.Errorf("NextFile() of rotate with checksum = %q, %v", file, ok)
+	}
+	if _, ok := got[1].NextFile(); ok {
+		t.Error("Expected NextFile() to reject a format description event")
+	}
+}
+
+func TestPacketsSplitAtMaximumSize(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	writer := &Conn{conn: client}
+	reader := &Conn{conn: server, r: bufio.NewReader(server)}
+
+	payload := bytes.Repeat([]byte{'x'}, maxPacketSize+10)
+	go writer.writePacket(payload)
+
+	got, err := reader.readPacket()
+	if err != nil {
+		t.Fatalf("readPacket returned error: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Errorf("Expected %d bytes back, got %d", len(payload), len(got))
+	}
+	if reader.seq != 2 {
+		t.Errorf("Expected the payload to arrive in two packets, next sequence is %d", reader.seq)
+	}
+}
+
+func TestNextFileName(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{name: "mysql-bin.000041", want: "mysql-bin.000042"},
+		{name: "binlog.000009", want: "binlog.000010"},
+		{name: "mysql-bin.999999", want: "mysql-bin.1000000"},
+		{name: "host.example.com-bin.000001", want: "host.example.com-bin.000002"},
+		{name: "mysql-bin", wantErr: true},
+		{name: "mysql-bin.index", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NextFileName(tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NextFileName(%q) error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("NextFileName(%q) = %q, want %q", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+// formatDescription builds a format description event of a file written
+// with or without checksums.
+func formatDescription(checksum bool) []byte {
+	body := make([]byte, 98)
+	if checksum {
+		body[len(body)-1] = checksumCRC32
+	}
+	return event(FormatDescriptionEvent, 0, 4+uint32(HeaderSize+len(body)+4), body, true)
+}
+
+// queryBody builds the body of a query event.
+func queryBody(database, query string, vars []byte) []byte {
+	body := binary.LittleEndian.AppendUint32(nil, 7) // thread id
+	body = binary.LittleEndian.AppendUint32(body, 0) // exec time
+	body = append(body, byte(len(database)))
+	body = binary.LittleEndian.AppendUint16(body, 0) // error code
+	body = binary.LittleEndian.AppendUint16(body, uint16(len(vars)))
+	body = append(body, vars...)
+	body = append(body, database...)
+	body = append(body, 0)
+	return append(body, query...)
+}
+
+func TestReader(t *testing.T) {
+	for _, checksum := range []bool{true, false} {
+		var file bytes.Buffer
+		file.Write(FileHeader)
+		file.Write(formatDescription(checksum))
+		file.Write(event(QueryEvent, 0, 300, queryBody("app", "BEGIN", nil), checksum))
+
+		r, err := NewReader(&file)
+		if err != nil {
+			t.Fatalf("NewReader returned error: %v", err)
+		}
+		fde, err := r.ReadEvent()
+		if err != nil || fde.Type != FormatDescriptionEvent || !fde.Checksum {
+			t.Fatalf("Expected a format description event with checksum, got %+v, %v", fde, err)
+		}
+		query, err := r.ReadEvent()
+		if err != nil {
+			t.Fatalf("ReadEvent returned error: %v", err)
+		}
+		if query.Checksum != checksum {
+			t.Errorf("checksum %v: event Checksum = %v", checksum, query.Checksum)
+		}
+		if !bytes.Equal(query.Body(), queryBody("app", "BEGIN", nil)) {
+			t.Errorf("checksum %v: Body() = %q", checksum, query.Body())
+		}
+		if _, err := r.ReadEvent(); err != io.EOF {
+			t.Errorf("Expected io.EOF at the end of the file, got %v", err)
+		}
+	}
+
+	if _, err := NewReader(bytes.NewReader([]byte("-- s3dbdump SQL dump"))); err == nil {
+		t.Error("Expected an error for a file that is not a binlog")
+	}
+
+	truncated := append(append([]byte{}, FileHeader...), formatDescription(true)[:30]...)
+	r, err := NewReader(bytes.NewReader(truncated))
+	if err != nil {
+		t.Fatalf("NewReader returned error: %v", err)
+	}
+	if _, err := r.ReadEvent(); err == nil || err == io.EOF {
+		t.Errorf("Expected an error for a truncated event, got %v", err)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	vars := []byte{0}
+	vars = binary.LittleEndian.AppendUint32(vars, optionNoForeignKeyChecks)
+	vars = append(vars, 1)
+	vars = binary.LittleEndian.AppendUint64(vars, 1436549152)
+	vars = append(vars, 4, 45, 0, 45, 0, 255, 0)
+	vars = append(vars, 5, 6)
+	vars = append(vars, "+01:00"...)
+	vars = append(vars, 200, 1, 2, 3) // unknown, stops decoding
+
+	e := Event{Timestamp: 1760535720, Type: QueryEvent, Raw: event(QueryEvent, 0, 400, queryBody("app", "ALTER TABLE t ADD c int", vars), false)}
+	q, err := e.Query()
+	if err != nil {
+		t.Fatalf("Query returned error: %v", err)
+	}
+	if q.Database != "app" || q.SQL != "ALTER TABLE t ADD c int" {
+		t.Errorf("Query() = %q in %q", q.SQL, q.Database)
+	}
+	want := []string{
+		"@@session.timestamp=1760535720",
+		"@@session.foreign_key_checks=0",
+		"@@session.sql_auto_is_null=0",
+		"@@session.unique_checks=1",
+		"@@session.autocommit=1",
+		"@@session.sql_mode=1436549152",
+		"@@session.character_set_client=45",
+		"@@session.collation_connection=45",
+		"@@session.collation_server=255",
+		"@@session.time_zone='+01:00'",
+	}
+	if strings.Join(q.Session, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Session = %q, want %q", q.Session, want)
+	}
+}
+
+func TestDecodeEvents(t *testing.T) {
+	tableMap := []byte{42, 0, 0, 0, 0, 0, 1, 0, 3, 'a', 'p', 'p', 0, 5, 'u', 's', 'e', 'r', 's', 0, 1, 3}
+	e := Event{Type: TableMapEvent, Raw: event(TableMapEvent, 0, 100, tableMap, false)}
+	id, database, table, err := e.TableMap()
+	if err != nil || id != 42 || database != "app" || table != "users" {
+		t.Errorf("TableMap() = %d, %q, %q, %v", id, database, table, err)
+	}
+
+	rows := Event{Type: WriteRowsEvent, Raw: event(WriteRowsEvent, 0, 150, []byte{42, 0, 0, 0, 0, 0, 1, 0, 2, 0}, false)}
+	if id, end, err := rows.Rows(); err != nil || id != 42 || !end || !rows.IsRows() {
+		t.Errorf("Rows() = %d, %v, %v", id, end, err)
+	}
+
+	uuid := []byte{0x3e, 0x11, 0xfa, 0x47, 0x71, 0xca, 0x11, 0xe1, 0x9e, 0x33, 0xc8, 0x0a, 0xa9, 0x42, 0x95, 0x62}
+	body := append(append([]byte{1}, uuid...), binary.LittleEndian.AppendUint64(nil, 23)...)
+	gtid := Event{Type: GTIDEvent, Raw: event(GTIDEvent, 0, 200, append(body, make([]byte, 17)...), false)}
+	if got, begin, err := gtid.GTID(); err != nil || got.String() != "3e11fa47-71ca-11e1-9e33-c80aa9429562:23" || begin {
+		t.Errorf("GTID() = %v, %v, %v", got, begin, err)
+	}
+
+	body = binary.LittleEndian.AppendUint64(nil, 100)
+	body = binary.LittleEndian.AppendUint32(body, 0)
+	mariadb := Event{Type: MariaDBGTIDEvent, ServerID: 1, Raw: event(MariaDBGTIDEvent, 0, 200, append(body, 0), false)}
+	if got, begin, err := mariadb.GTID(); err != nil || got.String() != "0-1-100" || !begin {
+		t.Errorf("MariaDB GTID() = %v, %v, %v", got, begin, err)
+	}
+	standalone := Event{Type: MariaDBGTIDEvent, ServerID: 1, Raw: event(MariaDBGTIDEvent, 0, 200, append(body, mariadbStandalone), false)}
+	if _, begin, _ := standalone.GTID(); begin {
+		t.Error("Expected a standalone MariaDB GTID event not to begin a transaction")
+	}
+
+	intvar := Event{Type: IntvarEvent, Raw: event(IntvarEvent, 0, 250, append([]byte{2}, binary.LittleEndian.AppendUint64(nil, 17)...), false)}
+	if vars, err := intvar.Variables(); err != nil || vars != "INSERT_ID=17" {
+		t.Errorf("Variables() = %q, %v", vars, err)
+	}
+}
+
+func TestGTIDSet(t *testing.T) {
+	tests := []struct {
+		set  string
+		gtid string
+		want bool
+	}{
+		{set: "3E11FA47-71CA-11E1-9E33-C80AA9429562:1-5:7", gtid: "3e11fa47-71ca-11e1-9e33-c80aa9429562:5", want: true},
+		{set: "3E11FA47-71CA-11E1-9E33-C80AA9429562:1-5:7", gtid: "3e11fa47-71ca-11e1-9e33-c80aa9429562:6"},
+		{set: "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5,\n4e11fa47-71ca-11e1-9e33-c80aa9429562:1-9", gtid: "4e11fa47-71ca-11e1-9e33-c80aa9429562:9", want: true},
+		{set: "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5:nightly:1-3", gtid: "3e11fa47-71ca-11e1-9e33-c80aa9429562:nightly:2", want: true},
+		{set: "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5:nightly:1-3", gtid: "3e11fa47-71ca-11e1-9e33-c80aa9429562:nightly:4"},
+		{set: "0-1-100,1-2-7", gtid: "0-2-99", want: true},
+		{set: "0-1-100,1-2-7", gtid: "1-2-8"},
+		{set: "0-1-100", gtid: "2-1-1"},
+		{set: "", gtid: "0-1-1"},
+	}
+	for _, tt := range tests {
+		set, err := ParseGTIDSet(tt.set)
+		if err != nil {
+			t.Fatalf("ParseGTIDSet(%q) returned error: %v", tt.set, err)
+		}
+		gtid, err := ParseGTID(tt.gtid)
+		if err != nil {
+			t.Fatalf("ParseGTID(%q) returned error: %v", tt.gtid, err)
+		}
+		if got := set.Contains(gtid); got != tt.want {
+			t.Errorf("ParseGTIDSet(%q).Contains(%s) = %v, want %v", tt.set, tt.gtid, got, tt.want)
+		}
+	}
+
+	for _, invalid := range []string{"0-1", "uuid:x", ":5", "a-b-c"} {
+		if _, err := ParseGTID(invalid); err == nil {
+			t.Errorf("Expected ParseGTID(%q) to fail", invalid)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package mybinlog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// checksumCRC32 is the binlog_checksum algorithm recorded in the format
+// description event when events end in a CRC32.
+const checksumCRC32 = 1
+
+// Reader reads the events of a binary log file, such as one shipped by the
+// streamer.
+type Reader struct {
+	r        *bufio.Reader
+	checksum bool
+}
+
+// NewReader checks the file header of a binary log and returns a Reader for
+// its events.
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReaderSize(r, 1<<16)
+	header := make([]byte, len(FileHeader))
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, fmt.Errorf("error reading binlog header: %w", err)
+	}
+	if !bytes.Equal(header, FileHeader) {
+		return nil, errors.New("not a binary log file")
+	}
+	return &Reader{r: br}, nil
+}
+
+// ReadEvent returns the next event of the file, or io.EOF at its end.
+func (r *Reader) ReadEvent() (Event, error) {
+	header := make([]byte, HeaderSize)
+	if _, err := io.ReadFull(r.r, header); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return Event{}, fmt.Errorf("binlog ends in the middle of an event: %w", err)
+		}
+		return Event{}, err
+	}
+	size := binary.LittleEndian.Uint32(header[9:])
+	if size < HeaderSize {
+		return Event{}, fmt.Errorf("binlog event claims %d bytes, less than its header", size)
+	}
+	raw := make([]byte, size)
+	copy(raw, header)
+	if _, err := io.ReadFull(r.r, raw[HeaderSize:]); err != nil {
+		return Event{}, fmt.Errorf("binlog ends in the middle of an event: %w", io.ErrUnexpectedEOF)
+	}
+
+	e := Event{
+		Timestamp: binary.LittleEndian.Uint32(raw[0:]),
+		Type:      raw[4],
+		ServerID:  binary.LittleEndian.Uint32(raw[5:]),
+		LogPos:    binary.LittleEndian.Uint32(raw[13:]),
+		Flags:     binary.LittleEndian.Uint16(raw[17:]),
+		Raw:       raw,
+	}
+	if e.Type == FormatDescriptionEvent {
+		// The format description event ends in the checksum algorithm of
+		// the file and, if there is one, its own checksum.
+		e.Checksum = hasChecksum(raw)
+		r.checksum = e.Checksum && raw[len(raw)-5] == checksumCRC32
+		return e, nil
+	}
+	e.Checksum = r.checksum
+	if e.Checksum && len(raw) < HeaderSize+4 {
+		return Event{}, fmt.Errorf("binlog event of %d bytes is too short for its checksum", len(raw))
+	}
+	return e, nil
+}
@@ -0,0 +1,148 @@
+package mybinlog
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// Event types the streamer looks at. Every other event is copied verbatim.
+// The types a restore decodes are in decode.go.
+const (
+	RotateEvent            = 4
+	FormatDescriptionEvent = 15
+	HeartbeatEvent         = 27
+	HeartbeatEventV2       = 41
+)
+
+// HeaderSize is the size of a v4 binlog event header.
+const HeaderSize = 19
+
+// FileHeader starts every binary log file.
+var FileHeader = []byte{0xfe, 'b', 'i', 'n'}
+
+// artificialFlag marks events the server makes up for the replica, such as
+// the rotate event naming the file a dump starts in. They are not part of
+// the binary log.
+const artificialFlag = 0x20
+
+// Event is one binlog event as sent by the server.
+type Event struct {
+	Timestamp uint32
+	Type      byte
+	ServerID  uint32
+	// LogPos is the position of the end of the event in its file.
+	LogPos uint32
+	Flags  uint16
+	// Raw is the event as written to the binary log, from the header to the
+	// checksum.
+	Raw []byte
+	// Checksum reports whether Raw ends in a CRC32. Only a Reader knows,
+	// from the format description event of the file.
+	Checksum bool
+}
+
+// Body returns the event without its header and checksum.
+func (e Event) Body() []byte {
+	body := e.Raw[HeaderSize:]
+	if e.Checksum {
+		body = body[:len(body)-4]
+	}
+	return body
+}
+
+// Artificial reports whether the event was made up by the server and does
+// not belong in the binary log file.
+func (e Event) Artificial() bool {
+	return e.Flags&artificialFlag != 0 || e.LogPos == 0 || e.Type == HeartbeatEvent || e.Type == HeartbeatEventV2
+}
+
+// NextFile returns the file named by a rotate event.
+func (e Event) NextFile() (string, bool) {
+	if e.Type != RotateEvent || len(e.Raw) < HeaderSize+8 {
+		return "", false
+	}
+	body := e.Raw[HeaderSize:]
+	if hasChecksum(e.Raw) {
+		body = body[:len(body)-4]
+	}
+	if len(body) < 8 {
+		return "", false
+	}
+	return string(body[8:]), true
+}
+
+// hasChecksum reports whether an event ends in a CRC32 of the rest of it.
+// Whether checksums are written depends on binlog_checksum, and the rotate
+// event that starts a dump comes before the format description event that
+// would tell, so the checksum is checked instead.
+func hasChecksum(raw []byte) bool {
+	n := len(raw)
+	return n >= HeaderSize+4 && crc32.ChecksumIEEE(raw[:n-4]) == binary.LittleEndian.Uint32(raw[n-4:])
+}
+
+// RegisterReplica announces the connection as a replica with serverID, so it
+// shows up in SHOW REPLICAS.
+func (c *Conn) RegisterReplica(serverID uint32) error {
+	payload := []byte{comRegisterSlave}
+	payload = binary.LittleEndian.AppendUint32(payload, serverID)
+	payload = append(payload, 0, 0, 0) // hostname, user, password
+	payload = binary.LittleEndian.AppendUint16(payload, 0)
+	payload = binary.LittleEndian.AppendUint32(payload, 0) // replication rank
+	payload = binary.LittleEndian.AppendUint32(payload, 0) // source id
+	if err := c.command(payload); err != nil {
+		return err
+	}
+	if err := c.readOK(); err != nil {
+		return fmt.Errorf("error registering as replica: %w", err)
+	}
+	return nil
+}
+
+// Dump asks the server to stream its binary log from position pos in file
+// on. The server keeps the stream open and sends new events as they are
+// written; read them with ReadEvent. serverID must be unique among the
+// replicas of the server.
+func (c *Conn) Dump(serverID uint32, file string, pos uint32) error {
+	payload := []byte{comBinlogDump}
+	payload = binary.LittleEndian.AppendUint32(payload, pos)
+	payload = binary.LittleEndian.AppendUint16(payload, 0) // blocking
+	payload = binary.LittleEndian.AppendUint32(payload, serverID)
+	payload = append(payload, file...)
+	return c.command(payload)
+}
+
+// ReadEvent returns the next event of a dump. It returns io.EOF when the
+// server ends the stream.
+func (c *Conn) ReadEvent() (Event, error) {
+	data, err := c.readPacket()
+	if err != nil {
+		return Event{}, err
+	}
+	switch {
+	case data[0] == 0xff:
+		return Event{}, parseError(data)
+	case data[0] == 0xfe && len(data) < 9:
+		return Event{}, io.EOF
+	case data[0] != 0x00:
+		return Event{}, fmt.Errorf("unexpected packet 0x%02x in binlog stream", data[0])
+	}
+
+	raw := data[1:]
+	if len(raw) < HeaderSize {
+		return Event{}, fmt.Errorf("binlog event of %d bytes is too short", len(raw))
+	}
+	e := Event{
+		Timestamp: binary.LittleEndian.Uint32(raw[0:]),
+		Type:      raw[4],
+		ServerID:  binary.LittleEndian.Uint32(raw[5:]),
+		LogPos:    binary.LittleEndian.Uint32(raw[13:]),
+		Flags:     binary.LittleEndian.Uint16(raw[17:]),
+		Raw:       raw,
+	}
+	if size := binary.LittleEndian.Uint32(raw[9:]); int(size) != len(raw) {
+		return Event{}, fmt.Errorf("binlog event claims %d bytes but has %d", size, len(raw))
+	}
+	return e, nil
+}
@@ -0,0 +1,222 @@
+package mydump
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// accountsDatabase names the accounts backup. It takes the place of the
+// database name in the object key, so retention keeps it like any other
+// backup, and cannot clash with a user schema as mysql itself is never
+// dumped.
+const accountsDatabase = "mysql.accounts"
+
+// reservedAccounts are created by the server itself and must not be
+// recreated on restore.
+var reservedAccounts = map[string]bool{
+	"mysql.sys":        true,
+	"mysql.session":    true,
+	"mysql.infoschema": true,
+	"mariadb.sys":      true,
+}
+
+type account struct {
+	user   string
+	host   string
+	isRole bool
+}
+
+func (a account) String() string {
+	return "'" + escapeString(a.user) + "'@'" + escapeString(a.host) + "'"
+}
+
+// dumpAccountsBackup uploads the users, roles and grants of the server as
+// their own backup next to the database dumps.
+func dumpAccountsBackup(config mysql.Config) error {
+	log.Printf("Dumping accounts")
+
+	config.DBName = ""
+	db, err := sql.Open("mysql", config.FormatDSN())
+	if err != nil {
+		return fmt.Errorf("error opening database: %w", err)
+	}
+	defer db.Close()
+
+	started := time.Now()
+	name := backupName(accountsDatabase, started)
+	meta := &backupMetadata{
+		Database:  accountsDatabase,
+		Engine:    engineMySQL,
+		Mode:      modeAccounts,
+		StartedAt: started.UTC(),
+	}
+
+	key, err := uploadDump(name+".sql", func(w io.Writer) error {
+		return dumpAccounts(context.Background(), db, w, meta, os.Getenv("DB_DUMP_DETERMINISTIC") == "1")
+	})
+	if err != nil {
+		return fmt.Errorf("error dumping accounts: %w", err)
+	}
+
+	meta.FinishedAt = time.Now().UTC()
+	meta.Files = []string{key}
+	if err := uploadMetadata(name, meta); err != nil {
+		return fmt.Errorf("error uploading backup metadata: %w", err)
+	}
+	return nil
+}
+
+// dumpAccounts writes a script recreating every account and its grants.
+// All accounts are created before any grant is replayed, with roles first,
+// since granting a role or naming it as a default role needs it to exist.
+// A deterministic script leaves out the time it was taken, as a
+// deterministic dump does.
+func dumpAccounts(ctx context.Context, db *sql.DB, w io.Writer, meta *backupMetadata, deterministic bool) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("error pinning connection: %w", err)
+	}
+	defer conn.Close()
+
+	if err := conn.QueryRowContext(ctx, "SELECT VERSION()").Scan(&meta.ServerVersion); err != nil {
+		return fmt.Errorf("error reading server version: %w", err)
+	}
+	mariaDB := isMariaDB(meta.ServerVersion)
+
+	if !mariaDB {
+		// Password hashes of caching_sha2_password are binary, print them
+		// as hex so the script survives text handling. Older servers lack
+		// the variable and print hashes that are plain text anyway.
+		conn.ExecContext(ctx, "SET SESSION print_identified_with_as_hex = ON")
+	}
+
+	accounts, err := listAccounts(ctx, conn, mariaDB)
+	if err != nil {
+		return err
+	}
+
+	out := bufio.NewWriterSize(w, 64*1024)
+	fmt.Fprintf(out, "-- s3dbdump accounts dump\n--\n-- ------------------------------------------------------\n-- Server version\t%s\n\n", meta.ServerVersion)
+
+	out.WriteString("--\n-- Accounts and roles\n--\n\n")
+	for _, a := range accounts {
+		if mariaDB && a.isRole {
+			fmt.Fprintf(out, "CREATE ROLE IF NOT EXISTS '%s';\n", escapeString(a.user))
+			continue
+		}
+		var createSQL string
+		if err := conn.QueryRowContext(ctx, "SHOW CREATE USER "+a.String()).Scan(&createSQL); err != nil {
+			return fmt.Errorf("error reading account %s: %w", a, err)
+		}
+		fmt.Fprintf(out, "%s;\n", strings.Replace(createSQL, "CREATE USER ", "CREATE USER IF NOT EXISTS ", 1))
+	}
+
+	out.WriteString("\n--\n-- Grants\n--\n\n")
+	for _, a := range accounts {
+		target := a.String()
+		if mariaDB && a.isRole {
+			target = "'" + escapeString(a.user) + "'"
+		}
+		if err := writeGrants(ctx, conn, out, target); err != nil {
+			return fmt.Errorf("error reading grants of %s: %w", a, err)
+		}
+	}
+
+	if !deterministic {
+		fmt.Fprintf(out, "\n-- Dump completed on %s\n", time.Now().UTC().Format("2006-01-02 15:04:05"))
+	}
+	return out.Flush()
+}
+
+func writeGrants(ctx context.Context, conn *sql.Conn, out *bufio.Writer, target string) error {
+	rows, err := conn.QueryContext(ctx, "SHOW GRANTS FOR "+target)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var grant string
+		if err := rows.Scan(&grant); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%s;\n", grant)
+	}
+	return rows.Err()
+}
+
+// listAccounts returns every account that is not reserved by the server,
+// roles first.
+func listAccounts(ctx context.Context, conn *sql.Conn, mariaDB bool) ([]account, error) {
+	query := "SELECT User, Host, 'N' FROM mysql.user ORDER BY User, Host"
+	if mariaDB {
+		query = "SELECT User, Host, is_role FROM mysql.user ORDER BY User, Host"
+	}
+	rows, err := conn.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("error listing accounts: %w", err)
+	}
+	defer rows.Close()
+
+	var accounts []account
+	for rows.Next() {
+		var a account
+		var isRole string
+		if err := rows.Scan(&a.user, &a.host, &isRole); err != nil {
+			return nil, fmt.Errorf("error scanning account: %w", err)
+		}
+		if reservedAccounts[a.user] {
+			continue
+		}
+		a.isRole = isRole == "Y"
+		accounts = append(accounts, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error listing accounts: %w", err)
+	}
+
+	if !mariaDB {
+		// MySQL 8 roles are accounts that have been granted to another
+		// account. The table does not exist before 8.0.
+		roles, err := conn.QueryContext(ctx, "SELECT DISTINCT FROM_USER, FROM_HOST FROM mysql.role_edges")
+		if err == nil {
+			defer roles.Close()
+			isRole := make(map[string]bool)
+			for roles.Next() {
+				var a account
+				if err := roles.Scan(&a.user, &a.host); err != nil {
+					return nil, fmt.Errorf("error scanning role: %w", err)
+				}
+				isRole[a.String()] = true
+			}
+			if err := roles.Err(); err != nil {
+				return nil, fmt.Errorf("error listing roles: %w", err)
+			}
+			for i, a := range accounts {
+				accounts[i].isRole = isRole[a.String()]
+			}
+		}
+	}
+
+	var sorted []account
+	for _, a := range accounts {
+		if a.isRole {
+			sorted = append(sorted, a)
+		}
+	}
+	for _, a := range accounts {
+		if !a.isRole {
+			sorted = append(sorted, a)
+		}
+	}
+	return sorted, nil
+}
@@ -0,0 +1,331 @@
+package mydump
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/stenstromen/s3dbdump/mybinlog"
+	"github.com/stenstromen/s3dbdump/mys3"
+)
+
+// defaultBinlogServerID is the server ID the binlog streamer registers with
+// unless DB_BINLOG_SERVER_ID is set. It is picked from the top of the range
+// to stay clear of the IDs servers are usually numbered with.
+const defaultBinlogServerID = 4294967040
+
+type binlogOptions struct {
+	serverID      uint32
+	prefix        string
+	heartbeat     time.Duration
+	flushInterval time.Duration
+	startFile     string
+}
+
+func binlogOptionsFromEnv() (binlogOptions, error) {
+	opts := binlogOptions{
+		serverID:  defaultBinlogServerID,
+		prefix:    mys3.BinlogPrefix(),
+		heartbeat: 30 * time.Second,
+		startFile: os.Getenv("DB_BINLOG_START_FILE"),
+	}
+
+	if v := os.Getenv("DB_BINLOG_SERVER_ID"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 32)
+		if err != nil || n == 0 {
+			return opts, fmt.Errorf("invalid DB_BINLOG_SERVER_ID value %q: must be a number between 1 and 4294967295", v)
+		}
+		opts.serverID = uint32(n)
+	}
+	if v := os.Getenv("DB_BINLOG_HEARTBEAT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < time.Second {
+			return opts, fmt.Errorf("invalid DB_BINLOG_HEARTBEAT value %q: must be a duration of at least 1s", v)
+		}
+		opts.heartbeat = d
+	}
+	if v := os.Getenv("DB_BINLOG_FLUSH_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < time.Second {
+			return opts, fmt.Errorf("invalid DB_BINLOG_FLUSH_INTERVAL value %q: must be a duration of at least 1s", v)
+		}
+		opts.flushInterval = d
+	}
+	return opts, nil
+}
+
+// HandleBinlogStream ships the binary logs of the server to the bucket for
+// as long as it runs. It exits on any error; a restart continues after the
+// last binlog shipped.
+func HandleBinlogStream(config mysql.Config) {
+	if err := streamBinlogs(config); err != nil {
+		log.Fatalf("Error streaming binlogs: %v", err)
+	}
+}
+
+// streamBinlogs connects to the server as a replica and uploads every binary
+// log file below DB_BINLOG_PREFIX as soon as the server rotates it.
+func streamBinlogs(config mysql.Config) error {
+	opts, err := binlogOptionsFromEnv()
+	if err != nil {
+		return err
+	}
+	file, err := binlogStartFile(opts)
+	if err != nil {
+		return err
+	}
+
+	conn, err := mybinlog.Dial(config.Addr, config.User, config.Passwd)
+	if err != nil {
+		return fmt.Errorf("error connecting as replica: %w", err)
+	}
+	defer conn.Close()
+	conn.ReadTimeout = 3 * opts.heartbeat
+
+	// Ask for events exactly as they are written, checksums included, and
+	// for heartbeats so a dead connection is noticed. MySQL 8.4 only knows
+	// the source_ names, older servers only the master_ ones. MariaDB only
+	// sends its GTID events unaltered to replicas that say they understand
+	// them; MySQL ignores the variable.
+	for _, query := range []string{
+		"SET @master_binlog_checksum = @@global.binlog_checksum",
+		"SET @source_binlog_checksum = @@global.binlog_checksum",
+		fmt.Sprintf("SET @master_heartbeat_period = %d", opts.heartbeat.Nanoseconds()),
+		fmt.Sprintf("SET @source_heartbeat_period = %d", opts.heartbeat.Nanoseconds()),
+		"SET @mariadb_slave_capability = 4",
+	} {
+		if err := conn.Exec(query); err != nil {
+			return err
+		}
+	}
+	if err := conn.RegisterReplica(opts.serverID); err != nil {
+		return err
+	}
+
+	if opts.flushInterval > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go flushBinlogs(ctx, config, opts.flushInterval)
+	}
+
+	log.Printf("Streaming binlogs of %s from %s as server ID %d", conn.ServerVersion, file, opts.serverID)
+	if err := conn.Dump(opts.serverID, file, 4); err != nil {
+		return fmt.Errorf("error starting binlog dump: %w", err)
+	}
+
+	shipper := &binlogShipper{
+		prefix: opts.prefix,
+		dir:    filepath.Join(dumpDir(), "binlogs"),
+		upload: uploadDump,
+	}
+	return shipper.run(conn, file)
+}
+
+// flushBinlogs rotates the binary log every interval, so that quiet servers
+// ship their binlogs in time too. This needs the RELOAD privilege.
+func flushBinlogs(ctx context.Context, config mysql.Config, interval time.Duration) {
+	config.DBName = ""
+	db, err := sql.Open("mysql", config.FormatDSN())
+	if err != nil {
+		log.Printf("Error opening database for binlog flushes: %v", err)
+		return
+	}
+	defer db.Close()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := db.ExecContext(ctx, "FLUSH BINARY LOGS"); err != nil {
+				log.Printf("Error flushing binary logs: %v", err)
+			}
+		}
+	}
+}
+
+// metadataTimestamp extracts the timestamp of a backup from the key of its
+// metadata, so the latest backup can be found without downloading them all.
+var metadataTimestamp = regexp.MustCompile(`-(\d{8}T\d{6})\.metadata\.json$`)
+
+// binlogStartFile decides where the stream starts: DB_BINLOG_START_FILE if
+// set, the file after the last one shipped, or else the file the latest full
+// backup recorded its binlog coordinates in, so the binlogs shipped connect
+// to a backup they can be replayed on.
+func binlogStartFile(opts binlogOptions) (string, error) {
+	if opts.startFile != "" {
+		return opts.startFile, nil
+	}
+
+	shipped, err := mys3.ListKeys(opts.prefix)
+	if err != nil {
+		return "", err
+	}
+	last, lastSeq := "", -1
+	for _, key := range shipped {
+		name := strings.TrimSuffix(strings.TrimPrefix(key, opts.prefix), ".gz")
+		if _, seq, ok := mybinlog.SplitFileName(name); ok && seq > lastSeq {
+			last, lastSeq = name, seq
+		}
+	}
+	if last != "" {
+		log.Printf("Continuing after binlog %s shipped before", last)
+		return mybinlog.NextFileName(last)
+	}
+
+	keys, err := mys3.ListKeys("")
+	if err != nil {
+		return "", err
+	}
+	keys = slices.DeleteFunc(keys, func(key string) bool {
+		return !metadataTimestamp.MatchString(key)
+	})
+	slices.SortFunc(keys, func(a, b string) int {
+		return strings.Compare(metadataTimestamp.FindStringSubmatch(b)[1], metadataTimestamp.FindStringSubmatch(a)[1])
+	})
+	for _, key := range keys {
+		data, err := mys3.Download(key)
+		if err != nil {
+			return "", err
+		}
+		var meta backupMetadata
+		if err := json.Unmarshal(data, &meta); err != nil {
+			return "", fmt.Errorf("error decoding %s: %w", key, err)
+		}
+		if meta.Binlog != nil && meta.Binlog.File != "" {
+			log.Printf("Starting at binlog %s, where the backup %s was taken", meta.Binlog.File, strings.TrimSuffix(key, ".metadata.json"))
+			return meta.Binlog.File, nil
+		}
+	}
+	return "", fmt.Errorf("no backup with binlog coordinates found, take one with DB_DUMP_MASTER_DATA=1 first or set DB_BINLOG_START_FILE")
+}
+
+// binlogEvents is a source of binlog events, such as a *mybinlog.Conn.
+type binlogEvents interface {
+	ReadEvent() (mybinlog.Event, error)
+}
+
+// binlogShipper writes the events of a binlog stream into local copies of
+// the server's binlog files and uploads each file once the server has moved
+// on to the next. The files are byte for byte what the server wrote, so
+// mysqlbinlog reads them as usual.
+type binlogShipper struct {
+	prefix string
+	dir    string
+	upload uploadFunc
+
+	name   string
+	file   *os.File
+	offset int64
+}
+
+func (s *binlogShipper) run(events binlogEvents, file string) error {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return fmt.Errorf("error creating binlog directory: %w", err)
+	}
+	if err := s.open(file); err != nil {
+		return err
+	}
+	defer s.discard()
+
+	for {
+		e, err := events.ReadEvent()
+		if errors.Is(err, io.EOF) {
+			return fmt.Errorf("server ended the binlog stream in %s", s.name)
+		}
+		if err != nil {
+			return fmt.Errorf("error reading binlog stream: %w", err)
+		}
+
+		if e.Artificial() {
+			// The server announces every file it starts sending with a
+			// made up rotate event. A new file without a rotate event at
+			// the end of the previous one means the server stopped or
+			// crashed while writing it; the file is complete all the same.
+			if next, ok := e.NextFile(); ok && next != s.name {
+				if err := s.rotate(next); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		if _, err := s.file.Write(e.Raw); err != nil {
+			return fmt.Errorf("error writing binlog %s: %w", s.name, err)
+		}
+		s.offset += int64(len(e.Raw))
+		if uint32(s.offset) != e.LogPos {
+			return fmt.Errorf("binlog stream out of sync in %s: event ends at %d, expected %d", s.name, s.offset, e.LogPos)
+		}
+
+		if next, ok := e.NextFile(); ok {
+			if err := s.rotate(next); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *binlogShipper) open(name string) error {
+	name = filepath.Base(name)
+	file, err := os.Create(filepath.Join(s.dir, name))
+	if err != nil {
+		return fmt.Errorf("error creating binlog %s: %w", name, err)
+	}
+	if _, err := file.Write(mybinlog.FileHeader); err != nil {
+		file.Close()
+		return fmt.Errorf("error writing binlog %s: %w", name, err)
+	}
+	s.name, s.file, s.offset = name, file, int64(len(mybinlog.FileHeader))
+	return nil
+}
+
+// rotate uploads the current file, unless nothing was written to it, and
+// starts next.
+func (s *binlogShipper) rotate(next string) error {
+	if s.offset > int64(len(mybinlog.FileHeader)) {
+		if err := s.ship(); err != nil {
+			return err
+		}
+	}
+	s.discard()
+	return s.open(next)
+}
+
+func (s *binlogShipper) ship() error {
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	key, err := s.upload(s.prefix+s.name, func(w io.Writer) error {
+		_, err := io.Copy(w, s.file)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error uploading binlog %s: %w", s.name, err)
+	}
+	log.Printf("Shipped binlog %s as %s", s.name, key)
+	return nil
+}
+
+// discard closes and removes the local copy of the current file.
+func (s *binlogShipper) discard() {
+	if s.file != nil {
+		s.file.Close()
+		os.Remove(s.file.Name())
+		s.file = nil
+	}
+}
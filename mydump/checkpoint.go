@@ -0,0 +1,343 @@
+package mydump
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stenstromen/s3dbdump/mys3"
+)
+
+// resumeMode selects what an interrupted run keeps, see DB_DUMP_RESUME.
+type resumeMode string
+
+const (
+	resumeOff resumeMode = "0"
+	// resumeDatabases keeps the databases that completed and dumps the
+	// others again, each in a snapshot of its own as usual.
+	resumeDatabases resumeMode = "databases"
+	// resumeParts also keeps the tables and chunks of a directory dump that
+	// were uploaded before the interruption. The dump then no longer comes
+	// from a single snapshot.
+	resumeParts resumeMode = "parts"
+)
+
+// checkpoint records which databases, tables and chunks of a run completed,
+// so that a run interrupted halfway can continue the same backup set instead
+// of starting over. It is saved in the background after every database and
+// every part of a directory dump, locally in DB_DUMP_PATH, in the bucket or
+// both, and removed once the run has completed.
+type checkpoint struct {
+	RunID     string                         `json:"run_id"`
+	StartedAt time.Time                      `json:"started_at"`
+	Databases map[string]*databaseCheckpoint `json:"databases"`
+
+	mu     sync.Mutex
+	local  bool
+	bucket bool
+	resume resumeMode
+	// pending is the latest encoding of the checkpoint not yet written.
+	// A single writer stores it outside mu, and a save made while it is
+	// busy replaces the one still waiting, so workers never wait on the
+	// bucket and a burst of parts is written once.
+	pending []byte
+	// idle is closed when the running writer has stored every save, nil
+	// when no writer is running.
+	idle chan struct{}
+}
+
+// databaseCheckpoint is the progress of one database. Parts maps the parts
+// of a directory dump that were uploaded to their keys.
+type databaseCheckpoint struct {
+	Name     string              `json:"name"`
+	Complete bool                `json:"complete"`
+	Parts    map[string][]string `json:"parts,omitempty"`
+}
+
+// openCheckpoint returns the checkpoint of the run named by DB_DUMP_RUN_ID,
+// or nil when runs are not checkpointed. With DB_DUMP_RESUME the progress
+// saved by an earlier attempt of the run is loaded, otherwise the run starts
+// over.
+func openCheckpoint() (*checkpoint, error) {
+	runID := os.Getenv("DB_DUMP_RUN_ID")
+	if runID == "" {
+		return nil, nil
+	}
+	if strings.ContainsAny(runID, `/\`) {
+		return nil, fmt.Errorf("invalid DB_DUMP_RUN_ID value %q: must not contain slashes", runID)
+	}
+
+	cp := &checkpoint{
+		RunID:     runID,
+		StartedAt: time.Now().UTC(),
+		Databases: make(map[string]*databaseCheckpoint),
+		resume:    resumeOff,
+	}
+
+	stores := os.Getenv("DB_DUMP_CHECKPOINT")
+	if stores == "" {
+		stores = "local,bucket"
+	}
+	for _, store := range strings.Split(stores, ",") {
+		switch strings.TrimSpace(store) {
+		case "local":
+			cp.local = true
+		case "bucket":
+			cp.bucket = true
+		default:
+			return nil, fmt.Errorf("invalid DB_DUMP_CHECKPOINT value %q: must be local, bucket or both", stores)
+		}
+	}
+
+	switch mode := resumeMode(os.Getenv("DB_DUMP_RESUME")); mode {
+	case "", resumeOff:
+	case "1", resumeDatabases:
+		cp.resume = resumeDatabases
+	case resumeParts:
+		cp.resume = resumeParts
+	default:
+		return nil, fmt.Errorf("invalid DB_DUMP_RESUME value %q: must be 0, databases or parts", mode)
+	}
+
+	if cp.resume == resumeOff {
+		return cp, nil
+	}
+	saved, err := cp.load()
+	if err != nil {
+		return nil, err
+	}
+	if saved == nil {
+		log.Printf("No checkpoint of run %s found, starting over", runID)
+		return cp, nil
+	}
+	cp.StartedAt = saved.StartedAt
+	cp.Databases = saved.Databases
+	if cp.Databases == nil {
+		cp.Databases = make(map[string]*databaseCheckpoint)
+	}
+	log.Printf("Resuming run %s started at %s", runID, cp.StartedAt.Format(time.RFC3339))
+	return cp, nil
+}
+
+func (cp *checkpoint) localPath() string {
+	return filepath.Join(dumpDir(), cp.RunID+".checkpoint.json")
+}
+
+func (cp *checkpoint) bucketKey() string {
+	return "checkpoints/" + cp.RunID + ".json"
+}
+
+// load reads the saved checkpoint, preferring the local copy as it is
+// written first. Returns nil when there is none.
+func (cp *checkpoint) load() (*checkpoint, error) {
+	var data []byte
+	if cp.local {
+		var err error
+		data, err = os.ReadFile(cp.localPath())
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("error reading checkpoint: %w", err)
+		}
+	}
+	if data == nil && cp.bucket {
+		var err error
+		data, err = mys3.Download(cp.bucketKey())
+		if err != nil && !errors.Is(err, mys3.ErrNotFound) {
+			return nil, fmt.Errorf("error downloading checkpoint: %w", err)
+		}
+	}
+	if data == nil {
+		return nil, nil
+	}
+
+	saved := &checkpoint{}
+	if err := json.Unmarshal(data, saved); err != nil {
+		return nil, fmt.Errorf("error decoding checkpoint: %w", err)
+	}
+	return saved, nil
+}
+
+// save encodes the checkpoint for the writer to store, starting it unless
+// it is running. The caller holds cp.mu.
+func (cp *checkpoint) save() {
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		log.Printf("Error encoding checkpoint: %v", err)
+		return
+	}
+	cp.pending = append(data, '\n')
+	if cp.idle == nil {
+		cp.idle = make(chan struct{})
+		go cp.write()
+	}
+}
+
+// write stores the pending checkpoint until no save is waiting.
+func (cp *checkpoint) write() {
+	for {
+		cp.mu.Lock()
+		data := cp.pending
+		cp.pending = nil
+		if data == nil {
+			close(cp.idle)
+			cp.idle = nil
+			cp.mu.Unlock()
+			return
+		}
+		cp.mu.Unlock()
+		cp.store(data)
+	}
+}
+
+// flush waits until every save has been stored.
+func (cp *checkpoint) flush() {
+	cp.mu.Lock()
+	idle := cp.idle
+	cp.mu.Unlock()
+	if idle != nil {
+		<-idle
+	}
+}
+
+// store writes data to every store. A checkpoint that cannot be saved only
+// costs work on resume, so failures are logged rather than failing the dump.
+func (cp *checkpoint) store(data []byte) {
+	if cp.local {
+		path := cp.localPath()
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err == nil {
+			// Write and rename so an interruption never leaves a torn
+			// checkpoint behind.
+			err = os.WriteFile(path+".tmp", data, 0644)
+		}
+		if err == nil {
+			err = os.Rename(path+".tmp", path)
+		}
+		if err != nil {
+			log.Printf("Error saving checkpoint: %v", err)
+		}
+	}
+	if cp.bucket {
+		if err := mys3.UploadStream(cp.bucketKey(), bytes.NewReader(data)); err != nil {
+			log.Printf("Error saving checkpoint: %v", err)
+		}
+	}
+}
+
+// startDatabase returns the progress of database and the name of its backup.
+// A database that an earlier attempt started keeps its name, so the resumed
+// dump replaces the objects already uploaded instead of leaving them behind.
+// newName is used for databases that were not started before.
+func (cp *checkpoint) startDatabase(database, newName string) (progress *databaseCheckpoint, name string) {
+	if cp == nil {
+		return nil, newName
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	progress = cp.Databases[database]
+	if progress == nil {
+		progress = &databaseCheckpoint{Name: newName}
+		cp.Databases[database] = progress
+		cp.save()
+	} else if cp.resume != resumeParts {
+		progress.Parts = nil
+	}
+	return progress, progress.Name
+}
+
+// completed reports whether an earlier attempt of the run already dumped
+// database.
+func (cp *checkpoint) completed(database string) (string, bool) {
+	if cp == nil {
+		return "", false
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	progress := cp.Databases[database]
+	if progress == nil || !progress.Complete {
+		return "", false
+	}
+	return progress.Name, true
+}
+
+// completeDatabase records database as completed and waits until that is
+// stored, so a run stopped right after never dumps it again.
+func (cp *checkpoint) completeDatabase(database string) {
+	if cp == nil {
+		return
+	}
+	cp.mu.Lock()
+	if progress := cp.Databases[database]; progress != nil {
+		progress.Complete = true
+		progress.Parts = nil
+		cp.save()
+	}
+	cp.mu.Unlock()
+	cp.flush()
+}
+
+// partKeys returns the keys of a part that was uploaded before, if resuming
+// parts.
+func (cp *checkpoint) partKeys(database, id string) ([]string, bool) {
+	if cp == nil {
+		return nil, false
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	progress := cp.Databases[database]
+	if progress == nil {
+		return nil, false
+	}
+	keys, ok := progress.Parts[id]
+	return keys, ok
+}
+
+func (cp *checkpoint) partDone(database, id string, keys []string) {
+	if cp == nil {
+		return
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	progress := cp.Databases[database]
+	if progress == nil {
+		return
+	}
+	if progress.Parts == nil {
+		progress.Parts = make(map[string][]string)
+	}
+	progress.Parts[id] = keys
+	cp.save()
+}
+
+// finish removes the checkpoint once the whole run has completed.
+func (cp *checkpoint) finish() {
+	if cp == nil {
+		return
+	}
+	// Let the writer finish first, or it could store the checkpoint again
+	// after it was removed.
+	cp.flush()
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	if cp.local {
+		if err := os.Remove(cp.localPath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Error removing checkpoint: %v", err)
+		}
+	}
+	if cp.bucket {
+		if err := mys3.Delete(cp.bucketKey()); err != nil {
+			log.Printf("Error removing checkpoint: %v", err)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package mydump
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+)
+
+// chunk is a primary key range of a table whose rows are dumped as a part
+// of their own, see DB_DUMP_CHUNK_ROWS. The first chunk has no lower bound
+// and the last no upper bound, so together they cover every row.
+type chunk struct {
+	index  int
+	count  int
+	column string
+	lower  int64
+	upper  int64
+}
+
+func (c chunk) first() bool {
+	return c.index == 0
+}
+
+func (c chunk) last() bool {
+	return c.index == c.count-1
+}
+
+// condition returns the WHERE condition selecting the rows of the chunk. A
+// table is only chunked into two or more chunks.
+func (c chunk) condition() string {
+	column := quoteIdentifier(c.column)
+	switch {
+	case c.first():
+		return fmt.Sprintf("%s < %d", column, c.upper)
+	case c.last():
+		return fmt.Sprintf("%s >= %d", column, c.lower)
+	default:
+		return fmt.Sprintf("%s >= %d AND %s < %d", column, c.lower, column, c.upper)
+	}
+}
+
+// tablePart is a unit of work of a dump: a whole table, or one chunk of the
+// rows of a large table. The first part of a table carries its definition
+// and the last its triggers.
+type tablePart struct {
+	table tableInfo
+	// chunk is nil when the table is dumped in one piece.
+	chunk *chunk
+}
+
+func (p tablePart) first() bool {
+	return p.chunk == nil || p.chunk.first()
+}
+
+func (p tablePart) last() bool {
+	return p.chunk == nil || p.chunk.last()
+}
+
+// where combines the DB_TABLE_WHERE condition of the table with the range of
+// the chunk.
+func (p tablePart) where() string {
+	if p.chunk == nil {
+		return p.table.where
+	}
+	if p.table.where == "" {
+		return p.chunk.condition()
+	}
+	return "(" + p.table.where + ") AND " + p.chunk.condition()
+}
+
+// id identifies the part in a checkpoint. It includes the range of a chunk,
+// so a resumed run whose chunks came out differently dumps them again.
+func (p tablePart) id() string {
+	if where := p.where(); where != "" {
+		return p.table.name + " WHERE " + where
+	}
+	return p.table.name
+}
+
+// splitParts returns the parts of tables in dump order.
+func splitParts(tables []tableInfo) []tablePart {
+	var parts []tablePart
+	for _, table := range tables {
+		if len(table.chunks) == 0 {
+			parts = append(parts, tablePart{table: table})
+			continue
+		}
+		for i := range table.chunks {
+			parts = append(parts, tablePart{table: table, chunk: &table.chunks[i]})
+		}
+	}
+	return parts
+}
+
+// countRows returns the number of rows of a table as estimated by the
+// server. The estimate changes with the statistics rather than the rows, so
+// deterministic dumps count them exactly, at the cost of a scan.
+func (d *dumper) countRows(ctx context.Context, conn *sql.Conn, table string) (int64, error) {
+	query := "SELECT TABLE_ROWS FROM information_schema.TABLES WHERE TABLE_SCHEMA = '" + escapeString(d.database) + "' AND TABLE_NAME = '" + escapeString(table) + "'"
+	column := "TABLE_ROWS"
+	if d.opts.deterministic {
+		query, column = "SELECT COUNT(*) AS count FROM "+quoteIdentifier(table), "count"
+	}
+	row, err := queryFirstRow(ctx, conn, query)
+	if err != nil {
+		return 0, fmt.Errorf("error estimating rows of %s: %w", table, err)
+	}
+	rows, _ := strconv.ParseInt(row[column], 10, 64)
+	return rows, nil
+}
+
+// chunkTable splits the rows of a table estimated to hold more than
+// DB_DUMP_CHUNK_ROWS rows into ranges of its primary key. Only tables with
+// a single integer primary key column can be split; the others are dumped
+// in one piece. The ranges are cut evenly between the smallest and largest
+// key, so gaps in the keys make for smaller chunks but never for missed
+// rows.
+func (d *dumper) chunkTable(ctx context.Context, conn *sql.Conn, table string) ([]chunk, error) {
+	rows, err := d.countRows(ctx, conn, table)
+	if err != nil {
+		return nil, err
+	}
+	if rows <= d.opts.chunkRows {
+		return nil, nil
+	}
+
+	keys, err := listNames(ctx, conn, "SHOW KEYS FROM "+quoteIdentifier(table)+" WHERE Key_name = 'PRIMARY'", "Column_name")
+	if err != nil {
+		return nil, fmt.Errorf("error reading primary key of %s: %w", table, err)
+	}
+	if len(keys) != 1 {
+		log.Printf("Not chunking table %s.%s of about %d rows: it has no single column primary key", d.database, table, rows)
+		return nil, nil
+	}
+	column := keys[0]
+
+	bounds, err := queryFirstRow(ctx, conn, "SELECT MIN("+quoteIdentifier(column)+") AS lower, MAX("+quoteIdentifier(column)+") AS upper FROM "+quoteIdentifier(table))
+	if err != nil {
+		return nil, fmt.Errorf("error reading primary key range of %s: %w", table, err)
+	}
+	lower, lowerErr := strconv.ParseInt(bounds["lower"], 10, 64)
+	upper, upperErr := strconv.ParseInt(bounds["upper"], 10, 64)
+	if lowerErr != nil || upperErr != nil {
+		log.Printf("Not chunking table %s.%s of about %d rows: primary key %s is not a signed integer", d.database, table, rows, column)
+		return nil, nil
+	}
+
+	count := (rows + d.opts.chunkRows - 1) / d.opts.chunkRows
+	// Unsigned arithmetic keeps the span from overflowing for keys that
+	// cover most of the int64 range.
+	span := uint64(upper - lower)
+	if uint64(count) > span {
+		count = int64(span) + 1
+	}
+	if count < 2 {
+		return nil, nil
+	}
+	step := span/uint64(count) + 1
+
+	chunks := make([]chunk, count)
+	for i := range chunks {
+		chunks[i] = chunk{
+			index:  i,
+			count:  len(chunks),
+			column: column,
+			lower:  lower + int64(uint64(i)*step),
+			upper:  lower + int64(uint64(i+1)*step),
+		}
+	}
+	log.Printf("Dumping table %s.%s of about %d rows in %d chunks on %s", d.database, table, rows, count, column)
+	return chunks, nil
+}
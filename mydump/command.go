@@ -0,0 +1,143 @@
+package mydump
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"strings"
+)
+
+// runCommand runs an external program with its output going to w. What it
+// writes to stderr is logged as it comes, and the last lines are part of the
+// error if it fails.
+func runCommand(ctx context.Context, env []string, w io.Writer, name string, args ...string) error {
+	stderr := &stderrLog{name: name}
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Env = env
+	cmd.Stdout = w
+	cmd.Stderr = stderr
+
+	err := cmd.Run()
+	stderr.flush()
+	if err != nil {
+		if len(stderr.tail) > 0 {
+			return fmt.Errorf("%s failed: %w: %s", name, err, strings.Join(stderr.tail, "\n"))
+		}
+		return fmt.Errorf("%s failed: %w", name, err)
+	}
+	return nil
+}
+
+// stderrTailLines is how many lines of stderr an error includes.
+const stderrTailLines = 10
+
+// maxStderrLine caps the length of a logged stderr line, so that output
+// without newlines, such as a progress bar, is still logged.
+const maxStderrLine = 4096
+
+// stderrLog logs the stderr of a command line by line and keeps the last
+// lines.
+type stderrLog struct {
+	name    string
+	partial []byte
+	tail    []string
+}
+
+func (l *stderrLog) Write(p []byte) (int, error) {
+	l.partial = append(l.partial, p...)
+	for {
+		i := bytes.IndexAny(l.partial, "\r\n")
+		if i < 0 {
+			if len(l.partial) >= maxStderrLine {
+				l.line(string(l.partial))
+				l.partial = l.partial[:0]
+			}
+			return len(p), nil
+		}
+		l.line(string(l.partial[:i]))
+		l.partial = l.partial[i+1:]
+	}
+}
+
+func (l *stderrLog) line(s string) {
+	if s = strings.TrimSpace(s); s == "" {
+		return
+	}
+	log.Printf("%s: %s", l.name, s)
+	l.tail = append(l.tail, s)
+	if len(l.tail) > stderrTailLines {
+		l.tail = l.tail[1:]
+	}
+}
+
+// flush logs what is left after the command exited.
+func (l *stderrLog) flush() {
+	l.line(string(l.partial))
+	l.partial = nil
+}
+
+// splitCommand splits a command line into its arguments the way a shell
+// does, honouring single and double quotes and backslashes, but without
+// expanding anything. Pipes and redirections take an explicit
+// sh -c '...'.
+func splitCommand(s string) ([]string, error) {
+	var (
+		args  []string
+		arg   strings.Builder
+		inArg bool
+		quote rune
+	)
+	runes := []rune(s)
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		switch {
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				arg.WriteRune(c)
+			}
+		case quote == '"':
+			switch {
+			case c == '"':
+				quote = 0
+			case c == '\\' && i+1 < len(runes) && strings.ContainsRune("\"\\$`", runes[i+1]):
+				i++
+				arg.WriteRune(runes[i])
+			default:
+				arg.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote, inArg = c, true
+		case c == '\\':
+			if i+1 == len(runes) {
+				return nil, fmt.Errorf("command %q ends with a backslash", s)
+			}
+			i++
+			arg.WriteRune(runes[i])
+			inArg = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(c)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("command %q has an unterminated %c quote", s, quote)
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("command is empty")
+	}
+	return args, nil
+}
@@ -0,0 +1,137 @@
+package mydump
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	// formatCSV is a directory dump with the rows of every table in an
+	// RFC 4180 CSV file instead of INSERT statements.
+	formatCSV dumpFormat = "csv"
+	// formatTSV is like formatCSV with tab separated values.
+	formatTSV dumpFormat = "tsv"
+)
+
+// delimited reports whether rows are written as CSV or TSV.
+func (f dumpFormat) delimited() bool {
+	return f == formatCSV || f == formatTSV
+}
+
+// delimitedOptions control the CSV and TSV formats.
+type delimitedOptions struct {
+	// null is written for NULL, see DB_DUMP_CSV_NULL.
+	null string
+	// base64 encodes binary columns in base64 rather than hex, see
+	// DB_DUMP_CSV_BINARY.
+	base64 bool
+}
+
+func delimitedOptionsFromEnv(format dumpFormat) (delimitedOptions, error) {
+	var opts delimitedOptions
+	if format == formatTSV {
+		opts.null = `\N`
+	}
+	if v, ok := os.LookupEnv("DB_DUMP_CSV_NULL"); ok {
+		if strings.ContainsAny(v, ",\t\"\r\n") {
+			return opts, fmt.Errorf("invalid DB_DUMP_CSV_NULL value %q: must not contain separators, quotes or line breaks", v)
+		}
+		opts.null = v
+	}
+	switch v := os.Getenv("DB_DUMP_CSV_BINARY"); v {
+	case "", "hex":
+	case "base64":
+		opts.base64 = true
+	default:
+		return opts, fmt.Errorf("invalid DB_DUMP_CSV_BINARY value %q: must be hex or base64", v)
+	}
+	return opts, nil
+}
+
+// writeDelimited writes the rows of part as CSV or TSV, with a header row
+// of the column names.
+//
+// CSV fields are quoted when they hold a comma, a quote or a line break, or
+// could be mistaken for NULL, which includes the empty string when NULL is
+// written as nothing. TSV fields escape tabs, line breaks and backslashes
+// with a backslash instead, as LOAD DATA and COPY expect.
+func (d *dumper) writeDelimited(ctx context.Context, conn *sql.Conn, out *bufio.Writer, part tablePart) error {
+	table := part.table.name
+	rows, err := d.selectRows(ctx, conn, part)
+	if err != nil || rows == nil {
+		return err
+	}
+	defer rows.Close()
+
+	field := d.csvField
+	separator := byte(',')
+	newline := "\r\n"
+	if d.opts.format == formatTSV {
+		field, separator, newline = d.tsvField, '\t', "\n"
+	}
+
+	for i, column := range rows.columns {
+		if i > 0 {
+			out.WriteByte(separator)
+		}
+		field(out, []byte(column), kindString)
+	}
+	out.WriteString(newline)
+
+	for rows.Next() {
+		if err := rows.Scan(rows.scans...); err != nil {
+			return fmt.Errorf("error scanning row of %s: %w", table, err)
+		}
+		for i := range rows.values {
+			if i > 0 {
+				out.WriteByte(separator)
+			}
+			value, kind := rows.value(i)
+			if value == nil {
+				out.WriteString(d.opts.delimited.null)
+				continue
+			}
+			if kind == kindBinary {
+				value = d.encodeBinary(value)
+			}
+			field(out, value, kind)
+		}
+		if _, err := out.WriteString(newline); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error reading rows of %s: %w", table, err)
+	}
+	return nil
+}
+
+func (d *dumper) encodeBinary(value []byte) []byte {
+	if d.opts.delimited.base64 {
+		return base64.StdEncoding.AppendEncode(nil, value)
+	}
+	return hex.AppendEncode(nil, value)
+}
+
+func (d *dumper) csvField(out *bufio.Writer, value []byte, kind valueKind) {
+	s := string(value)
+	if kind == kindNumber || !strings.ContainsAny(s, ",\"\r\n") && s != d.opts.delimited.null {
+		out.WriteString(s)
+		return
+	}
+	out.WriteByte('"')
+	out.WriteString(strings.ReplaceAll(s, `"`, `""`))
+	out.WriteByte('"')
+}
+
+var tsvEscaper = strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`, "\r", `\r`)
+
+func (d *dumper) tsvField(out *bufio.Writer, value []byte, kind valueKind) {
+	tsvEscaper.WriteString(out, string(value))
+}
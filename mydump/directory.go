@@ -0,0 +1,206 @@
+package mydump
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+)
+
+// dumpFormat selects the layout of a dump, see DB_DUMP_FORMAT.
+type dumpFormat string
+
+const (
+	// formatSQL is a single SQL script per database.
+	formatSQL dumpFormat = "sql"
+	// formatDirectory is a backup set of SQL scripts below a common
+	// prefix, with the schema and the data of every table in files of their
+	// own so that tables can be restored individually.
+	formatDirectory dumpFormat = "directory"
+)
+
+// uploadFunc uploads what write writes as filename and returns its key, see
+// uploadDump.
+type uploadFunc func(filename string, write func(w io.Writer) error) (string, error)
+
+// dumpDirectory dumps database as a backup set below dir and returns the
+// keys of the uploaded files in the order they are to be restored:
+//
+//	<db>.<table>-schema.sql           table definition
+//	<db>.<table>.sql                  rows
+//	<db>.<table>.00000.sql            rows of the first chunk
+//	<db>.<table>-schema-triggers.sql  triggers
+//	<db>-schema-post.sql              events and routines
+//	<db>-schema-views.sql             views
+//
+// In the CSV and TSV formats the rows go to <db>.<table>.csv or .tsv
+// instead, and in the JSON Lines format to <db>.<table>.jsonl; the rest
+// stays SQL. In the Parquet format they go to
+// db=<db>/table=<table>/dt=<day>/<backup name>.parquet next to dir.
+//
+// Parts that cp holds from an interrupted attempt are not dumped again, and
+// every part uploaded is recorded in cp.
+func dumpDirectory(ctx context.Context, db *sql.DB, database, dir string, opts dumpOptions, meta *backupMetadata, upload uploadFunc, cp *checkpoint) ([]string, error) {
+	d, err := openDumper(ctx, db, database, opts, meta)
+	if err != nil {
+		return nil, err
+	}
+	defer d.snap.Close()
+
+	baseTables, views, err := d.plan(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := splitParts(baseTables)
+	partKeys := make([][]string, len(parts))
+	resumed := make([]bool, len(parts))
+	done := 0
+	for i, part := range parts {
+		if partKeys[i], resumed[i] = cp.partKeys(database, part.id()); resumed[i] {
+			done++
+		}
+	}
+	if done > 0 {
+		log.Printf("Resuming database %s with %d of %d parts already uploaded", database, done, len(parts))
+	}
+
+	err = d.forEachPart(ctx, parts, func(ctx context.Context, conn *sql.Conn, i int) error {
+		if resumed[i] {
+			return nil
+		}
+		keys, err := d.uploadPart(ctx, conn, dir, parts[i], upload)
+		if err != nil {
+			return err
+		}
+		partKeys[i] = keys
+		cp.partDone(database, parts[i].id(), keys)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for i, k := range partKeys {
+		keys = append(keys, k...)
+		if resumed[i] {
+			meta.ResumedFiles = append(meta.ResumedFiles, k...)
+		}
+	}
+
+	prefix := dir + url.PathEscape(database)
+	if d.withSchema() && (d.opts.events || d.opts.routines) {
+		key, err := d.uploadFile(prefix+"-schema-post.sql", upload, func(out *bufio.Writer) error {
+			return d.writePostData(ctx, out)
+		})
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if len(views) > 0 {
+		key, err := d.uploadFile(prefix+"-schema-views.sql", upload, func(out *bufio.Writer) error {
+			return d.writeViews(ctx, out, views)
+		})
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// uploadPart uploads the files of one part of a table of a directory dump.
+func (d *dumper) uploadPart(ctx context.Context, conn *sql.Conn, dir string, part tablePart, upload uploadFunc) ([]string, error) {
+	table := part.table
+	prefix := dir + url.PathEscape(d.database) + "." + url.PathEscape(table.name)
+
+	var keys []string
+	write := func(filename string, write func(out *bufio.Writer) error) error {
+		key, err := d.uploadFile(filename, upload, write)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+		return nil
+	}
+
+	if d.withSchema() && part.first() {
+		err := write(prefix+"-schema.sql", func(out *bufio.Writer) error {
+			return d.writeStructure(ctx, conn, out, table)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !table.schemaOnly {
+		rowsPrefix, ext := prefix, ".sql"
+		if d.opts.format.delimited() || d.opts.format == formatJSONL {
+			ext = "." + string(d.opts.format)
+		}
+		if d.opts.format == formatParquet {
+			rowsPrefix, ext = d.lakePrefix(dir, table.name), ".parquet"
+		}
+		filename := rowsPrefix + ext
+		if part.chunk != nil {
+			filename = fmt.Sprintf("%s.%05d%s", rowsPrefix, part.chunk.index, ext)
+		}
+		var key string
+		var err error
+		switch {
+		case d.opts.format.delimited() || d.opts.format == formatJSONL:
+			writeRows := d.writeDelimited
+			if d.opts.format == formatJSONL {
+				writeRows = d.writeJSONL
+			}
+			key, err = upload(filename, func(w io.Writer) error {
+				out := bufio.NewWriterSize(w, 64*1024)
+				if err := writeRows(ctx, conn, out, part); err != nil {
+					return err
+				}
+				return out.Flush()
+			})
+		case d.opts.format == formatParquet:
+			key, err = upload(filename, func(w io.Writer) error {
+				return d.writeParquet(ctx, conn, w, part)
+			})
+		default:
+			key, err = d.uploadFile(filename, upload, func(out *bufio.Writer) error {
+				return d.writeData(ctx, conn, out, part)
+			})
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if len(table.triggers) > 0 && part.last() {
+		err := write(prefix+"-schema-triggers.sql", func(out *bufio.Writer) error {
+			return d.writeTriggers(ctx, conn, out, table)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// uploadFile uploads one file of a directory dump. Every file carries the
+// usual header and footer, so each can be fed to the mysql client on its
+// own.
+func (d *dumper) uploadFile(filename string, upload uploadFunc, write func(out *bufio.Writer) error) (string, error) {
+	return upload(filename, func(w io.Writer) error {
+		out := bufio.NewWriterSize(w, 64*1024)
+		d.writeHeader(out)
+		if err := write(out); err != nil {
+			return err
+		}
+		d.writeFooter(out)
+		return out.Flush()
+	})
+}
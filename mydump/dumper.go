@@ -0,0 +1,777 @@
+package mydump
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultMaxAllowedPacket = 4194304
+
+// deterministicBatchRows is the number of rows per INSERT statement of a
+// deterministic dump, see DB_DUMP_DETERMINISTIC.
+const deterministicBatchRows = 1000
+
+// dumpMode selects what a dump contains, see DB_DUMP_MODE.
+type dumpMode string
+
+const (
+	modeFull   dumpMode = "full"
+	modeSchema dumpMode = "schema"
+	modeData   dumpMode = "data"
+	// modeAccounts marks the users, roles and grants backup, it is not a
+	// DB_DUMP_MODE.
+	modeAccounts dumpMode = "accounts"
+)
+
+// suffix is inserted before .sql in the dump filename so that partial dumps
+// are recognisable at a glance.
+func (m dumpMode) suffix() string {
+	if m == modeFull {
+		return ""
+	}
+	return "." + string(m)
+}
+
+type dumpOptions struct {
+	singleTransaction bool
+	masterData        bool
+	maxAllowedPacket  int
+	threads           int
+	chunkRows         int64
+	deterministic     bool
+	mode              dumpMode
+	format            dumpFormat
+	delimited         delimitedOptions
+	parquet           parquetOptions
+	jsonl             jsonlOptions
+	routines          bool
+	triggers          bool
+	events            bool
+	views             bool
+	tables            tableFilter
+	where             []tableWhere
+	masking           *masking
+}
+
+func dumpOptionsFromEnv() (dumpOptions, error) {
+	opts := dumpOptions{
+		singleTransaction: os.Getenv("DB_DUMP_SINGLE_TRANSACTION") != "0",
+		masterData:        os.Getenv("DB_DUMP_MASTER_DATA") == "1",
+		maxAllowedPacket:  defaultMaxAllowedPacket,
+		threads:           1,
+		mode:              modeFull,
+		format:            formatSQL,
+		routines:          os.Getenv("DB_DUMP_ROUTINES") != "0",
+		triggers:          os.Getenv("DB_DUMP_TRIGGERS") != "0",
+		events:            os.Getenv("DB_DUMP_EVENTS") != "0",
+		views:             os.Getenv("DB_DUMP_VIEWS") != "0",
+		deterministic:     os.Getenv("DB_DUMP_DETERMINISTIC") == "1",
+	}
+
+	switch mode := dumpMode(os.Getenv("DB_DUMP_MODE")); mode {
+	case "":
+	case modeFull, modeSchema, modeData:
+		opts.mode = mode
+	default:
+		return opts, fmt.Errorf("invalid DB_DUMP_MODE value %q: must be full, schema or data", mode)
+	}
+
+	switch format := dumpFormat(os.Getenv("DB_DUMP_FORMAT")); format {
+	case "":
+	case formatSQL, formatDirectory, formatCSV, formatTSV, formatParquet, formatJSONL:
+		opts.format = format
+	default:
+		return opts, fmt.Errorf("invalid DB_DUMP_FORMAT value %q: must be sql, directory, csv, tsv, parquet or jsonl", format)
+	}
+	if opts.format.delimited() {
+		var err error
+		if opts.delimited, err = delimitedOptionsFromEnv(opts.format); err != nil {
+			return opts, err
+		}
+	}
+	if opts.format == formatParquet {
+		var err error
+		if opts.parquet, err = parquetOptionsFromEnv(); err != nil {
+			return opts, err
+		}
+	}
+	if opts.format == formatJSONL {
+		opts.jsonl = jsonlOptionsFromEnv()
+	}
+
+	if v := os.Getenv("DB_DUMP_MAX_ALLOWED_PACKET"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1024 {
+			return opts, fmt.Errorf("invalid DB_DUMP_MAX_ALLOWED_PACKET value %q: must be a number >= 1024", v)
+		}
+		opts.maxAllowedPacket = n
+	}
+
+	if v := os.Getenv("DB_DUMP_THREADS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return opts, fmt.Errorf("invalid DB_DUMP_THREADS value %q: must be a number >= 1", v)
+		}
+		opts.threads = n
+	}
+
+	if v := os.Getenv("DB_DUMP_CHUNK_ROWS"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 1 {
+			return opts, fmt.Errorf("invalid DB_DUMP_CHUNK_ROWS value %q: must be a number >= 1", v)
+		}
+		opts.chunkRows = n
+		// A SQL dump is a single object, so a failed chunk would still throw
+		// the whole dump away.
+		if opts.format == formatSQL {
+			return opts, fmt.Errorf("DB_DUMP_CHUNK_ROWS is not supported with DB_DUMP_FORMAT=sql, use directory, csv, tsv, parquet or jsonl")
+		}
+	}
+
+	var err error
+	if opts.tables, err = tableFilterFromEnv(); err != nil {
+		return opts, err
+	}
+	if opts.where, err = tableWheresFromEnv(); err != nil {
+		return opts, err
+	}
+	if opts.masking, err = maskingFromEnv(); err != nil {
+		return opts, err
+	}
+
+	return opts, nil
+}
+
+type tableInfo struct {
+	name       string
+	isView     bool
+	schemaOnly bool
+	// where limits the rows dumped, see DB_TABLE_WHERE.
+	where    string
+	triggers []string
+	// chunks splits the rows into primary key ranges, see
+	// DB_DUMP_CHUNK_ROWS.
+	chunks []chunk
+}
+
+// dumper writes a restorable SQL dump of one database read through a
+// snapshot.
+type dumper struct {
+	snap     *snapshot
+	database string
+	opts     dumpOptions
+	meta     *backupMetadata
+	out      *bufio.Writer
+}
+
+// openDumper starts the snapshot of database and fills in what it learned
+// about the server and snapshot in meta. The caller closes d.snap.
+func openDumper(ctx context.Context, db *sql.DB, database string, opts dumpOptions, meta *backupMetadata) (*dumper, error) {
+	snap, err := openSnapshot(ctx, db, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	meta.ServerVersion = snap.serverVersion
+	meta.SingleTransaction = snap.inTransaction
+	meta.Binlog = snap.coordinates
+	if opts.masking.enabled() {
+		for _, rule := range opts.masking.rules {
+			meta.Masking = append(meta.Masking, rule.line)
+		}
+	}
+
+	return &dumper{
+		snap:     snap,
+		database: database,
+		opts:     opts,
+		meta:     meta,
+	}, nil
+}
+
+// dumpSQL dumps database into w as a single SQL script.
+func dumpSQL(ctx context.Context, db *sql.DB, database string, w io.Writer, opts dumpOptions, meta *backupMetadata) error {
+	d, err := openDumper(ctx, db, database, opts, meta)
+	if err != nil {
+		return err
+	}
+	defer d.snap.Close()
+
+	d.out = bufio.NewWriterSize(w, 64*1024)
+	return d.dump(ctx)
+}
+
+// withSchema reports whether routines, triggers, events and views are
+// dumped. They are all part of the schema, so a data-only dump leaves them
+// out along with the table definitions.
+func (d *dumper) withSchema() bool {
+	return d.opts.mode != modeData
+}
+
+// plan lists the tables and views to dump and decides how each table is
+// dumped.
+func (d *dumper) plan(ctx context.Context) (baseTables []tableInfo, views []string, err error) {
+	tables, err := d.listTables(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var triggers map[string][]string
+	if d.opts.triggers && d.withSchema() {
+		if triggers, err = d.listTriggers(ctx); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for _, where := range unmatchedWheres(d.opts.where, d.database, tables) {
+		log.Printf("DB_TABLE_WHERE entry %s matches no table of database %s", where.pattern.raw, d.database)
+	}
+
+	for _, table := range tables {
+		if reason := d.opts.tables.excludeReason(d.database, table.name); reason != "" {
+			if !d.opts.tables.schemaOnly || d.opts.mode == modeData {
+				log.Printf("Skipping table %s.%s: %s", d.database, table.name, reason)
+				continue
+			}
+			log.Printf("Dumping structure only of table %s.%s: %s", d.database, table.name, reason)
+			table.schemaOnly = true
+		}
+		if d.opts.mode == modeSchema {
+			table.schemaOnly = true
+		}
+		if table.isView && !(d.opts.views && d.withSchema()) {
+			continue
+		}
+		table.triggers = triggers[table.name]
+		if !table.isView && !table.schemaOnly {
+			if table.where = whereFor(d.opts.where, d.database, table.name); table.where != "" {
+				log.Printf("Dumping rows of table %s.%s where %s", d.database, table.name, table.where)
+				if d.meta.Where == nil {
+					d.meta.Where = make(map[string]string)
+				}
+				d.meta.Where[table.name] = table.where
+			}
+			if d.opts.chunkRows > 0 {
+				if table.chunks, err = d.chunkTable(ctx, d.snap.conns[0], table.name); err != nil {
+					return nil, nil, err
+				}
+				if len(table.chunks) > 0 {
+					if d.meta.Chunks == nil {
+						d.meta.Chunks = make(map[string]int)
+					}
+					d.meta.Chunks[table.name] = len(table.chunks)
+				}
+			}
+		}
+		if table.isView {
+			views = append(views, table.name)
+		} else {
+			baseTables = append(baseTables, table)
+		}
+	}
+	return baseTables, views, nil
+}
+
+func (d *dumper) dump(ctx context.Context) error {
+	d.writeHeader(d.out)
+
+	baseTables, views, err := d.plan(ctx)
+	if err != nil {
+		return err
+	}
+
+	parts := splitParts(baseTables)
+	if len(d.snap.conns) > 1 && len(parts) > 1 {
+		err = d.writeTablesParallel(ctx, parts)
+	} else {
+		for _, part := range parts {
+			if err = d.writePart(ctx, d.snap.conns[0], d.out, part); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := d.writePostData(ctx, d.out); err != nil {
+		return err
+	}
+
+	// Views go last so every table and function they use already exists.
+	if err := d.writeViews(ctx, d.out, views); err != nil {
+		return err
+	}
+
+	d.writeFooter(d.out)
+	return d.out.Flush()
+}
+
+// writePostData writes the events and routines of the database.
+func (d *dumper) writePostData(ctx context.Context, out *bufio.Writer) error {
+	if d.opts.events && d.withSchema() {
+		if err := d.writeEvents(ctx, out); err != nil {
+			return err
+		}
+	}
+	if d.opts.routines && d.withSchema() {
+		if err := d.writeRoutines(ctx, out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *dumper) writeHeader(out *bufio.Writer) {
+	fmt.Fprintf(out, "-- s3dbdump SQL dump\n--\n-- Database: %s\n-- ------------------------------------------------------\n-- Server version\t%s\n", d.database, d.snap.serverVersion)
+
+	// The coordinates move with every write to the server, a deterministic
+	// dump leaves them to the metadata.
+	if c := d.snap.coordinates; c != nil && !d.opts.deterministic {
+		out.WriteString("\n--\n-- Binlog coordinates of this dump, for seeding a replica or point-in-time recovery\n--\n\n")
+		fmt.Fprintf(out, "-- CHANGE MASTER TO MASTER_LOG_FILE='%s', MASTER_LOG_POS=%d;\n", escapeString(c.File), c.Position)
+		if c.GTIDSet != "" {
+			if c.Flavor == "mariadb" {
+				fmt.Fprintf(out, "-- SET GLOBAL gtid_slave_pos='%s';\n", escapeString(c.GTIDSet))
+			} else {
+				fmt.Fprintf(out, "-- SET @@GLOBAL.GTID_PURGED='%s';\n", escapeString(c.GTIDSet))
+			}
+		}
+	}
+
+	out.WriteString(`
+/*!40101 SET @OLD_CHARACTER_SET_CLIENT=@@CHARACTER_SET_CLIENT */;
+/*!40101 SET @OLD_CHARACTER_SET_RESULTS=@@CHARACTER_SET_RESULTS */;
+/*!40101 SET @OLD_COLLATION_CONNECTION=@@COLLATION_CONNECTION */;
+ SET NAMES utf8mb4 ;
+/*!40103 SET @OLD_TIME_ZONE=@@TIME_ZONE */;
+/*!40103 SET TIME_ZONE='+00:00' */;
+/*!40014 SET @OLD_UNIQUE_CHECKS=@@UNIQUE_CHECKS, UNIQUE_CHECKS=0 */;
+/*!40014 SET @OLD_FOREIGN_KEY_CHECKS=@@FOREIGN_KEY_CHECKS, FOREIGN_KEY_CHECKS=0 */;
+/*!40101 SET @OLD_SQL_MODE=@@SQL_MODE, SQL_MODE='NO_AUTO_VALUE_ON_ZERO' */;
+/*!40111 SET @OLD_SQL_NOTES=@@SQL_NOTES, SQL_NOTES=0 */;
+`)
+}
+
+func (d *dumper) writeFooter(out *bufio.Writer) {
+	out.WriteString(`
+/*!40103 SET TIME_ZONE=@OLD_TIME_ZONE */;
+/*!40101 SET SQL_MODE=@OLD_SQL_MODE */;
+/*!40014 SET FOREIGN_KEY_CHECKS=@OLD_FOREIGN_KEY_CHECKS */;
+/*!40014 SET UNIQUE_CHECKS=@OLD_UNIQUE_CHECKS */;
+/*!40101 SET CHARACTER_SET_CLIENT=@OLD_CHARACTER_SET_CLIENT */;
+/*!40101 SET CHARACTER_SET_RESULTS=@OLD_CHARACTER_SET_RESULTS */;
+/*!40101 SET COLLATION_CONNECTION=@OLD_COLLATION_CONNECTION */;
+/*!40111 SET SQL_NOTES=@OLD_SQL_NOTES */;
+`)
+	// The metadata keeps the time of a deterministic dump.
+	if d.opts.deterministic {
+		return
+	}
+	fmt.Fprintf(out, "\n-- Dump completed on %s\n", time.Now().UTC().Format("2006-01-02 15:04:05"))
+}
+
+func (d *dumper) listTables(ctx context.Context) ([]tableInfo, error) {
+	rows, err := d.snap.conns[0].QueryContext(ctx, "SHOW FULL TABLES")
+	if err != nil {
+		return nil, fmt.Errorf("error listing tables: %w", err)
+	}
+	defer rows.Close()
+
+	var tables []tableInfo
+	for rows.Next() {
+		var name, tableType string
+		if err := rows.Scan(&name, &tableType); err != nil {
+			return nil, fmt.Errorf("error scanning table name: %w", err)
+		}
+		tables = append(tables, tableInfo{name: name, isView: tableType == "VIEW"})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if d.opts.deterministic {
+		// SHOW FULL TABLES lists tables in the order of the data
+		// dictionary, which may differ between servers.
+		sort.Slice(tables, func(i, j int) bool { return tables[i].name < tables[j].name })
+	}
+	return tables, nil
+}
+
+func (d *dumper) writePart(ctx context.Context, conn *sql.Conn, out *bufio.Writer, part tablePart) error {
+	// Data-only dumps load into an existing schema, so they leave the
+	// table definition alone.
+	if d.withSchema() && part.first() {
+		if err := d.writeStructure(ctx, conn, out, part.table); err != nil {
+			return err
+		}
+	}
+
+	if !part.table.schemaOnly {
+		if err := d.writeData(ctx, conn, out, part); err != nil {
+			return err
+		}
+	}
+
+	// Triggers are created after the rows are loaded so they do not fire
+	// for them.
+	if !part.last() {
+		return nil
+	}
+	return d.writeTriggers(ctx, conn, out, part.table)
+}
+
+func (d *dumper) writeStructure(ctx context.Context, conn *sql.Conn, out *bufio.Writer, table tableInfo) error {
+	createSQL, err := d.showCreate(ctx, conn, "TABLE", table.name)
+	if err != nil {
+		return err
+	}
+	if d.opts.deterministic {
+		createSQL = stripAutoIncrement(createSQL)
+	}
+
+	quoted := quoteIdentifier(table.name)
+	fmt.Fprintf(out, "\n--\n-- Table structure for table %s\n--\n\n", quoted)
+	fmt.Fprintf(out, "DROP TABLE IF EXISTS %s;\n", quoted)
+	out.WriteString("/*!40101 SET @saved_cs_client     = @@character_set_client */;\n SET character_set_client = utf8mb4 ;\n")
+	fmt.Fprintf(out, "%s;\n", createSQL)
+	out.WriteString("/*!40101 SET character_set_client = @saved_cs_client */;\n")
+	return nil
+}
+
+// autoIncrementOption is the table option SHOW CREATE TABLE adds for the
+// next AUTO_INCREMENT value, which moves with every insert even when the
+// rows end up the same.
+var autoIncrementOption = regexp.MustCompile(` AUTO_INCREMENT=[0-9]+`)
+
+// stripAutoIncrement removes the AUTO_INCREMENT table option from createSQL.
+// Restored tables then continue after their largest key instead. Only the
+// table options after the column list are searched, so column definitions
+// and comments are left alone.
+func stripAutoIncrement(createSQL string) string {
+	i := strings.Index(createSQL, "\n) ")
+	if i < 0 {
+		return createSQL
+	}
+	loc := autoIncrementOption.FindStringIndex(createSQL[i:])
+	if loc == nil {
+		return createSQL
+	}
+	return createSQL[:i+loc[0]] + createSQL[i+loc[1]:]
+}
+
+func (d *dumper) writeData(ctx context.Context, conn *sql.Conn, out *bufio.Writer, part tablePart) error {
+	quoted := quoteIdentifier(part.table.name)
+	fmt.Fprintf(out, "\n--\n-- Dumping data for table %s\n--\n", quoted)
+	if part.table.where != "" {
+		fmt.Fprintf(out, "-- WHERE:  %s\n", part.table.where)
+	}
+	if c := part.chunk; c != nil {
+		fmt.Fprintf(out, "-- Chunk %d of %d:  %s\n", c.index+1, c.count, c.condition())
+	}
+	out.WriteString("\n")
+	fmt.Fprintf(out, "LOCK TABLES %s WRITE;\n", quoted)
+	fmt.Fprintf(out, "/*!40000 ALTER TABLE %s DISABLE KEYS */;\n", quoted)
+	if err := d.writeRows(ctx, conn, out, part); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "/*!40000 ALTER TABLE %s ENABLE KEYS */;\n", quoted)
+	out.WriteString("UNLOCK TABLES;\n")
+
+	return nil
+}
+
+func (d *dumper) writeViews(ctx context.Context, out *bufio.Writer, names []string) error {
+	views := make([]view, len(names))
+	for i, name := range names {
+		createSQL, err := d.showCreate(ctx, d.snap.conns[0], "VIEW", name)
+		if err != nil {
+			return err
+		}
+		views[i] = view{name: name, createSQL: createSQL}
+	}
+
+	for _, v := range sortViews(views) {
+		quoted := quoteIdentifier(v.name)
+		fmt.Fprintf(out, "\n--\n-- View structure for view %s\n--\n\n", quoted)
+		fmt.Fprintf(out, "DROP VIEW IF EXISTS %s;\n", quoted)
+		out.WriteString("/*!40101 SET @saved_cs_client     = @@character_set_client */;\n SET character_set_client = utf8mb4 ;\n")
+		fmt.Fprintf(out, "%s;\n", v.createSQL)
+		out.WriteString("/*!40101 SET character_set_client = @saved_cs_client */;\n")
+	}
+	return nil
+}
+
+// insertableColumns lists the columns of a table that can be written back,
+// leaving out generated columns which reject explicit values, along with
+// their types as SHOW COLUMNS lists them.
+func (d *dumper) insertableColumns(ctx context.Context, conn *sql.Conn, table string) (columns, columnTypes []string, err error) {
+	rows, err := conn.QueryContext(ctx, "SHOW COLUMNS FROM "+quoteIdentifier(table))
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading columns of %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	names, err := rows.Columns()
+	if err != nil {
+		return nil, nil, err
+	}
+	fieldIndex, typeIndex, extraIndex := -1, -1, -1
+	for i, name := range names {
+		switch strings.ToLower(name) {
+		case "field":
+			fieldIndex = i
+		case "type":
+			typeIndex = i
+		case "extra":
+			extraIndex = i
+		}
+	}
+	if fieldIndex < 0 || typeIndex < 0 || extraIndex < 0 {
+		return nil, nil, fmt.Errorf("column information of %s is malformed", table)
+	}
+
+	values := make([]sql.NullString, len(names))
+	scans := make([]any, len(names))
+	for i := range values {
+		scans[i] = &values[i]
+	}
+
+	for rows.Next() {
+		if err := rows.Scan(scans...); err != nil {
+			return nil, nil, err
+		}
+		extra := strings.ToUpper(values[extraIndex].String)
+		if strings.Contains(extra, "VIRTUAL") || strings.Contains(extra, "STORED GENERATED") || strings.Contains(extra, "PERSISTENT") {
+			continue
+		}
+		columns = append(columns, values[fieldIndex].String)
+		columnTypes = append(columnTypes, values[typeIndex].String)
+	}
+	return columns, columnTypes, rows.Err()
+}
+
+// tableRows iterates over the rows of a part of a table, with masking
+// applied.
+type tableRows struct {
+	*sql.Rows
+	columns []string
+	types   []*sql.ColumnType
+	kinds   []valueKind
+	masks   []*columnMask
+	masking *masking
+	values  []sql.RawBytes
+	scans   []any
+}
+
+// selectRows reads the rows of part. It returns nil if the table has no
+// columns that can be written back.
+func (d *dumper) selectRows(ctx context.Context, conn *sql.Conn, part tablePart) (*tableRows, error) {
+	table := part.table.name
+	columns, columnTypes, err := d.insertableColumns(ctx, conn, table)
+	if err != nil {
+		return nil, err
+	}
+	if len(columns) == 0 {
+		return nil, nil
+	}
+
+	query := "SELECT " + quoteIdentifiers(columns) + " FROM " + quoteIdentifier(table)
+	if where := part.where(); where != "" {
+		query += " WHERE " + where
+	}
+	if d.opts.deterministic {
+		order, err := d.rowOrder(ctx, conn, table, columns)
+		if err != nil {
+			return nil, err
+		}
+		query += " ORDER BY " + quoteIdentifiers(order)
+	}
+	rows, err := conn.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("error reading rows of %s: %w", table, err)
+	}
+
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		rows.Close()
+		return nil, err
+	}
+	r := &tableRows{
+		Rows:    rows,
+		columns: columns,
+		types:   types,
+		kinds:   make([]valueKind, len(types)),
+		masks:   d.opts.masking.columnMasks(d.database, table, columns, columnTypes),
+		masking: d.opts.masking,
+		values:  make([]sql.RawBytes, len(types)),
+		scans:   make([]any, len(types)),
+	}
+	for i, columnType := range types {
+		r.kinds[i] = kindOf(columnType.DatabaseTypeName())
+		r.scans[i] = &r.values[i]
+	}
+	return r, nil
+}
+
+// rowOrder returns the columns ordering the rows of a deterministic dump:
+// the primary key, or every column of a table without one, which orders
+// all but identical rows.
+func (d *dumper) rowOrder(ctx context.Context, conn *sql.Conn, table string, columns []string) ([]string, error) {
+	keys, err := listNames(ctx, conn, "SHOW KEYS FROM "+quoteIdentifier(table)+" WHERE Key_name = 'PRIMARY'", "Column_name")
+	if err != nil {
+		return nil, fmt.Errorf("error reading primary key of %s: %w", table, err)
+	}
+	if len(keys) == 0 {
+		log.Printf("Ordering rows of table %s.%s by every column: it has no primary key", d.database, table)
+		return columns, nil
+	}
+	return keys, nil
+}
+
+// value returns column i of the current row, masked if a rule applies.
+func (r *tableRows) value(i int) (sql.RawBytes, valueKind) {
+	if r.masks != nil && r.masks[i] != nil {
+		return r.masking.apply(r.masks[i], r.values[i], r.kinds[i])
+	}
+	return r.values[i], r.kinds[i]
+}
+
+func (d *dumper) writeRows(ctx context.Context, conn *sql.Conn, out *bufio.Writer, part tablePart) error {
+	table := part.table.name
+	rows, err := d.selectRows(ctx, conn, part)
+	if err != nil || rows == nil {
+		return err
+	}
+	defer rows.Close()
+
+	insertPrefix := "INSERT INTO " + quoteIdentifier(table) + " (" + quoteIdentifiers(rows.columns) + ") VALUES "
+	separator := ","
+	if d.opts.deterministic {
+		// One row per line, so a diff shows the rows that changed.
+		insertPrefix, separator = strings.TrimSuffix(insertPrefix, " ")+"\n", ",\n"
+	}
+	var insert, row bytes.Buffer
+	batched := 0
+	for rows.Next() {
+		if err := rows.Scan(rows.scans...); err != nil {
+			return fmt.Errorf("error scanning row of %s: %w", table, err)
+		}
+
+		row.Reset()
+		row.WriteByte('(')
+		for i := range rows.values {
+			if i > 0 {
+				row.WriteByte(',')
+			}
+			value, kind := rows.value(i)
+			writeValue(&row, kind, value)
+		}
+		row.WriteByte(')')
+
+		// Start a new statement before the current one outgrows the
+		// server's max_allowed_packet on restore. Deterministic dumps also
+		// start one every deterministicBatchRows rows, so a changed row
+		// does not shift the statements after it.
+		if insert.Len() > 0 && (insert.Len()+row.Len()+len(separator)+1 > d.opts.maxAllowedPacket ||
+			d.opts.deterministic && batched == deterministicBatchRows) {
+			insert.WriteString(";\n")
+			if _, err := insert.WriteTo(out); err != nil {
+				return err
+			}
+			batched = 0
+		}
+		if insert.Len() == 0 {
+			insert.WriteString(insertPrefix)
+		} else {
+			insert.WriteString(separator)
+		}
+		row.WriteTo(&insert)
+		batched++
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error reading rows of %s: %w", table, err)
+	}
+
+	if insert.Len() > 0 {
+		insert.WriteString(";\n")
+		if _, err := insert.WriteTo(out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type valueKind int
+
+const (
+	kindString valueKind = iota
+	kindNumber
+	kindBinary
+)
+
+func kindOf(databaseTypeName string) valueKind {
+	switch strings.TrimPrefix(databaseTypeName, "UNSIGNED ") {
+	case "TINYINT", "SMALLINT", "MEDIUMINT", "INT", "BIGINT", "DECIMAL", "FLOAT", "DOUBLE", "YEAR":
+		return kindNumber
+	case "BINARY", "VARBINARY", "TINYBLOB", "BLOB", "MEDIUMBLOB", "LONGBLOB", "BIT", "GEOMETRY", "VECTOR":
+		return kindBinary
+	}
+	return kindString
+}
+
+func writeValue(b *bytes.Buffer, kind valueKind, value sql.RawBytes) {
+	switch {
+	case value == nil:
+		b.WriteString("NULL")
+	case kind == kindNumber:
+		b.Write(value)
+	case kind == kindBinary && len(value) > 0:
+		b.WriteString("0x")
+		b.WriteString(hex.EncodeToString(value))
+	default:
+		b.WriteByte('\'')
+		b.WriteString(escapeString(string(value)))
+		b.WriteByte('\'')
+	}
+}
+
+var stringEscaper = strings.NewReplacer(
+	"\x00", `\0`,
+	"'", `\'`,
+	`"`, `\"`,
+	"\b", `\b`,
+	"\n", `\n`,
+	"\r", `\r`,
+	"\x1A", `\Z`,
+	`\`, `\\`,
+)
+
+// escapeString escapes s for use inside a single quoted MySQL string
+// literal, see https://dev.mysql.com/doc/refman/8.0/en/string-literals.html.
+func escapeString(s string) string {
+	return stringEscaper.Replace(s)
+}
+
+func quoteIdentifier(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+func quoteIdentifiers(names []string) string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = quoteIdentifier(name)
+	}
+	return strings.Join(quoted, ",")
+}
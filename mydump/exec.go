@@ -0,0 +1,103 @@
+package mydump
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// execSource backs up whatever a configured command writes to stdout, for
+// databases without a source of their own, such as mongodump --archive or
+// redis-cli --rdb -. The backup fails if the command exits non-zero, and its
+// stderr goes to the log.
+type execSource struct {
+	command   []string
+	extension string
+}
+
+func execSourceFromEnv() (*execSource, error) {
+	command, err := splitCommand(os.Getenv("DB_EXEC_COMMAND"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid DB_EXEC_COMMAND: %w", err)
+	}
+	s := &execSource{command: command, extension: "dump"}
+	if ext := os.Getenv("DB_EXEC_EXTENSION"); ext != "" {
+		s.extension = strings.TrimPrefix(ext, ".")
+	}
+	if strings.ContainsAny(s.extension, "/ ") {
+		return nil, fmt.Errorf("invalid DB_EXEC_EXTENSION value %q", s.extension)
+	}
+
+	// The command decides what it dumps.
+	if mode := dumpMode(os.Getenv("DB_DUMP_MODE")); mode != "" && mode != modeFull {
+		return nil, fmt.Errorf("invalid DB_DUMP_MODE value %q: set what to dump in DB_EXEC_COMMAND", mode)
+	}
+	if format := os.Getenv("DB_DUMP_FORMAT"); format != "" {
+		return nil, fmt.Errorf("invalid DB_DUMP_FORMAT value %q: set what to dump in DB_EXEC_COMMAND", format)
+	}
+	if err := rejectMySQLOnlyEnv(engineExec); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ping checks that the command can be found, as running it would take a
+// backup.
+func (s *execSource) ping(ctx context.Context) error {
+	_, err := exec.LookPath(s.command[0])
+	return err
+}
+
+func (s *execSource) databases(ctx context.Context) ([]string, error) {
+	return nil, fmt.Errorf("DB_ALL_DATABASES is not supported with DB_ENGINE=exec, set DB_NAME to name the backup")
+}
+
+// dump runs the command with its stdout going to w. It gets the name of
+// the backup in DB_NAME.
+func (s *execSource) dump(ctx context.Context, database string, w io.Writer) error {
+	env := append(os.Environ(), "DB_NAME="+database)
+	return runCommand(ctx, env, w, s.command[0], s.command[1:]...)
+}
+
+func (s *execSource) dumpDatabase(ctx context.Context, database string, cp *checkpoint) error {
+	if name, ok := cp.completed(database); ok {
+		log.Printf("Skipping database %s: completed in run %s as %s", database, cp.RunID, name)
+		return nil
+	}
+	log.Printf("Dumping database %s with %s", database, s.command[0])
+
+	started := time.Now()
+	_, name := cp.startDatabase(database, backupName(database, started))
+	meta := &backupMetadata{
+		Database:  database,
+		Engine:    engineExec,
+		Mode:      modeFull,
+		StartedAt: started.UTC(),
+	}
+
+	key, err := uploadDump(name+"."+s.extension, func(w io.Writer) error {
+		return s.dump(ctx, database, w)
+	})
+	if err != nil {
+		return fmt.Errorf("error dumping: %w", err)
+	}
+
+	meta.FinishedAt = time.Now().UTC()
+	meta.Files = []string{key}
+	if err := uploadMetadata(name, meta); err != nil {
+		return fmt.Errorf("error uploading backup metadata: %w", err)
+	}
+	cp.completeDatabase(database)
+	return nil
+}
+
+// dumpAccounts does nothing, the command dumps whatever it is told to.
+func (s *execSource) dumpAccounts(ctx context.Context) error {
+	log.Printf("Skipping accounts: not supported with DB_ENGINE=exec")
+	return nil
+}
@@ -0,0 +1,246 @@
+package mydump
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeResult is a canned result set. types holds the MySQL type name of
+// each column as reported by the real driver, with the precision and scale
+// of decimals as in DECIMAL(10,2).
+type fakeResult struct {
+	columns []string
+	types   []string
+	rows    [][]any
+}
+
+// fakeServer answers queries from canned results and records every statement
+// it sees, so tests can check both the dump output and the order of the
+// locking and transaction statements.
+type fakeServer struct {
+	mu         sync.Mutex
+	results    map[string]fakeResult
+	errors     map[string]error
+	held       map[string]chan struct{}
+	statements []string
+}
+
+var (
+	fakeServersMu sync.Mutex
+	fakeServers   = make(map[string]*fakeServer)
+	registerFake  sync.Once
+)
+
+// newFakeDB returns a *sql.DB backed by a fakeServer.
+func newFakeDB(t *testing.T) (*sql.DB, *fakeServer) {
+	registerFake.Do(func() {
+		sql.Register("fakemysql", fakeDriver{})
+	})
+
+	server := &fakeServer{
+		results: make(map[string]fakeResult),
+		errors:  make(map[string]error),
+		held:    make(map[string]chan struct{}),
+	}
+	server.on("SELECT VERSION()", fakeResult{
+		columns: []string{"VERSION()"},
+		types:   []string{"VARCHAR"},
+		rows:    [][]any{{"8.0.36"}},
+	})
+
+	fakeServersMu.Lock()
+	fakeServers[t.Name()] = server
+	fakeServersMu.Unlock()
+
+	db, err := sql.Open("fakemysql", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to open fake database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, server
+}
+
+func (s *fakeServer) on(query string, result fakeResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.results[query] = result
+}
+
+func (s *fakeServer) fail(query string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errors[query] = err
+}
+
+// hold makes query block until release is called, to keep one part of a
+// dump in progress.
+func (s *fakeServer) hold(query string) (release func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	held := make(chan struct{})
+	s.held[query] = held
+	return func() { close(held) }
+}
+
+// table registers the queries the dumper issues for a base table.
+func (s *fakeServer) table(name, createSQL string, columns, types []string, rows [][]any) {
+	s.on("SHOW CREATE TABLE `"+name+"`", fakeResult{
+		columns: []string{"Table", "Create Table"},
+		types:   []string{"VARCHAR", "VARCHAR"},
+		rows:    [][]any{{name, createSQL}},
+	})
+
+	var columnRows [][]any
+	for i, column := range columns {
+		columnRows = append(columnRows, []any{column, strings.ToLower(types[i]), ""})
+	}
+	s.on("SHOW COLUMNS FROM `"+name+"`", fakeResult{
+		columns: []string{"Field", "Type", "Extra"},
+		types:   []string{"VARCHAR", "VARCHAR", "VARCHAR"},
+		rows:    columnRows,
+	})
+
+	s.on("SELECT "+quoteIdentifiers(columns)+" FROM `"+name+"`", fakeResult{
+		columns: columns,
+		types:   types,
+		rows:    rows,
+	})
+}
+
+func (s *fakeServer) executed() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.statements...)
+}
+
+func (s *fakeServer) query(query string) (driver.Rows, error) {
+	s.mu.Lock()
+	s.statements = append(s.statements, query)
+	held := s.held[query]
+	s.mu.Unlock()
+	if held != nil {
+		<-held
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err, ok := s.errors[query]; ok {
+		return nil, err
+	}
+	result, ok := s.results[query]
+	if !ok {
+		return nil, fmt.Errorf("fake server: unexpected query %q", query)
+	}
+	return &fakeRows{result: result}, nil
+}
+
+func (s *fakeServer) exec(query string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statements = append(s.statements, query)
+	return s.errors[query]
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	fakeServersMu.Lock()
+	defer fakeServersMu.Unlock()
+	server, ok := fakeServers[name]
+	if !ok {
+		return nil, fmt.Errorf("fake server %q not registered", name)
+	}
+	return &fakeConn{server: server, timeZone: "SYSTEM"}, nil
+}
+
+// fakeConn keeps the session time zone, the only session variable the
+// dumper sets, so tests can check it per pinned connection.
+type fakeConn struct {
+	server   *fakeServer
+	timeZone string
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, fmt.Errorf("fake server: prepared statements are not supported")
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return nil, fmt.Errorf("fake server: use START TRANSACTION")
+}
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	for _, arg := range args {
+		query = strings.Replace(query, "?", fmt.Sprintf("'%v'", arg.Value), 1)
+	}
+	if query == "SELECT @@SESSION.time_zone" {
+		return &fakeRows{result: fakeResult{
+			columns: []string{"@@SESSION.time_zone"},
+			types:   []string{"VARCHAR"},
+			rows:    [][]any{{c.timeZone}},
+		}}, nil
+	}
+	return c.server.query(query)
+}
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	for _, arg := range args {
+		query = strings.Replace(query, "?", fmt.Sprintf("'%v'", arg.Value), 1)
+	}
+	if err := c.server.exec(query); err != nil {
+		return nil, err
+	}
+	if zone, ok := strings.CutPrefix(query, "SET time_zone = "); ok {
+		c.timeZone = strings.Trim(zone, "'")
+	}
+	return driver.RowsAffected(0), nil
+}
+
+type fakeRows struct {
+	result fakeResult
+	next   int
+}
+
+func (r *fakeRows) Columns() []string { return r.result.columns }
+
+func (r *fakeRows) Close() error { return nil }
+
+// ColumnTypeDatabaseTypeName returns the type name without the precision
+// and scale a type such as DECIMAL(10,2) may carry.
+func (r *fakeRows) ColumnTypeDatabaseTypeName(index int) string {
+	name, _, _ := strings.Cut(r.result.types[index], "(")
+	return name
+}
+
+func (r *fakeRows) ColumnTypePrecisionScale(index int) (precision, scale int64, ok bool) {
+	_, size, ok := strings.Cut(r.result.types[index], "(")
+	if !ok {
+		return 0, 0, false
+	}
+	_, err := fmt.Sscanf(size, "%d,%d)", &precision, &scale)
+	return precision, scale, err == nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.result.rows) {
+		return io.EOF
+	}
+	for i, value := range r.result.rows[r.next] {
+		switch v := value.(type) {
+		case string:
+			dest[i] = []byte(v)
+		default:
+			dest[i] = v
+		}
+	}
+	r.next++
+	return nil
+}
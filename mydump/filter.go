@@ -0,0 +1,230 @@
+package mydump
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// systemSchemas are never dumped with DB_ALL_DATABASES. They are matched by
+// exact name so that user schemas such as mysql_app are not caught.
+var systemSchemas = map[string]bool{
+	"information_schema": true,
+	"performance_schema": true,
+	"mysql":              true,
+	"sys":                true,
+}
+
+// namePattern is either a glob such as app_* or, when written between
+// slashes, a regular expression such as /^(app|crm)_[0-9]+$/.
+type namePattern struct {
+	raw    string
+	regexp *regexp.Regexp
+}
+
+func parseNamePattern(raw string) (namePattern, error) {
+	if len(raw) > 1 && strings.HasPrefix(raw, "/") && strings.HasSuffix(raw, "/") {
+		re, err := regexp.Compile(raw[1 : len(raw)-1])
+		if err != nil {
+			return namePattern{}, fmt.Errorf("invalid regular expression %q: %w", raw, err)
+		}
+		return namePattern{raw: raw, regexp: re}, nil
+	}
+	if _, err := path.Match(raw, ""); err != nil {
+		return namePattern{}, fmt.Errorf("invalid glob %q: %w", raw, err)
+	}
+	return namePattern{raw: raw}, nil
+}
+
+func (p namePattern) match(name string) bool {
+	if p.regexp != nil {
+		return p.regexp.MatchString(name)
+	}
+	matched, _ := path.Match(p.raw, name)
+	return matched
+}
+
+// patternsFromEnv parses a comma separated list of patterns from key.
+func patternsFromEnv(key string) ([]namePattern, error) {
+	var patterns []namePattern
+	for _, raw := range strings.Split(os.Getenv(key), ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		pattern, err := parseNamePattern(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", key, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+func matchAny(patterns []namePattern, name string) (namePattern, bool) {
+	for _, pattern := range patterns {
+		if pattern.match(name) {
+			return pattern, true
+		}
+	}
+	return namePattern{}, false
+}
+
+// databaseFilter decides which schemas are dumped with DB_ALL_DATABASES.
+type databaseFilter struct {
+	include []namePattern
+	exclude []namePattern
+}
+
+func databaseFilterFromEnv() (databaseFilter, error) {
+	var f databaseFilter
+	var err error
+	if f.include, err = patternsFromEnv("DB_INCLUDE_DATABASES"); err != nil {
+		return f, err
+	}
+	if f.exclude, err = patternsFromEnv("DB_EXCLUDE_DATABASES"); err != nil {
+		return f, err
+	}
+	return f, nil
+}
+
+// skipReason returns why database is not dumped, or "" when it is.
+func (f databaseFilter) skipReason(database string) string {
+	if systemSchemas[database] {
+		return "system schema"
+	}
+	if pattern, ok := matchAny(f.exclude, database); ok {
+		return fmt.Sprintf("matches DB_EXCLUDE_DATABASES pattern %s", pattern.raw)
+	}
+	if len(f.include) > 0 {
+		if _, ok := matchAny(f.include, database); !ok {
+			return "does not match DB_INCLUDE_DATABASES"
+		}
+	}
+	return ""
+}
+
+// tableFilter decides which tables are dumped. Patterns are matched against
+// the qualified name db.table, so *.sessions excludes the sessions table of
+// every database and shop.* selects every table of shop.
+type tableFilter struct {
+	include []namePattern
+	exclude []namePattern
+	// schemaOnly keeps the structure of filtered out tables so a restore
+	// still creates every table, just without rows.
+	schemaOnly bool
+}
+
+func tableFilterFromEnv() (tableFilter, error) {
+	f := tableFilter{schemaOnly: os.Getenv("DB_EXCLUDED_TABLES_SCHEMA_ONLY") == "1"}
+	var err error
+	if f.include, err = qualifiedPatternsFromEnv("DB_INCLUDE_TABLES"); err != nil {
+		return f, err
+	}
+	if f.exclude, err = qualifiedPatternsFromEnv("DB_EXCLUDE_TABLES"); err != nil {
+		return f, err
+	}
+	return f, nil
+}
+
+// qualifiedPatternsFromEnv is patternsFromEnv for db.table patterns. A glob
+// without a dot would never match and is almost certainly a table name
+// missing its database, so it is rejected.
+func qualifiedPatternsFromEnv(key string) ([]namePattern, error) {
+	patterns, err := patternsFromEnv(key)
+	if err != nil {
+		return nil, err
+	}
+	for _, pattern := range patterns {
+		if pattern.regexp == nil && !strings.Contains(pattern.raw, ".") {
+			return nil, fmt.Errorf("invalid %s: pattern %q must be qualified as db.table", key, pattern.raw)
+		}
+	}
+	return patterns, nil
+}
+
+// excludeReason returns why the data of table is left out of the dump, or ""
+// when it is dumped in full.
+func (f tableFilter) excludeReason(database, table string) string {
+	name := database + "." + table
+	if pattern, ok := matchAny(f.exclude, name); ok {
+		return fmt.Sprintf("matches DB_EXCLUDE_TABLES pattern %s", pattern.raw)
+	}
+	if len(f.include) > 0 {
+		if _, ok := matchAny(f.include, name); !ok {
+			return "does not match DB_INCLUDE_TABLES"
+		}
+	}
+	return ""
+}
+
+// tableWhere limits the rows dumped from the tables matching pattern.
+type tableWhere struct {
+	pattern namePattern
+	clause  string
+}
+
+// tableWheresFromEnv parses DB_TABLE_WHERE, a list of table: condition
+// entries separated by newlines or semicolons, e.g.
+//
+//	events: created_at > NOW() - INTERVAL 90 DAY; shop.audit_*: id > 1000000
+//
+// A table without a database applies to that table in every database, and
+// a /regex/ is matched against db.table as in the table filters.
+func tableWheresFromEnv() ([]tableWhere, error) {
+	var wheres []tableWhere
+	entries := strings.FieldsFunc(os.Getenv("DB_TABLE_WHERE"), func(r rune) bool {
+		return r == '\n' || r == ';'
+	})
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		table, clause, ok := strings.Cut(entry, ":")
+		table, clause = strings.TrimSpace(table), strings.TrimSpace(clause)
+		if !ok || table == "" || clause == "" {
+			return nil, fmt.Errorf("invalid DB_TABLE_WHERE entry %q: must be table: condition", entry)
+		}
+		pattern, err := parseNamePattern(table)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DB_TABLE_WHERE entry %q: %w", entry, err)
+		}
+		if pattern.regexp == nil && !strings.Contains(table, ".") {
+			pattern.raw = "*." + table
+		}
+		wheres = append(wheres, tableWhere{pattern: pattern, clause: clause})
+	}
+	return wheres, nil
+}
+
+// unmatchedWheres returns the entries of wheres matching none of tables of
+// database, most likely a typo that leaves the table dumped in full.
+func unmatchedWheres(wheres []tableWhere, database string, tables []tableInfo) []tableWhere {
+	var unmatched []tableWhere
+	for _, where := range wheres {
+		matched := false
+		for _, table := range tables {
+			if !table.isView && where.pattern.match(database+"."+table.name) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			unmatched = append(unmatched, where)
+		}
+	}
+	return unmatched
+}
+
+// whereFor returns the condition of the first entry matching table, or "".
+func whereFor(wheres []tableWhere, database, table string) string {
+	for _, where := range wheres {
+		if where.pattern.match(database + "." + table) {
+			return where.clause
+		}
+	}
+	return ""
+}
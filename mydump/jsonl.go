@@ -0,0 +1,208 @@
+package mydump
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+	"unicode/utf8"
+)
+
+// formatJSONL is a directory dump with the rows of every table as JSON
+// Lines, one object per row keyed by column name.
+const formatJSONL dumpFormat = "jsonl"
+
+// jsonlOptions control the JSON Lines format.
+type jsonlOptions struct {
+	// bigintAsString writes BIGINT values as strings, which JavaScript and
+	// jq would otherwise round beyond 2^53, see DB_DUMP_JSON_BIGINT_AS_STRING.
+	bigintAsString bool
+}
+
+func jsonlOptionsFromEnv() jsonlOptions {
+	return jsonlOptions{bigintAsString: os.Getenv("DB_DUMP_JSON_BIGINT_AS_STRING") == "1"}
+}
+
+// jsonType is how the text of a MySQL value is written as JSON.
+type jsonType int
+
+const (
+	jsonString jsonType = iota
+	jsonNumber
+	jsonBinary
+	jsonDocument
+	jsonDate
+	jsonDatetime
+	jsonTimestamp
+)
+
+func (d *dumper) jsonTypeOf(columnType *sql.ColumnType) jsonType {
+	switch typeName := columnType.DatabaseTypeName(); typeName {
+	case "BIGINT", "UNSIGNED BIGINT":
+		if d.opts.jsonl.bigintAsString {
+			return jsonString
+		}
+		return jsonNumber
+	case "JSON":
+		return jsonDocument
+	case "DATE":
+		return jsonDate
+	case "DATETIME":
+		return jsonDatetime
+	case "TIMESTAMP":
+		return jsonTimestamp
+	default:
+		switch kindOf(typeName) {
+		case kindNumber:
+			return jsonNumber
+		case kindBinary:
+			return jsonBinary
+		}
+	}
+	return jsonString
+}
+
+// writeJSONL writes the rows of part as JSON Lines. Numbers are written as
+// MySQL returns them, so DECIMAL values keep their digits, and binary
+// values in base64. Dates are written in ISO 8601: DATETIME values without
+// a time zone, TIMESTAMP values in UTC, and dates MySQL allows but no
+// calendar has, such as 0000-00-00, as null.
+func (d *dumper) writeJSONL(ctx context.Context, conn *sql.Conn, out *bufio.Writer, part tablePart) error {
+	table := part.table.name
+	rows, err := d.selectRows(ctx, conn, part)
+	if err != nil || rows == nil {
+		return err
+	}
+	defer rows.Close()
+
+	// The keys are the same for every row.
+	keys := make([][]byte, len(rows.columns))
+	types := make([]jsonType, len(rows.columns))
+	for i, column := range rows.columns {
+		keys[i] = appendJSONString(nil, column)
+		keys[i] = append(keys[i], ':')
+		types[i] = d.jsonTypeOf(rows.types[i])
+	}
+
+	var line []byte
+	for rows.Next() {
+		if err := rows.Scan(rows.scans...); err != nil {
+			return fmt.Errorf("error scanning row of %s: %w", table, err)
+		}
+		line = append(line[:0], '{')
+		for i := range rows.values {
+			if i > 0 {
+				line = append(line, ',')
+			}
+			line = append(line, keys[i]...)
+			value, kind := rows.value(i)
+			line = appendJSONValue(line, types[i], kind, value)
+		}
+		line = append(line, '}', '\n')
+		if _, err := out.Write(line); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error reading rows of %s: %w", table, err)
+	}
+	return nil
+}
+
+// appendJSONValue appends value as JSON of type typ. kind is the kind of
+// the value after masking, which may have turned a number into text.
+func appendJSONValue(b []byte, typ jsonType, kind valueKind, value []byte) []byte {
+	if value == nil {
+		return append(b, "null"...)
+	}
+	switch typ {
+	case jsonNumber:
+		if kind == kindNumber {
+			if number, ok := jsonNumberOf(value); ok {
+				return append(b, number...)
+			}
+		}
+	case jsonBinary:
+		b = append(b, '"')
+		b = base64.StdEncoding.AppendEncode(b, value)
+		return append(b, '"')
+	case jsonDocument:
+		// A masked document may no longer be valid JSON.
+		if json.Valid(value) {
+			return append(b, value...)
+		}
+	case jsonDate:
+		if _, err := time.Parse(time.DateOnly, string(value)); err != nil {
+			return append(b, "null"...)
+		}
+	case jsonDatetime, jsonTimestamp:
+		t, err := time.Parse("2006-01-02 15:04:05.999999", string(value))
+		if err != nil {
+			return append(b, "null"...)
+		}
+		layout := "2006-01-02T15:04:05.999999"
+		if typ == jsonTimestamp {
+			layout += "Z07:00"
+		}
+		return appendJSONString(b, t.Format(layout))
+	}
+	return appendJSONString(b, string(value))
+}
+
+// jsonNumberOf returns value, a number as MySQL writes it, as a JSON number.
+// Leading zeros, as in YEAR 0000, are left out since JSON does not allow
+// them. ok is false for anything else that is no JSON number.
+func jsonNumberOf(value []byte) (number []byte, ok bool) {
+	digits, negative := bytes.CutPrefix(value, []byte("-"))
+	for len(digits) > 1 && digits[0] == '0' && digits[1] >= '0' && digits[1] <= '9' {
+		digits = digits[1:]
+	}
+	if len(digits) == 0 || digits[0] < '0' || digits[0] > '9' || !json.Valid(digits) {
+		return nil, false
+	}
+	if negative {
+		return append([]byte("-"), digits...), true
+	}
+	return digits, true
+}
+
+// appendJSONString appends s as a JSON string. Unlike encoding/json it
+// leaves <, > and & alone, which only matter when embedding JSON in HTML.
+func appendJSONString(b []byte, s string) []byte {
+	const hex = "0123456789abcdef"
+	b = append(b, '"')
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			switch {
+			case c == '"' || c == '\\':
+				b = append(b, '\\', c)
+			case c == '\n':
+				b = append(b, `\n`...)
+			case c == '\r':
+				b = append(b, `\r`...)
+			case c == '\t':
+				b = append(b, `\t`...)
+			case c < 0x20:
+				b = append(b, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xf])
+			default:
+				b = append(b, c)
+			}
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			b = append(b, `\ufffd`...)
+		} else {
+			b = append(b, s[i:i+size]...)
+		}
+		i += size
+	}
+	return append(b, '"')
+}
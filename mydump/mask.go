@@ -0,0 +1,369 @@
+package mydump
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"math/rand/v2"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"unicode"
+)
+
+const defaultMaskPrefix = "sanitized/"
+
+// maskStrategy replaces a column value in a sanitized dump. Every strategy
+// is deterministic for a given DB_MASK_SALT, so a value masks the same way
+// in every table and joins between masked columns keep working.
+type maskStrategy string
+
+const (
+	maskNull       maskStrategy = "null"
+	maskFixed      maskStrategy = "fixed"
+	maskHash       maskStrategy = "hash"
+	maskEmail      maskStrategy = "email"
+	maskName       maskStrategy = "name"
+	maskKeepFormat maskStrategy = "keep-format"
+)
+
+// maskRule masks the columns matching pattern, which is matched against
+// db.table.column.
+type maskRule struct {
+	pattern  namePattern
+	strategy maskStrategy
+	// value is the replacement of the fixed strategy.
+	value string
+	// line is the rule as written, recorded in the backup metadata.
+	line string
+	// used is set once the rule masks a column, so that rules that never
+	// do can be reported.
+	used atomic.Bool
+}
+
+// columnMask is the rule masking a column together with the bounds of the
+// column, which masked values are kept within so that the dump restores
+// under a strict sql_mode.
+type columnMask struct {
+	rule *maskRule
+	// length is the length of a CHAR, VARCHAR, BINARY or VARBINARY column
+	// and 0 for other columns.
+	length int
+	// min and max bound an integer or YEAR column and are nil for other
+	// columns.
+	min, max *big.Int
+}
+
+// masking holds the rules of DB_MASK_RULES_FILE.
+type masking struct {
+	rules  []*maskRule
+	salt   string
+	prefix string
+}
+
+func (m *masking) enabled() bool {
+	return m != nil && len(m.rules) > 0
+}
+
+// maskingFromEnv reads the rules file named by DB_MASK_RULES_FILE, one rule
+// per line:
+//
+//	# comment
+//	users.email: email
+//	users.password: null
+//	shop.customers.phone: keep-format
+//	*.notes: fixed redacted
+//
+// A column qualified as table.column applies in every database, and a
+// /regex/ is matched against db.table.column. Returns nil when masking is
+// not configured.
+func maskingFromEnv() (*masking, error) {
+	path := os.Getenv("DB_MASK_RULES_FILE")
+	if path == "" {
+		return nil, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening DB_MASK_RULES_FILE: %w", err)
+	}
+	defer file.Close()
+
+	m := &masking{
+		salt:   os.Getenv("DB_MASK_SALT"),
+		prefix: defaultMaskPrefix,
+	}
+	if prefix, ok := os.LookupEnv("DB_MASK_PREFIX"); ok {
+		m.prefix = prefix
+	}
+
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := parseMaskRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNumber, err)
+		}
+		m.rules = append(m.rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading DB_MASK_RULES_FILE: %w", err)
+	}
+	if len(m.rules) == 0 {
+		return nil, fmt.Errorf("DB_MASK_RULES_FILE %s holds no rules", path)
+	}
+	// Every strategy but null and fixed derives its value from an HMAC of
+	// the original, which without a secret salt anyone can recompute for
+	// the few possible phone numbers, birth dates and the like.
+	if m.salt == "" {
+		for _, rule := range m.rules {
+			if rule.strategy != maskNull && rule.strategy != maskFixed {
+				return nil, fmt.Errorf("DB_MASK_SALT must be set for rule %q: unsalted masks can be reversed by hashing guesses", rule.line)
+			}
+		}
+	}
+	return m, nil
+}
+
+func parseMaskRule(line string) (*maskRule, error) {
+	column, strategy, ok := strings.Cut(line, ":")
+	column, strategy = strings.TrimSpace(column), strings.TrimSpace(strategy)
+	if !ok || column == "" || strategy == "" {
+		return nil, fmt.Errorf("invalid mask rule %q: must be table.column: strategy", line)
+	}
+
+	pattern, err := parseNamePattern(column)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mask rule %q: %w", line, err)
+	}
+	// A regular expression is matched as written; only globs are qualified.
+	if pattern.regexp == nil {
+		switch strings.Count(column, ".") {
+		case 1:
+			pattern.raw = "*." + column
+		case 2:
+		default:
+			return nil, fmt.Errorf("invalid mask rule %q: column must be qualified as table.column or db.table.column", line)
+		}
+	}
+
+	rule := &maskRule{pattern: pattern, line: line}
+	name, value, _ := strings.Cut(strategy, " ")
+	rule.strategy = maskStrategy(name)
+	switch rule.strategy {
+	case maskFixed:
+		rule.value = strings.TrimSpace(value)
+	case maskNull, maskHash, maskEmail, maskName, maskKeepFormat:
+	default:
+		return nil, fmt.Errorf("invalid mask rule %q: unknown strategy %q", line, name)
+	}
+	return rule, nil
+}
+
+// columnMasks returns the mask of every column of table, nil entries for
+// columns left alone, or nil when no column of the table is masked.
+// columnTypes are the types of the columns as SHOW COLUMNS lists them.
+func (m *masking) columnMasks(database, table string, columns, columnTypes []string) []*columnMask {
+	if !m.enabled() {
+		return nil
+	}
+	var masks []*columnMask
+	for i, column := range columns {
+		for _, rule := range m.rules {
+			if rule.pattern.match(database + "." + table + "." + column) {
+				if masks == nil {
+					masks = make([]*columnMask, len(columns))
+				}
+				masks[i] = newColumnMask(rule, columnTypes[i])
+				rule.used.Store(true)
+				break
+			}
+		}
+	}
+	return masks
+}
+
+// unused returns the rules that masked no column so far, most likely rules
+// with a typo in the table or column name, which leave that column in the
+// clear.
+func (m *masking) unused() []string {
+	if !m.enabled() {
+		return nil
+	}
+	var lines []string
+	for _, rule := range m.rules {
+		if !rule.used.Load() {
+			lines = append(lines, rule.line)
+		}
+	}
+	return lines
+}
+
+// integerBits is the size of each integer type.
+var integerBits = map[string]uint{
+	"tinyint":   8,
+	"smallint":  16,
+	"mediumint": 24,
+	"int":       32,
+	"integer":   32,
+	"bigint":    64,
+}
+
+// newColumnMask reads the bounds of a column from its type as SHOW COLUMNS
+// lists it, such as varchar(64) or tinyint(3) unsigned.
+func newColumnMask(rule *maskRule, columnType string) *columnMask {
+	mask := &columnMask{rule: rule}
+	columnType = strings.ToLower(columnType)
+	name, size, _ := strings.Cut(columnType, "(")
+	name, _, _ = strings.Cut(name, " ")
+	size, _, _ = strings.Cut(size, ")")
+
+	switch name {
+	case "char", "varchar", "binary", "varbinary":
+		mask.length, _ = strconv.Atoi(size)
+	case "year":
+		mask.min, mask.max = big.NewInt(1901), big.NewInt(2155)
+	default:
+		bits, ok := integerBits[name]
+		if !ok {
+			break
+		}
+		one := big.NewInt(1)
+		if strings.Contains(columnType, "unsigned") {
+			mask.min = new(big.Int)
+			mask.max = new(big.Int).Sub(new(big.Int).Lsh(one, bits), one)
+		} else {
+			mask.min = new(big.Int).Neg(new(big.Int).Lsh(one, bits-1))
+			mask.max = new(big.Int).Sub(new(big.Int).Lsh(one, bits-1), one)
+		}
+	}
+	return mask
+}
+
+// apply masks value and returns how the result is to be written. NULL stays
+// NULL, so masking never changes whether a column is set. Hashes of numbers
+// stay numbers of their column; text replacing a number is quoted so the
+// dump stays valid SQL, and it is up to the rules to only put such text in
+// columns that take it. Generated text is cut to the length of the column.
+func (m *masking) apply(mask *columnMask, value []byte, kind valueKind) ([]byte, valueKind) {
+	rule := mask.rule
+	if value == nil || rule.strategy == maskNull {
+		return nil, kind
+	}
+
+	textKind := kind
+	if kind == kindNumber {
+		textKind = kindString
+	}
+
+	digest := m.digest(value)
+	switch rule.strategy {
+	case maskFixed:
+		return []byte(rule.value), textKind
+	case maskHash:
+		if kind == kindNumber {
+			return mask.number(value, digest), kind
+		}
+		return mask.fit([]byte(hex.EncodeToString(digest))), kind
+	case maskEmail:
+		return mask.fit([]byte("user_" + hex.EncodeToString(digest[:5]) + "@example.com")), textKind
+	case maskName:
+		first := fakeFirstNames[binary.BigEndian.Uint16(digest[0:])%uint16(len(fakeFirstNames))]
+		last := fakeLastNames[binary.BigEndian.Uint16(digest[2:])%uint16(len(fakeLastNames))]
+		return mask.fit([]byte(first + " " + last)), textKind
+	default:
+		if kind == kindNumber {
+			return mask.number(value, digest), kind
+		}
+		return keepFormat(value, digest), kind
+	}
+}
+
+// fit cuts generated text, which is always ASCII, to the column length.
+func (mask *columnMask) fit(text []byte) []byte {
+	if mask.length > 0 && len(text) > mask.length {
+		return text[:mask.length]
+	}
+	return text
+}
+
+// number masks the digits of a number like keepFormat does while keeping it
+// a number its column takes: the exponent of a float is kept, a masked
+// integer part does not start with a zero or grow from a single 0, and an
+// integer outside the range of its column is wrapped into it.
+func (mask *columnMask) number(value, digest []byte) []byte {
+	mantissa, exponent := value, []byte(nil)
+	if i := bytes.IndexAny(value, "eE"); i >= 0 {
+		mantissa, exponent = value[:i], value[i:]
+	}
+	masked := keepFormat(mantissa, digest)
+
+	sign := 0
+	if len(masked) > 0 && (masked[0] == '-' || masked[0] == '+') {
+		sign = 1
+	}
+	integerEnd := bytes.IndexByte(masked, '.')
+	if integerEnd < 0 {
+		integerEnd = len(masked)
+	}
+	switch {
+	case integerEnd-sign == 1 && mantissa[sign] == '0':
+		masked[sign] = '0'
+	case integerEnd-sign > 1 && masked[sign] == '0':
+		masked[sign] = '1' + digest[16]%9
+	}
+
+	if mask.min != nil {
+		if n, ok := new(big.Int).SetString(string(masked), 10); ok && (n.Cmp(mask.min) < 0 || n.Cmp(mask.max) > 0) {
+			size := new(big.Int).Sub(mask.max, mask.min)
+			size.Add(size, big.NewInt(1))
+			n.Sub(n, mask.min).Mod(n, size).Add(n, mask.min)
+			masked = []byte(n.String())
+		}
+	}
+	return append(masked, exponent...)
+}
+
+func (m *masking) digest(value []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(m.salt))
+	mac.Write(value)
+	return mac.Sum(nil)
+}
+
+// keepFormat replaces every letter and digit of value with a random one of
+// the same class, keeping case, punctuation and length, so phone numbers,
+// postcodes and the like still pass format checks.
+func keepFormat(value, digest []byte) []byte {
+	rng := rand.New(rand.NewPCG(binary.BigEndian.Uint64(digest[0:]), binary.BigEndian.Uint64(digest[8:])))
+	masked := []rune(string(value))
+	for i, r := range masked {
+		switch {
+		case unicode.IsDigit(r):
+			masked[i] = rune('0' + rng.IntN(10))
+		case unicode.IsUpper(r):
+			masked[i] = rune('A' + rng.IntN(26))
+		case unicode.IsLetter(r):
+			masked[i] = rune('a' + rng.IntN(26))
+		}
+	}
+	return []byte(string(masked))
+}
+
+var fakeFirstNames = []string{
+	"Alex", "Anna", "Ben", "Carla", "David", "Elena", "Felix", "Grace", "Hugo", "Ida",
+	"Jonas", "Karin", "Leo", "Maria", "Nils", "Olivia", "Paul", "Rosa", "Sam", "Tina",
+}
+
+var fakeLastNames = []string{
+	"Andersson", "Brown", "Costa", "Dubois", "Evans", "Fischer", "Garcia", "Hansen", "Ivanova", "Jensen",
+	"Keller", "Larsen", "Moreau", "Novak", "Olsen", "Petrov", "Rossi", "Smith", "Tanaka", "Weber",
+}
@@ -0,0 +1,52 @@
+package mydump
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/stenstromen/s3dbdump/mys3"
+)
+
+// backupMetadata is uploaded as <name>.metadata.json next to every dump. It
+// is written last, so its presence also marks the backup as complete.
+//
+// Engine is the kind of server the dump was taken from, see DB_ENGINE; it
+// is empty in backups taken before PostgreSQL was supported, which are all
+// MySQL. Mode and Format record DB_DUMP_MODE and DB_DUMP_FORMAT. Where holds the
+// DB_TABLE_WHERE condition of every table whose rows were only partially
+// dumped, and Masking the DB_MASK_RULES_FILE rules of a sanitized dump.
+// Chunks holds the number of chunks of every table split by
+// DB_DUMP_CHUNK_ROWS. ResumedFiles lists the files kept from an interrupted
+// attempt with DB_DUMP_RESUME=parts, which were read in an earlier snapshot
+// than the rest.
+// Files lists the uploaded objects in the order they are to be restored.
+type backupMetadata struct {
+	Database          string             `json:"database"`
+	Engine            string             `json:"engine,omitempty"`
+	Mode              dumpMode           `json:"mode"`
+	Format            dumpFormat         `json:"format,omitempty"`
+	ServerVersion     string             `json:"server_version"`
+	StartedAt         time.Time          `json:"started_at"`
+	FinishedAt        time.Time          `json:"finished_at"`
+	SingleTransaction bool               `json:"single_transaction"`
+	Binlog            *binlogCoordinates `json:"binlog,omitempty"`
+	Where             map[string]string  `json:"where,omitempty"`
+	Masking           []string           `json:"masking,omitempty"`
+	Chunks            map[string]int     `json:"chunks,omitempty"`
+	ResumedFiles      []string           `json:"resumed_files,omitempty"`
+	Files             []string           `json:"files"`
+}
+
+func metadataKey(name string) string {
+	return name + ".metadata.json"
+}
+
+func uploadMetadata(name string, meta *backupMetadata) error {
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding backup metadata: %w", err)
+	}
+	return mys3.UploadStream(metadataKey(name), bytes.NewReader(append(data, '\n')))
+}
@@ -4,10 +4,10 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
-	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -15,8 +15,6 @@ import (
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/go-sql-driver/mysql"
-	"github.com/jamf/go-mysqldump"
-	"github.com/stenstromen/s3dbdump/mygzip"
 	"github.com/stenstromen/s3dbdump/mys3"
 )
 
@@ -36,20 +34,64 @@ func InitConfig() {
 	Config.Addr = fmt.Sprintf("%s:%s", os.Getenv("DB_HOST"), db_port)
 }
 
-func dumpAllDatabases(config mysql.Config) {
+func dumpAllDatabases(src source, cp *checkpoint) error {
 	log.Printf("Dumping all databases")
 
-	db, err := sql.Open("mysql", config.FormatDSN())
+	parallel, err := parallelDatabasesFromEnv()
 	if err != nil {
-		log.Printf("Error opening database: %v", err)
-		return
+		return err
+	}
+	filter, err := databaseFilterFromEnv()
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	all, err := src.databases(ctx)
+	if err != nil {
+		return err
+	}
+
+	var databases []string
+	for _, dbName := range all {
+		if reason := filter.skipReason(dbName); reason != "" {
+			log.Printf("Skipping database %s: %s", dbName, reason)
+			continue
+		}
+		databases = append(databases, dbName)
+	}
+
+	summary := dumpDatabases(databases, parallel, func(database string) error {
+		return src.dumpDatabase(ctx, database, cp)
+	})
+	summary.log()
+	return summary.err()
+}
+
+// mysqlSource dumps MySQL and MariaDB with the dump engine of this package.
+type mysqlSource struct {
+	config mysql.Config
+}
+
+func (s *mysqlSource) ping(ctx context.Context) error {
+	db, err := sql.Open("mysql", s.config.FormatDSN())
+	if err != nil {
+		return fmt.Errorf("error opening database: %w", err)
 	}
 	defer db.Close()
+	return db.PingContext(ctx)
+}
 
-	rows, err := db.Query("SHOW DATABASES")
+func (s *mysqlSource) databases(ctx context.Context) ([]string, error) {
+	db, err := sql.Open("mysql", s.config.FormatDSN())
 	if err != nil {
-		log.Printf("Error querying databases: %v", err)
-		return
+		return nil, fmt.Errorf("error opening database: %w", err)
+	}
+	defer db.Close()
+
+	rows, err := db.QueryContext(ctx, "SHOW DATABASES")
+	if err != nil {
+		return nil, fmt.Errorf("error querying databases: %w", err)
 	}
 	defer rows.Close()
 
@@ -57,81 +99,98 @@ func dumpAllDatabases(config mysql.Config) {
 	for rows.Next() {
 		var dbName string
 		if err := rows.Scan(&dbName); err != nil {
-			log.Printf("Error scanning database name: %v", err)
-			return
-		}
-
-		if !strings.HasPrefix(dbName, "information_schema") &&
-			!strings.HasPrefix(dbName, "performance_schema") &&
-			!strings.HasPrefix(dbName, "mysql") &&
-			!strings.HasPrefix(dbName, "sys") {
-			databases = append(databases, dbName)
+			return nil, fmt.Errorf("error scanning database name: %w", err)
 		}
+		databases = append(databases, dbName)
 	}
-
 	if err = rows.Err(); err != nil {
-		log.Printf("Error iterating database names: %v", err)
-		return
+		return nil, fmt.Errorf("error iterating database names: %w", err)
 	}
+	return databases, nil
+}
 
-	for _, database := range databases {
-		dumpDatabase(database, config)
-	}
+func (s *mysqlSource) dumpAccounts(ctx context.Context) error {
+	return dumpAccountsBackup(s.config)
 }
 
-func dumpDatabase(database string, config mysql.Config) {
+func (s *mysqlSource) dumpDatabase(ctx context.Context, database string, cp *checkpoint) error {
+	if name, ok := cp.completed(database); ok {
+		log.Printf("Skipping database %s: completed in run %s as %s", database, cp.RunID, name)
+		return nil
+	}
 	log.Printf("Dumping database %s", database)
 
+	config := s.config
 	config.DBName = database
+	// The dump engine copies column values verbatim, so keep them as text.
+	config.ParseTime = false
 
 	db, err := sql.Open("mysql", config.FormatDSN())
 	if err != nil {
-		log.Printf("Error opening database: %v", err)
-		return
+		return fmt.Errorf("error opening database: %w", err)
 	}
 	defer db.Close()
 
 	var exists bool
-	err = db.QueryRow("SELECT EXISTS(SELECT SCHEMA_NAME FROM INFORMATION_SCHEMA.SCHEMATA WHERE SCHEMA_NAME = ?)", database).Scan(&exists)
+	err = db.QueryRowContext(ctx, "SELECT EXISTS(SELECT SCHEMA_NAME FROM INFORMATION_SCHEMA.SCHEMATA WHERE SCHEMA_NAME = ?)", database).Scan(&exists)
 	if err != nil {
-		log.Printf("Error checking if database exists: %v", err)
-		return
+		return fmt.Errorf("error checking if database exists: %w", err)
 	}
 	if !exists {
-		log.Fatalf("Database %s does not exist", database)
-		return
+		return fmt.Errorf("database %s does not exist", database)
 	}
 
-	dumpDir := os.Getenv("DB_DUMP_PATH")
-	if dumpDir == "" {
-		dumpDir = "/tmp/dumps"
-	}
-	dumpFilenameFormat := fmt.Sprintf("%s-20060102T150405", database)
-
-	dumper, err := mysqldump.Register(db, dumpDir, dumpFilenameFormat)
+	opts, err := dumpOptionsFromEnv()
 	if err != nil {
-		log.Printf("Error registering databse: %v", err)
-		return
+		return err
 	}
 
-	if err := dumper.Dump(); err != nil {
-		log.Fatalf("Error dumping: %v", err)
+	started := time.Now()
+	name := backupName(database, started)
+	if opts.masking.enabled() {
+		// Sanitized dumps live apart from the real backups, so access to
+		// them can be granted separately.
+		name = opts.masking.prefix + name
+		log.Printf("Masking columns, uploading sanitized dump under %s", name)
+	}
+	_, name = cp.startDatabase(database, name)
+	meta := &backupMetadata{
+		Database:  database,
+		Engine:    engineMySQL,
+		Mode:      opts.mode,
+		Format:    opts.format,
+		StartedAt: started.UTC(),
 	}
 
-	if file, ok := dumper.Out.(*os.File); ok {
-		if os.Getenv("DB_GZIP") == "0" {
-			mys3.UploadToS3(file.Name())
-			os.Remove(file.Name())
-		} else {
-			mygzip.GzipFile(file.Name())
-			mys3.UploadToS3(file.Name() + ".gz")
-			os.Remove(file.Name() + ".gz")
-		}
+	var files []string
+	if opts.format != formatSQL {
+		files, err = dumpDirectory(ctx, db, database, name+opts.mode.suffix()+"/", opts, meta, uploadDump, cp)
 	} else {
-		log.Printf("It's not part of *os.File, but dump is done")
+		var key string
+		key, err = uploadDump(name+opts.mode.suffix()+".sql", func(w io.Writer) error {
+			return dumpSQL(ctx, db, database, w, opts, meta)
+		})
+		files = []string{key}
+	}
+	if err != nil {
+		return fmt.Errorf("error dumping: %w", err)
 	}
+	for _, rule := range opts.masking.unused() {
+		log.Printf("Mask rule %q masked no column of database %s", rule, database)
+	}
+
+	meta.FinishedAt = time.Now().UTC()
+	meta.Files = files
+	if err := uploadMetadata(name, meta); err != nil {
+		return fmt.Errorf("error uploading backup metadata: %w", err)
+	}
+	cp.completeDatabase(database)
+	return nil
+}
 
-	dumper.Close()
+// backupName is the common prefix of every object belonging to one backup.
+func backupName(database string, t time.Time) string {
+	return database + "-" + t.Format("20060102T150405")
 }
 
 func HandleDbDump(config mysql.Config) {
@@ -140,34 +199,51 @@ func HandleDbDump(config mysql.Config) {
 		keepBackups = "7"
 	}
 
+	src, err := sourceFromEnv(config)
+	if err != nil {
+		log.Fatalf("Error configuring source database: %v", err)
+	}
+	cp, err := openCheckpoint()
+	if err != nil {
+		log.Fatalf("Error opening checkpoint: %v", err)
+	}
+
 	if os.Getenv("DB_ALL_DATABASES") == "1" {
-		dumpAllDatabases(config)
-		mys3.KeepOnlyNBackups(keepBackups)
+		if err := dumpAllDatabases(src, cp); err != nil {
+			log.Fatalf("Error dumping databases: %v", err)
+		}
 	} else if os.Getenv("DB_NAME") != "" {
-		dumpDatabase(os.Getenv("DB_NAME"), config)
-		mys3.KeepOnlyNBackups(keepBackups)
+		if err := src.dumpDatabase(context.Background(), os.Getenv("DB_NAME"), cp); err != nil {
+			log.Fatalf("Error dumping database %s: %v", os.Getenv("DB_NAME"), err)
+		}
 	} else {
 		log.Printf("No database name provided")
 		return
 	}
+
+	if os.Getenv("DB_DUMP_ACCOUNTS") == "1" {
+		if err := src.dumpAccounts(context.Background()); err != nil {
+			log.Fatalf("Error dumping accounts: %v", err)
+		}
+	}
+	cp.finish()
+	mys3.KeepOnlyNBackups(keepBackups)
 }
 
 func TestConnections() {
-	db, err := sql.Open("mysql", Config.FormatDSN())
+	src, err := sourceFromEnv(Config)
 	if err != nil {
-		log.Fatalf("Failed to open database connection: %v", err)
+		log.Fatalf("Error configuring source database: %v", err)
 	}
-	defer db.Close()
 
-	err = db.Ping()
-	if err != nil {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := src.ping(ctx); err != nil {
 		log.Fatalf("Failed to ping database: %v", err)
 	}
 	log.Printf("Successfully connected to database")
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
 	var cfg aws.Config
 	if endpoint := os.Getenv("S3_ENDPOINT"); endpoint != "" {
 		cfg, err = config.LoadDefaultConfig(ctx,
@@ -206,11 +282,7 @@ func TestConnections() {
 	}
 	log.Printf("Successfully connected to S3")
 
-	dumpDir := os.Getenv("DB_DUMP_PATH")
-	if dumpDir == "" {
-		dumpDir = "/tmp/dumps"
-	}
-
+	dumpDir := dumpDir()
 	if err := os.MkdirAll(dumpDir, 0755); err != nil {
 		log.Fatalf("Failed to create dump directory: %v", err)
 	}
@@ -1,12 +1,31 @@
 package mydump
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"io"
+	"maps"
+	"math/big"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/go-sql-driver/mysql"
+	"github.com/stenstromen/s3dbdump/mybinlog"
+	"github.com/stenstromen/s3dbdump/myparquet"
+	"github.com/stenstromen/s3dbdump/mys3"
 )
 
 func TestInitConfig(t *testing.T) {
@@ -212,19 +231,18 @@ func TestDatabaseFiltering(t *testing.T) {
 		"myapp_db",
 		"test_db",
 		"another_app",
+		"system_billing",
+		"mysql_app",
 	}
 
 	var filtered []string
 	for _, dbName := range databases {
-		if !strings.HasPrefix(dbName, "information_schema") &&
-			!strings.HasPrefix(dbName, "performance_schema") &&
-			!strings.HasPrefix(dbName, "mysql") &&
-			!strings.HasPrefix(dbName, "sys") {
+		if (databaseFilter{}).skipReason(dbName) == "" {
 			filtered = append(filtered, dbName)
 		}
 	}
 
-	expected := []string{"myapp_db", "test_db", "another_app"}
+	expected := []string{"myapp_db", "test_db", "another_app", "system_billing", "mysql_app"}
 	if len(filtered) != len(expected) {
 		t.Errorf("Filtered databases count = %d, want %d", len(filtered), len(expected))
 	}
@@ -250,6 +268,59 @@ func TestDumpFilenameFormat(t *testing.T) {
 	}
 }
 
+// Test database filters
+func TestDatabaseFilter(t *testing.T) {
+	tests := []struct {
+		name     string
+		include  string
+		exclude  string
+		database string
+		reason   string
+	}{
+		{name: "system schema", database: "performance_schema", reason: "system schema"},
+		{name: "no patterns", database: "shop"},
+		{name: "glob include", include: "app_*", database: "app_main"},
+		{name: "glob include miss", include: "app_*", database: "shop", reason: "does not match DB_INCLUDE_DATABASES"},
+		{name: "regex include", include: "/^(app|crm)_[0-9]+$/", database: "crm_42"},
+		{name: "regex include miss", include: "/^(app|crm)_[0-9]+$/", database: "crm_main", reason: "does not match DB_INCLUDE_DATABASES"},
+		{name: "exclude wins over include", include: "app_*", exclude: "*_tmp", database: "app_tmp", reason: "matches DB_EXCLUDE_DATABASES pattern *_tmp"},
+		{name: "second exclude pattern", exclude: "scratch, /test/", database: "my_test_db", reason: "matches DB_EXCLUDE_DATABASES pattern /test/"},
+		{name: "include cannot revive system schema", include: "*", database: "mysql", reason: "system schema"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DB_INCLUDE_DATABASES", tt.include)
+			t.Setenv("DB_EXCLUDE_DATABASES", tt.exclude)
+
+			filter, err := databaseFilterFromEnv()
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if got := filter.skipReason(tt.database); got != tt.reason {
+				t.Errorf("skipReason(%q) = %q, want %q", tt.database, got, tt.reason)
+			}
+		})
+	}
+}
+
+func TestDatabaseFilterFromEnv_InvalidPatterns(t *testing.T) {
+	for _, tt := range []struct{ key, value string }{
+		{"DB_INCLUDE_DATABASES", "/app_(/"},
+		{"DB_EXCLUDE_DATABASES", "app_[a-"},
+	} {
+		t.Run(tt.key, func(t *testing.T) {
+			t.Setenv("DB_INCLUDE_DATABASES", "")
+			t.Setenv("DB_EXCLUDE_DATABASES", "")
+			t.Setenv(tt.key, tt.value)
+
+			if _, err := databaseFilterFromEnv(); err == nil {
+				t.Errorf("Expected error for %s=%q", tt.key, tt.value)
+			}
+		})
+	}
+}
+
 // Test environment variable defaults
 func TestEnvironmentDefaults(t *testing.T) {
 	// Test DB_PORT default
@@ -373,3 +444,3221 @@ func TestConfigValidation(t *testing.T) {
 		})
 	}
 }
+
+func newUsersFakeDB(t *testing.T) (*sql.DB, *fakeServer) {
+	db, server := newFakeDB(t)
+	server.on("SHOW FULL TABLES", fakeResult{
+		columns: []string{"Tables_in_app", "Table_type"},
+		types:   []string{"VARCHAR", "VARCHAR"},
+		rows: [][]any{
+			{"active_users", "VIEW"},
+			{"users", "BASE TABLE"},
+		},
+	})
+	server.table("users",
+		"CREATE TABLE `users` (`id` int NOT NULL, `name` varchar(64), `avatar` blob, PRIMARY KEY (`id`))",
+		[]string{"id", "name", "avatar"},
+		[]string{"INT", "VARCHAR", "BLOB"},
+		[][]any{
+			{"1", "O'Brien\n", []byte{0x01, 0xff}},
+			{"2", nil, []byte{}},
+		},
+	)
+	server.on("SHOW CREATE VIEW `active_users`", fakeResult{
+		columns: []string{"View", "Create View", "character_set_client", "collation_connection"},
+		types:   []string{"VARCHAR", "VARCHAR", "VARCHAR", "VARCHAR"},
+		rows:    [][]any{{"active_users", "CREATE VIEW `active_users` AS select `id` from `users`", "utf8mb4", "utf8mb4_general_ci"}},
+	})
+	return db, server
+}
+
+func TestDumpSQL(t *testing.T) {
+	db, server := newUsersFakeDB(t)
+
+	var out strings.Builder
+	meta := &backupMetadata{}
+	opts := dumpOptions{singleTransaction: true, maxAllowedPacket: defaultMaxAllowedPacket, views: true}
+	if err := dumpSQL(context.Background(), db, "app", &out, opts, meta); err != nil {
+		t.Fatalf("dumpSQL returned error: %v", err)
+	}
+	dump := out.String()
+
+	for _, want := range []string{
+		"-- Database: app\n",
+		"DROP TABLE IF EXISTS `users`;\n",
+		"CREATE TABLE `users` (`id` int NOT NULL, `name` varchar(64), `avatar` blob, PRIMARY KEY (`id`));\n",
+		"INSERT INTO `users` (`id`,`name`,`avatar`) VALUES (1,'O\\'Brien\\n',0x01ff),(2,NULL,'');\n",
+		"DROP VIEW IF EXISTS `active_users`;\n",
+		"-- Dump completed on ",
+	} {
+		if !strings.Contains(dump, want) {
+			t.Errorf("Dump is missing %q\n%s", want, dump)
+		}
+	}
+	if strings.Index(dump, "CREATE VIEW") < strings.Index(dump, "CREATE TABLE") {
+		t.Errorf("Views must be dumped after tables")
+	}
+	if strings.Contains(dump, "CHANGE MASTER") {
+		t.Errorf("Dump should not contain binlog coordinates without DB_DUMP_MASTER_DATA")
+	}
+
+	executed := strings.Join(server.executed(), "\n")
+	if !strings.Contains(executed, "START TRANSACTION /*!40100 WITH CONSISTENT SNAPSHOT */") {
+		t.Errorf("Expected dump to run in a consistent snapshot, executed:\n%s", executed)
+	}
+	if strings.Contains(executed, "FLUSH TABLES WITH READ LOCK") {
+		t.Errorf("Did not expect a global read lock without DB_DUMP_MASTER_DATA")
+	}
+	if !meta.SingleTransaction || meta.ServerVersion != "8.0.36" || meta.Binlog != nil {
+		t.Errorf("Unexpected metadata: %+v", meta)
+	}
+}
+
+func TestDumpSQL_MasterData(t *testing.T) {
+	db, server := newUsersFakeDB(t)
+	server.on("SHOW MASTER STATUS", fakeResult{
+		columns: []string{"File", "Position", "Binlog_Do_DB", "Binlog_Ignore_DB", "Executed_Gtid_Set"},
+		types:   []string{"VARCHAR", "UNSIGNED BIGINT", "VARCHAR", "VARCHAR", "VARCHAR"},
+		rows:    [][]any{{"binlog.000042", "1337", "", "", ""}},
+	})
+	server.on("SELECT @@GLOBAL.gtid_executed", fakeResult{
+		columns: []string{"@@GLOBAL.gtid_executed"},
+		types:   []string{"VARCHAR"},
+		rows:    [][]any{{"3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5"}},
+	})
+
+	var out strings.Builder
+	meta := &backupMetadata{}
+	opts := dumpOptions{singleTransaction: true, masterData: true, maxAllowedPacket: defaultMaxAllowedPacket}
+	if err := dumpSQL(context.Background(), db, "app", &out, opts, meta); err != nil {
+		t.Fatalf("dumpSQL returned error: %v", err)
+	}
+
+	expectedOrder := []string{
+		"FLUSH TABLES WITH READ LOCK",
+		"START TRANSACTION /*!40100 WITH CONSISTENT SNAPSHOT */",
+		"SHOW MASTER STATUS",
+		"UNLOCK TABLES",
+		"SHOW FULL TABLES",
+	}
+	executed := server.executed()
+	position := 0
+	for _, statement := range executed {
+		if position < len(expectedOrder) && statement == expectedOrder[position] {
+			position++
+		}
+	}
+	if position != len(expectedOrder) {
+		t.Errorf("Expected statements in order %q, executed %q", expectedOrder, executed)
+	}
+
+	want := &binlogCoordinates{
+		File:     "binlog.000042",
+		Position: 1337,
+		GTIDSet:  "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5",
+		Flavor:   "mysql",
+	}
+	if meta.Binlog == nil || *meta.Binlog != *want {
+		t.Errorf("meta.Binlog = %+v, want %+v", meta.Binlog, want)
+	}
+	if !strings.Contains(out.String(), "-- CHANGE MASTER TO MASTER_LOG_FILE='binlog.000042', MASTER_LOG_POS=1337;\n") {
+		t.Errorf("Dump is missing binlog coordinates:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "-- SET @@GLOBAL.GTID_PURGED='3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5';\n") {
+		t.Errorf("Dump is missing GTID set:\n%s", out.String())
+	}
+}
+
+func TestDumpSQL_MasterDataFallsBackToBinaryLogStatus(t *testing.T) {
+	db, server := newUsersFakeDB(t)
+	server.on("SELECT VERSION()", fakeResult{
+		columns: []string{"VERSION()"},
+		types:   []string{"VARCHAR"},
+		rows:    [][]any{{"10.11.6-MariaDB"}},
+	})
+	server.fail("SHOW MASTER STATUS", fmt.Errorf("syntax error"))
+	server.on("SHOW BINARY LOG STATUS", fakeResult{
+		columns: []string{"File", "Position"},
+		types:   []string{"VARCHAR", "UNSIGNED BIGINT"},
+		rows:    [][]any{{"mariadb-bin.000007", "4"}},
+	})
+	server.on("SELECT @@GLOBAL.gtid_binlog_pos", fakeResult{
+		columns: []string{"@@GLOBAL.gtid_binlog_pos"},
+		types:   []string{"VARCHAR"},
+		rows:    [][]any{{"0-1-100"}},
+	})
+
+	var out strings.Builder
+	meta := &backupMetadata{}
+	opts := dumpOptions{singleTransaction: true, masterData: true, maxAllowedPacket: defaultMaxAllowedPacket}
+	if err := dumpSQL(context.Background(), db, "app", &out, opts, meta); err != nil {
+		t.Fatalf("dumpSQL returned error: %v", err)
+	}
+
+	if meta.Binlog == nil || meta.Binlog.File != "mariadb-bin.000007" || meta.Binlog.Flavor != "mariadb" || meta.Binlog.GTIDSet != "0-1-100" {
+		t.Errorf("Unexpected binlog coordinates: %+v", meta.Binlog)
+	}
+	if !strings.Contains(out.String(), "-- SET GLOBAL gtid_slave_pos='0-1-100';\n") {
+		t.Errorf("Dump is missing MariaDB GTID position:\n%s", out.String())
+	}
+}
+
+func TestDumpSQL_LockWithoutTransaction(t *testing.T) {
+	db, server := newUsersFakeDB(t)
+	server.on("SHOW MASTER STATUS", fakeResult{columns: []string{"File", "Position"}})
+
+	var out strings.Builder
+	opts := dumpOptions{masterData: true, maxAllowedPacket: defaultMaxAllowedPacket}
+	if err := dumpSQL(context.Background(), db, "app", &out, opts, &backupMetadata{}); err != nil {
+		t.Fatalf("dumpSQL returned error: %v", err)
+	}
+
+	executed := server.executed()
+	if executed[len(executed)-1] != "UNLOCK TABLES" {
+		t.Errorf("Expected the global read lock to be held until the end, executed %q", executed)
+	}
+	for _, statement := range executed {
+		if strings.HasPrefix(statement, "START TRANSACTION") {
+			t.Errorf("Did not expect a transaction with DB_DUMP_SINGLE_TRANSACTION=0")
+		}
+	}
+}
+
+func TestOpenSnapshot_UTCSession(t *testing.T) {
+	db, server := newFakeDB(t)
+
+	snap, err := openSnapshot(context.Background(), db, dumpOptions{singleTransaction: true, threads: 3})
+	if err != nil {
+		t.Fatalf("openSnapshot returned error: %v", err)
+	}
+	defer snap.Close()
+
+	if len(snap.conns) != 3 {
+		t.Fatalf("Expected 3 pinned connections, got %d", len(snap.conns))
+	}
+	for i, conn := range snap.conns {
+		var zone string
+		if err := conn.QueryRowContext(context.Background(), "SELECT @@SESSION.time_zone").Scan(&zone); err != nil {
+			t.Fatalf("Failed to read time zone of connection %d: %v", i, err)
+		}
+		if zone != "+00:00" {
+			t.Errorf("Connection %d time_zone = %q, want +00:00", i, zone)
+		}
+	}
+
+	executed := server.executed()
+	firstSet := slices.Index(executed, "SET time_zone = '+00:00'")
+	firstTransaction := slices.Index(executed, "START TRANSACTION /*!40100 WITH CONSISTENT SNAPSHOT */")
+	if firstSet < 0 || firstTransaction < firstSet {
+		t.Errorf("Expected the time zone to be set before the snapshot starts, executed %q", executed)
+	}
+}
+
+func TestOpenSnapshot_Locking(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       dumpOptions
+		wantLock   bool
+		wantLocked bool
+	}{
+		{name: "single transaction", opts: dumpOptions{singleTransaction: true, threads: 1}},
+		{name: "single transaction threads", opts: dumpOptions{singleTransaction: true, threads: 3}, wantLock: true},
+		{name: "single transaction master data", opts: dumpOptions{singleTransaction: true, masterData: true, threads: 1}, wantLock: true},
+		{name: "no transaction", opts: dumpOptions{threads: 1}},
+		{name: "no transaction threads", opts: dumpOptions{threads: 3}, wantLock: true, wantLocked: true},
+		{name: "no transaction master data", opts: dumpOptions{masterData: true, threads: 1}, wantLock: true, wantLocked: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, server := newFakeDB(t)
+			server.on("SHOW MASTER STATUS", fakeResult{columns: []string{"File", "Position"}})
+
+			snap, err := openSnapshot(context.Background(), db, tt.opts)
+			if err != nil {
+				t.Fatalf("openSnapshot returned error: %v", err)
+			}
+			executed := server.executed()
+			locked := slices.Contains(executed, "FLUSH TABLES WITH READ LOCK")
+			if locked != tt.wantLock {
+				t.Errorf("FLUSH TABLES WITH READ LOCK executed = %v, want %v: %q", locked, tt.wantLock, executed)
+			}
+			unlocked := slices.Contains(executed, "UNLOCK TABLES")
+			if snap.locked != tt.wantLocked || unlocked != (tt.wantLock && !tt.wantLocked) {
+				t.Errorf("Lock held for the dump = %v, want %v: %q", snap.locked, tt.wantLocked, executed)
+			}
+
+			snap.Close()
+			if tt.wantLocked && !slices.Contains(server.executed(), "UNLOCK TABLES") {
+				t.Errorf("Expected the lock to be released on close, executed %q", server.executed())
+			}
+		})
+	}
+}
+
+func TestDumpSQL_SplitsInsertsAtMaxAllowedPacket(t *testing.T) {
+	db, server := newFakeDB(t)
+	server.on("SHOW FULL TABLES", fakeResult{
+		columns: []string{"Tables_in_app", "Table_type"},
+		types:   []string{"VARCHAR", "VARCHAR"},
+		rows:    [][]any{{"t", "BASE TABLE"}},
+	})
+	var rows [][]any
+	for i := range 1000 {
+		rows = append(rows, []any{fmt.Sprint(i)})
+	}
+	server.table("t", "CREATE TABLE `t` (`id` int)", []string{"id"}, []string{"INT"}, rows)
+
+	var out strings.Builder
+	opts := dumpOptions{singleTransaction: true, maxAllowedPacket: 1024}
+	if err := dumpSQL(context.Background(), db, "app", &out, opts, &backupMetadata{}); err != nil {
+		t.Fatalf("dumpSQL returned error: %v", err)
+	}
+
+	inserts := 0
+	for _, line := range strings.Split(out.String(), "\n") {
+		if strings.HasPrefix(line, "INSERT INTO") {
+			inserts++
+			if len(line) > 1024 {
+				t.Errorf("INSERT statement is %d bytes, want at most 1024", len(line))
+			}
+		}
+	}
+	if inserts < 2 {
+		t.Errorf("Expected rows to be split across several INSERT statements, got %d", inserts)
+	}
+}
+
+func TestDumpSQL_Deterministic(t *testing.T) {
+	var dumps []string
+	for range 2 {
+		db, server := newFakeDB(t)
+		server.on("SHOW FULL TABLES", fakeResult{
+			columns: []string{"Tables_in_app", "Table_type"},
+			types:   []string{"VARCHAR", "VARCHAR"},
+			rows:    [][]any{{"orders", "BASE TABLE"}, {"log", "BASE TABLE"}},
+		})
+		var rows [][]any
+		for i := range 1001 {
+			rows = append(rows, []any{fmt.Sprint(i)})
+		}
+		server.table("orders", "CREATE TABLE `orders` (\n  `id` int NOT NULL AUTO_INCREMENT,\n  PRIMARY KEY (`id`)\n) ENGINE=InnoDB AUTO_INCREMENT=1002 DEFAULT CHARSET=utf8mb4", []string{"id"}, []string{"INT"}, nil)
+		server.on("SHOW KEYS FROM `orders` WHERE Key_name = 'PRIMARY'", fakeResult{
+			columns: []string{"Table", "Key_name", "Column_name"},
+			types:   []string{"VARCHAR", "VARCHAR", "VARCHAR"},
+			rows:    [][]any{{"orders", "PRIMARY", "id"}},
+		})
+		server.on("SELECT `id` FROM `orders` ORDER BY `id`", fakeResult{columns: []string{"id"}, types: []string{"INT"}, rows: rows})
+		server.table("log", "CREATE TABLE `log` (\n  `at` int,\n  `message` text\n) ENGINE=InnoDB", []string{"at", "message"}, []string{"INT", "TEXT"}, nil)
+		server.on("SHOW KEYS FROM `log` WHERE Key_name = 'PRIMARY'", fakeResult{
+			columns: []string{"Table", "Key_name", "Column_name"},
+			types:   []string{"VARCHAR", "VARCHAR", "VARCHAR"},
+		})
+		server.on("SELECT `at`,`message` FROM `log` ORDER BY `at`,`message`", fakeResult{
+			columns: []string{"at", "message"},
+			types:   []string{"INT", "TEXT"},
+			rows:    [][]any{{"1", "a"}, {"1", "b"}},
+		})
+
+		var out strings.Builder
+		opts := dumpOptions{singleTransaction: true, maxAllowedPacket: defaultMaxAllowedPacket, deterministic: true}
+		if err := dumpSQL(context.Background(), db, "app", &out, opts, &backupMetadata{}); err != nil {
+			t.Fatalf("dumpSQL returned error: %v", err)
+		}
+		dumps = append(dumps, out.String())
+	}
+
+	dump := dumps[0]
+	if dumps[1] != dump {
+		t.Errorf("Expected identical dumps of identical data, got:\n%s\n\nand:\n%s", dump, dumps[1])
+	}
+	for _, want := range []string{
+		"  `id` int NOT NULL AUTO_INCREMENT,\n",
+		"\n) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;\n",
+		"INSERT INTO `log` (`at`,`message`) VALUES\n(1,'a'),\n(1,'b');\n",
+		"INSERT INTO `orders` (`id`) VALUES\n(0),\n(1),\n",
+		",\n(999);\nINSERT INTO `orders` (`id`) VALUES\n(1000);\n",
+	} {
+		if !strings.Contains(dump, want) {
+			t.Errorf("Dump is missing %q\n%s", want, dump)
+		}
+	}
+	if strings.Contains(dump, "AUTO_INCREMENT=") || strings.Contains(dump, "Dump completed") {
+		t.Errorf("Expected no AUTO_INCREMENT counter or completion time in the dump:\n%s", dump)
+	}
+	if strings.Index(dump, "CREATE TABLE `log`") > strings.Index(dump, "CREATE TABLE `orders`") {
+		t.Errorf("Expected tables to be dumped in order of their names")
+	}
+}
+
+func TestStripAutoIncrement(t *testing.T) {
+	tests := []struct {
+		createSQL string
+		want      string
+	}{
+		{
+			createSQL: "CREATE TABLE `t` (\n  `id` int NOT NULL AUTO_INCREMENT\n) ENGINE=InnoDB AUTO_INCREMENT=42 DEFAULT CHARSET=utf8mb4",
+			want:      "CREATE TABLE `t` (\n  `id` int NOT NULL AUTO_INCREMENT\n) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+		},
+		{
+			createSQL: "CREATE TABLE `t` (\n  `c` varchar(9) DEFAULT ' AUTO_INCREMENT=1'\n) ENGINE=InnoDB",
+			want:      "CREATE TABLE `t` (\n  `c` varchar(9) DEFAULT ' AUTO_INCREMENT=1'\n) ENGINE=InnoDB",
+		},
+		{
+			createSQL: "CREATE TABLE `t` (`id` int)",
+			want:      "CREATE TABLE `t` (`id` int)",
+		},
+	}
+	for _, tt := range tests {
+		if got := stripAutoIncrement(tt.createSQL); got != tt.want {
+			t.Errorf("stripAutoIncrement(%q) = %q, want %q", tt.createSQL, got, tt.want)
+		}
+	}
+}
+
+func newManyTablesFakeDB(t *testing.T, count int) (*sql.DB, *fakeServer) {
+	db, server := newFakeDB(t)
+	var tables [][]any
+	for i := range count {
+		name := fmt.Sprintf("t%02d", i)
+		tables = append(tables, []any{name, "BASE TABLE"})
+		server.table(name, "CREATE TABLE `"+name+"` (`id` int)", []string{"id"}, []string{"INT"}, [][]any{{fmt.Sprint(i)}})
+	}
+	server.on("SHOW FULL TABLES", fakeResult{
+		columns: []string{"Tables_in_app", "Table_type"},
+		types:   []string{"VARCHAR", "VARCHAR"},
+		rows:    tables,
+	})
+	return db, server
+}
+
+func TestDumpSQL_Parallel(t *testing.T) {
+	t.Setenv("DB_DUMP_PATH", t.TempDir())
+
+	serialDB, _ := newManyTablesFakeDB(t, 12)
+	var serial strings.Builder
+	opts := dumpOptions{singleTransaction: true, maxAllowedPacket: defaultMaxAllowedPacket, threads: 1}
+	if err := dumpSQL(context.Background(), serialDB, "app", &serial, opts, &backupMetadata{}); err != nil {
+		t.Fatalf("serial dumpSQL returned error: %v", err)
+	}
+
+	parallelDB, server := newManyTablesFakeDB(t, 12)
+	var parallel strings.Builder
+	opts.threads = 4
+	if err := dumpSQL(context.Background(), parallelDB, "app", &parallel, opts, &backupMetadata{}); err != nil {
+		t.Fatalf("parallel dumpSQL returned error: %v", err)
+	}
+
+	stripCompletion := func(dump string) string {
+		return dump[:strings.Index(dump, "-- Dump completed on")]
+	}
+	if stripCompletion(parallel.String()) != stripCompletion(serial.String()) {
+		t.Errorf("Parallel dump differs from serial dump")
+	}
+
+	executed := server.executed()
+	snapshots := 0
+	for _, statement := range executed {
+		if statement == "START TRANSACTION /*!40100 WITH CONSISTENT SNAPSHOT */" {
+			snapshots++
+		}
+	}
+	if snapshots != 4 {
+		t.Errorf("Expected one snapshot per thread, got %d", snapshots)
+	}
+	lock := slices.Index(executed, "FLUSH TABLES WITH READ LOCK")
+	if lock < 0 || lock > slices.Index(executed, "START TRANSACTION /*!40100 WITH CONSISTENT SNAPSHOT */") {
+		t.Errorf("Expected snapshots to be synchronised under a global read lock, executed %q", executed)
+	}
+
+	leftovers, _ := os.ReadDir(os.Getenv("DB_DUMP_PATH"))
+	if len(leftovers) != 0 {
+		t.Errorf("Expected part files to be removed, found %d", len(leftovers))
+	}
+}
+
+func TestDumpSQL_ParallelBoundsPendingParts(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("DB_DUMP_PATH", dir)
+	db, server := newManyTablesFakeDB(t, 12)
+	release := server.hold("SELECT `id` FROM `t00`")
+
+	done := make(chan error, 1)
+	go func() {
+		opts := dumpOptions{singleTransaction: true, maxAllowedPacket: defaultMaxAllowedPacket, threads: 2}
+		done <- dumpSQL(context.Background(), db, "app", io.Discard, opts, &backupMetadata{})
+	}()
+
+	// While t00 is stuck the workers may only get this far ahead of it.
+	limit := pendingPartsPerThread * 2
+	selected := func(i int) bool {
+		return slices.Contains(server.executed(), fmt.Sprintf("SELECT `id` FROM `t%02d`", i))
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !selected(limit - 1) {
+		if time.Now().After(deadline) {
+			release()
+			t.Fatalf("Workers did not reach table %d, executed %q", limit-1, server.executed())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if selected(limit) {
+		t.Errorf("Workers ran more than %d parts ahead of the dump", limit)
+	}
+	if files, _ := os.ReadDir(dir); len(files) > limit {
+		t.Errorf("Expected at most %d part files while the first table is dumped, found %d", limit, len(files))
+	}
+
+	release()
+	if err := <-done; err != nil {
+		t.Fatalf("dumpSQL returned error: %v", err)
+	}
+}
+
+func TestDumpSQL_TableFilter(t *testing.T) {
+	exclude := []namePattern{{raw: "app.t01"}, {raw: "*.t02"}}
+
+	tests := []struct {
+		name       string
+		schemaOnly bool
+		wantTables []string
+		wantData   []string
+	}{
+		{name: "skip", wantTables: []string{"t00", "t03"}, wantData: []string{"t00", "t03"}},
+		{name: "schema only", schemaOnly: true, wantTables: []string{"t00", "t01", "t02", "t03"}, wantData: []string{"t00", "t03"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, _ := newManyTablesFakeDB(t, 4)
+			var out strings.Builder
+			opts := dumpOptions{
+				singleTransaction: true,
+				maxAllowedPacket:  defaultMaxAllowedPacket,
+				tables:            tableFilter{exclude: exclude, schemaOnly: tt.schemaOnly},
+			}
+			if err := dumpSQL(context.Background(), db, "app", &out, opts, &backupMetadata{}); err != nil {
+				t.Fatalf("dumpSQL returned error: %v", err)
+			}
+
+			dump := out.String()
+			for i := range 4 {
+				name := fmt.Sprintf("t%02d", i)
+				created := strings.Contains(dump, "CREATE TABLE `"+name+"`")
+				inserted := strings.Contains(dump, "INSERT INTO `"+name+"`")
+				if created != slices.Contains(tt.wantTables, name) {
+					t.Errorf("Table %s created = %v", name, created)
+				}
+				if inserted != slices.Contains(tt.wantData, name) {
+					t.Errorf("Table %s has data = %v", name, inserted)
+				}
+			}
+		})
+	}
+}
+
+func TestDumpSQL_TableWhere(t *testing.T) {
+	db, server := newManyTablesFakeDB(t, 2)
+	server.on("SELECT `id` FROM `t01` WHERE id > 10", fakeResult{
+		columns: []string{"id"},
+		types:   []string{"INT"},
+		rows:    [][]any{{"11"}},
+	})
+
+	t.Setenv("DB_TABLE_WHERE", "t01: id > 10")
+	where, err := tableWheresFromEnv()
+	if err != nil {
+		t.Fatalf("tableWheresFromEnv returned error: %v", err)
+	}
+
+	var out strings.Builder
+	meta := &backupMetadata{}
+	opts := dumpOptions{singleTransaction: true, maxAllowedPacket: defaultMaxAllowedPacket, where: where}
+	if err := dumpSQL(context.Background(), db, "app", &out, opts, meta); err != nil {
+		t.Fatalf("dumpSQL returned error: %v", err)
+	}
+
+	dump := out.String()
+	if !strings.Contains(dump, "-- WHERE:  id > 10\n") || !strings.Contains(dump, "INSERT INTO `t01` (`id`) VALUES (11);") {
+		t.Errorf("Expected filtered rows of t01, got:\n%s", dump)
+	}
+	if !strings.Contains(dump, "INSERT INTO `t00` (`id`) VALUES (0);") {
+		t.Errorf("Expected every row of t00, got:\n%s", dump)
+	}
+	if want := map[string]string{"t01": "id > 10"}; !reflect.DeepEqual(meta.Where, want) {
+		t.Errorf("meta.Where = %v, want %v", meta.Where, want)
+	}
+}
+
+func TestTableWheresFromEnv(t *testing.T) {
+	t.Setenv("DB_TABLE_WHERE", "events: created_at > NOW() - INTERVAL 90 DAY;\nshop.audit_*: id > 1000000\n/^crm\\.(orders|invoices)$/: total > 0\n")
+
+	wheres, err := tableWheresFromEnv()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		table string
+		where string
+	}{
+		{"shop.events", "created_at > NOW() - INTERVAL 90 DAY"},
+		{"crm.events", "created_at > NOW() - INTERVAL 90 DAY"},
+		{"shop.audit_log", "id > 1000000"},
+		{"crm.audit_log", ""},
+		{"shop.orders", ""},
+		{"crm.orders", "total > 0"},
+		{"crm.invoices", "total > 0"},
+	}
+	for _, tt := range tests {
+		database, table, _ := strings.Cut(tt.table, ".")
+		if got := whereFor(wheres, database, table); got != tt.where {
+			t.Errorf("whereFor(%q) = %q, want %q", tt.table, got, tt.where)
+		}
+	}
+
+	tables := []tableInfo{{name: "events"}, {name: "orders"}, {name: "audit_log", isView: true}}
+	var unmatched []string
+	for _, where := range unmatchedWheres(wheres, "shop", tables) {
+		unmatched = append(unmatched, where.clause)
+	}
+	if want := []string{"id > 1000000", "total > 0"}; !slices.Equal(unmatched, want) {
+		t.Errorf("unmatchedWheres = %v, want %v", unmatched, want)
+	}
+
+	t.Setenv("DB_TABLE_WHERE", "events created_at > NOW()")
+	if _, err := tableWheresFromEnv(); err == nil {
+		t.Errorf("Expected error for an entry without a table")
+	}
+}
+
+func TestDumpSQL_Modes(t *testing.T) {
+	tests := []struct {
+		mode       dumpMode
+		wantCreate bool
+		wantInsert bool
+		wantView   bool
+	}{
+		{mode: modeFull, wantCreate: true, wantInsert: true, wantView: true},
+		{mode: modeSchema, wantCreate: true, wantView: true},
+		{mode: modeData, wantInsert: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.mode), func(t *testing.T) {
+			db, server := newManyTablesFakeDB(t, 1)
+			server.on("SHOW FULL TABLES", fakeResult{
+				columns: []string{"Tables_in_app", "Table_type"},
+				types:   []string{"VARCHAR", "VARCHAR"},
+				rows:    [][]any{{"t00", "BASE TABLE"}, {"v00", "VIEW"}},
+			})
+			server.on("SHOW CREATE VIEW `v00`", fakeResult{
+				columns: []string{"View", "Create View", "character_set_client", "collation_connection"},
+				types:   []string{"VARCHAR", "VARCHAR", "VARCHAR", "VARCHAR"},
+				rows:    [][]any{{"v00", "CREATE VIEW `v00` AS select 1", "utf8mb4", "utf8mb4_general_ci"}},
+			})
+
+			var out strings.Builder
+			opts := dumpOptions{singleTransaction: true, maxAllowedPacket: defaultMaxAllowedPacket, mode: tt.mode, views: true}
+			if err := dumpSQL(context.Background(), db, "app", &out, opts, &backupMetadata{}); err != nil {
+				t.Fatalf("dumpSQL returned error: %v", err)
+			}
+
+			dump := out.String()
+			if got := strings.Contains(dump, "CREATE TABLE `t00`"); got != tt.wantCreate {
+				t.Errorf("CREATE TABLE in dump = %v, want %v", got, tt.wantCreate)
+			}
+			if got := strings.Contains(dump, "DROP TABLE"); got != tt.wantCreate {
+				t.Errorf("DROP TABLE in dump = %v, want %v", got, tt.wantCreate)
+			}
+			if got := strings.Contains(dump, "INSERT INTO `t00`"); got != tt.wantInsert {
+				t.Errorf("INSERT in dump = %v, want %v", got, tt.wantInsert)
+			}
+			if got := strings.Contains(dump, "CREATE VIEW `v00`"); got != tt.wantView {
+				t.Errorf("CREATE VIEW in dump = %v, want %v", got, tt.wantView)
+			}
+		})
+	}
+}
+
+func TestDumpModeSuffix(t *testing.T) {
+	for mode, want := range map[dumpMode]string{modeFull: "", modeSchema: ".schema", modeData: ".data"} {
+		if got := mode.suffix(); got != want {
+			t.Errorf("%s.suffix() = %q, want %q", mode, got, want)
+		}
+	}
+}
+
+func TestTableFilter(t *testing.T) {
+	tests := []struct {
+		name    string
+		include string
+		exclude string
+		table   string
+		reason  string
+	}{
+		{name: "no patterns", table: "shop.orders"},
+		{name: "excluded in every database", exclude: "*.sessions", table: "crm.sessions", reason: "matches DB_EXCLUDE_TABLES pattern *.sessions"},
+		{name: "exclude is database qualified", exclude: "shop.cache_*", table: "crm.cache_pages"},
+		{name: "include hit", include: "shop.orders,shop.customers", table: "shop.customers"},
+		{name: "include miss", include: "shop.orders", table: "shop.audit_log", reason: "does not match DB_INCLUDE_TABLES"},
+		{name: "regex exclude", exclude: `/\.audit_log_[0-9]{6}$/`, table: "shop.audit_log_202401", reason: `matches DB_EXCLUDE_TABLES pattern /\.audit_log_[0-9]{6}$/`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DB_INCLUDE_TABLES", tt.include)
+			t.Setenv("DB_EXCLUDE_TABLES", tt.exclude)
+
+			filter, err := tableFilterFromEnv()
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			database, table, _ := strings.Cut(tt.table, ".")
+			if got := filter.excludeReason(database, table); got != tt.reason {
+				t.Errorf("excludeReason(%q) = %q, want %q", tt.table, got, tt.reason)
+			}
+		})
+	}
+}
+
+func TestDumpSQL_ParallelFailureCleansUp(t *testing.T) {
+	t.Setenv("DB_DUMP_PATH", t.TempDir())
+
+	db, server := newManyTablesFakeDB(t, 12)
+	server.fail("SELECT `id` FROM `t05`", fmt.Errorf("table is corrupt"))
+
+	var out strings.Builder
+	opts := dumpOptions{singleTransaction: true, maxAllowedPacket: defaultMaxAllowedPacket, threads: 3}
+	err := dumpSQL(context.Background(), db, "app", &out, opts, &backupMetadata{})
+	if err == nil || !strings.Contains(err.Error(), "table is corrupt") {
+		t.Fatalf("Expected table error, got %v", err)
+	}
+
+	leftovers, _ := os.ReadDir(os.Getenv("DB_DUMP_PATH"))
+	if len(leftovers) != 0 {
+		t.Errorf("Expected part files to be removed, found %d", len(leftovers))
+	}
+}
+
+func TestWriteValue(t *testing.T) {
+	tests := []struct {
+		name     string
+		typeName string
+		value    sql.RawBytes
+		expected string
+	}{
+		{"NULL", "VARCHAR", nil, "NULL"},
+		{"integer", "INT", sql.RawBytes("42"), "42"},
+		{"unsigned bigint", "UNSIGNED BIGINT", sql.RawBytes("18446744073709551615"), "18446744073709551615"},
+		{"decimal", "DECIMAL", sql.RawBytes("12.50"), "12.50"},
+		{"string with quotes", "VARCHAR", sql.RawBytes(`it's "quoted"`), `'it\'s \"quoted\"'`},
+		{"string with control characters", "TEXT", sql.RawBytes("a\x00b\r\n\x1a\\"), `'a\0b\r\n\Z\\'`},
+		{"datetime", "DATETIME", sql.RawBytes("2023-01-01 12:00:00"), "'2023-01-01 12:00:00'"},
+		{"blob", "BLOB", sql.RawBytes{0x00, 0x27, 0xff}, "0x0027ff"},
+		{"empty blob", "VARBINARY", sql.RawBytes{}, "''"},
+		{"empty string", "VARCHAR", sql.RawBytes{}, "''"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			writeValue(&b, kindOf(tt.typeName), tt.value)
+			if b.String() != tt.expected {
+				t.Errorf("writeValue(%s, %q) = %s, want %s", tt.typeName, tt.value, b.String(), tt.expected)
+			}
+		})
+	}
+}
+
+func TestQuoteIdentifier(t *testing.T) {
+	if got := quoteIdentifier("my`table"); got != "`my``table`" {
+		t.Errorf("quoteIdentifier = %s, want `my``table`", got)
+	}
+}
+
+func TestDumpOptionsFromEnv(t *testing.T) {
+	defaults := dumpOptions{
+		singleTransaction: true,
+		maxAllowedPacket:  defaultMaxAllowedPacket,
+		threads:           1,
+		mode:              modeFull,
+		format:            formatSQL,
+		routines:          true,
+		triggers:          true,
+		events:            true,
+		views:             true,
+	}
+	with := func(change func(*dumpOptions)) dumpOptions {
+		opts := defaults
+		change(&opts)
+		return opts
+	}
+
+	tests := []struct {
+		name        string
+		envVars     map[string]string
+		expected    dumpOptions
+		expectError bool
+	}{
+		{
+			name:     "defaults",
+			envVars:  map[string]string{},
+			expected: defaults,
+		},
+		{
+			name: "master data without single transaction",
+			envVars: map[string]string{
+				"DB_DUMP_SINGLE_TRANSACTION": "0",
+				"DB_DUMP_MASTER_DATA":        "1",
+				"DB_DUMP_MAX_ALLOWED_PACKET": "16777216",
+			},
+			expected: with(func(o *dumpOptions) {
+				o.singleTransaction = false
+				o.masterData = true
+				o.maxAllowedPacket = 16777216
+			}),
+		},
+		{
+			name:     "parallel threads",
+			envVars:  map[string]string{"DB_DUMP_THREADS": "8"},
+			expected: with(func(o *dumpOptions) { o.threads = 8 }),
+		},
+		{
+			name: "table filters",
+			envVars: map[string]string{
+				"DB_EXCLUDE_TABLES":              "*.sessions",
+				"DB_EXCLUDED_TABLES_SCHEMA_ONLY": "1",
+			},
+			expected: with(func(o *dumpOptions) {
+				o.tables = tableFilter{exclude: []namePattern{{raw: "*.sessions"}}, schemaOnly: true}
+			}),
+		},
+		{
+			name:     "schema only mode",
+			envVars:  map[string]string{"DB_DUMP_MODE": "schema"},
+			expected: with(func(o *dumpOptions) { o.mode = modeSchema }),
+		},
+		{
+			name: "without stored objects",
+			envVars: map[string]string{
+				"DB_DUMP_ROUTINES": "0",
+				"DB_DUMP_TRIGGERS": "0",
+				"DB_DUMP_EVENTS":   "0",
+				"DB_DUMP_VIEWS":    "0",
+			},
+			expected: with(func(o *dumpOptions) {
+				o.routines, o.triggers, o.events, o.views = false, false, false, false
+			}),
+		},
+		{
+			name:     "directory format",
+			envVars:  map[string]string{"DB_DUMP_FORMAT": "directory"},
+			expected: with(func(o *dumpOptions) { o.format = formatDirectory }),
+		},
+		{
+			name:     "csv format",
+			envVars:  map[string]string{"DB_DUMP_FORMAT": "csv", "DB_DUMP_CSV_BINARY": "base64"},
+			expected: with(func(o *dumpOptions) { o.format, o.delimited.base64 = formatCSV, true }),
+		},
+		{
+			name:    "parquet format",
+			envVars: map[string]string{"DB_DUMP_FORMAT": "parquet", "DB_DUMP_PARQUET_ROW_GROUP_MB": "128"},
+			expected: with(func(o *dumpOptions) {
+				o.format, o.parquet = formatParquet, parquetOptions{rowGroupSize: 128 << 20, gzip: true}
+			}),
+		},
+		{
+			name:     "jsonl format",
+			envVars:  map[string]string{"DB_DUMP_FORMAT": "jsonl", "DB_DUMP_JSON_BIGINT_AS_STRING": "1"},
+			expected: with(func(o *dumpOptions) { o.format, o.jsonl.bigintAsString = formatJSONL, true }),
+		},
+		{
+			name:        "invalid parquet row group size",
+			envVars:     map[string]string{"DB_DUMP_FORMAT": "parquet", "DB_DUMP_PARQUET_ROW_GROUP_MB": "0"},
+			expectError: true,
+		},
+		{
+			name:     "chunk rows",
+			envVars:  map[string]string{"DB_DUMP_CHUNK_ROWS": "1000000", "DB_DUMP_FORMAT": "directory"},
+			expected: with(func(o *dumpOptions) { o.format, o.chunkRows = formatDirectory, 1000000 }),
+		},
+		{
+			name:        "chunk rows with sql format",
+			envVars:     map[string]string{"DB_DUMP_CHUNK_ROWS": "1000000"},
+			expectError: true,
+		},
+		{
+			name:        "invalid chunk rows",
+			envVars:     map[string]string{"DB_DUMP_CHUNK_ROWS": "0"},
+			expectError: true,
+		},
+		{
+			name:        "unknown format",
+			envVars:     map[string]string{"DB_DUMP_FORMAT": "tar"},
+			expectError: true,
+		},
+		{
+			name:        "unknown mode",
+			envVars:     map[string]string{"DB_DUMP_MODE": "structure"},
+			expectError: true,
+		},
+		{
+			name:        "unqualified table pattern",
+			envVars:     map[string]string{"DB_INCLUDE_TABLES": "sessions"},
+			expectError: true,
+		},
+		{
+			name:        "zero threads",
+			envVars:     map[string]string{"DB_DUMP_THREADS": "0"},
+			expectError: true,
+		},
+		{
+			name:     "deterministic",
+			envVars:  map[string]string{"DB_DUMP_DETERMINISTIC": "1"},
+			expected: with(func(o *dumpOptions) { o.deterministic = true }),
+		},
+		{
+			name:        "invalid max allowed packet",
+			envVars:     map[string]string{"DB_DUMP_MAX_ALLOWED_PACKET": "tiny"},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{
+				"DB_DUMP_SINGLE_TRANSACTION", "DB_DUMP_MASTER_DATA", "DB_DUMP_MAX_ALLOWED_PACKET", "DB_DUMP_THREADS", "DB_DUMP_MODE", "DB_DUMP_FORMAT", "DB_DUMP_CHUNK_ROWS", "DB_DUMP_DETERMINISTIC",
+				"DB_DUMP_ROUTINES", "DB_DUMP_TRIGGERS", "DB_DUMP_EVENTS", "DB_DUMP_VIEWS",
+				"DB_INCLUDE_TABLES", "DB_EXCLUDE_TABLES", "DB_EXCLUDED_TABLES_SCHEMA_ONLY", "DB_TABLE_WHERE", "DB_DUMP_CSV_BINARY", "DB_DUMP_PARQUET_ROW_GROUP_MB", "DB_GZIP", "DB_DUMP_JSON_BIGINT_AS_STRING",
+			} {
+				t.Setenv(key, tt.envVars[key])
+			}
+
+			opts, err := dumpOptionsFromEnv()
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(opts, tt.expected) {
+				t.Errorf("dumpOptionsFromEnv() = %+v, want %+v", opts, tt.expected)
+			}
+		})
+	}
+}
+
+func TestBackupName(t *testing.T) {
+	started := time.Date(2023, 1, 2, 15, 4, 5, 0, time.UTC)
+	// Database names must not be interpreted as time layout elements.
+	if got := backupName("Jan2", started); got != "Jan2-20230102T150405" {
+		t.Errorf("backupName = %q, want %q", got, "Jan2-20230102T150405")
+	}
+}
+
+func TestDumpDatabases(t *testing.T) {
+	databases := []string{"app", "billing", "crm", "logs", "shop"}
+
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	summary := dumpDatabases(databases, 2, func(database string) error {
+		mu.Lock()
+		running++
+		maxRunning = max(maxRunning, running)
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+
+		if database == "crm" || database == "shop" {
+			return fmt.Errorf("connection lost")
+		}
+		return nil
+	})
+
+	if maxRunning > 2 {
+		t.Errorf("Expected at most 2 dumps in flight, got %d", maxRunning)
+	}
+	if len(summary.results) != len(databases) {
+		t.Fatalf("Expected %d results, got %d", len(databases), len(summary.results))
+	}
+	for i, result := range summary.results {
+		if result.database != databases[i] {
+			t.Errorf("Result %d is for %q, want %q", i, result.database, databases[i])
+		}
+	}
+	if failed := summary.failed(); len(failed) != 2 {
+		t.Errorf("Expected 2 failed databases, got %d", len(failed))
+	}
+
+	err := summary.err()
+	if err == nil {
+		t.Fatal("Expected an error for the failed databases")
+	}
+	if want := "2 of 5 databases failed: crm, shop"; err.Error() != want {
+		t.Errorf("err() = %q, want %q", err.Error(), want)
+	}
+}
+
+func TestDumpDatabases_AllSucceed(t *testing.T) {
+	summary := dumpDatabases([]string{"app", "shop"}, 1, func(string) error { return nil })
+	if err := summary.err(); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+}
+
+func TestParallelDatabasesFromEnv(t *testing.T) {
+	tests := []struct {
+		value       string
+		expected    int
+		expectError bool
+	}{
+		{value: "", expected: 1},
+		{value: "4", expected: 4},
+		{value: "0", expectError: true},
+		{value: "many", expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			t.Setenv("DB_DUMP_PARALLEL_DATABASES", tt.value)
+
+			n, err := parallelDatabasesFromEnv()
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if n != tt.expected {
+				t.Errorf("parallelDatabasesFromEnv() = %d, want %d", n, tt.expected)
+			}
+		})
+	}
+}
+
+func TestDumpSQL_StoredObjects(t *testing.T) {
+	db, server := newManyTablesFakeDB(t, 1)
+	server.on("SHOW FULL TABLES", fakeResult{
+		columns: []string{"Tables_in_app", "Table_type"},
+		types:   []string{"VARCHAR", "VARCHAR"},
+		rows:    [][]any{{"a_summary", "VIEW"}, {"t00", "BASE TABLE"}, {"z_base", "VIEW"}},
+	})
+	viewColumns := []string{"View", "Create View", "character_set_client", "collation_connection"}
+	viewTypes := []string{"VARCHAR", "VARCHAR", "VARCHAR", "VARCHAR"}
+	server.on("SHOW CREATE VIEW `a_summary`", fakeResult{
+		columns: viewColumns,
+		types:   viewTypes,
+		rows:    [][]any{{"a_summary", "CREATE VIEW `a_summary` AS select count(0) AS `n` from `z_base`", "utf8mb4", "utf8mb4_0900_ai_ci"}},
+	})
+	server.on("SHOW CREATE VIEW `z_base`", fakeResult{
+		columns: viewColumns,
+		types:   viewTypes,
+		rows:    [][]any{{"z_base", "CREATE VIEW `z_base` AS select `double_id`(`t00`.`id`) AS `id` from `t00`", "utf8mb4", "utf8mb4_0900_ai_ci"}},
+	})
+
+	server.on("SHOW TRIGGERS", fakeResult{
+		columns: []string{"Trigger", "Event", "Table", "Statement", "Timing"},
+		types:   []string{"VARCHAR", "VARCHAR", "VARCHAR", "VARCHAR", "VARCHAR"},
+		rows:    [][]any{{"t00_bi", "INSERT", "t00", "SET NEW.id = NEW.id + 1", "BEFORE"}},
+	})
+	server.on("SHOW CREATE TRIGGER `t00_bi`", fakeResult{
+		columns: []string{"Trigger", "sql_mode", "SQL Original Statement", "character_set_client", "collation_connection", "Database Collation"},
+		types:   []string{"VARCHAR", "VARCHAR", "VARCHAR", "VARCHAR", "VARCHAR", "VARCHAR"},
+		rows:    [][]any{{"t00_bi", "STRICT_TRANS_TABLES", "CREATE TRIGGER `t00_bi` BEFORE INSERT ON `t00` FOR EACH ROW BEGIN SET NEW.id = NEW.id + 1; END", "utf8mb4", "utf8mb4_0900_ai_ci", "utf8mb4_0900_ai_ci"}},
+	})
+
+	routineColumns := []string{"Db", "Name", "Type"}
+	routineTypes := []string{"VARCHAR", "VARCHAR", "VARCHAR"}
+	server.on("SHOW FUNCTION STATUS WHERE Db = 'app'", fakeResult{
+		columns: routineColumns,
+		types:   routineTypes,
+		rows:    [][]any{{"app", "double_id", "FUNCTION"}},
+	})
+	server.on("SHOW CREATE FUNCTION `double_id`", fakeResult{
+		columns: []string{"Function", "sql_mode", "Create Function", "character_set_client", "collation_connection", "Database Collation"},
+		types:   []string{"VARCHAR", "VARCHAR", "VARCHAR", "VARCHAR", "VARCHAR", "VARCHAR"},
+		rows:    [][]any{{"double_id", "", "CREATE FUNCTION `double_id`(x int) RETURNS int DETERMINISTIC RETURN x * 2", "utf8mb4", "utf8mb4_0900_ai_ci", "utf8mb4_0900_ai_ci"}},
+	})
+	server.on("SHOW PROCEDURE STATUS WHERE Db = 'app'", fakeResult{
+		columns: routineColumns,
+		types:   routineTypes,
+		rows:    [][]any{{"app", "purge", "PROCEDURE"}},
+	})
+	server.on("SHOW CREATE PROCEDURE `purge`", fakeResult{
+		columns: []string{"Procedure", "sql_mode", "Create Procedure", "character_set_client", "collation_connection", "Database Collation"},
+		types:   []string{"VARCHAR", "VARCHAR", "VARCHAR", "VARCHAR", "VARCHAR", "VARCHAR"},
+		rows:    [][]any{{"purge", "", "CREATE PROCEDURE `purge`() BEGIN DELETE FROM t00 WHERE id < 0;; END", "utf8mb4", "utf8mb4_0900_ai_ci", "utf8mb4_0900_ai_ci"}},
+	})
+
+	server.on("SHOW EVENTS", fakeResult{
+		columns: []string{"Db", "Name"},
+		types:   []string{"VARCHAR", "VARCHAR"},
+		rows:    [][]any{{"app", "nightly"}},
+	})
+	server.on("SHOW CREATE EVENT `nightly`", fakeResult{
+		columns: []string{"Event", "sql_mode", "time_zone", "Create Event", "character_set_client", "collation_connection", "Database Collation"},
+		types:   []string{"VARCHAR", "VARCHAR", "VARCHAR", "VARCHAR", "VARCHAR", "VARCHAR", "VARCHAR"},
+		rows:    [][]any{{"nightly", "", "SYSTEM", "CREATE EVENT `nightly` ON SCHEDULE EVERY 1 DAY DO CALL `purge`()", "utf8mb4", "utf8mb4_0900_ai_ci", "utf8mb4_0900_ai_ci"}},
+	})
+
+	opts := dumpOptions{singleTransaction: true, maxAllowedPacket: defaultMaxAllowedPacket, routines: true, triggers: true, events: true, views: true}
+	var out strings.Builder
+	if err := dumpSQL(context.Background(), db, "app", &out, opts, &backupMetadata{}); err != nil {
+		t.Fatalf("dumpSQL returned error: %v", err)
+	}
+	dump := out.String()
+
+	for _, want := range []string{
+		"DELIMITER ;;\nCREATE TRIGGER `t00_bi` BEFORE INSERT ON `t00` FOR EACH ROW BEGIN SET NEW.id = NEW.id + 1; END ;;\nDELIMITER ;\n",
+		"/*!50003 SET sql_mode              = 'STRICT_TRANS_TABLES' */ ;\n",
+		"/*!50003 DROP FUNCTION IF EXISTS `double_id` */;\n",
+		"DELIMITER $$\nCREATE PROCEDURE `purge`() BEGIN DELETE FROM t00 WHERE id < 0;; END $$\nDELIMITER ;\n",
+		"/*!50106 SET time_zone             = 'SYSTEM' */ ;\n",
+	} {
+		if !strings.Contains(dump, want) {
+			t.Errorf("Dump is missing %q\n%s", want, dump)
+		}
+	}
+
+	// Rows, then triggers, then events and routines, then views with
+	// z_base before the a_summary view selecting from it.
+	order := []string{
+		"INSERT INTO `t00`",
+		"CREATE TRIGGER `t00_bi`",
+		"CREATE EVENT `nightly`",
+		"CREATE FUNCTION `double_id`",
+		"CREATE PROCEDURE `purge`",
+		"CREATE VIEW `z_base`",
+		"CREATE VIEW `a_summary`",
+	}
+	last := -1
+	for _, want := range order {
+		index := strings.Index(dump, want)
+		if index < last {
+			t.Errorf("Expected %q later in the dump, want order %q", want, order)
+		}
+		last = index
+	}
+}
+
+func TestDumpSQL_StoredObjectsSkippedInDataMode(t *testing.T) {
+	db, server := newManyTablesFakeDB(t, 1)
+
+	opts := dumpOptions{singleTransaction: true, maxAllowedPacket: defaultMaxAllowedPacket, mode: modeData, routines: true, triggers: true, events: true, views: true}
+	var out strings.Builder
+	if err := dumpSQL(context.Background(), db, "app", &out, opts, &backupMetadata{}); err != nil {
+		t.Fatalf("dumpSQL returned error: %v", err)
+	}
+
+	for _, statement := range server.executed() {
+		if strings.HasPrefix(statement, "SHOW TRIGGERS") || strings.HasPrefix(statement, "SHOW EVENTS") || strings.Contains(statement, "STATUS WHERE Db") {
+			t.Errorf("Did not expect %q in a data-only dump", statement)
+		}
+	}
+}
+
+func TestDelimiterFor(t *testing.T) {
+	tests := []struct {
+		body string
+		want string
+	}{
+		{"BEGIN SELECT 1; END", ";;"},
+		{"BEGIN SELECT ';;'; END", "$$"},
+		{"BEGIN SELECT ';;', '$$', '//', '##', '~~'; END", ";;;"},
+	}
+	for _, tt := range tests {
+		if got := delimiterFor(tt.body); got != tt.want {
+			t.Errorf("delimiterFor(%q) = %q, want %q", tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestSortViews(t *testing.T) {
+	views := []view{
+		{name: "a", createSQL: "CREATE VIEW `a` AS select * from `b` join `c`"},
+		{name: "b", createSQL: "CREATE VIEW `b` AS select * from `c`"},
+		{name: "c", createSQL: "CREATE VIEW `c` AS select * from `t`"},
+		{name: "d", createSQL: "CREATE VIEW `d` AS select * from `t`"},
+	}
+
+	var names []string
+	for _, v := range sortViews(views) {
+		names = append(names, v.name)
+	}
+	if want := []string{"c", "d", "b", "a"}; !slices.Equal(names, want) {
+		t.Errorf("sortViews() = %v, want %v", names, want)
+	}
+}
+
+func TestDumpAccounts(t *testing.T) {
+	db, server := newFakeDB(t)
+	server.on("SELECT User, Host, 'N' FROM mysql.user ORDER BY User, Host", fakeResult{
+		columns: []string{"User", "Host", "N"},
+		types:   []string{"VARCHAR", "VARCHAR", "VARCHAR"},
+		rows: [][]any{
+			{"app", "%", "N"},
+			{"mysql.sys", "localhost", "N"},
+			{"reader", "%", "N"},
+		},
+	})
+	server.on("SELECT DISTINCT FROM_USER, FROM_HOST FROM mysql.role_edges", fakeResult{
+		columns: []string{"FROM_USER", "FROM_HOST"},
+		types:   []string{"VARCHAR", "VARCHAR"},
+		rows:    [][]any{{"reader", "%"}},
+	})
+	server.on("SHOW CREATE USER 'app'@'%'", fakeResult{
+		columns: []string{"CREATE USER for app@%"},
+		types:   []string{"VARCHAR"},
+		rows:    [][]any{{"CREATE USER `app`@`%` IDENTIFIED WITH 'caching_sha2_password' AS 0x24412430 DEFAULT ROLE `reader`@`%`"}},
+	})
+	server.on("SHOW CREATE USER 'reader'@'%'", fakeResult{
+		columns: []string{"CREATE USER for reader@%"},
+		types:   []string{"VARCHAR"},
+		rows:    [][]any{{"CREATE USER `reader`@`%` IDENTIFIED WITH 'caching_sha2_password' ACCOUNT LOCK"}},
+	})
+	server.on("SHOW GRANTS FOR 'app'@'%'", fakeResult{
+		columns: []string{"Grants for app@%"},
+		types:   []string{"VARCHAR"},
+		rows:    [][]any{{"GRANT USAGE ON *.* TO `app`@`%`"}, {"GRANT `reader`@`%` TO `app`@`%`"}},
+	})
+	server.on("SHOW GRANTS FOR 'reader'@'%'", fakeResult{
+		columns: []string{"Grants for reader@%"},
+		types:   []string{"VARCHAR"},
+		rows:    [][]any{{"GRANT SELECT ON `shop`.* TO `reader`@`%`"}},
+	})
+
+	var out strings.Builder
+	meta := &backupMetadata{}
+	if err := dumpAccounts(context.Background(), db, &out, meta, false); err != nil {
+		t.Fatalf("dumpAccounts returned error: %v", err)
+	}
+	dump := out.String()
+
+	order := []string{
+		"CREATE USER IF NOT EXISTS `reader`@`%` IDENTIFIED WITH 'caching_sha2_password' ACCOUNT LOCK;\n",
+		"CREATE USER IF NOT EXISTS `app`@`%` IDENTIFIED WITH 'caching_sha2_password' AS 0x24412430 DEFAULT ROLE `reader`@`%`;\n",
+		"GRANT SELECT ON `shop`.* TO `reader`@`%`;\n",
+		"GRANT USAGE ON *.* TO `app`@`%`;\nGRANT `reader`@`%` TO `app`@`%`;\n",
+	}
+	last := -1
+	for _, want := range order {
+		index := strings.Index(dump, want)
+		if index < 0 {
+			t.Errorf("Dump is missing %q\n%s", want, dump)
+			continue
+		}
+		if index < last {
+			t.Errorf("Expected %q later in the dump\n%s", want, dump)
+		}
+		last = index
+	}
+	if strings.Contains(dump, "mysql.sys") {
+		t.Errorf("Reserved accounts must not be dumped\n%s", dump)
+	}
+	if !slices.Contains(server.executed(), "SET SESSION print_identified_with_as_hex = ON") {
+		t.Errorf("Expected password hashes to be printed as hex")
+	}
+	if meta.ServerVersion != "8.0.36" {
+		t.Errorf("Unexpected metadata: %+v", meta)
+	}
+	if !strings.Contains(dump, "-- Dump completed on ") {
+		t.Errorf("Dump is missing its completion time\n%s", dump)
+	}
+
+	var deterministic strings.Builder
+	if err := dumpAccounts(context.Background(), db, &deterministic, &backupMetadata{}, true); err != nil {
+		t.Fatalf("deterministic dumpAccounts returned error: %v", err)
+	}
+	if want := dump[:strings.Index(dump, "\n-- Dump completed on ")]; deterministic.String() != want {
+		t.Errorf("Deterministic dump = %q, want %q", deterministic.String(), want)
+	}
+}
+
+func TestDumpAccounts_MariaDBRoles(t *testing.T) {
+	db, server := newFakeDB(t)
+	server.on("SELECT VERSION()", fakeResult{
+		columns: []string{"VERSION()"},
+		types:   []string{"VARCHAR"},
+		rows:    [][]any{{"10.11.6-MariaDB"}},
+	})
+	server.on("SELECT User, Host, is_role FROM mysql.user ORDER BY User, Host", fakeResult{
+		columns: []string{"User", "Host", "is_role"},
+		types:   []string{"VARCHAR", "VARCHAR", "VARCHAR"},
+		rows:    [][]any{{"app", "%", "N"}, {"reader", "", "Y"}},
+	})
+	server.on("SHOW CREATE USER 'app'@'%'", fakeResult{
+		columns: []string{"CREATE USER for app@%"},
+		types:   []string{"VARCHAR"},
+		rows:    [][]any{{"CREATE USER `app`@`%` IDENTIFIED BY PASSWORD '*2470C0C06DEE42FD1618BB99005ADCA2EC9D1E19'"}},
+	})
+	server.on("SHOW GRANTS FOR 'app'@'%'", fakeResult{
+		columns: []string{"Grants for app@%"},
+		types:   []string{"VARCHAR"},
+		rows:    [][]any{{"GRANT `reader` TO `app`@`%`"}},
+	})
+	server.on("SHOW GRANTS FOR 'reader'", fakeResult{
+		columns: []string{"Grants for reader"},
+		types:   []string{"VARCHAR"},
+		rows:    [][]any{{"GRANT SELECT ON `shop`.* TO `reader`"}},
+	})
+
+	var out strings.Builder
+	if err := dumpAccounts(context.Background(), db, &out, &backupMetadata{}, false); err != nil {
+		t.Fatalf("dumpAccounts returned error: %v", err)
+	}
+	dump := out.String()
+
+	for _, want := range []string{
+		"CREATE ROLE IF NOT EXISTS 'reader';\n",
+		"CREATE USER IF NOT EXISTS `app`@`%` IDENTIFIED BY PASSWORD '*2470C0C06DEE42FD1618BB99005ADCA2EC9D1E19';\n",
+		"GRANT SELECT ON `shop`.* TO `reader`;\n",
+		"GRANT `reader` TO `app`@`%`;\n",
+	} {
+		if !strings.Contains(dump, want) {
+			t.Errorf("Dump is missing %q\n%s", want, dump)
+		}
+	}
+	if strings.Index(dump, "CREATE ROLE") > strings.Index(dump, "CREATE USER") {
+		t.Errorf("Roles must be created before users\n%s", dump)
+	}
+}
+
+func TestParseMaskRule(t *testing.T) {
+	tests := []struct {
+		line        string
+		column      string
+		strategy    maskStrategy
+		value       string
+		expectError bool
+	}{
+		{line: "users.email: email", column: "shop.users.email", strategy: maskEmail},
+		{line: "shop.users.notes: fixed  redacted by policy ", column: "shop.users.notes", strategy: maskFixed, value: "redacted by policy"},
+		{line: "*.users.phone: keep-format", column: "crm.users.phone", strategy: maskKeepFormat},
+		{line: `/users\.(email|phone)/: email`, column: "crm.users.phone", strategy: maskEmail},
+		{line: `/^shop\.users\.notes$/: null`, column: "shop.users.notes", strategy: maskNull},
+		{line: `/users\.(email/: email`, expectError: true},
+		{line: "email: email", expectError: true},
+		{line: "users.email email", expectError: true},
+		{line: "users.email: scramble", expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			rule, err := parseMaskRule(tt.line)
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !rule.pattern.match(tt.column) || rule.strategy != tt.strategy || rule.value != tt.value {
+				t.Errorf("parseMaskRule(%q) = %+v", tt.line, rule)
+			}
+		})
+	}
+}
+
+func TestMaskingApply(t *testing.T) {
+	m := &masking{salt: "pepper"}
+	rule := func(strategy maskStrategy, value string) *columnMask {
+		return &columnMask{rule: &maskRule{strategy: strategy, value: value}}
+	}
+
+	tests := []struct {
+		name     string
+		rule     *columnMask
+		value    []byte
+		kind     valueKind
+		check    func(masked []byte) bool
+		wantKind valueKind
+	}{
+		{"null", rule(maskNull, ""), []byte("secret"), kindString, func(b []byte) bool { return b == nil }, kindString},
+		{"null input stays null", rule(maskFixed, "x"), nil, kindString, func(b []byte) bool { return b == nil }, kindString},
+		{"fixed", rule(maskFixed, "redacted"), []byte("secret"), kindString, func(b []byte) bool { return string(b) == "redacted" }, kindString},
+		{"fixed in number column is quoted", rule(maskFixed, "n/a"), []byte("42"), kindNumber, func(b []byte) bool { return string(b) == "n/a" }, kindString},
+		{"hash", rule(maskHash, ""), []byte("secret"), kindString, func(b []byte) bool { return len(b) == 64 }, kindString},
+		{"hash fits column", newColumnMask(&maskRule{strategy: maskHash}, "varchar(16)"), []byte("secret"), kindString, func(b []byte) bool { return len(b) == 16 }, kindString},
+		{"email fits column", newColumnMask(&maskRule{strategy: maskEmail}, "char(10)"), []byte("jane@corp.com"), kindString, func(b []byte) bool { return strings.HasPrefix(string(b), "user_") && len(b) == 10 }, kindString},
+		{"hash of number stays number", rule(maskHash, ""), []byte("123456"), kindNumber, func(b []byte) bool {
+			_, err := strconv.Atoi(string(b))
+			return len(b) == 6 && err == nil
+		}, kindNumber},
+		{"email", rule(maskEmail, ""), []byte("jane@corp.com"), kindString, func(b []byte) bool {
+			return strings.HasPrefix(string(b), "user_") && strings.HasSuffix(string(b), "@example.com") && !strings.Contains(string(b), "jane")
+		}, kindString},
+		{"name", rule(maskName, ""), []byte("Jane Doe"), kindString, func(b []byte) bool {
+			return strings.Count(string(b), " ") == 1 && string(b) != "Jane Doe"
+		}, kindString},
+		{"keep format", rule(maskKeepFormat, ""), []byte("+46 (70) 123-45 Ab"), kindString, func(b []byte) bool {
+			return regexp.MustCompile(`^\+\d\d \(\d\d\) \d{3}-\d\d [A-Z][a-z]$`).MatchString(string(b))
+		}, kindString},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			masked, kind := m.apply(tt.rule, tt.value, tt.kind)
+			if !tt.check(masked) || kind != tt.wantKind {
+				t.Errorf("apply(%q) = (%q, %v)", tt.value, masked, kind)
+			}
+			again, _ := m.apply(tt.rule, tt.value, tt.kind)
+			if !bytes.Equal(masked, again) {
+				t.Errorf("apply(%q) is not deterministic: %q then %q", tt.value, masked, again)
+			}
+		})
+	}
+}
+
+func TestColumnMaskNumber(t *testing.T) {
+	tests := []struct {
+		columnType string
+		value      string
+		format     string
+		// min and max bound integer columns, when not both 0.
+		min, max int64
+	}{
+		{"tinyint(4)", "127", `^(0|-?[1-9]\d{0,2})$`, -128, 127},
+		{"tinyint(3) unsigned", "200", `^(0|[1-9]\d{0,2})$`, 0, 255},
+		{"smallint", "-4711", `^(0|-?[1-9]\d{0,4})$`, -32768, 32767},
+		{"bigint unsigned", "18446744073709551615", `^(0|[1-9]\d{0,19})$`, 0, 0},
+		{"year", "2023", `^\d{4}$`, 1901, 2155},
+		{"decimal(4,2)", "0.75", `^0\.\d\d$`, 0, 0},
+		{"decimal(10,2) unsigned", "1234.50", `^[1-9]\d{3}\.\d\d$`, 0, 0},
+		{"double", "-1.5e+300", `^-\d\.\de\+300$`, 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.columnType, func(t *testing.T) {
+			format := regexp.MustCompile(tt.format)
+			for _, strategy := range []maskStrategy{maskHash, maskKeepFormat} {
+				mask := newColumnMask(&maskRule{strategy: strategy}, tt.columnType)
+				// Every salt gives other digits.
+				for salt := range 200 {
+					m := &masking{salt: strconv.Itoa(salt)}
+					masked, kind := m.apply(mask, []byte(tt.value), kindNumber)
+					if kind != kindNumber || !format.Match(masked) {
+						t.Fatalf("%s of %s = %q, want a number matching %s", strategy, tt.value, masked, tt.format)
+					}
+					if tt.min == 0 && tt.max == 0 {
+						continue
+					}
+					if n, err := strconv.ParseInt(string(masked), 10, 64); err != nil || n < tt.min || n > tt.max {
+						t.Fatalf("%s of %s = %q, want a number from %d to %d", strategy, tt.value, masked, tt.min, tt.max)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestMaskingFromEnv_RequiresSalt(t *testing.T) {
+	tests := []struct {
+		rules       string
+		salt        string
+		expectError bool
+	}{
+		{rules: "users.password: null\nusers.notes: fixed redacted\n"},
+		{rules: "users.phone: keep-format\n", expectError: true},
+		{rules: "users.email: hash\n", expectError: true},
+		{rules: "users.email: hash\n", salt: "pepper"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.rules, func(t *testing.T) {
+			rulesFile := filepath.Join(t.TempDir(), "mask.rules")
+			if err := os.WriteFile(rulesFile, []byte(tt.rules), 0644); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv("DB_MASK_RULES_FILE", rulesFile)
+			t.Setenv("DB_MASK_SALT", tt.salt)
+
+			_, err := maskingFromEnv()
+			if tt.expectError && err == nil {
+				t.Error("Expected error, got nil")
+			}
+			if !tt.expectError && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestDumpSQL_Masking(t *testing.T) {
+	db, _ := newUsersFakeDB(t)
+
+	rulesFile := filepath.Join(t.TempDir(), "mask.rules")
+	rules := "# production PII\nusers.name: name\n/^app\\.users\\.avatar$/: null\nusers.phone: keep-format\n"
+	if err := os.WriteFile(rulesFile, []byte(rules), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DB_MASK_RULES_FILE", rulesFile)
+	t.Setenv("DB_MASK_SALT", "pepper")
+	t.Setenv("DB_MASK_PREFIX", "dev/")
+	masking, err := maskingFromEnv()
+	if err != nil {
+		t.Fatalf("maskingFromEnv returned error: %v", err)
+	}
+	if masking.prefix != "dev/" || len(masking.rules) != 3 {
+		t.Fatalf("Unexpected masking: %+v", masking)
+	}
+
+	var out strings.Builder
+	meta := &backupMetadata{}
+	opts := dumpOptions{singleTransaction: true, maxAllowedPacket: defaultMaxAllowedPacket, masking: masking}
+	if err := dumpSQL(context.Background(), db, "app", &out, opts, meta); err != nil {
+		t.Fatalf("dumpSQL returned error: %v", err)
+	}
+	dump := out.String()
+
+	if strings.Contains(dump, "Brien") || strings.Contains(dump, "0x01ff") {
+		t.Errorf("Dump leaks unmasked values:\n%s", dump)
+	}
+	if !regexp.MustCompile(`VALUES \(1,'[A-Za-z]+ [A-Za-z]+',NULL\),\(2,NULL,NULL\);`).MatchString(dump) {
+		t.Errorf("Unexpected masked rows:\n%s", dump)
+	}
+	if want := []string{"users.name: name", `/^app\.users\.avatar$/: null`, "users.phone: keep-format"}; !slices.Equal(meta.Masking, want) {
+		t.Errorf("meta.Masking = %v, want %v", meta.Masking, want)
+	}
+	if unused, want := masking.unused(), []string{"users.phone: keep-format"}; !slices.Equal(unused, want) {
+		t.Errorf("masking.unused() = %v, want %v", unused, want)
+	}
+}
+
+// memoryUpload is an uploadFunc that keeps uploads in memory.
+type memoryUpload struct {
+	mu    sync.Mutex
+	files map[string]string
+}
+
+func (m *memoryUpload) upload(filename string, write func(w io.Writer) error) (string, error) {
+	var b strings.Builder
+	if err := write(&b); err != nil {
+		return "", err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.files == nil {
+		m.files = make(map[string]string)
+	}
+	m.files[filename] = b.String()
+	return filename, nil
+}
+
+func TestDumpDirectory(t *testing.T) {
+	for _, threads := range []int{1, 3} {
+		t.Run(fmt.Sprintf("%d threads", threads), func(t *testing.T) {
+			db, server := newUsersFakeDB(t)
+			server.table("orders", "CREATE TABLE `orders` (`id` int)", []string{"id"}, []string{"INT"}, [][]any{{"7"}})
+			server.on("SHOW FULL TABLES", fakeResult{
+				columns: []string{"Tables_in_app", "Table_type"},
+				types:   []string{"VARCHAR", "VARCHAR"},
+				rows:    [][]any{{"active_users", "VIEW"}, {"orders", "BASE TABLE"}, {"users", "BASE TABLE"}},
+			})
+
+			var uploads memoryUpload
+			opts := dumpOptions{singleTransaction: true, maxAllowedPacket: defaultMaxAllowedPacket, threads: threads, views: true}
+			keys, err := dumpDirectory(context.Background(), db, "app", "app-20240101T000000/", opts, &backupMetadata{}, uploads.upload, nil)
+			if err != nil {
+				t.Fatalf("dumpDirectory returned error: %v", err)
+			}
+
+			want := []string{
+				"app-20240101T000000/app.orders-schema.sql",
+				"app-20240101T000000/app.orders.sql",
+				"app-20240101T000000/app.users-schema.sql",
+				"app-20240101T000000/app.users.sql",
+				"app-20240101T000000/app-schema-views.sql",
+			}
+			if !slices.Equal(keys, want) {
+				t.Fatalf("dumpDirectory() keys = %v, want %v", keys, want)
+			}
+
+			schema := uploads.files["app-20240101T000000/app.users-schema.sql"]
+			if !strings.Contains(schema, "CREATE TABLE `users`") || strings.Contains(schema, "INSERT") {
+				t.Errorf("Unexpected schema file:\n%s", schema)
+			}
+			data := uploads.files["app-20240101T000000/app.users.sql"]
+			if !strings.Contains(data, "INSERT INTO `users`") || strings.Contains(data, "CREATE TABLE") || strings.Contains(data, "`orders`") {
+				t.Errorf("Unexpected data file:\n%s", data)
+			}
+			for key, content := range uploads.files {
+				if !strings.Contains(content, "SET NAMES utf8mb4") || !strings.Contains(content, "-- Dump completed on") {
+					t.Errorf("File %s lacks the dump header or footer", key)
+				}
+			}
+		})
+	}
+}
+
+// newChunkedFakeDB serves a table big of ten rows with keys 1 to 10, which
+// DB_DUMP_CHUNK_ROWS=4 splits into the chunks below 5, from 5 below 9 and
+// from 9.
+func newChunkedFakeDB(t *testing.T) (*sql.DB, *fakeServer) {
+	db, server := newFakeDB(t)
+	server.on("SHOW FULL TABLES", fakeResult{
+		columns: []string{"Tables_in_app", "Table_type"},
+		types:   []string{"VARCHAR", "VARCHAR"},
+		rows:    [][]any{{"big", "BASE TABLE"}},
+	})
+	server.table("big", "CREATE TABLE `big` (`id` int NOT NULL, PRIMARY KEY (`id`))", []string{"id"}, []string{"INT"}, nil)
+	server.on("SELECT TABLE_ROWS FROM information_schema.TABLES WHERE TABLE_SCHEMA = 'app' AND TABLE_NAME = 'big'", fakeResult{
+		columns: []string{"TABLE_ROWS"},
+		types:   []string{"BIGINT"},
+		rows:    [][]any{{"10"}},
+	})
+	server.on("SHOW KEYS FROM `big` WHERE Key_name = 'PRIMARY'", fakeResult{
+		columns: []string{"Table", "Key_name", "Column_name"},
+		types:   []string{"VARCHAR", "VARCHAR", "VARCHAR"},
+		rows:    [][]any{{"big", "PRIMARY", "id"}},
+	})
+	server.on("SELECT MIN(`id`) AS lower, MAX(`id`) AS upper FROM `big`", fakeResult{
+		columns: []string{"lower", "upper"},
+		types:   []string{"INT", "INT"},
+		rows:    [][]any{{"1", "10"}},
+	})
+	for where, ids := range map[string][]int{
+		"`id` < 5":               {1, 2, 3, 4},
+		"`id` >= 5 AND `id` < 9": {5, 6, 7, 8},
+		"`id` >= 9":              {9, 10},
+	} {
+		var rows [][]any
+		for _, id := range ids {
+			rows = append(rows, []any{strconv.Itoa(id)})
+		}
+		server.on("SELECT `id` FROM `big` WHERE "+where, fakeResult{columns: []string{"id"}, types: []string{"INT"}, rows: rows})
+	}
+	return db, server
+}
+
+func TestDumpSQL_Chunks(t *testing.T) {
+	t.Setenv("DB_DUMP_PATH", t.TempDir())
+
+	var dumps []string
+	for _, threads := range []int{1, 3} {
+		db, _ := newChunkedFakeDB(t)
+		var out strings.Builder
+		meta := &backupMetadata{}
+		opts := dumpOptions{singleTransaction: true, maxAllowedPacket: defaultMaxAllowedPacket, threads: threads, chunkRows: 4}
+		if err := dumpSQL(context.Background(), db, "app", &out, opts, meta); err != nil {
+			t.Fatalf("dumpSQL with %d threads returned error: %v", threads, err)
+		}
+		if meta.Chunks["big"] != 3 {
+			t.Errorf("Expected 3 chunks recorded in metadata, got %v", meta.Chunks)
+		}
+		dump := out.String()
+		dumps = append(dumps, dump[:strings.Index(dump, "-- Dump completed on")])
+	}
+
+	dump := dumps[0]
+	for _, want := range []string{
+		"-- Chunk 1 of 3:  `id` < 5\n",
+		"INSERT INTO `big` (`id`) VALUES (1),(2),(3),(4);\n",
+		"-- Chunk 2 of 3:  `id` >= 5 AND `id` < 9\n",
+		"INSERT INTO `big` (`id`) VALUES (5),(6),(7),(8);\n",
+		"-- Chunk 3 of 3:  `id` >= 9\n",
+		"INSERT INTO `big` (`id`) VALUES (9),(10);\n",
+	} {
+		if !strings.Contains(dump, want) {
+			t.Errorf("Expected dump to contain %q, got:\n%s", want, dump)
+		}
+	}
+	if n := strings.Count(dump, "CREATE TABLE `big`"); n != 1 {
+		t.Errorf("Expected the table to be created once, got %d times", n)
+	}
+	if dumps[1] != dump {
+		t.Errorf("Parallel chunked dump differs from serial dump:\n%s", dumps[1])
+	}
+}
+
+func TestDumpDirectory_Chunks(t *testing.T) {
+	db, _ := newChunkedFakeDB(t)
+	var uploads memoryUpload
+	opts := dumpOptions{singleTransaction: true, maxAllowedPacket: defaultMaxAllowedPacket, threads: 2, chunkRows: 4}
+	keys, err := dumpDirectory(context.Background(), db, "app", "app-20240101T000000/", opts, &backupMetadata{}, uploads.upload, nil)
+	if err != nil {
+		t.Fatalf("dumpDirectory returned error: %v", err)
+	}
+
+	want := []string{
+		"app-20240101T000000/app.big-schema.sql",
+		"app-20240101T000000/app.big.00000.sql",
+		"app-20240101T000000/app.big.00001.sql",
+		"app-20240101T000000/app.big.00002.sql",
+	}
+	if !slices.Equal(keys, want) {
+		t.Fatalf("dumpDirectory() keys = %v, want %v", keys, want)
+	}
+	if last := uploads.files[want[3]]; !strings.Contains(last, "VALUES (9),(10);") {
+		t.Errorf("Unexpected last chunk:\n%s", last)
+	}
+}
+
+func TestChunkTable_Unsplittable(t *testing.T) {
+	tests := []struct {
+		name   string
+		keys   [][]any
+		bounds []any
+	}{
+		{name: "composite primary key", keys: [][]any{{"big", "PRIMARY", "a"}, {"big", "PRIMARY", "b"}}},
+		{name: "no primary key"},
+		{name: "string primary key", keys: [][]any{{"big", "PRIMARY", "id"}}, bounds: []any{"aaa", "zzz"}},
+		{name: "single key value", keys: [][]any{{"big", "PRIMARY", "id"}}, bounds: []any{"7", "7"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, server := newChunkedFakeDB(t)
+			server.on("SHOW KEYS FROM `big` WHERE Key_name = 'PRIMARY'", fakeResult{
+				columns: []string{"Table", "Key_name", "Column_name"},
+				types:   []string{"VARCHAR", "VARCHAR", "VARCHAR"},
+				rows:    tt.keys,
+			})
+			if tt.bounds != nil {
+				server.on("SELECT MIN(`id`) AS lower, MAX(`id`) AS upper FROM `big`", fakeResult{
+					columns: []string{"lower", "upper"},
+					types:   []string{"VARCHAR", "VARCHAR"},
+					rows:    [][]any{tt.bounds},
+				})
+			}
+
+			conn, err := db.Conn(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			d := &dumper{database: "app", opts: dumpOptions{chunkRows: 4}}
+			chunks, err := d.chunkTable(context.Background(), conn, "big")
+			if err != nil {
+				t.Fatalf("chunkTable returned error: %v", err)
+			}
+			if chunks != nil {
+				t.Errorf("Expected table not to be chunked, got %v", chunks)
+			}
+		})
+	}
+}
+
+func TestTablePartWhere(t *testing.T) {
+	c := &chunk{index: 1, count: 3, column: "id", lower: 5, upper: 9}
+	tests := []struct {
+		name string
+		part tablePart
+		want string
+	}{
+		{"whole table", tablePart{table: tableInfo{name: "t"}}, ""},
+		{"whole table with where", tablePart{table: tableInfo{name: "t", where: "a = 1"}}, "a = 1"},
+		{"chunk", tablePart{table: tableInfo{name: "t"}, chunk: c}, "`id` >= 5 AND `id` < 9"},
+		{"chunk with where", tablePart{table: tableInfo{name: "t", where: "a = 1 OR b = 2"}, chunk: c}, "(a = 1 OR b = 2) AND `id` >= 5 AND `id` < 9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.part.where(); got != tt.want {
+				t.Errorf("where() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOpenCheckpoint(t *testing.T) {
+	tests := []struct {
+		name        string
+		envVars     map[string]string
+		expectNil   bool
+		expectError bool
+	}{
+		{name: "no run id", envVars: map[string]string{}, expectNil: true},
+		{name: "run id", envVars: map[string]string{"DB_DUMP_RUN_ID": "nightly", "DB_DUMP_CHECKPOINT": "local"}},
+		{name: "slash in run id", envVars: map[string]string{"DB_DUMP_RUN_ID": "a/b"}, expectError: true},
+		{name: "unknown store", envVars: map[string]string{"DB_DUMP_RUN_ID": "nightly", "DB_DUMP_CHECKPOINT": "disk"}, expectError: true},
+		{name: "unknown resume mode", envVars: map[string]string{"DB_DUMP_RUN_ID": "nightly", "DB_DUMP_CHECKPOINT": "local", "DB_DUMP_RESUME": "tables"}, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DB_DUMP_PATH", t.TempDir())
+			for _, key := range []string{"DB_DUMP_RUN_ID", "DB_DUMP_CHECKPOINT", "DB_DUMP_RESUME"} {
+				t.Setenv(key, tt.envVars[key])
+			}
+
+			cp, err := openCheckpoint()
+			if tt.expectError {
+				if err == nil {
+					t.Error("Expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if (cp == nil) != tt.expectNil {
+				t.Errorf("openCheckpoint() = %v, want nil: %v", cp, tt.expectNil)
+			}
+		})
+	}
+}
+
+func TestCheckpoint_Resume(t *testing.T) {
+	t.Setenv("DB_DUMP_PATH", t.TempDir())
+	t.Setenv("DB_DUMP_RUN_ID", "nightly")
+	t.Setenv("DB_DUMP_CHECKPOINT", "local")
+	t.Setenv("DB_DUMP_RESUME", "")
+
+	first, err := openCheckpoint()
+	if err != nil {
+		t.Fatalf("openCheckpoint returned error: %v", err)
+	}
+	first.startDatabase("shop", "shop-20240101T000000")
+	first.completeDatabase("shop")
+	first.startDatabase("app", "app-20240101T000100")
+	first.partDone("app", "users", []string{"app-20240101T000100/app.users.sql"})
+	first.flush()
+
+	for _, tt := range []struct {
+		resume    string
+		keepParts bool
+	}{
+		{resume: "parts", keepParts: true},
+		{resume: "databases", keepParts: false},
+	} {
+		t.Run(tt.resume, func(t *testing.T) {
+			t.Setenv("DB_DUMP_RESUME", tt.resume)
+			cp, err := openCheckpoint()
+			if err != nil {
+				t.Fatalf("openCheckpoint returned error: %v", err)
+			}
+			if !cp.StartedAt.Equal(first.StartedAt) {
+				t.Errorf("Expected resumed run to keep its start time %v, got %v", first.StartedAt, cp.StartedAt)
+			}
+			if name, ok := cp.completed("shop"); !ok || name != "shop-20240101T000000" {
+				t.Errorf("completed(shop) = %q, %v", name, ok)
+			}
+			if _, ok := cp.completed("app"); ok {
+				t.Error("Expected interrupted database not to be completed")
+			}
+			if _, name := cp.startDatabase("app", "app-20240102T000000"); name != "app-20240101T000100" {
+				t.Errorf("Expected resumed database to keep its backup name, got %s", name)
+			}
+			if _, ok := cp.partKeys("app", "users"); ok != tt.keepParts {
+				t.Errorf("partKeys(app, users) found = %v, want %v", ok, tt.keepParts)
+			}
+		})
+	}
+
+	first.finish()
+	if _, err := os.Stat(first.localPath()); !os.IsNotExist(err) {
+		t.Errorf("Expected checkpoint to be removed, stat returned %v", err)
+	}
+}
+
+func TestCheckpoint_ConcurrentParts(t *testing.T) {
+	t.Setenv("DB_DUMP_PATH", t.TempDir())
+	cp := &checkpoint{
+		RunID:     "nightly",
+		Databases: make(map[string]*databaseCheckpoint),
+		local:     true,
+		resume:    resumeParts,
+	}
+	cp.startDatabase("app", "app-20240101T000000")
+
+	var wg sync.WaitGroup
+	for i := range 50 {
+		wg.Go(func() {
+			cp.partDone("app", fmt.Sprintf("t%02d", i), []string{fmt.Sprintf("app-20240101T000000/app.t%02d.sql", i)})
+		})
+	}
+	wg.Wait()
+	cp.flush()
+
+	saved, err := cp.load()
+	if err != nil || saved == nil {
+		t.Fatalf("load() = %v, %v", saved, err)
+	}
+	if parts := saved.Databases["app"].Parts; len(parts) != 50 {
+		t.Errorf("Expected the saved checkpoint to hold every part, got %d", len(parts))
+	}
+}
+
+func TestDumpDirectory_ResumeParts(t *testing.T) {
+	t.Setenv("DB_DUMP_PATH", t.TempDir())
+	db, server := newUsersFakeDB(t)
+	server.table("orders", "CREATE TABLE `orders` (`id` int)", []string{"id"}, []string{"INT"}, [][]any{{"7"}})
+	server.on("SHOW FULL TABLES", fakeResult{
+		columns: []string{"Tables_in_app", "Table_type"},
+		types:   []string{"VARCHAR", "VARCHAR"},
+		rows:    [][]any{{"orders", "BASE TABLE"}, {"users", "BASE TABLE"}},
+	})
+
+	cp := &checkpoint{
+		RunID:     "nightly",
+		Databases: make(map[string]*databaseCheckpoint),
+		local:     true,
+		resume:    resumeParts,
+	}
+	cp.startDatabase("app", "app-20240101T000000")
+	ordersKeys := []string{"app-20240101T000000/app.orders-schema.sql", "app-20240101T000000/app.orders.sql"}
+	cp.partDone("app", "orders", ordersKeys)
+
+	var uploads memoryUpload
+	meta := &backupMetadata{}
+	opts := dumpOptions{singleTransaction: true, maxAllowedPacket: defaultMaxAllowedPacket, threads: 1}
+	keys, err := dumpDirectory(context.Background(), db, "app", "app-20240101T000000/", opts, meta, uploads.upload, cp)
+	if err != nil {
+		t.Fatalf("dumpDirectory returned error: %v", err)
+	}
+
+	want := append(slices.Clone(ordersKeys), "app-20240101T000000/app.users-schema.sql", "app-20240101T000000/app.users.sql")
+	if !slices.Equal(keys, want) {
+		t.Errorf("dumpDirectory() keys = %v, want %v", keys, want)
+	}
+	if !slices.Equal(meta.ResumedFiles, ordersKeys) {
+		t.Errorf("Expected resumed files %v in metadata, got %v", ordersKeys, meta.ResumedFiles)
+	}
+	if slices.Contains(server.executed(), "SELECT `id` FROM `orders`") {
+		t.Error("Expected the resumed table not to be dumped again")
+	}
+	if _, ok := uploads.files["app-20240101T000000/app.orders.sql"]; ok {
+		t.Error("Expected the resumed table not to be uploaded again")
+	}
+	if _, ok := cp.partKeys("app", "users"); !ok {
+		t.Error("Expected the uploaded table to be recorded in the checkpoint")
+	}
+}
+
+// fakeBinlogStream replays events and then ends the stream.
+type fakeBinlogStream struct {
+	events []mybinlog.Event
+}
+
+func (f *fakeBinlogStream) ReadEvent() (mybinlog.Event, error) {
+	if len(f.events) == 0 {
+		return mybinlog.Event{}, io.EOF
+	}
+	e := f.events[0]
+	f.events = f.events[1:]
+	return e, nil
+}
+
+// binlogFile builds the events of one binlog file, starting at offset 4.
+// A rotate event is written with the name of the next file as its body.
+type binlogFile struct {
+	offset uint32
+	events []mybinlog.Event
+}
+
+func (f *binlogFile) add(eventType byte, body string) *binlogFile {
+	if f.offset == 0 {
+		f.offset = 4
+	}
+	if eventType == mybinlog.RotateEvent {
+		body = "\x04\x00\x00\x00\x00\x00\x00\x00" + body
+	}
+	raw := make([]byte, mybinlog.HeaderSize, mybinlog.HeaderSize+len(body))
+	raw[4] = eventType
+	raw = append(raw, body...)
+	f.offset += uint32(len(raw))
+	f.events = append(f.events, mybinlog.Event{Type: eventType, LogPos: f.offset, Raw: raw})
+	return f
+}
+
+func artificialRotate(file string) mybinlog.Event {
+	raw := append(make([]byte, mybinlog.HeaderSize), "\x04\x00\x00\x00\x00\x00\x00\x00"+file...)
+	raw[4] = mybinlog.RotateEvent
+	return mybinlog.Event{Type: mybinlog.RotateEvent, Flags: 0x20, Raw: raw}
+}
+
+func TestBinlogShipper(t *testing.T) {
+	first := (&binlogFile{}).add(mybinlog.FormatDescriptionEvent, "fde").add(2, "INSERT").add(mybinlog.RotateEvent, "mysql-bin.000008")
+	second := (&binlogFile{}).add(mybinlog.FormatDescriptionEvent, "fde").add(2, "UPDATE")
+	third := (&binlogFile{}).add(mybinlog.FormatDescriptionEvent, "fde")
+
+	var events []mybinlog.Event
+	events = append(events, artificialRotate("mysql-bin.000007"))
+	events = append(events, first.events...)
+	events = append(events, artificialRotate("mysql-bin.000008"))
+	events = append(events, second.events...)
+	events = append(events, mybinlog.Event{Type: mybinlog.HeartbeatEvent, Raw: make([]byte, mybinlog.HeaderSize)})
+	// The server restarted without writing a rotate event.
+	events = append(events, artificialRotate("mysql-bin.000009"))
+	events = append(events, third.events...)
+
+	var uploads memoryUpload
+	shipper := &binlogShipper{prefix: "binlogs/", dir: t.TempDir(), upload: uploads.upload}
+	err := shipper.run(&fakeBinlogStream{events: events}, "mysql-bin.000007")
+	if err == nil || !strings.Contains(err.Error(), "server ended the binlog stream in mysql-bin.000009") {
+		t.Fatalf("Expected the stream to end in mysql-bin.000009, got %v", err)
+	}
+
+	for name, file := range map[string]*binlogFile{"mysql-bin.000007": first, "mysql-bin.000008": second} {
+		want := string(mybinlog.FileHeader)
+		for _, e := range file.events {
+			want += string(e.Raw)
+		}
+		if got := uploads.files["binlogs/"+name]; got != want {
+			t.Errorf("Shipped %s = %q, want %q", name, got, want)
+		}
+	}
+	if _, ok := uploads.files["binlogs/mysql-bin.000009"]; ok {
+		t.Error("Expected the binlog still being written not to be shipped")
+	}
+	if leftovers, _ := os.ReadDir(shipper.dir); len(leftovers) != 0 {
+		t.Errorf("Expected local binlog copies to be removed, found %d", len(leftovers))
+	}
+}
+
+func TestBinlogShipper_OutOfSync(t *testing.T) {
+	file := (&binlogFile{}).add(mybinlog.FormatDescriptionEvent, "fde").add(2, "INSERT")
+	file.events[1].LogPos += 10
+
+	var uploads memoryUpload
+	shipper := &binlogShipper{prefix: "binlogs/", dir: t.TempDir(), upload: uploads.upload}
+	err := shipper.run(&fakeBinlogStream{events: file.events}, "mysql-bin.000001")
+	if err == nil || !strings.Contains(err.Error(), "out of sync") {
+		t.Errorf("Expected out of sync error, got %v", err)
+	}
+}
+
+func TestBinlogOptionsFromEnv(t *testing.T) {
+	tests := []struct {
+		name        string
+		envVars     map[string]string
+		expected    binlogOptions
+		expectError bool
+	}{
+		{
+			name:     "defaults",
+			envVars:  map[string]string{},
+			expected: binlogOptions{serverID: defaultBinlogServerID, prefix: "binlogs/", heartbeat: 30 * time.Second},
+		},
+		{
+			name: "all set",
+			envVars: map[string]string{
+				"DB_BINLOG_SERVER_ID":      "900",
+				"DB_BINLOG_PREFIX":         "prod/binlogs/",
+				"DB_BINLOG_HEARTBEAT":      "10s",
+				"DB_BINLOG_FLUSH_INTERVAL": "5m",
+				"DB_BINLOG_START_FILE":     "mysql-bin.000042",
+			},
+			expected: binlogOptions{serverID: 900, prefix: "prod/binlogs/", heartbeat: 10 * time.Second, flushInterval: 5 * time.Minute, startFile: "mysql-bin.000042"},
+		},
+		{name: "zero server id", envVars: map[string]string{"DB_BINLOG_SERVER_ID": "0"}, expectError: true},
+		{name: "server id too large", envVars: map[string]string{"DB_BINLOG_SERVER_ID": "4294967296"}, expectError: true},
+		{name: "invalid heartbeat", envVars: map[string]string{"DB_BINLOG_HEARTBEAT": "10"}, expectError: true},
+		{name: "invalid flush interval", envVars: map[string]string{"DB_BINLOG_FLUSH_INTERVAL": "100ms"}, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{"DB_BINLOG_SERVER_ID", "DB_BINLOG_PREFIX", "DB_BINLOG_HEARTBEAT", "DB_BINLOG_FLUSH_INTERVAL", "DB_BINLOG_START_FILE"} {
+				t.Setenv(key, tt.envVars[key])
+			}
+			opts, err := binlogOptionsFromEnv()
+			if tt.expectError {
+				if err == nil {
+					t.Error("Expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if opts != tt.expected {
+				t.Errorf("binlogOptionsFromEnv() = %+v, want %+v", opts, tt.expected)
+			}
+		})
+	}
+}
+
+func TestScriptScanner(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   []string
+	}{
+		{name: "statements", script: "SELECT 1;\nSELECT 2;\n", want: []string{"SELECT 1", "SELECT 2"}},
+		{name: "delimiters in quotes", script: "INSERT INTO t VALUES ('a;b','c\\';d'),(\"e;\");", want: []string{"INSERT INTO t VALUES ('a;b','c\\';d'),(\"e;\")"}},
+		{name: "line comments", script: "-- comment; here\nSELECT 1; # trailing; comment\nSELECT 1--1;\n", want: []string{"SELECT 1", "SELECT 1--1"}},
+		{name: "block comment", script: "/* block;\ncomment */ SELECT 1;", want: []string{"SELECT 1"}},
+		{name: "executable comment", script: "/*!40101 SET NAMES 'a;b' */;\n", want: []string{"/*!40101 SET NAMES 'a;b' */"}},
+		{name: "multi line statement", script: "CREATE TABLE `a;b` (\n  `id` int\n);\n", want: []string{"CREATE TABLE `a;b` (\n  `id` int\n)"}},
+		{
+			name:   "delimiter",
+			script: "DELIMITER ;;\nCREATE TRIGGER `t_bi` BEFORE INSERT ON `t` FOR EACH ROW BEGIN SET NEW.id = 1; END ;;\nDELIMITER ;\nSELECT 2;\n",
+			want:   []string{"CREATE TRIGGER `t_bi` BEFORE INSERT ON `t` FOR EACH ROW BEGIN SET NEW.id = 1; END", "SELECT 2"},
+		},
+		{name: "no final delimiter", script: "SELECT 1;\nSELECT 2", want: []string{"SELECT 1", "SELECT 2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scanner := newScriptScanner(strings.NewReader(tt.script))
+			var got []string
+			for {
+				stmt, err := scanner.next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("next returned error: %v", err)
+				}
+				got = append(got, stmt)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("statements = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRestoreOptionsFromArgs(t *testing.T) {
+	t.Setenv("DB_NAME", "app")
+	target := time.Date(2026, 10, 15, 13, 42, 0, 0, time.UTC)
+
+	opts, err := restoreOptionsFromArgs([]string{"--to-time", "2026-10-15T13:42:00Z", "--dry-run"})
+	if err != nil {
+		t.Fatalf("restoreOptionsFromArgs returned error: %v", err)
+	}
+	if opts.database != "app" || !opts.target.time.Equal(target) || opts.target.gtid != nil || !opts.dryRun {
+		t.Errorf("Unexpected options: %+v", opts)
+	}
+
+	opts, err = restoreOptionsFromArgs([]string{"--database", "shop", "--to-gtid", "0-1-100"})
+	if err != nil {
+		t.Fatalf("restoreOptionsFromArgs returned error: %v", err)
+	}
+	if opts.database != "shop" || opts.target.gtid == nil || opts.target.gtid.String() != "0-1-100" || !opts.target.time.IsZero() {
+		t.Errorf("Unexpected options: %+v", opts)
+	}
+
+	for _, args := range [][]string{
+		{},
+		{"--to-time", "yesterday"},
+		{"--to-gtid", "100"},
+		{"--to-time", "2026-10-15T13:42:00Z", "extra"},
+		{"--unknown"},
+	} {
+		if _, err := restoreOptionsFromArgs(args); err == nil {
+			t.Errorf("Expected restoreOptionsFromArgs(%q) to fail", args)
+		}
+	}
+}
+
+// restoreBucket builds the objects of a bucket holding backups of app, with
+// metadata readable through download.
+type restoreBucket struct {
+	objects  []mys3.Object
+	metadata map[string][]byte
+}
+
+func (b *restoreBucket) put(key string, modified time.Time) {
+	b.objects = append(b.objects, mys3.Object{Key: key, Size: 100, LastModified: modified})
+}
+
+func (b *restoreBucket) backup(name string, meta backupMetadata) {
+	data, _ := json.Marshal(meta)
+	b.metadata[name+".metadata.json"] = data
+	for _, key := range meta.Files {
+		b.put(key, meta.FinishedAt)
+	}
+	b.put(name+".metadata.json", meta.FinishedAt)
+}
+
+func (b *restoreBucket) download(key string) ([]byte, error) {
+	if data, ok := b.metadata[key]; ok {
+		return data, nil
+	}
+	return nil, mys3.ErrNotFound
+}
+
+func newRestoreBucket() *restoreBucket {
+	b := &restoreBucket{metadata: make(map[string][]byte)}
+	day := func(d, h int) time.Time { return time.Date(2026, 10, d, h, 0, 0, 0, time.UTC) }
+	full := func(started time.Time, file string, gtids string, files ...string) backupMetadata {
+		return backupMetadata{
+			Database: "app", Mode: modeFull, Format: formatSQL, StartedAt: started, FinishedAt: started.Add(time.Minute),
+			Binlog: &binlogCoordinates{File: file, Position: 154, GTIDSet: gtids, Flavor: "mariadb"}, Files: files,
+		}
+	}
+
+	b.backup("app-20261014T020000", full(day(14, 2), "mysql-bin.000003", "0-1-50", "app-20261014T020000.sql.gz"))
+	b.backup("app-20261015T020000", full(day(15, 2), "mysql-bin.000005", "0-1-80", "app-20261015T020000.sql.gz"))
+	data := full(day(15, 3), "mysql-bin.000005", "0-1-81", "app-20261015T030000.data.sql.gz")
+	data.Mode = modeData
+	b.backup("app-20261015T030000", data)
+	b.backup("app-20261015T140000", full(day(15, 14), "mysql-bin.000007", "0-1-120", "app-20261015T140000.sql.gz"))
+	b.backup("app-archive-20261015T120000", backupMetadata{Database: "app-archive", StartedAt: day(15, 12), Files: []string{"app-archive-20261015T120000.sql.gz"}})
+
+	for seq, modified := range map[int]time.Time{3: day(14, 8), 4: day(14, 20), 5: day(15, 8), 6: day(15, 13), 7: day(15, 14), 8: day(15, 15)} {
+		b.put(fmt.Sprintf("binlogs/mysql-bin.%06d.gz", seq), modified)
+	}
+	return b
+}
+
+func TestPlanRestore(t *testing.T) {
+	keys := func(objects []mys3.Object) []string {
+		var keys []string
+		for _, obj := range objects {
+			keys = append(keys, obj.Key)
+		}
+		return keys
+	}
+	at := time.Date(2026, 10, 15, 13, 42, 0, 0, time.UTC)
+
+	bucket := newRestoreBucket()
+	plan, err := planRestore("app", restoreTarget{time: at}, bucket.objects, "binlogs/", bucket.download)
+	if err != nil {
+		t.Fatalf("planRestore returned error: %v", err)
+	}
+	if plan.backup != "app-20261015T020000" {
+		t.Errorf("Expected the newest full backup before the target, got %s", plan.backup)
+	}
+	if got := keys(plan.files); !reflect.DeepEqual(got, []string{"app-20261015T020000.sql.gz"}) {
+		t.Errorf("files = %q", got)
+	}
+	// 000007 was shipped after the target and holds it, 000008 is not
+	// needed.
+	if got, want := keys(plan.binlogs), []string{"binlogs/mysql-bin.000005.gz", "binlogs/mysql-bin.000006.gz", "binlogs/mysql-bin.000007.gz"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("binlogs = %q, want %q", got, want)
+	}
+	if plan.binlogsEnd {
+		t.Error("Expected the shipped binlogs to reach past the target")
+	}
+
+	later, err := planRestore("app", restoreTarget{time: at.Add(48 * time.Hour)}, bucket.objects, "binlogs/", bucket.download)
+	if err != nil {
+		t.Fatalf("planRestore returned error: %v", err)
+	}
+	if later.backup != "app-20261015T140000" || !later.binlogsEnd || len(later.binlogs) != 2 {
+		t.Errorf("Expected the latest backup and all binlogs after it, got %s with %q", later.backup, keys(later.binlogs))
+	}
+
+	gtid, _ := mybinlog.ParseGTID("0-1-80")
+	byGTID, err := planRestore("app", restoreTarget{gtid: &gtid}, bucket.objects, "binlogs/", bucket.download)
+	if err != nil {
+		t.Fatalf("planRestore returned error: %v", err)
+	}
+	if byGTID.backup != "app-20261014T020000" {
+		t.Errorf("Expected the newest backup without GTID 0-1-80, got %s", byGTID.backup)
+	}
+
+	if _, err := planRestore("app", restoreTarget{time: at.Add(-72 * time.Hour)}, bucket.objects, "binlogs/", bucket.download); err == nil {
+		t.Error("Expected an error without a backup before the target")
+	}
+
+	gap := &restoreBucket{metadata: bucket.metadata}
+	for _, obj := range bucket.objects {
+		if obj.Key != "binlogs/mysql-bin.000006.gz" {
+			gap.objects = append(gap.objects, obj)
+		}
+	}
+	if _, err := planRestore("app", restoreTarget{time: at}, gap.objects, "binlogs/", gap.download); err == nil || !strings.Contains(err.Error(), "mysql-bin.000006 is missing") {
+		t.Errorf("Expected an error for the missing binlog, got %v", err)
+	}
+}
+
+// binlogBuilder writes a binlog file without checksums for restore tests.
+type binlogBuilder struct {
+	buf bytes.Buffer
+}
+
+func newBinlogBuilder() *binlogBuilder {
+	b := &binlogBuilder{}
+	b.buf.Write(mybinlog.FileHeader)
+	b.add(0, mybinlog.FormatDescriptionEvent, make([]byte, 98))
+	return b
+}
+
+// add appends an event and returns it.
+func (b *binlogBuilder) add(timestamp uint32, eventType byte, body []byte) []byte {
+	size := mybinlog.HeaderSize + len(body)
+	raw := binary.LittleEndian.AppendUint32(nil, timestamp)
+	raw = append(raw, eventType)
+	raw = binary.LittleEndian.AppendUint32(raw, 1)
+	raw = binary.LittleEndian.AppendUint32(raw, uint32(size))
+	raw = binary.LittleEndian.AppendUint32(raw, uint32(b.buf.Len()+size))
+	raw = binary.LittleEndian.AppendUint16(raw, 0)
+	raw = append(raw, body...)
+	b.buf.Write(raw)
+	return raw
+}
+
+func (b *binlogBuilder) pos() uint64 {
+	return uint64(b.buf.Len())
+}
+
+func (b *binlogBuilder) query(timestamp uint32, database, query string) []byte {
+	body := make([]byte, 8, 13+len(database)+1+len(query))
+	body = append(body, byte(len(database)), 0, 0, 0, 0)
+	body = append(body, database...)
+	body = append(body, 0)
+	return b.add(timestamp, mybinlog.QueryEvent, append(body, query...))
+}
+
+func (b *binlogBuilder) gtid(timestamp uint32, seq uint64) {
+	body := append([]byte{1}, bytes.Repeat([]byte{0x11}, 16)...)
+	body = binary.LittleEndian.AppendUint64(body, seq)
+	b.add(timestamp, mybinlog.GTIDEvent, append(body, make([]byte, 17)...))
+}
+
+// rowsTransaction adds a transaction writing a row to database.table with
+// the given table ID, and returns its table map and rows events.
+func (b *binlogBuilder) rowsTransaction(timestamp uint32, seq uint64, database, table string, id byte) []byte {
+	b.gtid(timestamp, seq)
+	b.query(timestamp, database, "BEGIN")
+	tableMap := []byte{id, 0, 0, 0, 0, 0, 1, 0, byte(len(database))}
+	tableMap = append(append(tableMap, database...), 0, byte(len(table)))
+	tableMap = append(append(tableMap, table...), 0, 1, 3, 0)
+	events := b.add(timestamp, mybinlog.TableMapEvent, tableMap)
+	events = append(events, b.add(timestamp, mybinlog.WriteRowsEvent, []byte{id, 0, 0, 0, 0, 0, 1, 0, 2, 0, 1, 0xfe, 7, 0, 0, 0})...)
+	b.add(timestamp, mybinlog.XIDEvent, make([]byte, 8))
+	return events
+}
+
+func replayBinlog(t *testing.T, b *binlogBuilder, start uint64, target restoreTarget) ([]string, error) {
+	t.Helper()
+	var executed []string
+	replayer := newBinlogReplayer("app", target, func(stmt string) error {
+		executed = append(executed, stmt)
+		return nil
+	})
+	events, err := mybinlog.NewReader(bytes.NewReader(b.buf.Bytes()))
+	if err != nil {
+		t.Fatalf("NewReader returned error: %v", err)
+	}
+	if err := replayer.replay(events, start); err != nil {
+		return executed, err
+	}
+	return executed, replayer.finish()
+}
+
+func TestBinlogReplayer(t *testing.T) {
+	b := newBinlogBuilder()
+	fde := binlogStatement(b.buf.Bytes()[len(mybinlog.FileHeader):])
+	b.rowsTransaction(1000, 1, "app", "users", 1)
+	start := b.pos()
+	b.rowsTransaction(1010, 2, "other", "logs", 2)
+	b.gtid(1020, 3)
+	b.query(1020, "app", "ALTER TABLE users ADD c int")
+	rows := b.rowsTransaction(1030, 4, "app", "users", 1)
+	b.rowsTransaction(1100, 5, "app", "users", 1)
+
+	executed, err := replayBinlog(t, b, start, restoreTarget{time: time.Unix(1050, 0)})
+	if err != nil {
+		t.Fatalf("replay returned error: %v", err)
+	}
+	want := []string{
+		fde,
+		"USE `app`",
+		"SET @@session.timestamp=1020",
+		"ALTER TABLE users ADD c int",
+		"BEGIN",
+		binlogStatement(rows),
+		"COMMIT",
+	}
+	if !reflect.DeepEqual(executed, want) {
+		t.Errorf("executed:\n%q\nwant:\n%q", executed, want)
+	}
+
+	gtid, _ := mybinlog.ParseGTID("11111111-1111-1111-1111-111111111111:3")
+	executed, err = replayBinlog(t, b, start, restoreTarget{gtid: &gtid})
+	if err != nil {
+		t.Fatalf("replay returned error: %v", err)
+	}
+	if len(executed) != 4 || executed[3] != "ALTER TABLE users ADD c int" {
+		t.Errorf("Expected the replay to stop after GTID %s, executed %q", gtid, executed)
+	}
+
+	missing, _ := mybinlog.ParseGTID("11111111-1111-1111-1111-111111111111:9")
+	if _, err := replayBinlog(t, b, start, restoreTarget{gtid: &missing}); err == nil {
+		t.Error("Expected an error for a GTID that is not in the binlogs")
+	}
+}
+
+func TestBinlogReplayer_UnsupportedEvent(t *testing.T) {
+	b := newBinlogBuilder()
+	b.gtid(1000, 1)
+	b.add(1000, 40, make([]byte, 20)) // compressed transaction payload
+
+	if _, err := replayBinlog(t, b, 4, restoreTarget{time: time.Unix(2000, 0)}); err == nil || !strings.Contains(err.Error(), "type 40") {
+		t.Errorf("Expected an error for an event that cannot be replayed, got %v", err)
+	}
+}
+
+func TestRestoreInto(t *testing.T) {
+	source, _ := newUsersFakeDB(t)
+	var dump bytes.Buffer
+	gz := gzip.NewWriter(&dump)
+	opts := dumpOptions{singleTransaction: true, maxAllowedPacket: defaultMaxAllowedPacket, views: true}
+	if err := dumpSQL(context.Background(), source, "app", gz, opts, &backupMetadata{}); err != nil {
+		t.Fatalf("dumpSQL returned error: %v", err)
+	}
+	gz.Close()
+
+	b := newBinlogBuilder()
+	start := b.pos()
+	rows := b.rowsTransaction(1000, 1, "app", "users", 1)
+
+	objects := map[string][]byte{
+		"app-20261015T020000.sql.gz": dump.Bytes(),
+		"binlogs/mysql-bin.000001":   b.buf.Bytes(),
+	}
+	open := func(key string) (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(objects[key])), nil
+	}
+	plan := &restorePlan{
+		database: "app",
+		target:   restoreTarget{time: time.Unix(2000, 0)},
+		meta:     &backupMetadata{Binlog: &binlogCoordinates{File: "mysql-bin.000001", Position: start}},
+		files:    []mys3.Object{{Key: "app-20261015T020000.sql.gz"}},
+		binlogs:  []mys3.Object{{Key: "binlogs/mysql-bin.000001"}},
+	}
+
+	target, server := newFakeDB(t)
+	if err := restoreInto(context.Background(), target, plan, open); err != nil {
+		t.Fatalf("restoreInto returned error: %v", err)
+	}
+	executed := server.executed()
+
+	if executed[0] != "CREATE DATABASE IF NOT EXISTS `app`" || executed[1] != "USE `app`" {
+		t.Errorf("Expected the database to be created and used first, executed %q", executed[:2])
+	}
+	for _, want := range []string{
+		"CREATE TABLE `users` (`id` int NOT NULL, `name` varchar(64), `avatar` blob, PRIMARY KEY (`id`))",
+		"INSERT INTO `users` (`id`,`name`,`avatar`) VALUES (1,'O\\'Brien\\n',0x01ff),(2,NULL,'')",
+		"/*!40101 SET SQL_MODE=@OLD_SQL_MODE */",
+	} {
+		if !slices.Contains(executed, want) {
+			t.Errorf("Expected %q to be executed, executed:\n%s", want, strings.Join(executed, "\n"))
+		}
+	}
+	for _, stmt := range executed {
+		if strings.HasPrefix(stmt, "--") {
+			t.Errorf("Comment executed as a statement: %q", stmt)
+		}
+	}
+	if got := executed[len(executed)-3:]; !reflect.DeepEqual(got, []string{"BEGIN", binlogStatement(rows), "COMMIT"}) {
+		t.Errorf("Expected the binlog transaction to be replayed last, got %q", got)
+	}
+}
+
+func TestSourceFromEnv(t *testing.T) {
+	tests := []struct {
+		engine      string
+		expected    string
+		expectError bool
+	}{
+		{engine: "", expected: "*mydump.mysqlSource"},
+		{engine: "mariadb", expected: "*mydump.mysqlSource"},
+		{engine: "postgres", expected: "*mydump.postgresSource"},
+		{engine: "postgresql", expected: "*mydump.postgresSource"},
+		{engine: "sqlite", expected: "*mydump.sqliteSource"},
+		{engine: "redis", expected: "*mydump.redisSource"},
+		{engine: "exec", expected: "*mydump.execSource"},
+		{engine: "oracle", expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.engine, func(t *testing.T) {
+			t.Setenv("DB_ENGINE", tt.engine)
+			t.Setenv("DB_DUMP_FORMAT", "")
+			t.Setenv("DB_DUMP_MODE", "")
+			t.Setenv("DB_SQLITE_METHOD", "")
+			t.Setenv("DB_EXEC_COMMAND", "mongodump --archive")
+			t.Setenv("DB_REDIS_INSTANCES", "")
+			src, err := sourceFromEnv(mysql.Config{})
+			if tt.expectError {
+				if err == nil {
+					t.Error("Expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if got := fmt.Sprintf("%T", src); got != tt.expected {
+				t.Errorf("sourceFromEnv() = %s, want %s", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestPostgresSourceFromEnv(t *testing.T) {
+	tests := []struct {
+		name        string
+		envVars     map[string]string
+		expected    postgresSource
+		expectError bool
+	}{
+		{
+			name:     "defaults",
+			envVars:  map[string]string{"DB_HOST": "db"},
+			expected: postgresSource{host: "db", port: "5432", mode: modeFull, format: formatSQL},
+		},
+		{
+			name: "all set",
+			envVars: map[string]string{
+				"DB_HOST":        "db",
+				"DB_PORT":        "6432",
+				"DB_USER":        "backup",
+				"DB_PASSWORD":    "secret",
+				"DB_DUMP_MODE":   "schema",
+				"DB_DUMP_FORMAT": "custom",
+			},
+			expected: postgresSource{host: "db", port: "6432", user: "backup", password: "secret", mode: modeSchema, format: formatCustom},
+		},
+		{name: "directory format", envVars: map[string]string{"DB_DUMP_FORMAT": "directory"}, expectError: true},
+		{name: "unknown mode", envVars: map[string]string{"DB_DUMP_MODE": "structure"}, expectError: true},
+		{name: "masking rules", envVars: map[string]string{"DB_MASK_RULES_FILE": "/etc/s3dbdump/mask.rules"}, expectError: true},
+		{name: "table filter", envVars: map[string]string{"DB_EXCLUDE_TABLES": "app.logs"}, expectError: true},
+		{name: "deterministic off", envVars: map[string]string{"DB_DUMP_DETERMINISTIC": "0"}, expected: postgresSource{port: "5432", mode: modeFull, format: formatSQL}},
+		{name: "threads", envVars: map[string]string{"DB_DUMP_THREADS": "4"}, expectError: true},
+		{name: "master data", envVars: map[string]string{"DB_DUMP_MASTER_DATA": "1"}, expectError: true},
+		{name: "views off", envVars: map[string]string{"DB_DUMP_VIEWS": "0"}, expectError: true},
+		{name: "parquet row groups", envVars: map[string]string{"DB_DUMP_PARQUET_ROW_GROUP_MB": "128"}, expectError: true},
+		{name: "defaults of mysql options", envVars: map[string]string{"DB_DUMP_THREADS": "1", "DB_DUMP_VIEWS": "1", "DB_DUMP_CSV_BINARY": "hex"}, expected: postgresSource{port: "5432", mode: modeFull, format: formatSQL}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range slices.AppendSeq([]string{"DB_HOST", "DB_PORT", "DB_USER", "DB_PASSWORD", "DB_DUMP_MODE", "DB_DUMP_FORMAT"}, maps.Keys(mysqlOnlyEnv)) {
+				t.Setenv(key, tt.envVars[key])
+			}
+			src, err := postgresSourceFromEnv()
+			if tt.expectError {
+				if err == nil {
+					t.Error("Expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if *src != tt.expected {
+				t.Errorf("postgresSourceFromEnv() = %+v, want %+v", *src, tt.expected)
+			}
+		})
+	}
+}
+
+func TestPostgresSourceDumpArgs(t *testing.T) {
+	tests := []struct {
+		mode      dumpMode
+		format    dumpFormat
+		expected  []string
+		extension string
+	}{
+		{modeFull, formatSQL, []string{"--no-password", "--format=plain"}, ".sql"},
+		{modeSchema, formatSQL, []string{"--no-password", "--format=plain", "--schema-only"}, ".sql"},
+		{modeData, formatCustom, []string{"--no-password", "--format=custom", "--compress=0", "--data-only"}, ".dump"},
+	}
+
+	for _, tt := range tests {
+		src := &postgresSource{mode: tt.mode, format: tt.format}
+		if got := src.dumpArgs(); !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("dumpArgs() for %s %s = %q, want %q", tt.mode, tt.format, got, tt.expected)
+		}
+		if got := src.extension(); got != tt.extension {
+			t.Errorf("extension() for %s = %q, want %q", tt.format, got, tt.extension)
+		}
+	}
+}
+
+// fakeCommand puts a shell script called name first on the PATH.
+func fakeCommand(t *testing.T, name, script string) {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "bin")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestPostgresSource(t *testing.T) {
+	fakeCommand(t, "pg_dump", `echo "-- $PGUSER@$PGHOST:$PGPORT/$PGDATABASE password $PGPASSWORD: $*"; echo "pg_dump: warning: something to note" >&2`)
+	fakeCommand(t, "psql", `printf 'app\nshop\n'`)
+	t.Setenv("DB_NAME", "")
+
+	src := &postgresSource{host: "db", port: "5432", user: "backup", password: "secret", mode: modeFull, format: formatSQL}
+	databases, err := src.databases(context.Background())
+	if err != nil {
+		t.Fatalf("databases() error: %v", err)
+	}
+	if !reflect.DeepEqual(databases, []string{"app", "shop"}) {
+		t.Errorf("databases() = %q, want [app shop]", databases)
+	}
+
+	var out bytes.Buffer
+	if err := src.dump(context.Background(), "app", &out); err != nil {
+		t.Fatalf("dump() error: %v", err)
+	}
+	expected := "-- backup@db:5432/app password secret: --no-password --format=plain\n"
+	if out.String() != expected {
+		t.Errorf("dump() wrote %q, want %q", out.String(), expected)
+	}
+}
+
+func TestPostgresSource_Failure(t *testing.T) {
+	fakeCommand(t, "pg_dump", `echo "partial"; echo 'pg_dump: error: connection to server failed' >&2; exit 1`)
+
+	src := &postgresSource{port: "5432", mode: modeFull, format: formatSQL}
+	err := src.dump(context.Background(), "app", io.Discard)
+	if err == nil {
+		t.Fatal("Expected error, got nil")
+	}
+	if !strings.Contains(err.Error(), "exit status 1") || !strings.Contains(err.Error(), "connection to server failed") {
+		t.Errorf("Expected the exit status and stderr in the error, got %v", err)
+	}
+}
+
+func TestSQLiteSourceFromEnv(t *testing.T) {
+	tests := []struct {
+		name        string
+		envVars     map[string]string
+		expected    sqliteSource
+		expectError bool
+	}{
+		{name: "defaults", envVars: map[string]string{}, expected: sqliteSource{method: sqliteBackup}},
+		{
+			name:     "vacuum",
+			envVars:  map[string]string{"DB_SQLITE_DIR": "/data", "DB_SQLITE_METHOD": "vacuum", "DB_DUMP_MODE": "full"},
+			expected: sqliteSource{dir: "/data", method: sqliteVacuum},
+		},
+		{name: "unknown method", envVars: map[string]string{"DB_SQLITE_METHOD": "copy"}, expectError: true},
+		{name: "schema mode", envVars: map[string]string{"DB_DUMP_MODE": "schema"}, expectError: true},
+		{name: "directory format", envVars: map[string]string{"DB_DUMP_FORMAT": "directory"}, expectError: true},
+		{name: "row filter", envVars: map[string]string{"DB_TABLE_WHERE": "app.users=id > 10"}, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range slices.AppendSeq([]string{"DB_SQLITE_DIR", "DB_SQLITE_METHOD", "DB_DUMP_MODE", "DB_DUMP_FORMAT"}, maps.Keys(mysqlOnlyEnv)) {
+				t.Setenv(key, tt.envVars[key])
+			}
+			src, err := sqliteSourceFromEnv()
+			if tt.expectError {
+				if err == nil {
+					t.Error("Expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if *src != tt.expected {
+				t.Errorf("sqliteSourceFromEnv() = %+v, want %+v", *src, tt.expected)
+			}
+		})
+	}
+}
+
+func TestSQLiteSource(t *testing.T) {
+	dir := t.TempDir()
+	db, err := sql.Open("sqlite", filepath.Join(dir, "app.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, stmt := range []string{
+		"PRAGMA journal_mode=WAL",
+		"CREATE TABLE items (id INTEGER PRIMARY KEY, name TEXT)",
+		"INSERT INTO items (name) VALUES ('a'), ('b')",
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+	// A write in progress is not part of the copy.
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("INSERT INTO items (name) VALUES ('uncommitted')"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not a database"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, method := range []string{sqliteBackup, sqliteVacuum} {
+		t.Run(method, func(t *testing.T) {
+			src := &sqliteSource{dir: dir, method: method}
+			databases, err := src.databases(context.Background())
+			if err != nil {
+				t.Fatalf("databases() error: %v", err)
+			}
+			if !reflect.DeepEqual(databases, []string{"app.db"}) {
+				t.Errorf("databases() = %q, want [app.db]", databases)
+			}
+
+			dst := filepath.Join(t.TempDir(), "copy.db")
+			version, err := src.copy(context.Background(), "app.db", dst)
+			if err != nil {
+				t.Fatalf("copy() error: %v", err)
+			}
+			if version == "" {
+				t.Error("Expected the SQLite version")
+			}
+
+			copied, err := sql.Open("sqlite", dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer copied.Close()
+			var n int
+			if err := copied.QueryRow("SELECT count(*) FROM items").Scan(&n); err != nil {
+				t.Fatalf("Error reading copy: %v", err)
+			}
+			if n != 2 {
+				t.Errorf("Expected the 2 committed rows in the copy, got %d", n)
+			}
+		})
+	}
+
+	if _, err := (&sqliteSource{dir: dir}).copy(context.Background(), "notes.txt", filepath.Join(t.TempDir(), "copy.db")); err == nil {
+		t.Error("Expected an error copying a file that is not a SQLite database")
+	}
+}
+
+func TestSplitCommand(t *testing.T) {
+	tests := []struct {
+		command     string
+		expected    []string
+		expectError bool
+	}{
+		{command: "mongodump --archive --gzip=false", expected: []string{"mongodump", "--archive", "--gzip=false"}},
+		{command: "  redis-cli\t--rdb -  ", expected: []string{"redis-cli", "--rdb", "-"}},
+		{command: `sh -c 'pg_dump "$DB_NAME" | head'`, expected: []string{"sh", "-c", `pg_dump "$DB_NAME" | head`}},
+		{command: `echo "a \"b\" \$c" d\ e ''`, expected: []string{"echo", `a "b" $c`, "d e", ""}},
+		{command: "", expectError: true},
+		{command: "sh -c 'unterminated", expectError: true},
+		{command: `trailing\`, expectError: true},
+	}
+
+	for _, tt := range tests {
+		args, err := splitCommand(tt.command)
+		if tt.expectError {
+			if err == nil {
+				t.Errorf("splitCommand(%q) expected error, got %q", tt.command, args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("splitCommand(%q) error: %v", tt.command, err)
+			continue
+		}
+		if !reflect.DeepEqual(args, tt.expected) {
+			t.Errorf("splitCommand(%q) = %q, want %q", tt.command, args, tt.expected)
+		}
+	}
+}
+
+func TestStderrLog(t *testing.T) {
+	l := &stderrLog{name: "cmd"}
+	for i := 0; i < stderrTailLines+2; i++ {
+		fmt.Fprintf(l, "line %d\n", i)
+	}
+	l.Write([]byte("progress 10%\rprogress 20%\r\n\nunterminated"))
+	l.flush()
+
+	if len(l.tail) != stderrTailLines {
+		t.Fatalf("Expected the last %d lines, got %q", stderrTailLines, l.tail)
+	}
+	if got := l.tail[len(l.tail)-3:]; !reflect.DeepEqual(got, []string{"progress 10%", "progress 20%", "unterminated"}) {
+		t.Errorf("Expected carriage returns to end lines and the rest to be flushed, got %q", got)
+	}
+}
+
+func TestExecSourceFromEnv(t *testing.T) {
+	tests := []struct {
+		name        string
+		envVars     map[string]string
+		expected    *execSource
+		expectError bool
+	}{
+		{
+			name:     "defaults",
+			envVars:  map[string]string{"DB_EXEC_COMMAND": "mongodump --archive"},
+			expected: &execSource{command: []string{"mongodump", "--archive"}, extension: "dump"},
+		},
+		{
+			name:     "extension",
+			envVars:  map[string]string{"DB_EXEC_COMMAND": "redis-cli --rdb -", "DB_EXEC_EXTENSION": ".rdb"},
+			expected: &execSource{command: []string{"redis-cli", "--rdb", "-"}, extension: "rdb"},
+		},
+		{name: "no command", envVars: map[string]string{}, expectError: true},
+		{name: "invalid extension", envVars: map[string]string{"DB_EXEC_COMMAND": "true", "DB_EXEC_EXTENSION": "a/b"}, expectError: true},
+		{name: "schema mode", envVars: map[string]string{"DB_EXEC_COMMAND": "true", "DB_DUMP_MODE": "schema"}, expectError: true},
+		{name: "chunk rows", envVars: map[string]string{"DB_EXEC_COMMAND": "true", "DB_DUMP_CHUNK_ROWS": "1000"}, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range slices.AppendSeq([]string{"DB_EXEC_COMMAND", "DB_EXEC_EXTENSION", "DB_DUMP_MODE", "DB_DUMP_FORMAT"}, maps.Keys(mysqlOnlyEnv)) {
+				t.Setenv(key, tt.envVars[key])
+			}
+			src, err := execSourceFromEnv()
+			if tt.expectError {
+				if err == nil {
+					t.Error("Expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(src, tt.expected) {
+				t.Errorf("execSourceFromEnv() = %+v, want %+v", src, tt.expected)
+			}
+		})
+	}
+}
+
+func TestExecSource(t *testing.T) {
+	fakeCommand(t, "dumper", `echo "dump of $DB_NAME: $*"; echo "dumper: 2 collections" >&2`)
+	fakeCommand(t, "failing", `echo "partial"; echo "failing: authentication failed" >&2; exit 3`)
+
+	src := &execSource{command: []string{"dumper", "--archive"}, extension: "dump"}
+	if err := src.ping(context.Background()); err != nil {
+		t.Errorf("ping() error: %v", err)
+	}
+	var out bytes.Buffer
+	if err := src.dump(context.Background(), "catalog", &out); err != nil {
+		t.Fatalf("dump() error: %v", err)
+	}
+	if out.String() != "dump of catalog: --archive\n" {
+		t.Errorf("dump() wrote %q", out.String())
+	}
+
+	failing := &execSource{command: []string{"failing"}, extension: "dump"}
+	err := failing.dump(context.Background(), "catalog", io.Discard)
+	if err == nil || !strings.Contains(err.Error(), "exit status 3") || !strings.Contains(err.Error(), "authentication failed") {
+		t.Errorf("Expected the exit status and stderr in the error, got %v", err)
+	}
+
+	missing := &execSource{command: []string{"no-such-dumper"}}
+	if err := missing.ping(context.Background()); err == nil {
+		t.Error("Expected ping to fail for a missing command")
+	}
+}
+
+func TestRedisSourceFromEnv(t *testing.T) {
+	tests := []struct {
+		name        string
+		envVars     map[string]string
+		expected    *redisSource
+		expectError bool
+	}{
+		{
+			name:     "defaults",
+			envVars:  map[string]string{"DB_HOST": "redis"},
+			expected: &redisSource{addr: "redis:6379", instances: map[string]string{}},
+		},
+		{
+			name: "instances",
+			envVars: map[string]string{
+				"DB_HOST":            "redis",
+				"DB_PORT":            "6380",
+				"DB_PASSWORD":        "secret",
+				"DB_REDIS_INSTANCES": "cache=redis-cache:6379, sessions = redis-sessions",
+			},
+			expected: &redisSource{
+				addr:      "redis:6380",
+				password:  "secret",
+				instances: map[string]string{"cache": "redis-cache:6379", "sessions": "redis-sessions:6379"},
+				names:     []string{"cache", "sessions"},
+			},
+		},
+		{name: "missing address", envVars: map[string]string{"DB_REDIS_INSTANCES": "cache"}, expectError: true},
+		{name: "duplicate name", envVars: map[string]string{"DB_REDIS_INSTANCES": "cache=a:6379,cache=b:6379"}, expectError: true},
+		{name: "schema mode", envVars: map[string]string{"DB_DUMP_MODE": "schema"}, expectError: true},
+		{name: "deterministic", envVars: map[string]string{"DB_HOST": "redis", "DB_DUMP_DETERMINISTIC": "1"}, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range slices.AppendSeq([]string{"DB_HOST", "DB_PORT", "DB_USER", "DB_PASSWORD", "DB_REDIS_INSTANCES", "DB_DUMP_MODE", "DB_DUMP_FORMAT"}, maps.Keys(mysqlOnlyEnv)) {
+				t.Setenv(key, tt.envVars[key])
+			}
+			src, err := redisSourceFromEnv()
+			if tt.expectError {
+				if err == nil {
+					t.Error("Expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(src, tt.expected) {
+				t.Errorf("redisSourceFromEnv() = %+v, want %+v", src, tt.expected)
+			}
+			if tt.expected.names != nil && src.address("sessions") != "redis-sessions:6379" {
+				t.Errorf("address(sessions) = %s", src.address("sessions"))
+			}
+		})
+	}
+}
+
+func TestDumpDirectory_Delimited(t *testing.T) {
+	tests := []struct {
+		format    dumpFormat
+		delimited delimitedOptions
+		expected  string
+	}{
+		{
+			format: formatCSV,
+			expected: "id,payload,note,data\r\n" +
+				"1,\"{\"\"k\"\": \"\"a,b\"\", \"\"p\"\": \"\"C:\\\\dir\"\"}\",\"\",01ff\r\n" +
+				"2,,\"tab\there\nline\",\r\n",
+		},
+		{
+			format:    formatCSV,
+			delimited: delimitedOptions{null: "NULL"},
+			expected: "id,payload,note,data\r\n" +
+				"1,\"{\"\"k\"\": \"\"a,b\"\", \"\"p\"\": \"\"C:\\\\dir\"\"}\",,01ff\r\n" +
+				"2,NULL,\"tab\there\nline\",NULL\r\n",
+		},
+		{
+			format:    formatTSV,
+			delimited: delimitedOptions{null: `\N`, base64: true},
+			expected: "id\tpayload\tnote\tdata\n" +
+				"1\t{\"k\": \"a,b\", \"p\": \"C:\\\\\\\\dir\"}\t\tAf8=\n" +
+				"2\t\\N\ttab\\there\\nline\t\\N\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.format)+" "+tt.delimited.null, func(t *testing.T) {
+			db, server := newFakeDB(t)
+			server.on("SHOW FULL TABLES", fakeResult{
+				columns: []string{"Tables_in_app", "Table_type"},
+				types:   []string{"VARCHAR", "VARCHAR"},
+				rows:    [][]any{{"events", "BASE TABLE"}},
+			})
+			server.table("events", "CREATE TABLE `events` (`id` int, `payload` json, `note` text, `data` blob)",
+				[]string{"id", "payload", "note", "data"},
+				[]string{"INT", "JSON", "TEXT", "BLOB"},
+				[][]any{
+					{"1", `{"k": "a,b", "p": "C:\\dir"}`, "", []byte{0x01, 0xff}},
+					{"2", nil, "tab\there\nline", nil},
+				},
+			)
+
+			var uploads memoryUpload
+			opts := dumpOptions{singleTransaction: true, maxAllowedPacket: defaultMaxAllowedPacket, threads: 1, format: tt.format, delimited: tt.delimited}
+			keys, err := dumpDirectory(context.Background(), db, "app", "app-20240101T000000/", opts, &backupMetadata{}, uploads.upload, nil)
+			if err != nil {
+				t.Fatalf("dumpDirectory returned error: %v", err)
+			}
+			dataKey := "app-20240101T000000/app.events." + string(tt.format)
+			if want := []string{"app-20240101T000000/app.events-schema.sql", dataKey}; !slices.Equal(keys, want) {
+				t.Fatalf("dumpDirectory() keys = %v, want %v", keys, want)
+			}
+			if got := uploads.files[dataKey]; got != tt.expected {
+				t.Errorf("%s file =\n%q\nwant\n%q", tt.format, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestDelimitedOptionsFromEnv(t *testing.T) {
+	tests := []struct {
+		name        string
+		format      dumpFormat
+		envVars     map[string]string
+		expected    delimitedOptions
+		expectError bool
+	}{
+		{name: "csv defaults", format: formatCSV, expected: delimitedOptions{}},
+		{name: "tsv defaults", format: formatTSV, expected: delimitedOptions{null: `\N`}},
+		{name: "empty null for tsv", format: formatTSV, envVars: map[string]string{"DB_DUMP_CSV_NULL": ""}, expected: delimitedOptions{}},
+		{name: "base64", format: formatCSV, envVars: map[string]string{"DB_DUMP_CSV_NULL": "NULL", "DB_DUMP_CSV_BINARY": "base64"}, expected: delimitedOptions{null: "NULL", base64: true}},
+		{name: "null with separator", format: formatCSV, envVars: map[string]string{"DB_DUMP_CSV_NULL": "a,b"}, expectError: true},
+		{name: "unknown binary encoding", format: formatCSV, envVars: map[string]string{"DB_DUMP_CSV_BINARY": "raw"}, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{"DB_DUMP_CSV_NULL", "DB_DUMP_CSV_BINARY"} {
+				if v, ok := tt.envVars[key]; ok {
+					t.Setenv(key, v)
+				} else {
+					t.Setenv(key, "")
+					os.Unsetenv(key)
+				}
+			}
+			opts, err := delimitedOptionsFromEnv(tt.format)
+			if tt.expectError {
+				if err == nil {
+					t.Error("Expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if opts != tt.expected {
+				t.Errorf("delimitedOptionsFromEnv() = %+v, want %+v", opts, tt.expected)
+			}
+		})
+	}
+}
+
+func TestDumpDirectory_Parquet(t *testing.T) {
+	db, server := newFakeDB(t)
+	server.on("SHOW FULL TABLES", fakeResult{
+		columns: []string{"Tables_in_app", "Table_type"},
+		types:   []string{"VARCHAR", "VARCHAR"},
+		rows:    [][]any{{"orders", "BASE TABLE"}},
+	})
+	server.table("orders", "CREATE TABLE `orders` (`id` int, `total` decimal(10,2), `placed` datetime, `shipped` date, `items` json, `status` enum('new','paid'))",
+		[]string{"id", "total", "placed", "shipped", "items", "status"},
+		[]string{"INT", "DECIMAL(10,2)", "DATETIME", "DATE", "JSON", "ENUM"},
+		[][]any{
+			{"1", "-12.50", "2024-01-01 12:00:00.5", "2024-01-02", `[{"sku": 1}]`, "paid"},
+			{"2", nil, "2024-01-01 13:00:00", "0000-00-00", nil, "new"},
+		},
+	)
+
+	var uploads memoryUpload
+	opts := dumpOptions{singleTransaction: true, maxAllowedPacket: defaultMaxAllowedPacket, threads: 1, format: formatParquet, parquet: parquetOptions{gzip: true}}
+	meta := &backupMetadata{StartedAt: time.Date(2024, 1, 1, 2, 0, 0, 0, time.UTC)}
+	keys, err := dumpDirectory(context.Background(), db, "app", "sanitized/app-20240101T020000/", opts, meta, uploads.upload, nil)
+	if err != nil {
+		t.Fatalf("dumpDirectory returned error: %v", err)
+	}
+	dataKey := "sanitized/db=app/table=orders/dt=2024-01-01/app-20240101T020000.parquet"
+	if want := []string{"sanitized/app-20240101T020000/app.orders-schema.sql", dataKey}; !slices.Equal(keys, want) {
+		t.Fatalf("dumpDirectory() keys = %v, want %v", keys, want)
+	}
+	data := uploads.files[dataKey]
+	if !strings.HasPrefix(data, "PAR1") || !strings.HasSuffix(data, "PAR1") {
+		t.Errorf("Expected a Parquet file, got %q", data)
+	}
+	for _, column := range []string{"id", "total", "placed", "shipped", "items", "status"} {
+		if !strings.Contains(data, column) {
+			t.Errorf("Expected column %s in the schema of the file", column)
+		}
+	}
+	if !slices.Contains(server.executed(), "SET time_zone = '+00:00'") {
+		t.Errorf("Expected TIMESTAMP values to be read in UTC, got statements %v", server.executed())
+	}
+}
+
+func TestParquetColumnOf(t *testing.T) {
+	tests := []struct {
+		typeName string
+		expected parquetColumn
+	}{
+		{"TINYINT", parquetColumn{myparquet.Column{Type: myparquet.Int32, Logical: myparquet.Integer, BitWidth: 8, Signed: true}, convertInt}},
+		{"UNSIGNED INT", parquetColumn{myparquet.Column{Type: myparquet.Int64, Logical: myparquet.Integer, BitWidth: 64, Signed: true}, convertInt}},
+		{"UNSIGNED BIGINT", parquetColumn{myparquet.Column{Type: myparquet.FixedLenByteArray, Length: 9, Logical: myparquet.Decimal, Precision: 20}, convertDecimal}},
+		{"DECIMAL(9,2)", parquetColumn{myparquet.Column{Type: myparquet.Int32, Logical: myparquet.Decimal, Precision: 9, Scale: 2}, convertDecimal}},
+		{"DECIMAL(18,4)", parquetColumn{myparquet.Column{Type: myparquet.Int64, Logical: myparquet.Decimal, Precision: 18, Scale: 4}, convertDecimal}},
+		{"DECIMAL(65,30)", parquetColumn{myparquet.Column{Type: myparquet.FixedLenByteArray, Length: 28, Logical: myparquet.Decimal, Precision: 65, Scale: 30}, convertDecimal}},
+		{"DOUBLE", parquetColumn{myparquet.Column{Type: myparquet.Double}, convertFloat}},
+		{"DATE", parquetColumn{myparquet.Column{Type: myparquet.Int32, Logical: myparquet.Date}, convertDate}},
+		{"DATETIME", parquetColumn{myparquet.Column{Type: myparquet.Int64, Logical: myparquet.Timestamp}, convertDatetime}},
+		{"TIMESTAMP", parquetColumn{myparquet.Column{Type: myparquet.Int64, Logical: myparquet.Timestamp, UTC: true}, convertDatetime}},
+		{"JSON", parquetColumn{myparquet.Column{Type: myparquet.ByteArray, Logical: myparquet.JSON}, convertBytes}},
+		{"ENUM", parquetColumn{myparquet.Column{Type: myparquet.ByteArray, Logical: myparquet.Enum}, convertBytes}},
+		{"TIME", parquetColumn{myparquet.Column{Type: myparquet.ByteArray, Logical: myparquet.String}, convertBytes}},
+		{"BLOB", parquetColumn{myparquet.Column{Type: myparquet.ByteArray}, convertBytes}},
+	}
+
+	db, server := newFakeDB(t)
+	for _, tt := range tests {
+		t.Run(tt.typeName, func(t *testing.T) {
+			server.on("SELECT c", fakeResult{columns: []string{"c"}, types: []string{tt.typeName}})
+			rows, err := db.Query("SELECT c")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rows.Close()
+			types, err := rows.ColumnTypes()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tt.expected.Name = "c"
+			if got := parquetColumnOf("c", types[0]); got != tt.expected {
+				t.Errorf("parquetColumnOf(%s) = %+v, want %+v", tt.typeName, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestUnscaledDecimal(t *testing.T) {
+	tests := []struct {
+		value    string
+		scale    int
+		expected string
+		bytes    []byte
+	}{
+		{value: "12.5", scale: 2, expected: "1250", bytes: []byte{0x00, 0x04, 0xe2}},
+		{value: "-0.01", scale: 2, expected: "-1", bytes: []byte{0xff, 0xff, 0xff}},
+		{value: "-83.88", scale: 2, expected: "-8388", bytes: []byte{0xff, 0xdf, 0x3c}},
+		{value: "18446744073709551615", scale: 0, expected: "18446744073709551615"},
+		{value: "1.234", scale: 2},
+		{value: "abc", scale: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := unscaledDecimal(tt.value, tt.scale)
+			if tt.expected == "" {
+				if err == nil {
+					t.Errorf("Expected an error, got %s", got)
+				}
+				return
+			}
+			if err != nil || got.String() != tt.expected {
+				t.Fatalf("unscaledDecimal(%q, %d) = %v, %v, want %s", tt.value, tt.scale, got, err, tt.expected)
+			}
+			if tt.bytes == nil {
+				return
+			}
+			if b, err := twosComplement(got, 3); err != nil || !bytes.Equal(b, tt.bytes) {
+				t.Errorf("twosComplement(%s, 3) = % x, %v, want % x", got, b, err, tt.bytes)
+			}
+		})
+	}
+
+	for _, v := range []int64{1 << 23, -1<<23 - 1} {
+		if _, err := twosComplement(big.NewInt(v), 3); err == nil {
+			t.Errorf("Expected %d not to fit in 3 bytes", v)
+		}
+	}
+}
+
+func TestDumpDirectory_JSONL(t *testing.T) {
+	tests := []struct {
+		name     string
+		jsonl    jsonlOptions
+		expected string
+	}{
+		{
+			name: "numbers",
+			expected: `{"id":9007199254740993,"price":12.50,"placed":"2024-01-01T12:00:00.5","paid":"2024-01-01T13:00:00Z","shipped":"2024-01-02","items":[{"sku": 1}],"data":"Af8=","note":"<a & \"b\">\n"}` + "\n" +
+				`{"id":2,"price":null,"placed":null,"paid":null,"shipped":null,"items":null,"data":null,"note":"café"}` + "\n",
+		},
+		{
+			name:  "bigint as string",
+			jsonl: jsonlOptions{bigintAsString: true},
+			expected: `{"id":"9007199254740993","price":12.50,"placed":"2024-01-01T12:00:00.5","paid":"2024-01-01T13:00:00Z","shipped":"2024-01-02","items":[{"sku": 1}],"data":"Af8=","note":"<a & \"b\">\n"}` + "\n" +
+				`{"id":"2","price":null,"placed":null,"paid":null,"shipped":null,"items":null,"data":null,"note":"café"}` + "\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, server := newFakeDB(t)
+			server.on("SHOW FULL TABLES", fakeResult{
+				columns: []string{"Tables_in_app", "Table_type"},
+				types:   []string{"VARCHAR", "VARCHAR"},
+				rows:    [][]any{{"orders", "BASE TABLE"}},
+			})
+			server.table("orders", "CREATE TABLE `orders` (`id` bigint, `price` decimal(10,2), `placed` datetime(1), `paid` timestamp, `shipped` date, `items` json, `data` blob, `note` text)",
+				[]string{"id", "price", "placed", "paid", "shipped", "items", "data", "note"},
+				[]string{"BIGINT", "DECIMAL", "DATETIME", "TIMESTAMP", "DATE", "JSON", "BLOB", "TEXT"},
+				[][]any{
+					{"9007199254740993", "12.50", "2024-01-01 12:00:00.5", "2024-01-01 13:00:00", "2024-01-02", `[{"sku": 1}]`, []byte{0x01, 0xff}, "<a & \"b\">\n"},
+					{"2", nil, "0000-00-00 00:00:00", nil, "0000-00-00", nil, nil, "café"},
+				},
+			)
+
+			var uploads memoryUpload
+			opts := dumpOptions{singleTransaction: true, maxAllowedPacket: defaultMaxAllowedPacket, threads: 1, format: formatJSONL, jsonl: tt.jsonl}
+			keys, err := dumpDirectory(context.Background(), db, "app", "app-20240101T000000/", opts, &backupMetadata{}, uploads.upload, nil)
+			if err != nil {
+				t.Fatalf("dumpDirectory returned error: %v", err)
+			}
+			dataKey := "app-20240101T000000/app.orders.jsonl"
+			if want := []string{"app-20240101T000000/app.orders-schema.sql", dataKey}; !slices.Equal(keys, want) {
+				t.Fatalf("dumpDirectory() keys = %v, want %v", keys, want)
+			}
+			got := uploads.files[dataKey]
+			if got != tt.expected {
+				t.Errorf("jsonl file =\n%s\nwant\n%s", got, tt.expected)
+			}
+			for _, line := range strings.Split(strings.TrimSuffix(got, "\n"), "\n") {
+				if !json.Valid([]byte(line)) {
+					t.Errorf("Expected every line to be valid JSON, got %s", line)
+				}
+			}
+		})
+	}
+}
+
+func TestAppendJSONString(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{value: "plain", expected: `"plain"`},
+		{value: "quote \" backslash \\", expected: `"quote \" backslash \\"`},
+		{value: "tab\tnul\x00bell\x07", expected: `"tab\tnul\u0000bell\u0007"`},
+		{value: "<html> & ünïcode", expected: `"<html> & ünïcode"`},
+		{value: "invalid \xff utf-8", expected: `"invalid \ufffd utf-8"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expected, func(t *testing.T) {
+			got := string(appendJSONString(nil, tt.value))
+			if got != tt.expected {
+				t.Errorf("appendJSONString(%q) = %s, want %s", tt.value, got, tt.expected)
+			}
+			var decoded string
+			if err := json.Unmarshal([]byte(got), &decoded); err != nil {
+				t.Errorf("Expected valid JSON, got %v", err)
+			}
+		})
+	}
+}
+
+func TestAppendJSONValue_Numbers(t *testing.T) {
+	tests := []struct {
+		value    string
+		kind     valueKind
+		expected string
+	}{
+		{value: "42", kind: kindNumber, expected: `42`},
+		{value: "-12.50", kind: kindNumber, expected: `-12.50`},
+		{value: "1.5e+300", kind: kindNumber, expected: `1.5e+300`},
+		{value: "0000", kind: kindNumber, expected: `0`},
+		{value: "0123", kind: kindNumber, expected: `123`},
+		{value: "-007.5", kind: kindNumber, expected: `-7.5`},
+		{value: "0.25", kind: kindNumber, expected: `0.25`},
+		{value: "n/a", kind: kindString, expected: `"n/a"`},
+		{value: "12abc", kind: kindNumber, expected: `"12abc"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got := string(appendJSONValue(nil, jsonNumber, tt.kind, []byte(tt.value)))
+			if got != tt.expected {
+				t.Errorf("appendJSONValue(%q) = %s, want %s", tt.value, got, tt.expected)
+			}
+			if !json.Valid([]byte(got)) {
+				t.Errorf("Expected valid JSON, got %s", got)
+			}
+		})
+	}
+}
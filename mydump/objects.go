@@ -0,0 +1,303 @@
+package mydump
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// storedObject is a routine, trigger or event as returned by SHOW CREATE.
+// Their bodies contain semicolons, so they are written between DELIMITER
+// statements, and they are recreated with the sql_mode and character set
+// they were created with, as their behaviour depends on both.
+type storedObject struct {
+	kind                string
+	name                string
+	createSQL           string
+	sqlMode             string
+	characterSetClient  string
+	collationConnection string
+	// timeZone is only set for events.
+	timeZone string
+}
+
+// createColumns maps the kind of object to the SHOW CREATE column holding
+// its definition.
+var createColumns = map[string]string{
+	"TABLE":     "Create Table",
+	"VIEW":      "Create View",
+	"FUNCTION":  "Create Function",
+	"PROCEDURE": "Create Procedure",
+	"EVENT":     "Create Event",
+	"TRIGGER":   "SQL Original Statement",
+}
+
+func (d *dumper) showCreateRow(ctx context.Context, conn *sql.Conn, kind, name string) (map[string]string, error) {
+	row, err := queryFirstRow(ctx, conn, "SHOW CREATE "+kind+" "+quoteIdentifier(name))
+	if err != nil {
+		return nil, fmt.Errorf("error reading definition of %s: %w", name, err)
+	}
+	// Routines the dump user may not see come back with an empty definition
+	// instead of an error.
+	if row == nil || row[createColumns[kind]] == "" {
+		return nil, fmt.Errorf("no definition returned for %s %s, check the privileges of the dump user", strings.ToLower(kind), name)
+	}
+	return row, nil
+}
+
+func (d *dumper) showCreate(ctx context.Context, conn *sql.Conn, kind, name string) (string, error) {
+	row, err := d.showCreateRow(ctx, conn, kind, name)
+	if err != nil {
+		return "", err
+	}
+	return row[createColumns[kind]], nil
+}
+
+func (d *dumper) storedObject(ctx context.Context, conn *sql.Conn, kind, name string) (storedObject, error) {
+	row, err := d.showCreateRow(ctx, conn, kind, name)
+	if err != nil {
+		return storedObject{}, err
+	}
+	return storedObject{
+		kind:                kind,
+		name:                name,
+		createSQL:           row[createColumns[kind]],
+		sqlMode:             row["sql_mode"],
+		characterSetClient:  row["character_set_client"],
+		collationConnection: row["collation_connection"],
+		timeZone:            row["time_zone"],
+	}, nil
+}
+
+// listNames returns the values of column for every row of query.
+func listNames(ctx context.Context, conn *sql.Conn, query, column string) ([]string, error) {
+	rows, err := conn.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	index := slices.Index(columns, column)
+	if index < 0 {
+		return nil, fmt.Errorf("%s returned no %s column", query, column)
+	}
+
+	values := make([]sql.NullString, len(columns))
+	scans := make([]any, len(columns))
+	for i := range values {
+		scans[i] = &values[i]
+	}
+
+	var names []string
+	for rows.Next() {
+		if err := rows.Scan(scans...); err != nil {
+			return nil, err
+		}
+		names = append(names, values[index].String)
+	}
+	return names, rows.Err()
+}
+
+// listTriggers returns the triggers of the database by table, in the order
+// they fire.
+func (d *dumper) listTriggers(ctx context.Context) (map[string][]string, error) {
+	rows, err := d.snap.conns[0].QueryContext(ctx, "SHOW TRIGGERS")
+	if err != nil {
+		return nil, fmt.Errorf("error listing triggers: %w", err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	triggerIndex, tableIndex := slices.Index(columns, "Trigger"), slices.Index(columns, "Table")
+	if triggerIndex < 0 || tableIndex < 0 {
+		return nil, fmt.Errorf("trigger information is malformed")
+	}
+
+	values := make([]sql.NullString, len(columns))
+	scans := make([]any, len(columns))
+	for i := range values {
+		scans[i] = &values[i]
+	}
+
+	triggers := make(map[string][]string)
+	for rows.Next() {
+		if err := rows.Scan(scans...); err != nil {
+			return nil, fmt.Errorf("error scanning trigger: %w", err)
+		}
+		table := values[tableIndex].String
+		triggers[table] = append(triggers[table], values[triggerIndex].String)
+	}
+	return triggers, rows.Err()
+}
+
+func (d *dumper) writeTriggers(ctx context.Context, conn *sql.Conn, out *bufio.Writer, table tableInfo) error {
+	if len(table.triggers) == 0 {
+		return nil
+	}
+	fmt.Fprintf(out, "\n--\n-- Triggers of table %s\n--\n", quoteIdentifier(table.name))
+	for _, name := range table.triggers {
+		trigger, err := d.storedObject(ctx, conn, "TRIGGER", name)
+		if err != nil {
+			return err
+		}
+		writeStoredObject(out, trigger)
+	}
+	return nil
+}
+
+// writeRoutines writes the stored functions and then the procedures of the
+// database. Functions go first, and both go before the views, since views
+// may call functions and MySQL checks that they exist when a view is
+// created. Routine bodies themselves are only resolved when called, so the
+// order between routines does not matter.
+func (d *dumper) writeRoutines(ctx context.Context, out *bufio.Writer) error {
+	conn := d.snap.conns[0]
+	for _, kind := range []string{"FUNCTION", "PROCEDURE"} {
+		names, err := listNames(ctx, conn, "SHOW "+kind+" STATUS WHERE Db = '"+escapeString(d.database)+"'", "Name")
+		if err != nil {
+			return fmt.Errorf("error listing %s routines: %w", strings.ToLower(kind), err)
+		}
+		for _, name := range names {
+			routine, err := d.storedObject(ctx, conn, kind, name)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "\n--\n-- Dumping routine %s\n--\n", quoteIdentifier(name))
+			writeStoredObject(out, routine)
+		}
+	}
+	return nil
+}
+
+func (d *dumper) writeEvents(ctx context.Context, out *bufio.Writer) error {
+	conn := d.snap.conns[0]
+	names, err := listNames(ctx, conn, "SHOW EVENTS", "Name")
+	if err != nil {
+		return fmt.Errorf("error listing events: %w", err)
+	}
+	for _, name := range names {
+		event, err := d.storedObject(ctx, conn, "EVENT", name)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "\n--\n-- Dumping event %s\n--\n", quoteIdentifier(name))
+		writeStoredObject(out, event)
+	}
+	return nil
+}
+
+func writeStoredObject(out *bufio.Writer, o storedObject) {
+	version := "50003"
+	switch o.kind {
+	case "TRIGGER":
+		version = "50032"
+	case "EVENT":
+		version = "50106"
+	}
+	fmt.Fprintf(out, "\n/*!%s DROP %s IF EXISTS %s */;\n", version, o.kind, quoteIdentifier(o.name))
+
+	out.WriteString("/*!50003 SET @saved_cs_client      = @@character_set_client */ ;\n")
+	out.WriteString("/*!50003 SET @saved_cs_results     = @@character_set_results */ ;\n")
+	out.WriteString("/*!50003 SET @saved_col_connection = @@collation_connection */ ;\n")
+	if o.characterSetClient != "" {
+		fmt.Fprintf(out, "/*!50003 SET character_set_client  = %s */ ;\n", o.characterSetClient)
+		fmt.Fprintf(out, "/*!50003 SET character_set_results = %s */ ;\n", o.characterSetClient)
+	}
+	if o.collationConnection != "" {
+		fmt.Fprintf(out, "/*!50003 SET collation_connection  = %s */ ;\n", o.collationConnection)
+	}
+	out.WriteString("/*!50003 SET @saved_sql_mode       = @@sql_mode */ ;\n")
+	fmt.Fprintf(out, "/*!50003 SET sql_mode              = '%s' */ ;\n", escapeString(o.sqlMode))
+	if o.timeZone != "" {
+		out.WriteString("/*!50106 SET @saved_time_zone      = @@time_zone */ ;\n")
+		fmt.Fprintf(out, "/*!50106 SET time_zone             = '%s' */ ;\n", escapeString(o.timeZone))
+	}
+
+	delimiter := delimiterFor(o.createSQL)
+	fmt.Fprintf(out, "DELIMITER %s\n", delimiter)
+	fmt.Fprintf(out, "%s %s\n", o.createSQL, delimiter)
+	out.WriteString("DELIMITER ;\n")
+
+	if o.timeZone != "" {
+		out.WriteString("/*!50106 SET time_zone             = @saved_time_zone */ ;\n")
+	}
+	out.WriteString("/*!50003 SET sql_mode              = @saved_sql_mode */ ;\n")
+	out.WriteString("/*!50003 SET character_set_client  = @saved_cs_client */ ;\n")
+	out.WriteString("/*!50003 SET character_set_results = @saved_cs_results */ ;\n")
+	out.WriteString("/*!50003 SET collation_connection  = @saved_col_connection */ ;\n")
+}
+
+// delimiterFor picks a statement delimiter that does not occur in body, so
+// the mysql client does not cut the definition short.
+func delimiterFor(body string) string {
+	for _, delimiter := range []string{";;", "$$", "//", "##", "~~"} {
+		if !strings.Contains(body, delimiter) {
+			return delimiter
+		}
+	}
+	for n := 3; ; n++ {
+		if delimiter := strings.Repeat(";", n); !strings.Contains(body, delimiter) {
+			return delimiter
+		}
+	}
+}
+
+type view struct {
+	name      string
+	createSQL string
+}
+
+// sortViews orders views so that every view comes after the views it
+// selects from, keeping the listed order otherwise. A view is taken to
+// depend on another when its definition mentions the other's quoted name,
+// which is how SHOW CREATE VIEW always writes table references.
+func sortViews(views []view) []view {
+	dependsOn := func(v, other view) bool {
+		return v.name != other.name && strings.Contains(v.createSQL, quoteIdentifier(other.name))
+	}
+
+	var sorted []view
+	done := make(map[string]bool)
+	for len(sorted) < len(views) {
+		progress := false
+		for _, v := range views {
+			if done[v.name] {
+				continue
+			}
+			ready := true
+			for _, other := range views {
+				if !done[other.name] && dependsOn(v, other) {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				sorted = append(sorted, v)
+				done[v.name] = true
+				progress = true
+			}
+		}
+		// A mention that is not a real dependency, such as a column named
+		// like another view, can form a cycle. Break it in listed order.
+		if !progress {
+			for _, v := range views {
+				if !done[v.name] {
+					sorted = append(sorted, v)
+					done[v.name] = true
+					break
+				}
+			}
+		}
+	}
+	return sorted
+}
@@ -0,0 +1,256 @@
+package mydump
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pendingPartsPerThread bounds how far the workers of writeTablesParallel
+// may run ahead of the part being copied into the dump: one part in progress
+// and one finished per thread.
+const pendingPartsPerThread = 2
+
+type partFile struct {
+	file *os.File
+	err  error
+	done chan struct{}
+}
+
+// writeTablesParallel dumps the parts of tables with one worker per snapshot
+// connection. Each worker renders its part into a temporary file in
+// DB_DUMP_PATH and the files are copied into the dump in the original table
+// order, so the result is identical to a serial dump. A part holds a slot
+// from when it is handed out until it has been copied, so however long the
+// part at the head of the line takes, at most pendingPartsPerThread part
+// files per thread sit in DB_DUMP_PATH.
+func (d *dumper) writeTablesParallel(ctx context.Context, tableParts []tablePart) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	parts := make([]*partFile, len(tableParts))
+	for i := range parts {
+		parts[i] = &partFile{done: make(chan struct{})}
+	}
+
+	// Parts are handed out in order, so the part the copier waits for
+	// always holds a slot already.
+	slots := make(chan struct{}, pendingPartsPerThread*len(d.snap.conns))
+	jobs := make(chan int)
+	go func() {
+		defer close(jobs)
+		for i := range tableParts {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case jobs <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for _, conn := range d.snap.conns {
+		wg.Go(func() {
+			for i := range jobs {
+				parts[i].file, parts[i].err = d.writeTablePart(ctx, conn, tableParts[i])
+				close(parts[i].done)
+			}
+		})
+	}
+
+	var err error
+	for i, part := range parts {
+		<-part.done
+		if part.err != nil {
+			err = part.err
+			break
+		}
+		_, err = io.Copy(d.out, part.file)
+		part.file.Close()
+		os.Remove(part.file.Name())
+		part.file = nil
+		if err != nil {
+			err = fmt.Errorf("error copying dump of table %s: %w", tableParts[i].table.name, err)
+			break
+		}
+		<-slots
+	}
+
+	// On failure stop handing out parts and clean up whatever the
+	// workers already finished.
+	cancel()
+	wg.Wait()
+	for _, part := range parts {
+		if part.file != nil {
+			part.file.Close()
+			os.Remove(part.file.Name())
+		}
+	}
+
+	return err
+}
+
+// forEachPart runs fn for every part, spread over the connections of the
+// snapshot, and stops handing out parts at the first error.
+func (d *dumper) forEachPart(ctx context.Context, parts []tablePart, fn func(ctx context.Context, conn *sql.Conn, i int) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jobs := make(chan int)
+	go func() {
+		defer close(jobs)
+		for i := range parts {
+			select {
+			case jobs <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var mu sync.Mutex
+	var firstErr error
+	var wg sync.WaitGroup
+	for _, conn := range d.snap.conns {
+		wg.Go(func() {
+			for i := range jobs {
+				if err := fn(ctx, conn, i); err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+						cancel()
+					}
+					mu.Unlock()
+				}
+			}
+		})
+	}
+	wg.Wait()
+
+	return firstErr
+}
+
+// writeTablePart dumps one part into a temporary file, rewound and ready to
+// be copied.
+func (d *dumper) writeTablePart(ctx context.Context, conn *sql.Conn, part tablePart) (*os.File, error) {
+	file, err := os.CreateTemp(dumpDir(), d.database+".*.part")
+	if err != nil {
+		return nil, fmt.Errorf("error creating part file for table %s: %w", part.table.name, err)
+	}
+
+	out := bufio.NewWriterSize(file, 64*1024)
+	err = d.writePart(ctx, conn, out, part)
+	if err == nil {
+		err = out.Flush()
+	}
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return file, nil
+}
+
+func parallelDatabasesFromEnv() (int, error) {
+	v := os.Getenv("DB_DUMP_PARALLEL_DATABASES")
+	if v == "" {
+		return 1, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid DB_DUMP_PARALLEL_DATABASES value %q: must be a number >= 1", v)
+	}
+	return n, nil
+}
+
+type dumpResult struct {
+	database string
+	duration time.Duration
+	err      error
+}
+
+// runSummary collects the outcome of every database dumped in one run, in
+// the order the databases were listed.
+type runSummary struct {
+	results  []dumpResult
+	duration time.Duration
+}
+
+// dumpDatabases runs dump for every database with at most parallel dumps in
+// flight and keeps going when one of them fails.
+func dumpDatabases(databases []string, parallel int, dump func(database string) error) runSummary {
+	started := time.Now()
+	results := make([]dumpResult, len(databases))
+
+	slots := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for i, database := range databases {
+		slots <- struct{}{}
+		wg.Go(func() {
+			defer func() { <-slots }()
+
+			databaseStarted := time.Now()
+			err := dump(database)
+			results[i] = dumpResult{
+				database: database,
+				duration: time.Since(databaseStarted),
+				err:      err,
+			}
+			if err != nil {
+				log.Printf("Error dumping database %s: %v", database, err)
+			}
+		})
+	}
+	wg.Wait()
+
+	return runSummary{results: results, duration: time.Since(started)}
+}
+
+func (s runSummary) failed() []dumpResult {
+	var failed []dumpResult
+	for _, result := range s.results {
+		if result.err != nil {
+			failed = append(failed, result)
+		}
+	}
+	return failed
+}
+
+func (s runSummary) log() {
+	log.Printf("Dumped %d of %d databases in %s", len(s.results)-len(s.failed()), len(s.results), s.duration.Round(time.Second))
+	for _, result := range s.results {
+		if result.err != nil {
+			log.Printf("  %s: failed after %s: %v", result.database, result.duration.Round(time.Second), result.err)
+		} else {
+			log.Printf("  %s: ok in %s", result.database, result.duration.Round(time.Second))
+		}
+	}
+}
+
+func (s runSummary) err() error {
+	failed := s.failed()
+	if len(failed) == 0 {
+		return nil
+	}
+	names := make([]string, len(failed))
+	for i, result := range failed {
+		names[i] = result.database
+	}
+	return fmt.Errorf("%d of %d databases failed: %s", len(failed), len(s.results), strings.Join(names, ", "))
+}
@@ -0,0 +1,285 @@
+package mydump
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stenstromen/s3dbdump/myparquet"
+)
+
+// formatParquet is a directory dump with the rows of every table in a
+// Parquet file, uploaded under a Hive-style prefix so that the backups of a
+// table form one partitioned dataset.
+const formatParquet dumpFormat = "parquet"
+
+// parquetOptions control the Parquet format.
+type parquetOptions struct {
+	// rowGroupSize is the size of row groups in bytes, see
+	// DB_DUMP_PARQUET_ROW_GROUP_MB.
+	rowGroupSize int64
+	// gzip compresses the pages; the files themselves are never gzipped,
+	// see uploadDump.
+	gzip bool
+}
+
+func parquetOptionsFromEnv() (parquetOptions, error) {
+	opts := parquetOptions{
+		rowGroupSize: 64 << 20,
+		gzip:         os.Getenv("DB_GZIP") != "0",
+	}
+	if v := os.Getenv("DB_DUMP_PARQUET_ROW_GROUP_MB"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return opts, fmt.Errorf("invalid DB_DUMP_PARQUET_ROW_GROUP_MB value %q: must be a number >= 1", v)
+		}
+		opts.rowGroupSize = int64(n) << 20
+	}
+	return opts, nil
+}
+
+// lakePrefix returns the prefix of the Parquet files of table for the
+// backup set in dir: db=<db>/table=<table>/dt=<day>/<backup name>, next to
+// the set rather than inside it. Retention still counts the files as part
+// of the backup, see mys3.backupID.
+func (d *dumper) lakePrefix(dir, table string) string {
+	parent, name := path.Split(strings.TrimSuffix(dir, "/"))
+	return parent + "db=" + url.PathEscape(d.database) + "/table=" + url.PathEscape(table) +
+		"/dt=" + d.meta.StartedAt.Format("2006-01-02") + "/" + name
+}
+
+// parquetConversion is how the text of a MySQL value becomes a Parquet
+// value.
+type parquetConversion int
+
+const (
+	convertBytes parquetConversion = iota
+	convertInt
+	convertFloat
+	convertDecimal
+	convertDate
+	convertDatetime
+)
+
+type parquetColumn struct {
+	myparquet.Column
+	conversion parquetConversion
+}
+
+// parquetColumnOf maps a MySQL column to a Parquet column. Unsigned
+// integers are widened to the next signed type, BIGINT UNSIGNED to a
+// DECIMAL, as many readers ignore unsignedness. TIME may exceed a day and
+// SET holds several values, both stay strings.
+func parquetColumnOf(name string, columnType *sql.ColumnType) parquetColumn {
+	c := parquetColumn{Column: myparquet.Column{Name: name, Type: myparquet.ByteArray}}
+	integer := func(bits int) {
+		c.Type, c.Logical, c.BitWidth, c.Signed, c.conversion = myparquet.Int32, myparquet.Integer, bits, true, convertInt
+		if bits == 64 {
+			c.Type = myparquet.Int64
+		}
+	}
+	decimal := func(precision, scale int) {
+		c.Logical, c.Precision, c.Scale, c.conversion = myparquet.Decimal, precision, scale, convertDecimal
+		switch {
+		case precision <= 9:
+			c.Type = myparquet.Int32
+		case precision <= 18:
+			c.Type = myparquet.Int64
+		default:
+			// The fewest bytes that hold every value of the precision
+			// with a sign bit.
+			c.Type = myparquet.FixedLenByteArray
+			c.Length = int(math.Ceil((float64(precision)*math.Log2(10) + 1) / 8))
+		}
+	}
+
+	switch typeName := columnType.DatabaseTypeName(); typeName {
+	case "TINYINT":
+		integer(8)
+	case "SMALLINT", "UNSIGNED TINYINT":
+		integer(16)
+	case "MEDIUMINT", "INT", "UNSIGNED SMALLINT", "UNSIGNED MEDIUMINT":
+		integer(32)
+	case "BIGINT", "UNSIGNED INT":
+		integer(64)
+	case "UNSIGNED BIGINT":
+		decimal(20, 0)
+	case "YEAR":
+		integer(16)
+	case "FLOAT":
+		c.Type, c.conversion = myparquet.Float, convertFloat
+	case "DOUBLE":
+		c.Type, c.conversion = myparquet.Double, convertFloat
+	case "DECIMAL":
+		precision, scale, ok := columnType.DecimalSize()
+		if !ok {
+			c.Logical = myparquet.String
+			break
+		}
+		decimal(int(min(precision, 65)), int(scale))
+	case "DATE":
+		c.Type, c.Logical, c.conversion = myparquet.Int32, myparquet.Date, convertDate
+	case "DATETIME", "TIMESTAMP":
+		// TIMESTAMP values are read in UTC and are instants, DATETIME
+		// values are a date and time without a time zone.
+		c.Type, c.Logical, c.UTC, c.conversion = myparquet.Int64, myparquet.Timestamp, typeName == "TIMESTAMP", convertDatetime
+	case "JSON":
+		c.Logical = myparquet.JSON
+	case "ENUM":
+		c.Logical = myparquet.Enum
+	default:
+		if kindOf(typeName) != kindBinary {
+			c.Logical = myparquet.String
+		}
+	}
+	return c
+}
+
+// write writes value, the text MySQL returned for the column, to column i
+// of w. Dates MySQL allows but no calendar has, such as 0000-00-00, are
+// written as null.
+func (c *parquetColumn) write(w *myparquet.Writer, i int, value []byte) error {
+	if value == nil {
+		w.WriteNull(i)
+		return nil
+	}
+	s := string(value)
+	switch c.conversion {
+	case convertInt:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		if c.Type == myparquet.Int32 {
+			w.WriteInt32(i, int32(n))
+		} else {
+			w.WriteInt64(i, n)
+		}
+	case convertFloat:
+		if c.Type == myparquet.Float {
+			f, err := strconv.ParseFloat(s, 32)
+			if err != nil {
+				return err
+			}
+			w.WriteFloat(i, float32(f))
+		} else {
+			f, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				return err
+			}
+			w.WriteDouble(i, f)
+		}
+	case convertDecimal:
+		return c.writeDecimal(w, i, s)
+	case convertDate:
+		t, err := time.Parse(time.DateOnly, s)
+		if err != nil {
+			w.WriteNull(i)
+			return nil
+		}
+		w.WriteInt32(i, int32(t.Unix()/86400))
+	case convertDatetime:
+		t, err := time.Parse("2006-01-02 15:04:05.999999", s)
+		if err != nil {
+			w.WriteNull(i)
+			return nil
+		}
+		w.WriteInt64(i, t.UnixMicro())
+	default:
+		w.WriteBytes(i, value)
+	}
+	return nil
+}
+
+// writeDecimal writes s, a decimal number, as its unscaled value.
+func (c *parquetColumn) writeDecimal(w *myparquet.Writer, i int, s string) error {
+	unscaled, err := unscaledDecimal(s, c.Scale)
+	if err != nil {
+		return err
+	}
+	switch c.Type {
+	case myparquet.Int32:
+		w.WriteInt32(i, int32(unscaled.Int64()))
+	case myparquet.Int64:
+		w.WriteInt64(i, unscaled.Int64())
+	default:
+		b, err := twosComplement(unscaled, c.Length)
+		if err != nil {
+			return fmt.Errorf("%s exceeds the precision of %d digits", s, c.Precision)
+		}
+		w.WriteBytes(i, b)
+	}
+	return nil
+}
+
+// unscaledDecimal returns the decimal number s multiplied by 10^scale.
+func unscaledDecimal(s string, scale int) (*big.Int, error) {
+	whole, fraction, _ := strings.Cut(s, ".")
+	if len(fraction) > scale {
+		return nil, fmt.Errorf("%s has more than %d decimals", s, scale)
+	}
+	unscaled, ok := new(big.Int).SetString(whole+fraction+strings.Repeat("0", scale-len(fraction)), 10)
+	if !ok {
+		return nil, fmt.Errorf("invalid decimal %s", s)
+	}
+	return unscaled, nil
+}
+
+// twosComplement returns v as an n-byte big-endian two's complement number.
+func twosComplement(v *big.Int, n int) ([]byte, error) {
+	if v.Sign() < 0 {
+		v = new(big.Int).Add(v, new(big.Int).Lsh(big.NewInt(1), uint(8*n)))
+		if v.Sign() < 0 || v.Bit(8*n-1) == 0 {
+			return nil, fmt.Errorf("%d bytes are too few", n)
+		}
+	} else if v.BitLen() >= 8*n {
+		return nil, fmt.Errorf("%d bytes are too few", n)
+	}
+	return v.FillBytes(make([]byte, n)), nil
+}
+
+// writeParquet writes the rows of part as a Parquet file.
+func (d *dumper) writeParquet(ctx context.Context, conn *sql.Conn, out io.Writer, part tablePart) error {
+	table := part.table.name
+	rows, err := d.selectRows(ctx, conn, part)
+	if err != nil || rows == nil {
+		return err
+	}
+	defer rows.Close()
+
+	columns := make([]parquetColumn, len(rows.types))
+	schema := make([]myparquet.Column, len(rows.types))
+	for i, columnType := range rows.types {
+		columns[i] = parquetColumnOf(rows.columns[i], columnType)
+		schema[i] = columns[i].Column
+	}
+	w := myparquet.NewWriter(out, schema, myparquet.Options{RowGroupSize: d.opts.parquet.rowGroupSize, Gzip: d.opts.parquet.gzip})
+
+	for rows.Next() {
+		if err := rows.Scan(rows.scans...); err != nil {
+			return fmt.Errorf("error scanning row of %s: %w", table, err)
+		}
+		for i := range rows.values {
+			value, _ := rows.value(i)
+			if err := columns[i].write(w, i, value); err != nil {
+				return fmt.Errorf("error converting column %s of %s: %w", rows.columns[i], table, err)
+			}
+		}
+		if err := w.EndRow(); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error reading rows of %s: %w", table, err)
+	}
+	return w.Close()
+}
@@ -0,0 +1,107 @@
+package mydump
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/stenstromen/s3dbdump/mygzip"
+	"github.com/stenstromen/s3dbdump/mys3"
+)
+
+// uploadDump runs dump and uploads what it writes as filename, gzipped
+// unless DB_GZIP=0. It returns the key of the uploaded object. The dump is
+// streamed straight into S3 unless DB_DUMP_TEMP_FILE=1, in which case it is
+// written to DB_DUMP_PATH first. Parquet files compress their pages
+// themselves and are read in place, so they are never gzipped as a whole.
+func uploadDump(filename string, dump func(w io.Writer) error) (string, error) {
+	compress := os.Getenv("DB_GZIP") != "0" && path.Ext(filename) != ".parquet"
+	key := filename
+	if compress {
+		key += ".gz"
+	}
+
+	if os.Getenv("DB_DUMP_TEMP_FILE") == "1" {
+		return key, dumpToFile(filename, compress, dump)
+	}
+	return key, streamDump(key, compress, dump)
+}
+
+func dumpDir() string {
+	if dir := os.Getenv("DB_DUMP_PATH"); dir != "" {
+		return dir
+	}
+	return "/tmp/dumps"
+}
+
+// streamDump pipes the dump through gzip straight into an S3 upload so that
+// nothing is written to DB_DUMP_PATH.
+func streamDump(key string, compress bool, dump func(w io.Writer) error) error {
+	pr, pw := io.Pipe()
+	dumpErr := make(chan error, 1)
+	go func() {
+		err := writeDump(pw, compress, dump)
+		pw.CloseWithError(err)
+		dumpErr <- err
+	}()
+
+	uploadErr := mys3.UploadStream(key, pr)
+	// Unblock the dump if the upload gave up before reading everything.
+	pr.CloseWithError(uploadErr)
+
+	if err := <-dumpErr; err != nil {
+		return err
+	}
+	return uploadErr
+}
+
+func writeDump(w io.Writer, compress bool, dump func(w io.Writer) error) error {
+	if !compress {
+		return dump(w)
+	}
+
+	gw, err := mygzip.NewWriter(w)
+	if err != nil {
+		return err
+	}
+	if err := dump(gw); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// dumpToFile writes the dump to a file of its own in DB_DUMP_PATH before
+// uploading it. The file name is unique rather than derived from filename,
+// since keys such as the Parquet ones share their base name across tables
+// and parallel workers must not overwrite each other's files.
+func dumpToFile(filename string, compress bool, dump func(w io.Writer) error) error {
+	key := filename
+	file, err := os.CreateTemp(dumpDir(), filepath.Base(filename)+".*")
+	if err != nil {
+		return fmt.Errorf("error creating dump file: %w", err)
+	}
+	path := file.Name()
+
+	err = dump(file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	if compress {
+		if err := mygzip.GzipFile(path); err != nil {
+			os.Remove(path)
+			return err
+		}
+		path += ".gz"
+		key += ".gz"
+	}
+	defer os.Remove(path)
+
+	return mys3.UploadFile(key, path)
+}
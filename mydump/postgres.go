@@ -0,0 +1,219 @@
+package mydump
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// formatCustom is the pg_dump archive format, restored with pg_restore. It
+// is only valid for PostgreSQL.
+const formatCustom dumpFormat = "custom"
+
+// postgresAccountsDatabase names the roles backup of a PostgreSQL server,
+// like accountsDatabase does for MySQL.
+const postgresAccountsDatabase = "postgres.accounts"
+
+// postgresSource dumps PostgreSQL with pg_dump, which must be installed
+// along with psql and be at least as new as the server. Connection settings
+// are handed over in the PG* environment variables rather than as
+// arguments, so the password does not show up in the process list.
+type postgresSource struct {
+	host     string
+	port     string
+	user     string
+	password string
+	mode     dumpMode
+	format   dumpFormat
+}
+
+func postgresSourceFromEnv() (*postgresSource, error) {
+	s := &postgresSource{
+		host:     os.Getenv("DB_HOST"),
+		port:     os.Getenv("DB_PORT"),
+		user:     os.Getenv("DB_USER"),
+		password: os.Getenv("DB_PASSWORD"),
+		mode:     modeFull,
+		format:   formatSQL,
+	}
+	if s.port == "" {
+		s.port = "5432"
+	}
+
+	switch mode := dumpMode(os.Getenv("DB_DUMP_MODE")); mode {
+	case "":
+	case modeFull, modeSchema, modeData:
+		s.mode = mode
+	default:
+		return nil, fmt.Errorf("invalid DB_DUMP_MODE value %q: must be full, schema or data", mode)
+	}
+
+	switch format := dumpFormat(os.Getenv("DB_DUMP_FORMAT")); format {
+	case "":
+	case formatSQL, formatCustom:
+		s.format = format
+	default:
+		return nil, fmt.Errorf("invalid DB_DUMP_FORMAT value %q: must be sql or custom for PostgreSQL", format)
+	}
+	if err := rejectMySQLOnlyEnv(enginePostgres); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// env returns the environment of pg_dump and psql connecting to database.
+func (s *postgresSource) env(database string) []string {
+	env := append(os.Environ(), "PGPORT="+s.port, "PGDATABASE="+database)
+	if s.host != "" {
+		env = append(env, "PGHOST="+s.host)
+	}
+	if s.user != "" {
+		env = append(env, "PGUSER="+s.user)
+	}
+	if s.password != "" {
+		env = append(env, "PGPASSWORD="+s.password)
+	}
+	return env
+}
+
+// run runs a PostgreSQL client program connecting to database.
+func (s *postgresSource) run(ctx context.Context, database string, w io.Writer, name string, args ...string) error {
+	return runCommand(ctx, s.env(database), w, name, args...)
+}
+
+// query runs a query with psql and returns the rows of its single column.
+func (s *postgresSource) query(ctx context.Context, database, query string) ([]string, error) {
+	var out bytes.Buffer
+	if err := s.run(ctx, database, &out, "psql", "--no-psqlrc", "--no-password", "--tuples-only", "--no-align", "--quiet", "--command", query); err != nil {
+		return nil, err
+	}
+	return strings.FieldsFunc(out.String(), func(r rune) bool { return r == '\n' }), nil
+}
+
+// maintenanceDatabase is the database psql connects to for queries about
+// the server as a whole.
+func (s *postgresSource) maintenanceDatabase() string {
+	if database := os.Getenv("DB_NAME"); database != "" && os.Getenv("DB_ALL_DATABASES") != "1" {
+		return database
+	}
+	return "postgres"
+}
+
+func (s *postgresSource) ping(ctx context.Context) error {
+	_, err := s.query(ctx, s.maintenanceDatabase(), "SELECT 1")
+	return err
+}
+
+func (s *postgresSource) databases(ctx context.Context) ([]string, error) {
+	databases, err := s.query(ctx, s.maintenanceDatabase(), "SELECT datname FROM pg_database WHERE datallowconn AND NOT datistemplate ORDER BY datname")
+	if err != nil {
+		return nil, fmt.Errorf("error querying databases: %w", err)
+	}
+	return databases, nil
+}
+
+// dumpArgs returns the pg_dump arguments for the mode and format.
+func (s *postgresSource) dumpArgs() []string {
+	args := []string{"--no-password"}
+	switch s.format {
+	case formatCustom:
+		// Compression is left to DB_GZIP, as for every other dump.
+		args = append(args, "--format=custom", "--compress=0")
+	default:
+		args = append(args, "--format=plain")
+	}
+	switch s.mode {
+	case modeSchema:
+		args = append(args, "--schema-only")
+	case modeData:
+		args = append(args, "--data-only")
+	}
+	return args
+}
+
+// extension is the file extension of a dump in the format.
+func (s *postgresSource) extension() string {
+	if s.format == formatCustom {
+		return ".dump"
+	}
+	return ".sql"
+}
+
+// dump writes a dump of database to w. pg_dump reads all tables in one
+// repeatable read transaction, so the dump is consistent.
+func (s *postgresSource) dump(ctx context.Context, database string, w io.Writer) error {
+	return s.run(ctx, database, w, "pg_dump", s.dumpArgs()...)
+}
+
+func (s *postgresSource) dumpDatabase(ctx context.Context, database string, cp *checkpoint) error {
+	if name, ok := cp.completed(database); ok {
+		log.Printf("Skipping database %s: completed in run %s as %s", database, cp.RunID, name)
+		return nil
+	}
+	log.Printf("Dumping database %s", database)
+
+	version, err := s.query(ctx, database, "SHOW server_version")
+	if err != nil {
+		return fmt.Errorf("error querying server version: %w", err)
+	}
+
+	started := time.Now()
+	_, name := cp.startDatabase(database, backupName(database, started))
+	meta := &backupMetadata{
+		Database:          database,
+		Engine:            enginePostgres,
+		Mode:              s.mode,
+		Format:            s.format,
+		ServerVersion:     strings.Join(version, " "),
+		StartedAt:         started.UTC(),
+		SingleTransaction: true,
+	}
+
+	key, err := uploadDump(name+s.mode.suffix()+s.extension(), func(w io.Writer) error {
+		return s.dump(ctx, database, w)
+	})
+	if err != nil {
+		return fmt.Errorf("error dumping: %w", err)
+	}
+
+	meta.FinishedAt = time.Now().UTC()
+	meta.Files = []string{key}
+	if err := uploadMetadata(name, meta); err != nil {
+		return fmt.Errorf("error uploading backup metadata: %w", err)
+	}
+	cp.completeDatabase(database)
+	return nil
+}
+
+// dumpAccounts uploads the roles of the server with pg_dumpall. Reading
+// their passwords takes a superuser.
+func (s *postgresSource) dumpAccounts(ctx context.Context) error {
+	log.Printf("Dumping accounts")
+
+	started := time.Now()
+	name := backupName(postgresAccountsDatabase, started)
+	meta := &backupMetadata{
+		Database:  postgresAccountsDatabase,
+		Engine:    enginePostgres,
+		Mode:      modeAccounts,
+		StartedAt: started.UTC(),
+	}
+	key, err := uploadDump(name+".sql", func(w io.Writer) error {
+		return s.run(ctx, s.maintenanceDatabase(), w, "pg_dumpall", "--no-password", "--roles-only")
+	})
+	if err != nil {
+		return fmt.Errorf("error dumping accounts: %w", err)
+	}
+
+	meta.FinishedAt = time.Now().UTC()
+	meta.Files = []string{key}
+	if err := uploadMetadata(name, meta); err != nil {
+		return fmt.Errorf("error uploading backup metadata: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package mydump
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/stenstromen/s3dbdump/myredis"
+)
+
+// redisSource backs up Redis instances with the RDB snapshot a replica
+// receives on a full resynchronization, streamed from the socket to the
+// bucket. Every instance is a database named by DB_NAME, or by its entry in
+// DB_REDIS_INSTANCES, so retention keeps the backups of each instance apart.
+type redisSource struct {
+	addr      string
+	user      string
+	password  string
+	instances map[string]string
+	names     []string
+}
+
+func redisSourceFromEnv() (*redisSource, error) {
+	port := os.Getenv("DB_PORT")
+	if port == "" {
+		port = "6379"
+	}
+	s := &redisSource{
+		addr:      net.JoinHostPort(os.Getenv("DB_HOST"), port),
+		user:      os.Getenv("DB_USER"),
+		password:  os.Getenv("DB_PASSWORD"),
+		instances: make(map[string]string),
+	}
+
+	// Entries are name=host:port, separated by commas.
+	for _, entry := range strings.Split(os.Getenv("DB_REDIS_INSTANCES"), ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		name, addr, ok := strings.Cut(entry, "=")
+		name, addr = strings.TrimSpace(name), strings.TrimSpace(addr)
+		if !ok || name == "" || strings.Contains(name, "/") {
+			return nil, fmt.Errorf("invalid DB_REDIS_INSTANCES entry %q: must be name=host:port", entry)
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, "6379")
+		}
+		if _, ok := s.instances[name]; ok {
+			return nil, fmt.Errorf("invalid DB_REDIS_INSTANCES entry %q: duplicate name %s", entry, name)
+		}
+		s.instances[name] = addr
+		s.names = append(s.names, name)
+	}
+
+	// An RDB snapshot holds the whole dataset.
+	if mode := dumpMode(os.Getenv("DB_DUMP_MODE")); mode != "" && mode != modeFull {
+		return nil, fmt.Errorf("invalid DB_DUMP_MODE value %q: Redis backups are always full", mode)
+	}
+	if format := os.Getenv("DB_DUMP_FORMAT"); format != "" {
+		return nil, fmt.Errorf("invalid DB_DUMP_FORMAT value %q: Redis backups are RDB files", format)
+	}
+	if err := rejectMySQLOnlyEnv(engineRedis); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// address returns the address of the instance database.
+func (s *redisSource) address(database string) string {
+	if addr, ok := s.instances[database]; ok {
+		return addr
+	}
+	return s.addr
+}
+
+func (s *redisSource) ping(ctx context.Context) error {
+	addrs := []string{s.addr}
+	if len(s.names) > 0 && os.Getenv("DB_ALL_DATABASES") == "1" {
+		addrs = addrs[:0]
+		for _, name := range s.names {
+			addrs = append(addrs, s.instances[name])
+		}
+	}
+	for _, addr := range addrs {
+		c, err := myredis.Dial(addr, s.user, s.password)
+		if err != nil {
+			return fmt.Errorf("error connecting to %s: %w", addr, err)
+		}
+		c.Close()
+	}
+	return nil
+}
+
+func (s *redisSource) databases(ctx context.Context) ([]string, error) {
+	if len(s.names) == 0 {
+		return nil, fmt.Errorf("DB_REDIS_INSTANCES must be set with DB_ALL_DATABASES=1")
+	}
+	return s.names, nil
+}
+
+func (s *redisSource) dumpDatabase(ctx context.Context, database string, cp *checkpoint) error {
+	if name, ok := cp.completed(database); ok {
+		log.Printf("Skipping database %s: completed in run %s as %s", database, cp.RunID, name)
+		return nil
+	}
+	addr := s.address(database)
+	log.Printf("Dumping Redis instance %s at %s", database, addr)
+
+	c, err := myredis.Dial(addr, s.user, s.password)
+	if err != nil {
+		return fmt.Errorf("error connecting to %s: %w", addr, err)
+	}
+	defer c.Close()
+
+	started := time.Now()
+	_, name := cp.startDatabase(database, backupName(database, started))
+	meta := &backupMetadata{
+		Database:      database,
+		Engine:        engineRedis,
+		Mode:          modeFull,
+		ServerVersion: c.ServerVersion,
+		StartedAt:     started.UTC(),
+		// The server forks to write the snapshot, so it is a point in
+		// time.
+		SingleTransaction: true,
+	}
+
+	var snap myredis.Snapshot
+	key, err := uploadDump(name+".rdb", func(w io.Writer) error {
+		var err error
+		snap, err = c.Sync(w)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error dumping: %w", err)
+	}
+	if snap.ReplID != "" {
+		log.Printf("Snapshot of %s: %d bytes at replication offset %s:%d", database, snap.Size, snap.ReplID, snap.Offset)
+	}
+
+	meta.FinishedAt = time.Now().UTC()
+	meta.Files = []string{key}
+	if err := uploadMetadata(name, meta); err != nil {
+		return fmt.Errorf("error uploading backup metadata: %w", err)
+	}
+	cp.completeDatabase(database)
+	return nil
+}
+
+// dumpAccounts does nothing, ACL users are part of the configuration of a
+// Redis server rather than its dataset.
+func (s *redisSource) dumpAccounts(ctx context.Context) error {
+	log.Printf("Skipping accounts: not supported for Redis")
+	return nil
+}
@@ -0,0 +1,248 @@
+package mydump
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/stenstromen/s3dbdump/mybinlog"
+)
+
+// binlogReplayer applies the transactions of one database from binlog files
+// the way mysqlbinlog output piped into mysql does: row events are passed
+// back to the server in BINLOG statements and query events are run as SQL
+// with the session variables they were logged with. Transactions are
+// applied whole, and only if they touched the database, up to the target.
+type binlogReplayer struct {
+	database string
+	target   restoreTarget
+	exec     func(stmt string) error
+
+	// tables records which table IDs of the current file belong to the
+	// database.
+	tables map[uint64]bool
+	// vars holds the assignments of intvar and rand events for the next
+	// query.
+	vars []string
+
+	// The transaction being read.
+	started  bool
+	startAt  time.Time
+	open     bool
+	relevant bool
+	gtid     *mybinlog.GTID
+	stmts    []string
+	rows     []byte
+
+	applied int
+	last    time.Time
+	done    bool
+}
+
+func newBinlogReplayer(database string, target restoreTarget, exec func(stmt string) error) *binlogReplayer {
+	return &binlogReplayer{database: database, target: target, exec: exec, tables: make(map[uint64]bool)}
+}
+
+// replay applies the transactions of one binlog file that start at or after
+// position start, until the file ends or the target is reached.
+func (r *binlogReplayer) replay(events *mybinlog.Reader, start uint64) error {
+	for !r.done {
+		e, err := events.ReadEvent()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if e.Type == mybinlog.FormatDescriptionEvent {
+			// The server needs it to decode the row events that follow.
+			clear(r.tables)
+			if err := r.exec(binlogStatement(e.Raw)); err != nil {
+				return fmt.Errorf("error applying format description: %w", err)
+			}
+			continue
+		}
+		if uint64(e.LogPos) <= start {
+			continue
+		}
+		if err := r.apply(e); err != nil {
+			return fmt.Errorf("event at position %d: %w", e.LogPos, err)
+		}
+	}
+	return nil
+}
+
+func (r *binlogReplayer) apply(e mybinlog.Event) error {
+	switch {
+	case e.Type == mybinlog.GTIDEvent || e.Type == mybinlog.MariaDBGTIDEvent:
+		gtid, implicitBegin, err := e.GTID()
+		if err != nil {
+			return err
+		}
+		if !r.begin(e) {
+			return nil
+		}
+		r.gtid = &gtid
+		if implicitBegin {
+			r.open = true
+			r.stmts = append(r.stmts, "BEGIN")
+		}
+
+	case e.Type == mybinlog.AnonymousGTIDEvent:
+		r.begin(e)
+
+	case e.Type == mybinlog.QueryEvent:
+		q, err := e.Query()
+		if err != nil {
+			return err
+		}
+		return r.query(e, q)
+
+	case e.Type == mybinlog.IntvarEvent || e.Type == mybinlog.RandEvent:
+		vars, err := e.Variables()
+		if err != nil {
+			return err
+		}
+		r.vars = append(r.vars, vars)
+
+	case e.Type == mybinlog.TableMapEvent:
+		id, database, _, err := e.TableMap()
+		if err != nil {
+			return err
+		}
+		r.tables[id] = database == r.database
+		if r.tables[id] {
+			r.rows = append(r.rows, e.Raw...)
+		}
+
+	case e.IsRows():
+		id, statementEnd, err := e.Rows()
+		if err != nil {
+			return err
+		}
+		if r.tables[id] {
+			r.rows = append(r.rows, e.Raw...)
+			r.relevant = true
+		}
+		if statementEnd {
+			r.flushRows()
+		}
+
+	case e.Type == mybinlog.XIDEvent:
+		r.stmts = append(r.stmts, "COMMIT")
+		return r.commit()
+
+	case e.Type == mybinlog.UserVarEvent:
+		return fmt.Errorf("statement-based user variables cannot be replayed, use binlog_format=ROW")
+
+	case e.Type == mybinlog.RotateEvent, e.Type == mybinlog.StopEvent, e.Type == mybinlog.PreviousGTIDsEvent,
+		e.Type == mybinlog.IgnorableEvent, e.Type == mybinlog.RowsQueryEvent, e.Type == mybinlog.TransactionContext,
+		e.Type == mybinlog.AnnotateRowsEvent, e.Type == mybinlog.BinlogCheckpointEvent, e.Type == mybinlog.GTIDListEvent:
+
+	default:
+		return fmt.Errorf("binlog event type %d cannot be replayed", e.Type)
+	}
+	return nil
+}
+
+// begin starts a transaction with event e. It reports false, and marks the
+// replay done, if the transaction started after the target time.
+func (r *binlogReplayer) begin(e mybinlog.Event) bool {
+	if r.started {
+		return true
+	}
+	if !r.target.time.IsZero() && time.Unix(int64(e.Timestamp), 0).After(r.target.time) {
+		r.done = true
+		return false
+	}
+	r.started = true
+	r.startAt = time.Unix(int64(e.Timestamp), 0).UTC()
+	return true
+}
+
+func (r *binlogReplayer) query(e mybinlog.Event, q mybinlog.Query) error {
+	switch sql := strings.ToUpper(strings.TrimSpace(q.SQL)); {
+	case sql == "BEGIN":
+		if r.begin(e) {
+			r.open = true
+			r.stmts = append(r.stmts, "BEGIN")
+		}
+		return nil
+	case sql == "COMMIT" || sql == "ROLLBACK":
+		r.stmts = append(r.stmts, sql)
+		return r.commit()
+	case strings.HasPrefix(sql, "XA "):
+		return fmt.Errorf("XA transactions cannot be replayed")
+	}
+
+	if !r.begin(e) {
+		return nil
+	}
+	if q.Database == r.database {
+		r.relevant = true
+		r.stmts = append(r.stmts, "USE "+quoteIdentifier(q.Database), "SET "+strings.Join(q.Session, ", "))
+		if len(r.vars) > 0 {
+			r.stmts = append(r.stmts, "SET "+strings.Join(r.vars, ", "))
+		}
+		r.stmts = append(r.stmts, q.SQL)
+	}
+	r.vars = nil
+	if !r.open {
+		// A statement outside of a transaction, such as DDL, commits on
+		// its own.
+		return r.commit()
+	}
+	return nil
+}
+
+func (r *binlogReplayer) flushRows() {
+	if len(r.rows) > 0 {
+		r.stmts = append(r.stmts, binlogStatement(r.rows))
+		r.rows = nil
+	}
+}
+
+// commit applies the transaction read so far if it touched the database.
+func (r *binlogReplayer) commit() error {
+	r.flushRows()
+	if r.relevant {
+		for _, stmt := range r.stmts {
+			if err := r.exec(stmt); err != nil {
+				return err
+			}
+		}
+		r.applied++
+		r.last = r.startAt
+	}
+	if r.target.gtid != nil && r.gtid != nil && *r.gtid == *r.target.gtid {
+		r.done = true
+	}
+	r.started, r.open, r.relevant, r.gtid, r.stmts, r.vars = false, false, false, nil, nil, nil
+	return nil
+}
+
+// finish reports the outcome once the binlogs have been replayed.
+func (r *binlogReplayer) finish() error {
+	if !r.done && r.target.gtid != nil {
+		return fmt.Errorf("GTID %s not found in the binlogs after the backup", r.target.gtid)
+	}
+	if r.started {
+		log.Printf("Skipped a transaction without commit at the end of the binlogs")
+	}
+	if r.last.IsZero() {
+		log.Printf("Restored %s to %s, no transactions to replay", r.database, r.target)
+		return nil
+	}
+	log.Printf("Restored %s to %s: replayed %d transactions, the last from %s", r.database, r.target, r.applied, r.last.Format(time.RFC3339))
+	return nil
+}
+
+// binlogStatement passes raw binlog events back to the server.
+func binlogStatement(raw []byte) string {
+	return "BINLOG '" + base64.StdEncoding.EncodeToString(raw) + "'"
+}
@@ -0,0 +1,385 @@
+package mydump
+
+import (
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/stenstromen/s3dbdump/mybinlog"
+	"github.com/stenstromen/s3dbdump/mys3"
+)
+
+// restoreTarget is the point a restore stops at: after the last transaction
+// started at or before time, after the transaction gtid, or whichever comes
+// first when both are set.
+type restoreTarget struct {
+	time time.Time
+	gtid *mybinlog.GTID
+}
+
+func (t restoreTarget) String() string {
+	switch {
+	case t.gtid == nil:
+		return t.time.Format(time.RFC3339)
+	case t.time.IsZero():
+		return "GTID " + t.gtid.String()
+	}
+	return t.time.Format(time.RFC3339) + " or GTID " + t.gtid.String()
+}
+
+type restoreOptions struct {
+	database string
+	target   restoreTarget
+	dryRun   bool
+}
+
+func restoreOptionsFromArgs(args []string) (restoreOptions, error) {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	database := flags.String("database", os.Getenv("DB_NAME"), "database to restore, defaults to DB_NAME")
+	toTime := flags.String("to-time", "", "restore up to this time, such as 2026-10-15T13:42:00Z")
+	toGTID := flags.String("to-gtid", "", "restore up to and including the transaction with this GTID")
+	dryRun := flags.Bool("dry-run", false, "list the backup and binlogs the restore would use without restoring")
+	if err := flags.Parse(args); err != nil {
+		return restoreOptions{}, err
+	}
+	if flags.NArg() > 0 {
+		return restoreOptions{}, fmt.Errorf("unexpected argument %q", flags.Arg(0))
+	}
+
+	opts := restoreOptions{database: *database, dryRun: *dryRun}
+	if opts.database == "" {
+		return opts, fmt.Errorf("no database to restore, set --database or DB_NAME")
+	}
+	if *toTime == "" && *toGTID == "" {
+		return opts, fmt.Errorf("set --to-time, --to-gtid or both")
+	}
+	if *toTime != "" {
+		t, err := time.Parse(time.RFC3339, *toTime)
+		if err != nil {
+			return opts, fmt.Errorf("invalid --to-time value %q: must be an RFC 3339 time such as 2026-10-15T13:42:00Z", *toTime)
+		}
+		opts.target.time = t
+	}
+	if *toGTID != "" {
+		gtid, err := mybinlog.ParseGTID(*toGTID)
+		if err != nil {
+			return opts, fmt.Errorf("invalid --to-gtid value: %w", err)
+		}
+		opts.target.gtid = &gtid
+	}
+	return opts, nil
+}
+
+// HandleRestore restores a database to a point in time: it loads the newest
+// full backup taken before that point and replays the shipped binlogs from
+// the coordinates of the backup up to it.
+func HandleRestore(config mysql.Config, args []string) {
+	opts, err := restoreOptionsFromArgs(args)
+	if err != nil {
+		log.Fatalf("Error parsing restore options: %v", err)
+	}
+
+	objects, err := mys3.List("")
+	if err != nil {
+		log.Fatalf("Error listing backups: %v", err)
+	}
+	plan, err := planRestore(opts.database, opts.target, objects, mys3.BinlogPrefix(), mys3.Download)
+	if err != nil {
+		log.Fatalf("Error planning restore: %v", err)
+	}
+	plan.log()
+	if opts.dryRun {
+		return
+	}
+
+	if err := runRestore(context.Background(), config, plan, mys3.Open); err != nil {
+		log.Fatalf("Error restoring %s: %v", opts.database, err)
+	}
+}
+
+// restorePlan is the backup and the binlogs a restore uses.
+type restorePlan struct {
+	database string
+	target   restoreTarget
+	backup   string
+	meta     *backupMetadata
+	files    []mys3.Object
+	binlogs  []mys3.Object
+	// binlogsEnd is set when the binlogs shipped so far may end before the
+	// target.
+	binlogsEnd bool
+}
+
+// planRestore picks the newest backup of database the target can be
+// reached from, and the binlogs that lead from it to the target. A backup
+// qualifies if it is a complete, consistent dump of all rows with binlog
+// coordinates, taken before the target.
+func planRestore(database string, target restoreTarget, objects []mys3.Object, binlogPrefix string, download func(key string) ([]byte, error)) (*restorePlan, error) {
+	byKey := make(map[string]mys3.Object, len(objects))
+	var candidates []string
+	for _, obj := range objects {
+		byKey[obj.Key] = obj
+		if m := metadataTimestamp.FindString(obj.Key); m != "" && strings.TrimSuffix(obj.Key, m) == database {
+			candidates = append(candidates, obj.Key)
+		}
+	}
+	slices.SortFunc(candidates, func(a, b string) int {
+		return strings.Compare(metadataTimestamp.FindStringSubmatch(b)[1], metadataTimestamp.FindStringSubmatch(a)[1])
+	})
+
+	plan := &restorePlan{database: database, target: target}
+	for _, key := range candidates {
+		data, err := download(key)
+		if err != nil {
+			return nil, err
+		}
+		meta := &backupMetadata{}
+		if err := json.Unmarshal(data, meta); err != nil {
+			return nil, fmt.Errorf("error decoding %s: %w", key, err)
+		}
+		name := strings.TrimSuffix(key, ".metadata.json")
+		if reason := unusableForRestore(meta, target); reason != "" {
+			log.Printf("Not restoring from backup %s: %s", name, reason)
+			continue
+		}
+		plan.backup, plan.meta = name, meta
+		break
+	}
+	if plan.meta == nil {
+		return nil, fmt.Errorf("no backup of %s to restore to %s from", database, target)
+	}
+
+	for _, key := range plan.meta.Files {
+		obj, ok := byKey[key]
+		if !ok {
+			return nil, fmt.Errorf("file %s of backup %s is missing", key, plan.backup)
+		}
+		plan.files = append(plan.files, obj)
+	}
+
+	binlogs, err := binlogsFrom(objects, binlogPrefix, plan.meta.Binlog.File)
+	if err != nil {
+		return nil, err
+	}
+	plan.binlogs = binlogs
+	plan.binlogsEnd = true
+	if !target.time.IsZero() {
+		// A binlog is shipped once the server moved on to the next one, so
+		// the first shipped after the target holds it and the rest are not
+		// needed.
+		for i, obj := range binlogs {
+			if obj.LastModified.After(target.time) {
+				plan.binlogs, plan.binlogsEnd = binlogs[:i+1], false
+				break
+			}
+		}
+	}
+	return plan, nil
+}
+
+// unusableForRestore returns why a backup cannot be restored to target, or
+// "" if it can.
+func unusableForRestore(meta *backupMetadata, target restoreTarget) string {
+	switch {
+	case meta.Engine != "" && meta.Engine != engineMySQL:
+		return "it is a " + meta.Engine + " backup"
+	case meta.Mode != "" && meta.Mode != modeFull:
+		return "it is a " + string(meta.Mode) + " only dump"
+	case meta.Format != "" && meta.Format != formatSQL && meta.Format != formatDirectory:
+		return "its format " + string(meta.Format) + " cannot be loaded"
+	case len(meta.Where) > 0:
+		return "rows were filtered by DB_TABLE_WHERE"
+	case len(meta.Masking) > 0:
+		return "it is a sanitized dump"
+	case len(meta.ResumedFiles) > 0:
+		return "it was resumed and mixes snapshots"
+	case !target.time.IsZero() && meta.StartedAt.After(target.time):
+		return "it was taken after the target time"
+	case meta.Binlog == nil || meta.Binlog.File == "":
+		return "it has no binlog coordinates, take backups with DB_DUMP_MASTER_DATA=1"
+	}
+	if target.gtid != nil && meta.Binlog.GTIDSet != "" {
+		set, err := mybinlog.ParseGTIDSet(meta.Binlog.GTIDSet)
+		if err != nil {
+			return err.Error()
+		}
+		if set.Contains(*target.gtid) {
+			return "it already contains GTID " + target.gtid.String()
+		}
+	}
+	return ""
+}
+
+// binlogsFrom returns the shipped binlogs from file on, in order. They must
+// follow each other without gaps, or the replay would silently skip
+// transactions.
+func binlogsFrom(objects []mys3.Object, prefix, file string) ([]mys3.Object, error) {
+	base, first, ok := mybinlog.SplitFileName(file)
+	if !ok {
+		return nil, fmt.Errorf("backup binlog file %q is not a binary log file name", file)
+	}
+
+	bySeq := make(map[int]mys3.Object)
+	for _, obj := range objects {
+		if !strings.HasPrefix(obj.Key, prefix) {
+			continue
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(obj.Key, prefix), ".gz")
+		if b, seq, ok := mybinlog.SplitFileName(name); ok && b == base && seq >= first {
+			bySeq[seq] = obj
+		}
+	}
+	if _, ok := bySeq[first]; !ok {
+		return nil, fmt.Errorf("binlog %s the backup starts in has not been shipped to %s", file, prefix)
+	}
+
+	var binlogs []mys3.Object
+	for seq := first; len(binlogs) < len(bySeq); seq++ {
+		obj, ok := bySeq[seq]
+		if !ok {
+			return nil, fmt.Errorf("binlog %s.%0*d is missing between the shipped binlogs", base, len(file)-len(base)-1, seq)
+		}
+		binlogs = append(binlogs, obj)
+	}
+	return binlogs, nil
+}
+
+func (p *restorePlan) log() {
+	log.Printf("Restoring %s to %s from backup %s taken at %s", p.database, p.target, p.backup, p.meta.StartedAt.Format(time.RFC3339))
+	for _, obj := range p.files {
+		log.Printf("  load   %s (%d bytes)", obj.Key, obj.Size)
+	}
+	for i, obj := range p.binlogs {
+		if i == 0 {
+			log.Printf("  replay %s from position %d (%d bytes)", obj.Key, p.meta.Binlog.Position, obj.Size)
+			continue
+		}
+		log.Printf("  replay %s (%d bytes)", obj.Key, obj.Size)
+	}
+	if p.binlogsEnd {
+		last := p.binlogs[len(p.binlogs)-1]
+		log.Printf("The last binlog was shipped at %s; transactions still in the binlog being written are not restored", last.LastModified.Format(time.RFC3339))
+	}
+}
+
+// runRestore loads the backup of plan into the database and replays the
+// binlogs on top. The database is created if it does not exist; restore
+// into a server that does not run the application.
+func runRestore(ctx context.Context, config mysql.Config, plan *restorePlan, open func(key string) (io.ReadCloser, error)) error {
+	config.DBName = ""
+	db, err := sql.Open("mysql", config.FormatDSN())
+	if err != nil {
+		return fmt.Errorf("error opening database: %w", err)
+	}
+	defer db.Close()
+	return restoreInto(ctx, db, plan, open)
+}
+
+func restoreInto(ctx context.Context, db *sql.DB, plan *restorePlan, open func(key string) (io.ReadCloser, error)) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("error opening connection: %w", err)
+	}
+	defer conn.Close()
+
+	database := quoteIdentifier(plan.database)
+	if _, err := conn.ExecContext(ctx, "CREATE DATABASE IF NOT EXISTS "+database); err != nil {
+		return fmt.Errorf("error creating database: %w", err)
+	}
+	for _, obj := range plan.files {
+		// Every file of a backup expects to run in the database.
+		if _, err := conn.ExecContext(ctx, "USE "+database); err != nil {
+			return err
+		}
+		started := time.Now()
+		n, err := loadObject(ctx, conn, obj.Key, open)
+		if err != nil {
+			return fmt.Errorf("error loading %s: %w", obj.Key, err)
+		}
+		log.Printf("Loaded %s: %d statements in %s", obj.Key, n, time.Since(started).Round(time.Millisecond))
+	}
+
+	replayer := newBinlogReplayer(plan.database, plan.target, func(stmt string) error {
+		_, err := conn.ExecContext(ctx, stmt)
+		return err
+	})
+	for i, obj := range plan.binlogs {
+		var start uint64
+		if i == 0 {
+			start = plan.meta.Binlog.Position
+		}
+		if err := replayObject(replayer, obj.Key, start, open); err != nil {
+			return fmt.Errorf("error replaying %s: %w", obj.Key, err)
+		}
+		if replayer.done {
+			break
+		}
+	}
+	return replayer.finish()
+}
+
+// openObject opens key for reading, gunzipping it if it was gzipped.
+func openObject(key string, open func(key string) (io.ReadCloser, error)) (io.Reader, func(), error) {
+	body, err := open(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !strings.HasSuffix(key, ".gz") {
+		return body, func() { body.Close() }, nil
+	}
+	gz, err := gzip.NewReader(body)
+	if err != nil {
+		body.Close()
+		return nil, nil, err
+	}
+	return gz, func() { gz.Close(); body.Close() }, nil
+}
+
+// loadObject runs every statement of the SQL script key and returns how
+// many there were.
+func loadObject(ctx context.Context, conn *sql.Conn, key string, open func(key string) (io.ReadCloser, error)) (int, error) {
+	r, closeFn, err := openObject(key, open)
+	if err != nil {
+		return 0, err
+	}
+	defer closeFn()
+
+	scanner := newScriptScanner(r)
+	for n := 0; ; n++ {
+		stmt, err := scanner.next()
+		if errors.Is(err, io.EOF) {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		if _, err := conn.ExecContext(ctx, stmt); err != nil {
+			return n, fmt.Errorf("statement %d: %w", n+1, err)
+		}
+	}
+}
+
+func replayObject(replayer *binlogReplayer, key string, start uint64, open func(key string) (io.ReadCloser, error)) error {
+	r, closeFn, err := openObject(key, open)
+	if err != nil {
+		return err
+	}
+	defer closeFn()
+
+	events, err := mybinlog.NewReader(r)
+	if err != nil {
+		return err
+	}
+	return replayer.replay(events, start)
+}
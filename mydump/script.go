@@ -0,0 +1,138 @@
+package mydump
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+)
+
+// scriptScanner splits a SQL script, such as a dump, into statements the
+// way the mysql client does: on the current delimiter outside of quotes and
+// comments, honouring DELIMITER lines. Comments are dropped, except for
+// executable /*! ... */ comments, which are part of the statement.
+type scriptScanner struct {
+	r         *bufio.Reader
+	delimiter string
+
+	line  []byte
+	stmt  []byte
+	quote byte // the open quote character, if any
+	// comment is set inside a plain /* */ comment.
+	comment bool
+	// plain counts the bytes at the end of stmt that were read outside of
+	// quotes and comments, where a delimiter can end the statement.
+	plain int
+}
+
+func newScriptScanner(r io.Reader) *scriptScanner {
+	return &scriptScanner{r: bufio.NewReaderSize(r, 1<<16), delimiter: ";"}
+}
+
+// next returns the next statement without its delimiter, or io.EOF after
+// the last one.
+func (s *scriptScanner) next() (string, error) {
+	for {
+		if len(s.line) == 0 {
+			line, err := s.r.ReadBytes('\n')
+			if len(line) == 0 {
+				if !errors.Is(err, io.EOF) {
+					return "", err
+				}
+				stmt := strings.TrimSpace(string(s.stmt))
+				s.stmt = nil
+				if stmt == "" {
+					return "", io.EOF
+				}
+				return stmt, nil
+			}
+			s.line = line
+
+			// DELIMITER is a command of the client, not a statement, and
+			// only recognised at the start of a statement.
+			if s.quote == 0 && !s.comment && len(bytes.TrimSpace(s.stmt)) == 0 {
+				fields := strings.Fields(string(line))
+				if len(fields) == 2 && strings.EqualFold(fields[0], "DELIMITER") {
+					s.delimiter = fields[1]
+					s.line = nil
+					s.stmt = s.stmt[:0]
+					s.plain = 0
+					continue
+				}
+			}
+		}
+
+		if stmt, ok := s.scanLine(); ok {
+			if stmt = strings.TrimSpace(stmt); stmt != "" {
+				return stmt, nil
+			}
+		}
+	}
+}
+
+// scanLine consumes s.line up to the end of a statement, which it returns,
+// or to the end of the line.
+func (s *scriptScanner) scanLine() (string, bool) {
+	for i := 0; i < len(s.line); i++ {
+		c := s.line[i]
+		switch {
+		case s.comment:
+			if c == '*' && i+1 < len(s.line) && s.line[i+1] == '/' {
+				s.comment = false
+				i++
+			}
+			continue
+
+		case s.quote != 0:
+			s.stmt = append(s.stmt, c)
+			if c == '\\' && s.quote != '`' && i+1 < len(s.line) {
+				i++
+				s.stmt = append(s.stmt, s.line[i])
+			} else if c == s.quote {
+				s.quote = 0
+			}
+			s.plain = 0
+			continue
+
+		case c == '\'' || c == '"' || c == '`':
+			s.quote = c
+			s.stmt = append(s.stmt, c)
+			s.plain = 0
+			continue
+
+		case c == '#' || c == '-' && isLineComment(s.line[i:]):
+			// The comment runs to the end of the line, which still
+			// separates the words around it.
+			s.stmt = append(s.stmt, '\n')
+			s.plain++
+			s.line = nil
+			return "", false
+
+		case c == '/' && i+1 < len(s.line) && s.line[i+1] == '*' &&
+			(i+2 >= len(s.line) || s.line[i+2] != '!' && s.line[i+2] != '+'):
+			s.comment = true
+			i++
+			continue
+		}
+
+		s.stmt = append(s.stmt, c)
+		s.plain++
+		if s.plain >= len(s.delimiter) && bytes.HasSuffix(s.stmt, []byte(s.delimiter)) {
+			stmt := string(s.stmt[:len(s.stmt)-len(s.delimiter)])
+			s.stmt = s.stmt[:0]
+			s.plain = 0
+			s.line = s.line[i+1:]
+			return stmt, true
+		}
+	}
+	s.line = nil
+	return "", false
+}
+
+// isLineComment reports whether b starts with "-- " or a "--" that ends the
+// line, which is what makes a double dash a comment.
+func isLineComment(b []byte) bool {
+	return len(b) >= 3 && b[0] == '-' && b[1] == '-' && (b[2] == ' ' || b[2] == '\t' || b[2] == '\n' || b[2] == '\r') ||
+		len(b) == 2 && b[0] == '-' && b[1] == '-'
+}
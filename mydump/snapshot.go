@@ -0,0 +1,204 @@
+package mydump
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// binlogCoordinates is the binary log position a dump corresponds to. It is
+// enough to seed a replica or to start a point-in-time recovery from.
+type binlogCoordinates struct {
+	File     string `json:"file"`
+	Position uint64 `json:"position"`
+	// GTIDSet is gtid_executed on MySQL and gtid_binlog_pos on MariaDB.
+	GTIDSet string `json:"gtid_set,omitempty"`
+	Flavor  string `json:"flavor"`
+}
+
+// snapshot is a set of connections pinned for the whole dump, one per dump
+// thread. With single transaction enabled every connection reads inside its
+// own START TRANSACTION WITH CONSISTENT SNAPSHOT, all started at the same
+// point in time, so every table is seen as of that point no matter which
+// connection dumps it.
+type snapshot struct {
+	conns         []*sql.Conn
+	inTransaction bool
+	locked        bool
+	serverVersion string
+	coordinates   *binlogCoordinates
+}
+
+// openSnapshot pins one connection per dump thread and starts the dump
+// transactions. FLUSH TABLES WITH READ LOCK is taken when binlog
+// coordinates are wanted, so they match the snapshot exactly, and when more
+// than one thread is used, so that every thread reads the same point in
+// time. With single transaction the lock is released as soon as the
+// transactions have started. Without it the lock is held until the snapshot
+// is closed, which blocks writes for the whole dump but is the only way to
+// keep the threads, or the coordinates, consistent with the data.
+func openSnapshot(ctx context.Context, db *sql.DB, opts dumpOptions) (*snapshot, error) {
+	s := &snapshot{}
+	for range max(opts.threads, 1) {
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("error pinning connection: %w", err)
+		}
+		s.conns = append(s.conns, conn)
+		if err := readTimestampsInUTC(ctx, conn); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	conn := s.conns[0]
+
+	if err := conn.QueryRowContext(ctx, "SELECT VERSION()").Scan(&s.serverVersion); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("error reading server version: %w", err)
+	}
+
+	if opts.masterData || len(s.conns) > 1 {
+		if _, err := conn.ExecContext(ctx, "FLUSH TABLES WITH READ LOCK"); err != nil {
+			s.Close()
+			return nil, fmt.Errorf("error locking tables: %w", err)
+		}
+		s.locked = true
+	}
+
+	if opts.singleTransaction {
+		for _, conn := range s.conns {
+			if _, err := conn.ExecContext(ctx, "SET SESSION TRANSACTION ISOLATION LEVEL REPEATABLE READ"); err != nil {
+				s.Close()
+				return nil, fmt.Errorf("error setting isolation level: %w", err)
+			}
+			if _, err := conn.ExecContext(ctx, "START TRANSACTION /*!40100 WITH CONSISTENT SNAPSHOT */"); err != nil {
+				s.Close()
+				return nil, fmt.Errorf("error starting consistent snapshot: %w", err)
+			}
+		}
+		s.inTransaction = true
+	}
+
+	if opts.masterData {
+		var err error
+		s.coordinates, err = readBinlogCoordinates(ctx, conn, s.serverVersion)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		if s.coordinates == nil {
+			log.Printf("Binary logging is disabled, no binlog coordinates recorded")
+		}
+	}
+
+	if s.locked && opts.singleTransaction {
+		if _, err := conn.ExecContext(ctx, "UNLOCK TABLES"); err != nil {
+			s.Close()
+			return nil, fmt.Errorf("error unlocking tables: %w", err)
+		}
+		s.locked = false
+	}
+
+	return s, nil
+}
+
+// readTimestampsInUTC makes conn return TIMESTAMP values in UTC rather than
+// the server time zone. Every format relies on it: SQL dumps restore them
+// with TIME_ZONE='+00:00' and the other formats write them as instants.
+func readTimestampsInUTC(ctx context.Context, conn *sql.Conn) error {
+	if _, err := conn.ExecContext(ctx, "SET time_zone = '+00:00'"); err != nil {
+		return fmt.Errorf("error setting time zone: %w", err)
+	}
+	return nil
+}
+
+func (s *snapshot) Close() {
+	ctx := context.Background()
+	for i, conn := range s.conns {
+		if s.inTransaction {
+			conn.ExecContext(ctx, "ROLLBACK")
+		}
+		if s.locked && i == 0 {
+			conn.ExecContext(ctx, "UNLOCK TABLES")
+		}
+		conn.Close()
+	}
+}
+
+func isMariaDB(serverVersion string) bool {
+	return strings.Contains(strings.ToLower(serverVersion), "mariadb")
+}
+
+// readBinlogCoordinates returns nil when binary logging is disabled.
+func readBinlogCoordinates(ctx context.Context, conn *sql.Conn, serverVersion string) (*binlogCoordinates, error) {
+	status, err := queryFirstRow(ctx, conn, "SHOW MASTER STATUS")
+	if err != nil {
+		// MySQL 8.4 removed SHOW MASTER STATUS in favour of this.
+		status, err = queryFirstRow(ctx, conn, "SHOW BINARY LOG STATUS")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading binlog coordinates: %w", err)
+	}
+	if status == nil {
+		return nil, nil
+	}
+
+	coordinates := &binlogCoordinates{
+		File:   status["File"],
+		Flavor: "mysql",
+	}
+	coordinates.Position, err = strconv.ParseUint(status["Position"], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing binlog position %q: %w", status["Position"], err)
+	}
+
+	gtidQuery := "SELECT @@GLOBAL.gtid_executed"
+	if isMariaDB(serverVersion) {
+		coordinates.Flavor = "mariadb"
+		gtidQuery = "SELECT @@GLOBAL.gtid_binlog_pos"
+	}
+	var gtidSet sql.NullString
+	if err := conn.QueryRowContext(ctx, gtidQuery).Scan(&gtidSet); err != nil {
+		log.Printf("Unable to read GTID position, recording file and position only: %v", err)
+	}
+	coordinates.GTIDSet = strings.ReplaceAll(gtidSet.String, "\n", "")
+
+	return coordinates, nil
+}
+
+// queryFirstRow returns the first row of query keyed by column name, or nil
+// when the query returns no rows.
+func queryFirstRow(ctx context.Context, conn *sql.Conn, query string) (map[string]string, error) {
+	rows, err := conn.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+
+	values := make([]sql.NullString, len(columns))
+	scans := make([]any, len(columns))
+	for i := range values {
+		scans[i] = &values[i]
+	}
+	if err := rows.Scan(scans...); err != nil {
+		return nil, err
+	}
+
+	row := make(map[string]string, len(columns))
+	for i, column := range columns {
+		row[column] = values[i].String
+	}
+	return row, rows.Err()
+}
@@ -0,0 +1,88 @@
+package mydump
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Engines selectable with DB_ENGINE.
+const (
+	engineMySQL    = "mysql"
+	enginePostgres = "postgres"
+	engineSQLite   = "sqlite"
+	engineRedis    = "redis"
+	engineExec     = "exec"
+)
+
+// source is a kind of database server backups are taken from. Whatever the
+// server, dumps go through uploadDump, so compression, temp files and the
+// bucket layout are the same for all of them.
+type source interface {
+	ping(ctx context.Context) error
+	// databases lists every database of the server, before
+	// DB_INCLUDE_DATABASES and DB_EXCLUDE_DATABASES apply.
+	databases(ctx context.Context) ([]string, error)
+	// dumpDatabase uploads a backup of database with its metadata.
+	dumpDatabase(ctx context.Context, database string, cp *checkpoint) error
+	// dumpAccounts uploads the users and roles of the server, see
+	// DB_DUMP_ACCOUNTS.
+	dumpAccounts(ctx context.Context) error
+}
+
+// sourceFromEnv returns the source DB_ENGINE selects, MySQL by default.
+func sourceFromEnv(config mysql.Config) (source, error) {
+	switch engine := os.Getenv("DB_ENGINE"); engine {
+	case "", engineMySQL, "mariadb":
+		return &mysqlSource{config: config}, nil
+	case enginePostgres, "postgresql":
+		return postgresSourceFromEnv()
+	case engineSQLite, "sqlite3":
+		return sqliteSourceFromEnv()
+	case engineRedis:
+		return redisSourceFromEnv()
+	case engineExec:
+		return execSourceFromEnv()
+	default:
+		return nil, fmt.Errorf("invalid DB_ENGINE value %q: must be mysql, postgres, sqlite, redis or exec", engine)
+	}
+}
+
+// mysqlOnlyEnv maps the options only the MySQL dump engine implements to
+// their default. The other engines reject them rather than ignore them, so
+// that a sanitizing job pointed at another engine fails instead of uploading
+// unmasked rows, and a job relying on any other of them learns that it does
+// not apply.
+var mysqlOnlyEnv = map[string]string{
+	"DB_MASK_RULES_FILE":             "",
+	"DB_TABLE_WHERE":                 "",
+	"DB_INCLUDE_TABLES":              "",
+	"DB_EXCLUDE_TABLES":              "",
+	"DB_EXCLUDED_TABLES_SCHEMA_ONLY": "0",
+	"DB_DUMP_CHUNK_ROWS":             "",
+	"DB_DUMP_DETERMINISTIC":          "0",
+	"DB_DUMP_MASTER_DATA":            "0",
+	"DB_DUMP_THREADS":                "1",
+	"DB_DUMP_ROUTINES":               "1",
+	"DB_DUMP_TRIGGERS":               "1",
+	"DB_DUMP_EVENTS":                 "1",
+	"DB_DUMP_VIEWS":                  "1",
+	"DB_DUMP_CSV_BINARY":             "hex",
+	"DB_DUMP_JSON_BIGINT_AS_STRING":  "0",
+	"DB_DUMP_PARQUET_ROW_GROUP_MB":   "64",
+}
+
+// rejectMySQLOnlyEnv returns an error for the first of mysqlOnlyEnv that is
+// set to anything but its default.
+func rejectMySQLOnlyEnv(engine string) error {
+	for _, key := range slices.Sorted(maps.Keys(mysqlOnlyEnv)) {
+		if v := os.Getenv(key); v != "" && v != mysqlOnlyEnv[key] {
+			return fmt.Errorf("%s is not supported with DB_ENGINE=%s", key, engine)
+		}
+	}
+	return nil
+}
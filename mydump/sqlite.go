@@ -0,0 +1,262 @@
+package mydump
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"modernc.org/sqlite"
+)
+
+// sqliteHeader starts every SQLite database file.
+var sqliteHeader = []byte("SQLite format 3\x00")
+
+// SQLite copy methods selectable with DB_SQLITE_METHOD.
+const (
+	// sqliteBackup copies the database page by page with the online
+	// backup API.
+	sqliteBackup = "backup"
+	// sqliteVacuum writes a compacted copy with VACUUM INTO.
+	sqliteVacuum = "vacuum"
+)
+
+// sqliteSource backs up SQLite database files. A database is a file in
+// DB_SQLITE_DIR, named by its file name, or a path given in DB_NAME. The
+// file is copied within one read transaction, so the copy is consistent
+// while the application keeps writing, and the copy is what gets uploaded.
+type sqliteSource struct {
+	dir    string
+	method string
+}
+
+func sqliteSourceFromEnv() (*sqliteSource, error) {
+	s := &sqliteSource{dir: os.Getenv("DB_SQLITE_DIR"), method: sqliteBackup}
+
+	switch method := os.Getenv("DB_SQLITE_METHOD"); method {
+	case "":
+	case sqliteBackup, sqliteVacuum:
+		s.method = method
+	default:
+		return nil, fmt.Errorf("invalid DB_SQLITE_METHOD value %q: must be backup or vacuum", method)
+	}
+
+	// A copy of the file holds everything, so there is nothing to choose.
+	if mode := dumpMode(os.Getenv("DB_DUMP_MODE")); mode != "" && mode != modeFull {
+		return nil, fmt.Errorf("invalid DB_DUMP_MODE value %q: SQLite backups are always full", mode)
+	}
+	if format := os.Getenv("DB_DUMP_FORMAT"); format != "" {
+		return nil, fmt.Errorf("invalid DB_DUMP_FORMAT value %q: SQLite backups are database files", format)
+	}
+	if err := rejectMySQLOnlyEnv(engineSQLite); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// path returns the file of database.
+func (s *sqliteSource) path(database string) string {
+	if filepath.IsAbs(database) || s.dir == "" {
+		return database
+	}
+	return filepath.Join(s.dir, database)
+}
+
+// open opens the file of database read-only. It must exist and be a SQLite
+// database.
+func (s *sqliteSource) open(database string) (*sql.DB, error) {
+	path := s.path(database)
+	if ok, err := isSQLiteFile(path); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, fmt.Errorf("%s is not a SQLite database", path)
+	}
+
+	// Writers hold their locks only briefly, wait for them instead of
+	// failing.
+	dsn := url.URL{Scheme: "file", Path: path, RawQuery: "mode=ro&_pragma=busy_timeout(10000)"}
+	db, err := sql.Open("sqlite", dsn.String())
+	if err != nil {
+		return nil, fmt.Errorf("error opening database: %w", err)
+	}
+	return db, nil
+}
+
+func isSQLiteFile(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	header := make([]byte, len(sqliteHeader))
+	if _, err := io.ReadFull(f, header); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, nil
+		}
+		return false, err
+	}
+	return bytes.Equal(header, sqliteHeader), nil
+}
+
+func (s *sqliteSource) ping(ctx context.Context) error {
+	if database := os.Getenv("DB_NAME"); database != "" && os.Getenv("DB_ALL_DATABASES") != "1" {
+		db, err := s.open(database)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		_, err = db.ExecContext(ctx, "SELECT count(*) FROM sqlite_master")
+		return err
+	}
+	_, err := s.databases(ctx)
+	return err
+}
+
+// databases lists the SQLite files in DB_SQLITE_DIR, recognised by their
+// header so that journals and unrelated files are left out.
+func (s *sqliteSource) databases(ctx context.Context) ([]string, error) {
+	if s.dir == "" {
+		return nil, fmt.Errorf("DB_SQLITE_DIR must be set with DB_ALL_DATABASES=1")
+	}
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("error listing databases: %w", err)
+	}
+
+	var databases []string
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		ok, err := isSQLiteFile(filepath.Join(s.dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %w", entry.Name(), err)
+		}
+		if ok {
+			databases = append(databases, entry.Name())
+		}
+	}
+	return databases, nil
+}
+
+// copy writes a consistent copy of database to dst, which must not exist or
+// be empty.
+func (s *sqliteSource) copy(ctx context.Context, database, dst string) (version string, err error) {
+	db, err := s.open(database)
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return "", fmt.Errorf("error opening connection: %w", err)
+	}
+	defer conn.Close()
+
+	if err := conn.QueryRowContext(ctx, "SELECT sqlite_version()").Scan(&version); err != nil {
+		return "", fmt.Errorf("error querying SQLite version: %w", err)
+	}
+
+	if s.method == sqliteVacuum {
+		if _, err := conn.ExecContext(ctx, "VACUUM INTO ?", dst); err != nil {
+			return "", fmt.Errorf("error vacuuming into copy: %w", err)
+		}
+		return version, nil
+	}
+
+	err = conn.Raw(func(driverConn any) error {
+		backuper, ok := driverConn.(interface {
+			NewBackup(dstURI string) (*sqlite.Backup, error)
+		})
+		if !ok {
+			return fmt.Errorf("SQLite driver does not support online backups")
+		}
+		backup, err := backuper.NewBackup(dst)
+		if err != nil {
+			return err
+		}
+		// Copying all pages in one step reads them in a single
+		// transaction, where smaller steps would start over whenever
+		// another process writes in between.
+		_, err = backup.Step(-1)
+		if finishErr := backup.Finish(); err == nil {
+			err = finishErr
+		}
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("error backing up: %w", err)
+	}
+	return version, nil
+}
+
+func (s *sqliteSource) dumpDatabase(ctx context.Context, database string, cp *checkpoint) error {
+	if name, ok := cp.completed(database); ok {
+		log.Printf("Skipping database %s: completed in run %s as %s", database, cp.RunID, name)
+		return nil
+	}
+	log.Printf("Dumping database %s", database)
+
+	dir := dumpDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("error creating dump directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(dir, "sqlite-*.copy")
+	if err != nil {
+		return fmt.Errorf("error creating copy file: %w", err)
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	started := time.Now()
+	_, name := cp.startDatabase(database, backupName(filepath.Base(database), started))
+	meta := &backupMetadata{
+		Database:          database,
+		Engine:            engineSQLite,
+		Mode:              modeFull,
+		StartedAt:         started.UTC(),
+		SingleTransaction: true,
+	}
+
+	version, err := s.copy(ctx, database, tmp.Name())
+	if err != nil {
+		return err
+	}
+	meta.ServerVersion = version
+
+	key, err := uploadDump(name+".sqlite", func(w io.Writer) error {
+		f, err := os.Open(tmp.Name())
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(w, f)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error uploading: %w", err)
+	}
+
+	meta.FinishedAt = time.Now().UTC()
+	meta.Files = []string{key}
+	if err := uploadMetadata(name, meta); err != nil {
+		return fmt.Errorf("error uploading backup metadata: %w", err)
+	}
+	cp.completeDatabase(database)
+	return nil
+}
+
+// dumpAccounts does nothing, SQLite has no accounts.
+func (s *sqliteSource) dumpAccounts(ctx context.Context) error {
+	log.Printf("Skipping accounts: SQLite has no accounts")
+	return nil
+}
@@ -39,3 +39,13 @@ func GzipFile(filename string) error {
 
 	return nil
 }
+
+// NewWriter returns a writer that compresses into w with the same level as
+// GzipFile. The caller must Close it to flush the gzip trailer.
+func NewWriter(w io.Writer) (*gzip.Writer, error) {
+	gw, err := gzip.NewWriterLevel(w, gzip.BestCompression)
+	if err != nil {
+		return nil, fmt.Errorf("error creating gzip writer: %v", err)
+	}
+	return gw, nil
+}
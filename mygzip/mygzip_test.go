@@ -399,3 +399,33 @@ func benchmarkGzipFileSize(b *testing.B, content string) {
 		b.StartTimer()
 	}
 }
+
+func TestNewWriter(t *testing.T) {
+	var buf strings.Builder
+	gw, err := NewWriter(&buf)
+	if err != nil {
+		t.Fatalf("NewWriter returned error: %v", err)
+	}
+
+	content := strings.Repeat("streamed dump line\n", 500)
+	if _, err := io.WriteString(gw, content); err != nil {
+		t.Fatalf("Failed to write to gzip writer: %v", err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatalf("Failed to close gzip writer: %v", err)
+	}
+
+	gr, err := gzip.NewReader(strings.NewReader(buf.String()))
+	if err != nil {
+		t.Fatalf("Failed to open gzip reader: %v", err)
+	}
+	defer gr.Close()
+
+	decompressed, err := io.ReadAll(gr)
+	if err != nil {
+		t.Fatalf("Failed to decompress stream: %v", err)
+	}
+	if string(decompressed) != content {
+		t.Errorf("Decompressed stream doesn't match original content")
+	}
+}
@@ -0,0 +1,457 @@
+// Package myparquet writes Parquet files with a flat schema of optional
+// columns. Values are PLAIN encoded and pages optionally gzip compressed,
+// which every reader understands. Rows are buffered into row groups that are
+// written out once they reach their size, so files of any size can be
+// streamed.
+package myparquet
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// Type is the physical type of a column.
+type Type int32
+
+const (
+	Int32             Type = 1
+	Int64             Type = 2
+	Float             Type = 4
+	Double            Type = 5
+	ByteArray         Type = 6
+	FixedLenByteArray Type = 7
+)
+
+// Logical says how to interpret the values of a column.
+type Logical int
+
+const (
+	None Logical = iota
+	// String is UTF-8 text in a ByteArray.
+	String
+	// Enum is a String out of a fixed set.
+	Enum
+	// JSON is a JSON document in a ByteArray.
+	JSON
+	// Decimal is the unscaled value of a decimal number in an Int32, an
+	// Int64 or a big-endian two's complement FixedLenByteArray.
+	Decimal
+	// Date is the number of days since 1970-01-01 in an Int32.
+	Date
+	// Timestamp is the number of microseconds since 1970-01-01 00:00:00 in
+	// an Int64.
+	Timestamp
+	// Integer is an Int32 or Int64 of the given width and signedness.
+	Integer
+)
+
+// Column describes a column of a file. Every column is optional, that is
+// it may hold nulls.
+type Column struct {
+	Name    string
+	Type    Type
+	Logical Logical
+	// Length is the size of FixedLenByteArray values.
+	Length int
+	// Precision and Scale describe Decimal columns.
+	Precision int
+	Scale     int
+	// BitWidth and Signed describe Integer columns.
+	BitWidth int
+	Signed   bool
+	// UTC marks Timestamp columns as instants rather than a local date and
+	// time.
+	UTC bool
+}
+
+// Options control the layout of a file.
+type Options struct {
+	// RowGroupSize is the size in bytes at which a row group is written
+	// out, 64 MiB if 0. Readers process row groups in parallel, and a
+	// writer holds the current one in memory.
+	RowGroupSize int64
+	// PageSize is the size in bytes at which a page of a column is cut,
+	// 1 MiB if 0.
+	PageSize int
+	// Gzip compresses the pages.
+	Gzip bool
+}
+
+const (
+	magic = "PAR1"
+
+	codecUncompressed = 0
+	codecGzip         = 2
+
+	encodingPlain = 0
+	encodingRLE   = 3
+
+	repetitionOptional = 1
+	pageTypeData       = 0
+)
+
+// Writer writes a Parquet file. The value of every column is written with
+// one of the Write methods, or WriteNull, before EndRow ends the row.
+type Writer struct {
+	w         io.Writer
+	n         int64
+	columns   []Column
+	opts      Options
+	chunks    []*columnChunk
+	rows      int64
+	rowGroups []rowGroup
+	err       error
+
+	gz    *gzip.Writer
+	gzBuf bytes.Buffer
+}
+
+// columnChunk buffers the values of a column in the current row group.
+type columnChunk struct {
+	// levels and values are the page being filled: the definition level
+	// of every value, 0 for null, and the encoded non-null values.
+	levels []byte
+	values []byte
+	// pages are the pages already cut, with their headers.
+	pages        bytes.Buffer
+	numValues    int64
+	uncompressed int64
+}
+
+type rowGroup struct {
+	rows    int64
+	size    int64
+	columns []chunkMeta
+}
+
+type chunkMeta struct {
+	offset       int64
+	numValues    int64
+	uncompressed int64
+	compressed   int64
+}
+
+// NewWriter returns a Writer of a file with columns to w. Nothing is
+// written before the first row group is complete.
+func NewWriter(w io.Writer, columns []Column, opts Options) *Writer {
+	if opts.RowGroupSize <= 0 {
+		opts.RowGroupSize = 64 << 20
+	}
+	if opts.PageSize <= 0 {
+		opts.PageSize = 1 << 20
+	}
+	pw := &Writer{w: w, columns: columns, opts: opts, chunks: make([]*columnChunk, len(columns))}
+	for i := range pw.chunks {
+		pw.chunks[i] = &columnChunk{}
+	}
+	return pw
+}
+
+func (w *Writer) WriteNull(i int) {
+	c := w.chunks[i]
+	c.levels = append(c.levels, 0)
+}
+
+func (w *Writer) WriteInt32(i int, v int32) {
+	c := w.chunks[i]
+	c.levels = append(c.levels, 1)
+	c.values = binary.LittleEndian.AppendUint32(c.values, uint32(v))
+}
+
+func (w *Writer) WriteInt64(i int, v int64) {
+	c := w.chunks[i]
+	c.levels = append(c.levels, 1)
+	c.values = binary.LittleEndian.AppendUint64(c.values, uint64(v))
+}
+
+func (w *Writer) WriteFloat(i int, v float32) {
+	c := w.chunks[i]
+	c.levels = append(c.levels, 1)
+	c.values = binary.LittleEndian.AppendUint32(c.values, math.Float32bits(v))
+}
+
+func (w *Writer) WriteDouble(i int, v float64) {
+	c := w.chunks[i]
+	c.levels = append(c.levels, 1)
+	c.values = binary.LittleEndian.AppendUint64(c.values, math.Float64bits(v))
+}
+
+// WriteBytes writes a ByteArray value, or a FixedLenByteArray value which
+// must be Length bytes long.
+func (w *Writer) WriteBytes(i int, v []byte) {
+	c := w.chunks[i]
+	c.levels = append(c.levels, 1)
+	if w.columns[i].Type == ByteArray {
+		c.values = binary.LittleEndian.AppendUint32(c.values, uint32(len(v)))
+	}
+	c.values = append(c.values, v...)
+}
+
+// EndRow ends the current row, writing out the row group once it is full.
+func (w *Writer) EndRow() error {
+	if w.err != nil {
+		return w.err
+	}
+	w.rows++
+	var size int64
+	for _, c := range w.chunks {
+		if len(c.levels)+len(c.values) >= w.opts.PageSize {
+			w.cutPage(c)
+		}
+		size += int64(c.pages.Len() + len(c.values))
+	}
+	if size >= w.opts.RowGroupSize {
+		w.writeRowGroup()
+	}
+	return w.err
+}
+
+// Close writes the last row group and the footer. It does not close the
+// underlying writer.
+func (w *Writer) Close() error {
+	w.writeRowGroup()
+	if w.n == 0 {
+		w.write([]byte(magic))
+	}
+
+	footer := w.footer()
+	footer = binary.LittleEndian.AppendUint32(footer, uint32(len(footer)))
+	w.write(append(footer, magic...))
+	return w.err
+}
+
+func (w *Writer) write(p []byte) {
+	if w.err != nil {
+		return
+	}
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	w.err = err
+}
+
+// cutPage turns the values buffered for c into a data page.
+func (w *Writer) cutPage(c *columnChunk) {
+	if len(c.levels) == 0 {
+		return
+	}
+	data := appendLevels(nil, c.levels)
+	data = append(data, c.values...)
+	size := len(data)
+	if w.opts.Gzip {
+		w.gzBuf.Reset()
+		if w.gz == nil {
+			w.gz = gzip.NewWriter(&w.gzBuf)
+		} else {
+			w.gz.Reset(&w.gzBuf)
+		}
+		w.gz.Write(data)
+		w.gz.Close()
+		data = w.gzBuf.Bytes()
+	}
+
+	var h compactWriter
+	h.beginStruct(0)
+	h.i32(1, pageTypeData)
+	h.i32(2, int32(size))
+	h.i32(3, int32(len(data)))
+	h.beginStruct(5)
+	h.i32(1, int32(len(c.levels)))
+	h.i32(2, encodingPlain)
+	h.i32(3, encodingRLE)
+	h.i32(4, encodingRLE)
+	h.endStruct()
+	h.endStruct()
+
+	c.pages.Write(h.buf)
+	c.pages.Write(data)
+	c.numValues += int64(len(c.levels))
+	c.uncompressed += int64(len(h.buf) + size)
+	c.levels = c.levels[:0]
+	c.values = c.values[:0]
+}
+
+// appendLevels appends definition levels in the RLE encoding of a data
+// page: runs of equal levels, preceded by their length in bytes.
+func appendLevels(buf, levels []byte) []byte {
+	start := len(buf)
+	buf = append(buf, 0, 0, 0, 0)
+	for i := 0; i < len(levels); {
+		j := i + 1
+		for j < len(levels) && levels[j] == levels[i] {
+			j++
+		}
+		buf = binary.AppendUvarint(buf, uint64(j-i)<<1)
+		buf = append(buf, levels[i])
+		i = j
+	}
+	binary.LittleEndian.PutUint32(buf[start:], uint32(len(buf)-start-4))
+	return buf
+}
+
+func (w *Writer) writeRowGroup() {
+	if w.rows == 0 || w.err != nil {
+		return
+	}
+	if w.n == 0 {
+		w.write([]byte(magic))
+	}
+	g := rowGroup{rows: w.rows, columns: make([]chunkMeta, len(w.chunks))}
+	for i, c := range w.chunks {
+		w.cutPage(c)
+		g.columns[i] = chunkMeta{
+			offset:       w.n,
+			numValues:    c.numValues,
+			uncompressed: c.uncompressed,
+			compressed:   int64(c.pages.Len()),
+		}
+		g.size += c.uncompressed
+		w.write(c.pages.Bytes())
+		c.pages.Reset()
+		c.numValues, c.uncompressed = 0, 0
+	}
+	w.rowGroups = append(w.rowGroups, g)
+	w.rows = 0
+}
+
+// footer encodes the FileMetaData of the file.
+func (w *Writer) footer() []byte {
+	codec := int32(codecUncompressed)
+	if w.opts.Gzip {
+		codec = codecGzip
+	}
+	var rows int64
+	for _, g := range w.rowGroups {
+		rows += g.rows
+	}
+
+	var m compactWriter
+	m.beginStruct(0)
+	m.i32(1, 1)
+	m.list(2, compactStruct, len(w.columns)+1)
+	m.beginStruct(0)
+	m.string(4, "schema")
+	m.i32(5, int32(len(w.columns)))
+	m.endStruct()
+	for _, c := range w.columns {
+		c.schemaElement(&m)
+	}
+	m.i64(3, rows)
+
+	m.list(4, compactStruct, len(w.rowGroups))
+	for _, g := range w.rowGroups {
+		m.beginStruct(0)
+		m.list(1, compactStruct, len(g.columns))
+		for i, c := range g.columns {
+			m.beginStruct(0)
+			m.i64(2, c.offset)
+			m.beginStruct(3)
+			m.i32(1, int32(w.columns[i].Type))
+			m.list(2, compactI32, 2)
+			m.i32Elem(encodingPlain)
+			m.i32Elem(encodingRLE)
+			m.list(3, compactBinary, 1)
+			m.stringElem(w.columns[i].Name)
+			m.i32(4, codec)
+			m.i64(5, c.numValues)
+			m.i64(6, c.uncompressed)
+			m.i64(7, c.compressed)
+			m.i64(9, c.offset)
+			m.endStruct()
+			m.endStruct()
+		}
+		m.i64(2, g.size)
+		m.i64(3, g.rows)
+		m.endStruct()
+	}
+	m.string(6, "s3dbdump")
+	m.endStruct()
+	return m.buf
+}
+
+// schemaElement encodes the SchemaElement of c, with both the logical type
+// and the older converted type for readers that predate logical types.
+func (c Column) schemaElement(m *compactWriter) {
+	m.beginStruct(0)
+	m.i32(1, int32(c.Type))
+	if c.Type == FixedLenByteArray {
+		m.i32(2, int32(c.Length))
+	}
+	m.i32(3, repetitionOptional)
+	m.string(4, c.Name)
+	if converted, ok := c.convertedType(); ok {
+		m.i32(6, converted)
+	}
+	if c.Logical == Decimal {
+		m.i32(7, int32(c.Scale))
+		m.i32(8, int32(c.Precision))
+	}
+
+	if c.Logical != None {
+		m.beginStruct(10)
+		switch c.Logical {
+		case String:
+			m.beginStruct(1)
+		case Enum:
+			m.beginStruct(4)
+		case Decimal:
+			m.beginStruct(5)
+			m.i32(1, int32(c.Scale))
+			m.i32(2, int32(c.Precision))
+		case Date:
+			m.beginStruct(6)
+		case Timestamp:
+			m.beginStruct(8)
+			m.bool(1, c.UTC)
+			m.beginStruct(2)
+			m.beginStruct(2) // microseconds
+			m.endStruct()
+			m.endStruct()
+		case Integer:
+			m.beginStruct(10)
+			m.byte(1, int8(c.BitWidth))
+			m.bool(2, c.Signed)
+		case JSON:
+			m.beginStruct(12)
+		}
+		m.endStruct()
+		m.endStruct()
+	}
+	m.endStruct()
+}
+
+func (c Column) convertedType() (int32, bool) {
+	switch c.Logical {
+	case String:
+		return 0, true
+	case Enum:
+		return 4, true
+	case Decimal:
+		return 5, true
+	case Date:
+		return 6, true
+	case Timestamp:
+		// TIMESTAMP_MICROS is always an instant.
+		return 10, c.UTC
+	case Integer:
+		base := int32(15)
+		if !c.Signed {
+			base = 11
+		}
+		switch c.BitWidth {
+		case 8:
+			return base, true
+		case 16:
+			return base + 1, true
+		case 32:
+			return base + 2, true
+		case 64:
+			return base + 3, true
+		}
+	case JSON:
+		return 19, true
+	}
+	return 0, false
+}
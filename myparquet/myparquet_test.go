@@ -0,0 +1,228 @@
+package myparquet
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// readCompact decodes a Thrift struct in the compact protocol into a map of
+// field IDs to values: int64, bool, []byte, []any or map[int16]any.
+func readCompact(r *bytes.Reader) (map[int16]any, error) {
+	fields := make(map[int16]any)
+	var last int16
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b == 0 {
+			return fields, nil
+		}
+		id := last + int16(b>>4)
+		if b>>4 == 0 {
+			v, err := binary.ReadVarint(r)
+			if err != nil {
+				return nil, err
+			}
+			id = int16(v)
+		}
+		last = id
+		if fields[id], err = readCompactValue(r, b&0x0f); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func readCompactValue(r *bytes.Reader, typ byte) (any, error) {
+	switch typ {
+	case compactTrue:
+		return true, nil
+	case compactFalse:
+		return false, nil
+	case compactByte:
+		b, err := r.ReadByte()
+		return int64(int8(b)), err
+	case compactI32, compactI64:
+		return binary.ReadVarint(r)
+	case compactBinary:
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		b := make([]byte, n)
+		_, err = io.ReadFull(r, b)
+		return b, err
+	case compactList:
+		h, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		n := uint64(h >> 4)
+		if n == 15 {
+			if n, err = binary.ReadUvarint(r); err != nil {
+				return nil, err
+			}
+		}
+		list := make([]any, n)
+		for i := range list {
+			elemType := h & 0x0f
+			if elemType == compactTrue {
+				// Booleans in lists are bytes, which this writer never
+				// writes.
+				return nil, fmt.Errorf("boolean lists are not supported")
+			}
+			if list[i], err = readCompactValue(r, elemType); err != nil {
+				return nil, err
+			}
+		}
+		return list, nil
+	case compactStruct:
+		return readCompact(r)
+	}
+	return nil, fmt.Errorf("unknown type %d", typ)
+}
+
+func TestCompactWriter(t *testing.T) {
+	var w compactWriter
+	w.beginStruct(0)
+	w.i32(1, -3)
+	w.string(2, "ab")
+	w.i64(20, 300)
+	w.beginStruct(21)
+	w.bool(1, true)
+	w.endStruct()
+	w.list(22, compactI32, 2)
+	w.i32Elem(1)
+	w.i32Elem(2)
+	w.endStruct()
+
+	want := []byte{
+		0x15, 0x05, // field 1, i32 -3
+		0x18, 0x02, 'a', 'b', // field 2, binary
+		0x06, 0x28, 0xd8, 0x04, // field 20 in long form, i64 300
+		0x1c, 0x11, 0x00, // field 21, struct with field 1 true
+		0x19, 0x25, 0x02, 0x04, // field 22, list of two i32
+		0x00,
+	}
+	if !bytes.Equal(w.buf, want) {
+		t.Errorf("encoded % x, want % x", w.buf, want)
+	}
+}
+
+func TestAppendLevels(t *testing.T) {
+	got := appendLevels(nil, []byte{1, 1, 1, 0, 1})
+	want := []byte{6, 0, 0, 0, 3 << 1, 1, 1 << 1, 0, 1 << 1, 1}
+	if !bytes.Equal(got, want) {
+		t.Errorf("appendLevels() = % x, want % x", got, want)
+	}
+}
+
+func TestWriter(t *testing.T) {
+	columns := []Column{
+		{Name: "id", Type: Int64, Logical: Integer, BitWidth: 64, Signed: true},
+		{Name: "name", Type: ByteArray, Logical: String},
+		{Name: "price", Type: FixedLenByteArray, Length: 9, Logical: Decimal, Precision: 20, Scale: 2},
+		{Name: "created", Type: Int64, Logical: Timestamp},
+	}
+
+	for _, compress := range []bool{false, true} {
+		t.Run(fmt.Sprintf("gzip=%v", compress), func(t *testing.T) {
+			var out bytes.Buffer
+			w := NewWriter(&out, columns, Options{RowGroupSize: 2000, PageSize: 300, Gzip: compress})
+			for i := range 500 {
+				w.WriteInt64(0, int64(i))
+				if i%2 == 0 {
+					w.WriteNull(1)
+				} else {
+					w.WriteBytes(1, []byte(fmt.Sprintf("row %d", i)))
+				}
+				w.WriteBytes(2, make([]byte, 9))
+				w.WriteInt64(3, 1700000000000000)
+				if err := w.EndRow(); err != nil {
+					t.Fatalf("EndRow: %v", err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+
+			data := out.Bytes()
+			if !bytes.HasPrefix(data, []byte(magic)) || !bytes.HasSuffix(data, []byte(magic)) {
+				t.Fatalf("Expected the file to start and end with %s", magic)
+			}
+			size := binary.LittleEndian.Uint32(data[len(data)-8:])
+			meta, err := readCompact(bytes.NewReader(data[len(data)-8-int(size) : len(data)-8]))
+			if err != nil {
+				t.Fatalf("Error decoding the footer: %v", err)
+			}
+
+			if meta[3] != int64(500) {
+				t.Errorf("num_rows = %v, want 500", meta[3])
+			}
+			schema := meta[2].([]any)
+			if len(schema) != len(columns)+1 {
+				t.Fatalf("Expected %d schema elements, got %d", len(columns)+1, len(schema))
+			}
+			price := schema[3].(map[int16]any)
+			if string(price[4].([]byte)) != "price" || price[2] != int64(9) || price[8] != int64(20) || price[7] != int64(2) {
+				t.Errorf("price schema element = %v", price)
+			}
+			if created := schema[4].(map[int16]any); created[6] != nil {
+				t.Errorf("Expected no converted type for a local timestamp, got %v", created[6])
+			}
+
+			// Every column chunk must be where the footer says, and its
+			// pages must add up to its values.
+			rowGroups := meta[4].([]any)
+			if len(rowGroups) < 2 {
+				t.Errorf("Expected several row groups, got %d", len(rowGroups))
+			}
+			var rows int64
+			for _, g := range rowGroups {
+				group := g.(map[int16]any)
+				rows += group[3].(int64)
+				for _, c := range group[1].([]any) {
+					chunk := c.(map[int16]any)[3].(map[int16]any)
+					r := bytes.NewReader(data[chunk[9].(int64) : chunk[9].(int64)+chunk[7].(int64)])
+					var values int64
+					for r.Len() > 0 {
+						header, err := readCompact(r)
+						if err != nil {
+							t.Fatalf("Error decoding a page header: %v", err)
+						}
+						page := make([]byte, header[3].(int64))
+						io.ReadFull(r, page)
+						if compress {
+							if _, err := gzip.NewReader(bytes.NewReader(page)); err != nil {
+								t.Errorf("Expected a gzipped page: %v", err)
+							}
+						}
+						values += header[5].(map[int16]any)[1].(int64)
+					}
+					if values != chunk[5].(int64) || values != group[3].(int64) {
+						t.Errorf("Expected %d values in the pages of the chunk, got %d", chunk[5], values)
+					}
+				}
+			}
+			if rows != 500 {
+				t.Errorf("Expected 500 rows in the row groups, got %d", rows)
+			}
+		})
+	}
+}
+
+func TestWriter_Empty(t *testing.T) {
+	var out bytes.Buffer
+	w := NewWriter(&out, []Column{{Name: "id", Type: Int32}}, Options{})
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	data := out.Bytes()
+	if !bytes.HasPrefix(data, []byte(magic)) || !bytes.HasSuffix(data, []byte(magic)) || len(data) < 12 {
+		t.Errorf("Expected an empty file with a footer, got % x", data)
+	}
+}
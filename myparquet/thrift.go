@@ -0,0 +1,99 @@
+package myparquet
+
+import "encoding/binary"
+
+// Types of the Thrift compact protocol the Parquet metadata is encoded in.
+const (
+	compactTrue   = 1
+	compactFalse  = 2
+	compactByte   = 3
+	compactI32    = 5
+	compactI64    = 6
+	compactBinary = 8
+	compactList   = 9
+	compactStruct = 12
+)
+
+// compactWriter encodes Thrift structs in the compact protocol. Fields are
+// written in increasing order of their IDs, which the protocol encodes as
+// deltas.
+type compactWriter struct {
+	buf   []byte
+	last  int16
+	stack []int16
+}
+
+func (w *compactWriter) field(id int16, typ byte) {
+	if delta := id - w.last; delta > 0 && delta <= 15 {
+		w.buf = append(w.buf, byte(delta)<<4|typ)
+	} else {
+		w.buf = append(w.buf, typ)
+		w.buf = binary.AppendVarint(w.buf, int64(id))
+	}
+	w.last = id
+}
+
+func (w *compactWriter) bool(id int16, v bool) {
+	if v {
+		w.field(id, compactTrue)
+	} else {
+		w.field(id, compactFalse)
+	}
+}
+
+func (w *compactWriter) byte(id int16, v int8) {
+	w.field(id, compactByte)
+	w.buf = append(w.buf, byte(v))
+}
+
+func (w *compactWriter) i32(id int16, v int32) {
+	w.field(id, compactI32)
+	w.buf = binary.AppendVarint(w.buf, int64(v))
+}
+
+func (w *compactWriter) i64(id int16, v int64) {
+	w.field(id, compactI64)
+	w.buf = binary.AppendVarint(w.buf, v)
+}
+
+func (w *compactWriter) string(id int16, v string) {
+	w.field(id, compactBinary)
+	w.buf = binary.AppendUvarint(w.buf, uint64(len(v)))
+	w.buf = append(w.buf, v...)
+}
+
+// beginStruct starts a struct field, or a struct element of a list when id
+// is 0.
+func (w *compactWriter) beginStruct(id int16) {
+	if id != 0 {
+		w.field(id, compactStruct)
+	}
+	w.stack = append(w.stack, w.last)
+	w.last = 0
+}
+
+func (w *compactWriter) endStruct() {
+	w.buf = append(w.buf, 0)
+	w.last = w.stack[len(w.stack)-1]
+	w.stack = w.stack[:len(w.stack)-1]
+}
+
+// list starts a list field of n elements of type typ, which follow.
+func (w *compactWriter) list(id int16, typ byte, n int) {
+	w.field(id, compactList)
+	if n < 15 {
+		w.buf = append(w.buf, byte(n)<<4|typ)
+	} else {
+		w.buf = append(w.buf, 0xf0|typ)
+		w.buf = binary.AppendUvarint(w.buf, uint64(n))
+	}
+}
+
+func (w *compactWriter) i32Elem(v int32) {
+	w.buf = binary.AppendVarint(w.buf, int64(v))
+}
+
+func (w *compactWriter) stringElem(v string) {
+	w.buf = binary.AppendUvarint(w.buf, uint64(len(v)))
+	w.buf = append(w.buf, v...)
+}
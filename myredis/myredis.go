@@ -0,0 +1,153 @@
+// Package myredis implements the part of the Redis protocol a replica uses
+// to pull a snapshot: authenticating and a full resynchronization with PSYNC
+// or SYNC, which makes the server send an RDB file of its whole dataset.
+package myredis
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultReadTimeout = time.Minute
+
+// ServerError is an error reply sent by the server.
+type ServerError struct {
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	return e.Message
+}
+
+// Conn is a connection to a Redis server.
+type Conn struct {
+	conn          net.Conn
+	r             *bufio.Reader
+	ServerVersion string
+	// ReadTimeout bounds the wait for the next bytes from the server, so a
+	// dead connection is noticed. While it prepares a snapshot the server
+	// sends a newline every second to keep the connection alive.
+	ReadTimeout time.Duration
+}
+
+// Dial connects to addr and authenticates with password, as user if set,
+// unless password is empty. The connection is not encrypted.
+func Dial(addr, user, password string) (*Conn, error) {
+	nc, err := net.DialTimeout("tcp", addr, 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	c := &Conn{conn: nc, ReadTimeout: defaultReadTimeout}
+	c.r = bufio.NewReaderSize(timeoutReader{c}, 64*1024)
+
+	if password != "" {
+		args := []string{"AUTH", password}
+		if user != "" {
+			args = []string{"AUTH", user, password}
+		}
+		if _, err := c.Do(args...); err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("error authenticating: %w", err)
+		}
+	}
+
+	// The version is informational, a user without access to INFO can
+	// still take snapshots.
+	info, err := c.Do("INFO", "server")
+	var serverErr *ServerError
+	if err != nil && !errors.As(err, &serverErr) {
+		nc.Close()
+		return nil, err
+	}
+	for _, line := range strings.Split(info, "\n") {
+		if v, ok := strings.CutPrefix(strings.TrimSpace(line), "redis_version:"); ok {
+			c.ServerVersion = v
+		}
+	}
+	return c, nil
+}
+
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// timeoutReader renews the read deadline of the connection before every
+// read.
+type timeoutReader struct {
+	c *Conn
+}
+
+func (t timeoutReader) Read(p []byte) (int, error) {
+	if t.c.ReadTimeout > 0 {
+		t.c.conn.SetReadDeadline(time.Now().Add(t.c.ReadTimeout))
+	}
+	return t.c.conn.Read(p)
+}
+
+// send writes a command as an array of bulk strings.
+func (c *Conn) send(args ...string) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := c.conn.Write(b.Bytes())
+	return err
+}
+
+// Do runs a command and returns its reply, which must be a simple string,
+// an integer or a bulk string.
+func (c *Conn) Do(args ...string) (string, error) {
+	if err := c.send(args...); err != nil {
+		return "", err
+	}
+	return c.readReply()
+}
+
+// readLine reads a line without its CRLF. Bare newlines the server sends
+// to keep the connection alive are skipped.
+func (c *Conn) readLine() (string, error) {
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		if line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"); line != "" {
+			return line, nil
+		}
+	}
+}
+
+func (c *Conn) readReply() (string, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return "", err
+	}
+	switch line[0] {
+	case '+', ':':
+		return line[1:], nil
+	case '-':
+		return "", &ServerError{Message: line[1:]}
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return "", fmt.Errorf("invalid bulk string length %q", line)
+		}
+		if n < 0 {
+			return "", nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return "", err
+		}
+		return string(data[:n]), nil
+	}
+	return "", fmt.Errorf("unexpected reply %q", line)
+}
@@ -0,0 +1,240 @@
+package myredis
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fakeServer serves one connection, answering every command with what
+// reply returns for it.
+func fakeServer(t *testing.T, reply func(args []string) string) (addr string, commands chan []string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	commands = make(chan []string, 100)
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			args, err := readCommand(r)
+			if err != nil {
+				close(commands)
+				return
+			}
+			commands <- args
+			if _, err := io.WriteString(conn, reply(args)); err != nil {
+				return
+			}
+		}
+	}()
+	return ln.Addr().String(), commands
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	args := make([]string, n)
+	for i := range args {
+		if _, err := r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		arg, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		args[i] = strings.TrimSuffix(arg, "\r\n")
+	}
+	return args, nil
+}
+
+// rdbFile returns a minimal RDB file with a valid checksum.
+func rdbFile(body string) []byte {
+	data := append([]byte("REDIS0011"+body), rdbEOF)
+	return binary.LittleEndian.AppendUint64(data, crc(0, data))
+}
+
+func TestCRC(t *testing.T) {
+	// The check value of the Jones CRC-64 Redis uses.
+	if got := crc(0, []byte("123456789")); got != 0xe9c6d914c4b8d9ca {
+		t.Errorf("crc = %016x, want e9c6d914c4b8d9ca", got)
+	}
+	if got := crc(crc(0, []byte("1234")), []byte("56789")); got != 0xe9c6d914c4b8d9ca {
+		t.Errorf("Expected the CRC to continue across writes, got %016x", got)
+	}
+}
+
+func TestSync(t *testing.T) {
+	rdb := rdbFile(strings.Repeat("\x00\x03key\x05value", 1000))
+	mark := strings.Repeat("m", eofMarkLen)
+
+	tests := []struct {
+		name     string
+		psync    string
+		snapshot string
+		replID   string
+	}{
+		{
+			name:     "sized",
+			psync:    "\n\n+FULLRESYNC 8de1787ba490483314a4d30f1c628bc5025eb761 2035\r\n",
+			snapshot: fmt.Sprintf("\n\n$%d\r\n%s", len(rdb), rdb),
+			replID:   "8de1787ba490483314a4d30f1c628bc5025eb761",
+		},
+		{
+			name:     "diskless",
+			psync:    "+FULLRESYNC 8de1787ba490483314a4d30f1c628bc5025eb761 2035\r\n",
+			snapshot: "$EOF:" + mark + "\r\n" + string(rdb) + mark + "*1\r\n$4\r\nPING\r\n",
+			replID:   "8de1787ba490483314a4d30f1c628bc5025eb761",
+		},
+		{
+			name:     "sync fallback",
+			psync:    "-ERR unknown command 'PSYNC'\r\n",
+			snapshot: fmt.Sprintf("$%d\r\n%s", len(rdb), rdb),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, commands := fakeServer(t, func(args []string) string {
+				switch args[0] {
+				case "AUTH":
+					return "+OK\r\n"
+				case "INFO":
+					info := "# Server\r\nredis_version:7.2.4\r\n"
+					return fmt.Sprintf("$%d\r\n%s\r\n", len(info), info)
+				case "REPLCONF":
+					return "+OK\r\n"
+				case "PSYNC":
+					if strings.HasPrefix(tt.psync, "-") {
+						return tt.psync
+					}
+					return tt.psync + tt.snapshot
+				case "SYNC":
+					return tt.snapshot
+				}
+				return "-ERR unknown command\r\n"
+			})
+
+			c, err := Dial(addr, "backup", "secret")
+			if err != nil {
+				t.Fatalf("Dial: %v", err)
+			}
+			defer c.Close()
+			if c.ServerVersion != "7.2.4" {
+				t.Errorf("ServerVersion = %q, want 7.2.4", c.ServerVersion)
+			}
+
+			var out bytes.Buffer
+			snap, err := c.Sync(&out)
+			if err != nil {
+				t.Fatalf("Sync: %v", err)
+			}
+			if !bytes.Equal(out.Bytes(), rdb) {
+				t.Errorf("Expected the RDB file, got %d bytes", out.Len())
+			}
+			if snap.ReplID != tt.replID || snap.Size != int64(len(rdb)) {
+				t.Errorf("snapshot = %+v", snap)
+			}
+			if tt.replID != "" && snap.Offset != 2035 {
+				t.Errorf("Offset = %d, want 2035", snap.Offset)
+			}
+			if auth := <-commands; strings.Join(auth, " ") != "AUTH backup secret" {
+				t.Errorf("Expected AUTH with user and password first, got %q", auth)
+			}
+		})
+	}
+}
+
+func TestSync_Invalid(t *testing.T) {
+	rdb := rdbFile("\x00\x03key\x05value")
+	corrupt := bytes.Clone(rdb)
+	corrupt[12] ^= 1
+	noChecksum := append(bytes.Clone(rdb[:len(rdb)-8]), make([]byte, 8)...)
+	noChecksum[12] ^= 1
+
+	tests := []struct {
+		name     string
+		snapshot []byte
+		errMsg   string
+	}{
+		{name: "checksum mismatch", snapshot: corrupt, errMsg: "checksum mismatch"},
+		{name: "checksum disabled", snapshot: noChecksum},
+		{name: "not an RDB file", snapshot: []byte("HELLO0011\xff\x00\x00\x00\x00\x00\x00\x00\x00"), errMsg: "not an RDB file"},
+		{name: "truncated", snapshot: rdb[:len(rdb)-9], errMsg: "truncated"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, _ := fakeServer(t, func(args []string) string {
+				switch args[0] {
+				case "INFO":
+					return "-NOPERM no permissions\r\n"
+				case "PSYNC":
+					return fmt.Sprintf("+FULLRESYNC id 1\r\n$%d\r\n%s", len(tt.snapshot), tt.snapshot)
+				}
+				return "+OK\r\n"
+			})
+			c, err := Dial(addr, "", "")
+			if err != nil {
+				t.Fatalf("Dial: %v", err)
+			}
+			defer c.Close()
+
+			_, err = c.Sync(io.Discard)
+			if tt.errMsg == "" {
+				if err != nil {
+					t.Errorf("Sync: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.errMsg) {
+				t.Errorf("Expected error containing %q, got %v", tt.errMsg, err)
+			}
+		})
+	}
+}
+
+func TestDial_AuthFailure(t *testing.T) {
+	addr, _ := fakeServer(t, func(args []string) string {
+		return "-WRONGPASS invalid username-password pair or user is disabled.\r\n"
+	})
+	if _, err := Dial(addr, "", "wrong"); err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Errorf("Expected the server error, got %v", err)
+	}
+}
+
+func TestCopyUntilMark(t *testing.T) {
+	mark := []byte(strings.Repeat("x", eofMarkLen))
+	// The mark straddles reads of the 64 KiB buffer.
+	data := bytes.Repeat([]byte("abc"), 30000)
+	input := append(append(bytes.Clone(data), mark...), "rest"...)
+
+	var out bytes.Buffer
+	if err := copyUntilMark(&out, bufio.NewReaderSize(bytes.NewReader(input), 16), mark); err != nil {
+		t.Fatalf("copyUntilMark: %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Errorf("Expected %d bytes before the mark, got %d", len(data), out.Len())
+	}
+
+	if err := copyUntilMark(io.Discard, bufio.NewReader(bytes.NewReader(data)), mark); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected io.ErrUnexpectedEOF without the mark, got %v", err)
+	}
+}
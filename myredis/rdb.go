@@ -0,0 +1,196 @@
+package myredis
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Snapshot describes an RDB snapshot taken with Sync.
+type Snapshot struct {
+	// ReplID and Offset are the replication ID and offset of the dataset,
+	// unknown when the server only understood SYNC.
+	ReplID string
+	Offset int64
+	Size   int64
+}
+
+// eofMarkLen is the length of the random mark that ends a snapshot sent
+// without its size, straight from the server's fork to the socket.
+const eofMarkLen = 40
+
+// Sync asks the server for a full resynchronization and writes the RDB
+// snapshot it sends to w. The header and checksum of the snapshot are
+// verified; w has received all of it once Sync returns without an error.
+// The connection is of no further use afterwards.
+func (c *Conn) Sync(w io.Writer) (Snapshot, error) {
+	var snap Snapshot
+	var serverErr *ServerError
+
+	// Ask for the snapshot alone, without the stream of commands that
+	// normally follows it; servers before 7.0 do not know rdb-only. The eof
+	// capability allows diskless transfers.
+	for _, args := range [][]string{{"REPLCONF", "rdb-only", "1"}, {"REPLCONF", "capa", "eof", "capa", "psync2"}} {
+		if _, err := c.Do(args...); err != nil && !errors.As(err, &serverErr) {
+			return snap, err
+		}
+	}
+
+	reply, err := c.Do("PSYNC", "?", "-1")
+	switch {
+	case errors.As(err, &serverErr):
+		// Before Redis 2.8 there is only SYNC, which replies with the
+		// snapshot directly.
+		if err := c.send("SYNC"); err != nil {
+			return snap, err
+		}
+	case err != nil:
+		return snap, err
+	default:
+		fields := strings.Fields(reply)
+		if len(fields) != 3 || fields[0] != "FULLRESYNC" {
+			return snap, fmt.Errorf("unexpected reply to PSYNC: %q", reply)
+		}
+		snap.ReplID = fields[1]
+		if snap.Offset, err = strconv.ParseInt(fields[2], 10, 64); err != nil {
+			return snap, fmt.Errorf("unexpected reply to PSYNC: %q", reply)
+		}
+	}
+
+	line, err := c.readLine()
+	if err != nil {
+		return snap, err
+	}
+	if line[0] == '-' {
+		return snap, &ServerError{Message: line[1:]}
+	}
+	if line[0] != '$' {
+		return snap, fmt.Errorf("unexpected snapshot header %q", line)
+	}
+
+	rdb := &rdbWriter{w: w}
+	if mark, ok := strings.CutPrefix(line, "$EOF:"); ok {
+		if len(mark) != eofMarkLen {
+			return snap, fmt.Errorf("invalid snapshot end mark %q", mark)
+		}
+		err = copyUntilMark(rdb, c.r, []byte(mark))
+	} else {
+		var size int64
+		if size, err = strconv.ParseInt(line[1:], 10, 64); err != nil || size < 0 {
+			return snap, fmt.Errorf("invalid snapshot size %q", line)
+		}
+		_, err = io.CopyN(rdb, c.r, size)
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	if err != nil {
+		return snap, err
+	}
+	snap.Size = rdb.n
+	return snap, rdb.finish()
+}
+
+// copyUntilMark copies from r to w until mark, which is not copied.
+func copyUntilMark(w io.Writer, r *bufio.Reader, mark []byte) error {
+	buf := make([]byte, 64*1024)
+	var pending []byte
+	for {
+		n, err := r.Read(buf)
+		pending = append(pending, buf[:n]...)
+		if i := bytes.Index(pending, mark); i >= 0 {
+			_, err := w.Write(pending[:i])
+			return err
+		}
+		// The end of pending may be the start of the mark.
+		if keep := len(mark) - 1; len(pending) > keep {
+			if _, err := w.Write(pending[:len(pending)-keep]); err != nil {
+				return err
+			}
+			pending = append(pending[:0], pending[len(pending)-keep:]...)
+		}
+		if errors.Is(err, io.EOF) {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// crcTable is the CRC-64 with the Jones polynomial that RDB files end with.
+var crcTable = crc64.MakeTable(0x95ac9329ac4bc9b5)
+
+// crc continues the RDB checksum crc with p. The hash/crc64 functions
+// invert the value before and after, which RDB checksums do not.
+func crc(crc uint64, p []byte) uint64 {
+	return ^crc64.Update(^crc, crcTable, p)
+}
+
+// rdbFileHeader starts every RDB file, followed by four digits of version.
+const rdbFileHeader = "REDIS"
+
+// rdbEOF is the opcode that precedes the checksum at the end of a file.
+const rdbEOF = 0xff
+
+// rdbWriter passes an RDB file through to w and checks it once it is
+// complete. It holds back the last eight bytes, the checksum, from the
+// running CRC.
+type rdbWriter struct {
+	w      io.Writer
+	n      int64
+	header []byte
+	crc    uint64
+	last   byte
+	tail   []byte
+}
+
+func (r *rdbWriter) Write(p []byte) (int, error) {
+	n, err := r.w.Write(p)
+	p = p[:n]
+	r.n += int64(n)
+	if need := len(rdbFileHeader) + 4 - len(r.header); need > 0 {
+		r.header = append(r.header, p[:min(need, len(p))]...)
+	}
+
+	if len(p) >= 8 {
+		r.add(r.tail)
+		r.add(p[:len(p)-8])
+		r.tail = append(r.tail[:0], p[len(p)-8:]...)
+	} else {
+		r.tail = append(r.tail, p...)
+		if extra := len(r.tail) - 8; extra > 0 {
+			r.add(r.tail[:extra])
+			r.tail = append(r.tail[:0], r.tail[extra:]...)
+		}
+	}
+	return n, err
+}
+
+func (r *rdbWriter) add(p []byte) {
+	if len(p) > 0 {
+		r.crc = crc(r.crc, p)
+		r.last = p[len(p)-1]
+	}
+}
+
+// finish checks the complete file. A checksum of zero means the server
+// has rdbchecksum disabled.
+func (r *rdbWriter) finish() error {
+	if !strings.HasPrefix(string(r.header), rdbFileHeader) || len(r.header) < len(rdbFileHeader)+4 {
+		return fmt.Errorf("snapshot is not an RDB file")
+	}
+	if r.n < int64(len(r.header))+1+8 || r.last != rdbEOF {
+		return fmt.Errorf("snapshot is truncated")
+	}
+	if sum := binary.LittleEndian.Uint64(r.tail); sum != 0 && sum != r.crc {
+		return fmt.Errorf("snapshot checksum mismatch: got %016x, want %016x", r.crc, sum)
+	}
+	return nil
+}
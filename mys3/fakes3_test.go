@@ -0,0 +1,201 @@
+package mys3
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is an in-memory stand-in for the subset of the S3 API used by this
+// package. Requests arrive path-style as /bucket/key.
+type fakeS3 struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	modified map[string]time.Time
+	uploads  map[string]map[int][]byte
+	aborted  int
+	nextID   int
+	requests []string
+
+	// failPart makes UploadPart return an error for the given part number
+	// this many times before succeeding.
+	failPart      int
+	failPartTimes int
+}
+
+func newFakeS3(t *testing.T) *fakeS3 {
+	f := &fakeS3{
+		objects:  make(map[string][]byte),
+		modified: make(map[string]time.Time),
+		uploads:  make(map[string]map[int][]byte),
+	}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+
+	originalValues := setupTestEnv(map[string]string{
+		"S3_BUCKET":             "test-bucket",
+		"S3_ENDPOINT":           server.URL,
+		"AWS_ACCESS_KEY_ID":     "testkey",
+		"AWS_SECRET_ACCESS_KEY": "testsecret",
+	})
+	t.Cleanup(func() { restoreTestEnv(originalValues) })
+
+	return f
+}
+
+func (f *fakeS3) put(key string, data []byte, modified time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[key] = data
+	f.modified[key] = modified
+}
+
+func (f *fakeS3) keys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for key := range f.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	_, key, _ := strings.Cut(path, "/")
+	query := r.URL.Query()
+	body, _ := io.ReadAll(r.Body)
+	if r.Header.Get("Content-Encoding") == "aws-chunked" || strings.Contains(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING") {
+		body = decodeAWSChunked(body)
+	}
+	f.requests = append(f.requests, r.Method+" "+r.URL.RawQuery)
+
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.nextID++
+		id := strconv.Itoa(f.nextID)
+		f.uploads[id] = make(map[int][]byte)
+		fmt.Fprintf(w, `<InitiateMultipartUploadResult><Bucket>test-bucket</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>`, key, id)
+
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		if number == f.failPart && f.failPartTimes > 0 {
+			f.failPartTimes--
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `<Error><Code>AccessDenied</Code><Message>injected failure</Message></Error>`)
+			return
+		}
+		f.uploads[query.Get("uploadId")][number] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"etag-%d"`, number))
+
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		parts := f.uploads[query.Get("uploadId")]
+		var numbers []int
+		for number := range parts {
+			numbers = append(numbers, number)
+		}
+		sort.Ints(numbers)
+		var data bytes.Buffer
+		for _, number := range numbers {
+			data.Write(parts[number])
+		}
+		f.objects[key] = data.Bytes()
+		f.modified[key] = time.Now()
+		delete(f.uploads, query.Get("uploadId"))
+		fmt.Fprintf(w, `<CompleteMultipartUploadResult><Bucket>test-bucket</Bucket><Key>%s</Key><ETag>"done"</ETag></CompleteMultipartUploadResult>`, key)
+
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(f.uploads, query.Get("uploadId"))
+		f.aborted++
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodPut:
+		f.objects[key] = body
+		f.modified[key] = time.Now()
+		w.Header().Set("ETag", `"etag"`)
+
+	case r.Method == http.MethodGet && key == "":
+		f.writeList(w, query.Get("prefix"))
+
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		data, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `<Error><Code>NoSuchKey</Code><Message>not found</Message></Error>`)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func (f *fakeS3) writeList(w http.ResponseWriter, prefix string) {
+	type content struct {
+		Key          string
+		LastModified string
+		Size         int
+	}
+	result := struct {
+		XMLName  xml.Name `xml:"ListBucketResult"`
+		Name     string
+		KeyCount int
+		Contents []content
+	}{Name: "test-bucket"}
+
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		result.Contents = append(result.Contents, content{
+			Key:          key,
+			LastModified: f.modified[key].UTC().Format(time.RFC3339),
+			Size:         len(f.objects[key]),
+		})
+	}
+	result.KeyCount = len(result.Contents)
+	xml.NewEncoder(w).Encode(result)
+}
+
+// decodeAWSChunked strips the aws-chunked framing the SDK uses when it sends
+// checksums as trailers.
+func decodeAWSChunked(body []byte) []byte {
+	var out bytes.Buffer
+	for len(body) > 0 {
+		line, rest, ok := bytes.Cut(body, []byte("\r\n"))
+		if !ok {
+			break
+		}
+		sizeHex, _, _ := strings.Cut(string(line), ";")
+		size, err := strconv.ParseInt(sizeHex, 16, 64)
+		if err != nil || size == 0 {
+			break
+		}
+		out.Write(rest[:size])
+		body = rest[size+2:]
+	}
+	return out.Bytes()
+}
@@ -1,35 +1,50 @@
 package mys3
 
 import (
-	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stenstromen/s3dbdump/mybinlog"
 )
 
-func UploadToS3(filename string) error {
+func newClient(ctx context.Context) (*s3.Client, error) {
+	var cfg aws.Config
 
-	if os.Getenv("S3_BUCKET") == "" {
-		return fmt.Errorf("S3_BUCKET is not set")
+	maxConnections, err := maxConnectionsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	httpClient := awshttp.NewBuildableClient()
+	if maxConnections > 0 {
+		httpClient = httpClient.WithTransportOptions(func(tr *http.Transport) {
+			tr.MaxConnsPerHost = maxConnections
+		})
 	}
-
-	var cfg aws.Config
-	var err error
 
 	if endpoint := os.Getenv("S3_ENDPOINT"); endpoint != "" {
-		cfg, err = config.LoadDefaultConfig(context.TODO(),
+		cfg, err = config.LoadDefaultConfig(ctx,
+			config.WithHTTPClient(httpClient),
 			config.WithRegion("us-east-1"),
 			config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
 				os.Getenv("AWS_ACCESS_KEY_ID"),
@@ -48,16 +63,40 @@ func UploadToS3(filename string) error {
 			)),
 		)
 	} else {
-		cfg, err = config.LoadDefaultConfig(context.TODO(),
+		cfg, err = config.LoadDefaultConfig(ctx,
+			config.WithHTTPClient(httpClient),
 			config.WithRegion(os.Getenv("AWS_REGION")),
 		)
 	}
 
 	if err != nil {
-		return fmt.Errorf("unable to load AWS SDK config: %w", err)
+		return nil, fmt.Errorf("unable to load AWS SDK config: %w", err)
+	}
+
+	return s3.NewFromConfig(cfg), nil
+}
+
+func UploadToS3(filename string) error {
+	return UploadFile(filepath.Base(filename), filename)
+}
+
+// UploadFile uploads the local file filename as key.
+func UploadFile(key, filename string) error {
+
+	bucket := os.Getenv("S3_BUCKET")
+	if bucket == "" {
+		return fmt.Errorf("S3_BUCKET is not set")
+	}
+
+	opts, err := uploadOptionsFromEnv()
+	if err != nil {
+		return err
 	}
 
-	s3Client := s3.NewFromConfig(cfg)
+	s3Client, err := newClient(context.TODO())
+	if err != nil {
+		return err
+	}
 
 	file, err := os.Open(filename)
 	if err != nil {
@@ -65,104 +104,245 @@ func UploadToS3(filename string) error {
 	}
 	defer file.Close()
 
-	fileInfo, _ := file.Stat()
-	var size = fileInfo.Size()
-	buffer := make([]byte, size)
-	file.Read(buffer)
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("unable to stat file %q: %w", filename, err)
+	}
 
-	_, err = s3Client.PutObject(context.TODO(), &s3.PutObjectInput{
-		Bucket: aws.String(os.Getenv("S3_BUCKET")),
-		Key:    aws.String(filepath.Base(filename)),
-		Body:   bytes.NewReader(buffer),
-		ACL:    types.ObjectCannedACLPrivate,
-	})
+	parts, err := upload(context.TODO(), s3Client, bucket, key, file, fileInfo.Size(), opts)
 	if err != nil {
-		return fmt.Errorf("unable to upload %q to %q: %w", filename, os.Getenv("S3_BUCKET"), err)
+		return fmt.Errorf("unable to upload %q to %q: %w", filename, bucket, err)
 	}
 
-	log.Println("Successfully uploaded", filename, "to", os.Getenv("S3_BUCKET"))
+	log.Println("Successfully uploaded", filename, "to", bucket, "in", parts, "part(s)")
 
 	return nil
 }
 
-func KeepOnlyNBackups(keepBackups string) error {
-	keepBackupsInt, keepBackupsErr := strconv.Atoi(keepBackups)
-	if keepBackupsErr != nil {
-		return fmt.Errorf("invalid DB_DUMP_FILE_KEEP_DAYS value: %w", keepBackupsErr)
+// UploadStream uploads everything read from body to key in S3_BUCKET without
+// knowing the size in advance, so dumps can be piped straight into S3.
+func UploadStream(key string, body io.Reader) error {
+	bucket := os.Getenv("S3_BUCKET")
+	if bucket == "" {
+		return fmt.Errorf("S3_BUCKET is not set")
 	}
 
-	var cfg aws.Config
-	var err error
+	opts, err := uploadOptionsFromEnv()
+	if err != nil {
+		return err
+	}
 
-	if endpoint := os.Getenv("S3_ENDPOINT"); endpoint != "" {
-		cfg, err = config.LoadDefaultConfig(context.TODO(),
-			config.WithRegion("us-east-1"),
-			config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
-				os.Getenv("AWS_ACCESS_KEY_ID"),
-				os.Getenv("AWS_SECRET_ACCESS_KEY"),
-				"",
-			)),
-			config.WithEndpointResolver(aws.EndpointResolverFunc(
-				func(service, region string) (aws.Endpoint, error) {
-					return aws.Endpoint{
-						PartitionID:       "aws",
-						URL:               endpoint,
-						SigningRegion:     "us-east-2",
-						HostnameImmutable: true,
-					}, nil
-				},
-			)),
-		)
-	} else {
-		cfg, err = config.LoadDefaultConfig(context.TODO(),
-			config.WithRegion(os.Getenv("AWS_REGION")),
-		)
+	s3Client, err := newClient(context.TODO())
+	if err != nil {
+		return err
+	}
+
+	parts, err := upload(context.TODO(), s3Client, bucket, key, body, -1, opts)
+	if err != nil {
+		return fmt.Errorf("unable to upload %q to %q: %w", key, bucket, err)
+	}
+
+	log.Println("Successfully uploaded", key, "to", bucket, "in", parts, "part(s)")
+
+	return nil
+}
+
+// ErrNotFound is returned by Download for a key that does not exist.
+var ErrNotFound = errors.New("object not found")
+
+// Download returns the content of key in S3_BUCKET.
+func Download(key string) ([]byte, error) {
+	bucket := os.Getenv("S3_BUCKET")
+	if bucket == "" {
+		return nil, fmt.Errorf("S3_BUCKET is not set")
+	}
+
+	s3Client, err := newClient(context.TODO())
+	if err != nil {
+		return nil, err
 	}
 
+	return download(context.TODO(), s3Client, bucket, key)
+}
+
+func download(ctx context.Context, s3Client *s3.Client, bucket, key string) ([]byte, error) {
+	body, err := open(ctx, s3Client, bucket, key)
 	if err != nil {
-		return fmt.Errorf("unable to load AWS SDK config: %w", err)
+		return nil, err
 	}
+	defer body.Close()
 
-	s3Client := s3.NewFromConfig(cfg)
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to download %q from %q: %w", key, bucket, err)
+	}
+	return data, nil
+}
+
+// Open streams the content of key in S3_BUCKET, for objects too large to
+// hold in memory. The caller closes the returned body.
+func Open(key string) (io.ReadCloser, error) {
+	bucket := os.Getenv("S3_BUCKET")
+	if bucket == "" {
+		return nil, fmt.Errorf("S3_BUCKET is not set")
+	}
 
-	resp, err := s3Client.ListObjectsV2(context.TODO(), &s3.ListObjectsV2Input{
-		Bucket: aws.String(os.Getenv("S3_BUCKET")),
+	s3Client, err := newClient(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+
+	return open(context.TODO(), s3Client, bucket, key)
+}
+
+func open(ctx context.Context, s3Client *s3.Client, bucket, key string) (io.ReadCloser, error) {
+	out, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
 	})
 	if err != nil {
-		return fmt.Errorf("unable to list objects in bucket %q: %w", os.Getenv("S3_BUCKET"), err)
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("unable to download %q from %q: %w", key, bucket, err)
 	}
+	return out.Body, nil
+}
+
+// Object describes an object in the bucket.
+type Object struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
 
-	dbBackups := make(map[string][]types.Object)
-	for _, obj := range resp.Contents {
-		dbName := extractDatabaseName(*obj.Key)
-		dbBackups[dbName] = append(dbBackups[dbName], obj)
+// List returns the objects in S3_BUCKET whose keys start with prefix.
+func List(prefix string) ([]Object, error) {
+	bucket := os.Getenv("S3_BUCKET")
+	if bucket == "" {
+		return nil, fmt.Errorf("S3_BUCKET is not set")
 	}
 
+	s3Client, err := newClient(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+
+	objects, err := listObjects(context.TODO(), s3Client, bucket, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list objects in bucket %q: %w", bucket, err)
+	}
+	list := make([]Object, len(objects))
+	for i, obj := range objects {
+		list[i] = Object{Key: aws.ToString(obj.Key), Size: aws.ToInt64(obj.Size), LastModified: aws.ToTime(obj.LastModified)}
+	}
+	return list, nil
+}
+
+// ListKeys returns the keys in S3_BUCKET that start with prefix.
+func ListKeys(prefix string) ([]string, error) {
+	objects, err := List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, len(objects))
+	for i, obj := range objects {
+		keys[i] = obj.Key
+	}
+	return keys, nil
+}
+
+// BinlogPrefix is the prefix below which binary logs are shipped, set by
+// DB_BINLOG_PREFIX.
+func BinlogPrefix() string {
+	if prefix := os.Getenv("DB_BINLOG_PREFIX"); prefix != "" {
+		return prefix
+	}
+	return "binlogs/"
+}
+
+// Delete removes key from S3_BUCKET.
+func Delete(key string) error {
+	bucket := os.Getenv("S3_BUCKET")
+	if bucket == "" {
+		return fmt.Errorf("S3_BUCKET is not set")
+	}
+
+	s3Client, err := newClient(context.TODO())
+	if err != nil {
+		return err
+	}
+
+	_, err = s3Client.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("unable to delete %q from %q: %w", key, bucket, err)
+	}
+	return nil
+}
+
+func KeepOnlyNBackups(keepBackups string) error {
+	keepBackupsInt, keepBackupsErr := strconv.Atoi(keepBackups)
+	if keepBackupsErr != nil {
+		return fmt.Errorf("invalid DB_DUMP_FILE_KEEP_DAYS value: %w", keepBackupsErr)
+	}
+
+	s3Client, err := newClient(context.TODO())
+	if err != nil {
+		return err
+	}
+
+	objects, err := listObjects(context.TODO(), s3Client, os.Getenv("S3_BUCKET"), "")
+	if err != nil {
+		return fmt.Errorf("unable to list objects in bucket %q: %w", os.Getenv("S3_BUCKET"), err)
+	}
+
+	// Binary logs are not backups of their own, they are kept for as long
+	// as a retained backup needs them.
+	var binlogs []types.Object
+	binlogPrefix := BinlogPrefix()
+	objects = slices.DeleteFunc(objects, func(obj types.Object) bool {
+		if _, ok := binlogName(*obj.Key, binlogPrefix); ok {
+			binlogs = append(binlogs, obj)
+			return true
+		}
+		return false
+	})
+
+	dbBackups := groupBackups(objects)
+	var retained []*backup
+
 	var wg sync.WaitGroup
 	var mu sync.Mutex
 	var deleteErrors []error
 
 	for dbName, backups := range dbBackups {
 		sort.Slice(backups, func(i, j int) bool {
-			return backups[i].LastModified.After(*backups[j].LastModified)
+			return backups[i].lastModified.After(backups[j].lastModified)
 		})
 
+		retained = append(retained, backups[:min(keepBackupsInt, len(backups))]...)
 		if len(backups) > keepBackupsInt {
-			objectsToDelete := backups[keepBackupsInt:]
+			backupsToDelete := backups[keepBackupsInt:]
 
 			// Use the new WaitGroup.Go method for cleaner goroutine management
 			wg.Go(func() {
-				for _, obj := range objectsToDelete {
-					_, err := s3Client.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
-						Bucket: aws.String(os.Getenv("S3_BUCKET")),
-						Key:    obj.Key,
-					})
-					if err != nil {
-						mu.Lock()
-						deleteErrors = append(deleteErrors, fmt.Errorf("unable to delete object %q: %w", *obj.Key, err))
-						mu.Unlock()
-					} else {
-						log.Printf("Deleted old backup for database %s: %s", dbName, *obj.Key)
+				for _, backup := range backupsToDelete {
+					for _, obj := range backup.objects {
+						_, err := s3Client.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
+							Bucket: aws.String(os.Getenv("S3_BUCKET")),
+							Key:    obj.Key,
+						})
+						if err != nil {
+							mu.Lock()
+							deleteErrors = append(deleteErrors, fmt.Errorf("unable to delete object %q: %w", *obj.Key, err))
+							mu.Unlock()
+						} else {
+							log.Printf("Deleted old backup for database %s: %s", dbName, *obj.Key)
+						}
 					}
 				}
 			})
@@ -177,6 +357,10 @@ func KeepOnlyNBackups(keepBackups string) error {
 		return deleteErrors[0]
 	}
 
+	if err := pruneBinlogs(context.TODO(), s3Client, os.Getenv("S3_BUCKET"), binlogPrefix, binlogs, retained); err != nil {
+		return err
+	}
+
 	dumpDir := os.Getenv("DB_DUMP_PATH")
 	if dumpDir == "" {
 		dumpDir = "./dumps"
@@ -198,6 +382,153 @@ func KeepOnlyNBackups(keepBackups string) error {
 	return nil
 }
 
+// pruneBinlogs deletes the binary logs that no retained backup needs. A
+// backup taken with DB_DUMP_MASTER_DATA=1 records the binlog file it was
+// taken at in its metadata, and point-in-time recovery replays every binlog
+// from that file on, so binlogs older than the oldest such file are no
+// longer needed. Binlogs of a server no retained backup has coordinates of
+// are all kept, as it is unknown which are needed.
+func pruneBinlogs(ctx context.Context, s3Client *s3.Client, bucket, prefix string, binlogs []types.Object, retained []*backup) error {
+	if len(binlogs) == 0 {
+		return nil
+	}
+
+	oldest := make(map[string]int)
+	for _, b := range retained {
+		for _, obj := range b.objects {
+			if !strings.HasSuffix(*obj.Key, ".metadata.json") {
+				continue
+			}
+			data, err := download(ctx, s3Client, bucket, *obj.Key)
+			if err != nil {
+				return err
+			}
+			var meta struct {
+				Binlog *struct {
+					File string `json:"file"`
+				} `json:"binlog"`
+			}
+			if err := json.Unmarshal(data, &meta); err != nil {
+				return fmt.Errorf("unable to decode %q: %w", *obj.Key, err)
+			}
+			if meta.Binlog == nil {
+				continue
+			}
+			base, seq, ok := mybinlog.SplitFileName(meta.Binlog.File)
+			if !ok {
+				continue
+			}
+			if current, seen := oldest[base]; !seen || seq < current {
+				oldest[base] = seq
+			}
+		}
+	}
+
+	for _, obj := range binlogs {
+		name, _ := binlogName(*obj.Key, prefix)
+		base, seq, ok := mybinlog.SplitFileName(name)
+		if !ok {
+			continue
+		}
+		if needed, known := oldest[base]; !known || seq >= needed {
+			continue
+		}
+		_, err := s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    obj.Key,
+		})
+		if err != nil {
+			return fmt.Errorf("unable to delete object %q: %w", *obj.Key, err)
+		}
+		log.Printf("Deleted binlog no retained backup needs: %s", *obj.Key)
+	}
+	return nil
+}
+
+// binlogName returns the binary log file name of key, such as
+// mysql-bin.000042 for binlogs/mysql-bin.000042.gz, and whether key is a
+// shipped binlog. Every key below prefix is one, and so is a key outside it
+// named like a binlog, so that binlogs shipped with another DB_BINLOG_PREFIX
+// are never taken for a backup and deleted as such.
+func binlogName(key, prefix string) (string, bool) {
+	if strings.HasPrefix(key, prefix) {
+		return strings.TrimSuffix(strings.TrimPrefix(key, prefix), ".gz"), true
+	}
+	if backupNamePattern.MatchString(lakePartitions.ReplaceAllString(key, "$1")) {
+		return "", false
+	}
+	name := strings.TrimSuffix(path.Base(key), ".gz")
+	_, _, ok := mybinlog.SplitFileName(name)
+	return name, ok
+}
+
+func listObjects(ctx context.Context, s3Client *s3.Client, bucket, prefix string) ([]types.Object, error) {
+	input := &s3.ListObjectsV2Input{Bucket: aws.String(bucket)}
+	if prefix != "" {
+		input.Prefix = aws.String(prefix)
+	}
+
+	var objects []types.Object
+	paginator := s3.NewListObjectsV2Paginator(s3Client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, page.Contents...)
+	}
+	return objects, nil
+}
+
+// backup is every object that belongs to one dump, e.g. the .sql.gz file and
+// its .metadata.json. Retention keeps or deletes them together.
+type backup struct {
+	id           string
+	objects      []types.Object
+	lastModified time.Time
+}
+
+// backupNamePattern matches keys named <database>-<timestamp> followed by an
+// extension or a path below it, optionally under a prefix such as the one of
+// sanitized dumps. The prefix counts as part of the database so that each
+// prefix is retained on its own.
+var backupNamePattern = regexp.MustCompile(`^((?:[^/]+/)*?[^/]+)-(\d{8}T\d{6})(?:[./]|$)`)
+
+// lakePartitions matches the Hive-style directories Parquet files are
+// uploaded under, db=<db>/table=<table>/dt=<day>/, which are named after
+// the backup they belong to.
+var lakePartitions = regexp.MustCompile(`(^|/)db=[^/]+/table=[^/]+/dt=[^/]+/`)
+
+// backupID returns the backup a key belongs to and the database it was taken
+// from. Keys that don't follow the naming scheme are treated as a backup of
+// their own.
+func backupID(key string) (id, database string) {
+	key = lakePartitions.ReplaceAllString(key, "$1")
+	if m := backupNamePattern.FindStringSubmatch(key); m != nil {
+		return m[1] + "-" + m[2], m[1]
+	}
+	return key, extractDatabaseName(key)
+}
+
+func groupBackups(objects []types.Object) map[string][]*backup {
+	backups := make(map[string]*backup)
+	dbBackups := make(map[string][]*backup)
+	for _, obj := range objects {
+		id, dbName := backupID(*obj.Key)
+		b := backups[id]
+		if b == nil {
+			b = &backup{id: id}
+			backups[id] = b
+			dbBackups[dbName] = append(dbBackups[dbName], b)
+		}
+		b.objects = append(b.objects, obj)
+		if obj.LastModified != nil && obj.LastModified.After(b.lastModified) {
+			b.lastModified = *obj.LastModified
+		}
+	}
+	return dbBackups
+}
+
 func extractDatabaseName(filename string) string {
 	parts := strings.Split(filename, "-")
 	if len(parts) > 0 {
@@ -1,11 +1,17 @@
 package mys3
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
@@ -254,6 +260,21 @@ func TestUploadToS3_FileErrors(t *testing.T) {
 	}
 }
 
+func TestUploadStream_EnvironmentValidation(t *testing.T) {
+	originalValues := setupTestEnv(map[string]string{
+		"S3_BUCKET": "",
+	})
+	defer restoreTestEnv(originalValues)
+
+	err := UploadStream("test.sql.gz", strings.NewReader("data"))
+	if err == nil {
+		t.Fatalf("Expected error but got none")
+	}
+	if !strings.Contains(err.Error(), "S3_BUCKET is not set") {
+		t.Errorf("Expected error message to contain %q, got %q", "S3_BUCKET is not set", err.Error())
+	}
+}
+
 func TestKeepOnlyNBackups_ValidationErrors(t *testing.T) {
 	tests := []struct {
 		name           string
@@ -579,3 +600,456 @@ func TestKeepOnlyNBackups_Integration(t *testing.T) {
 		t.Errorf("Integration test failed: %v", err)
 	}
 }
+
+func TestUploadStream_SinglePut(t *testing.T) {
+	fake := newFakeS3(t)
+
+	content := "small dump"
+	if err := UploadStream("small-20230101T120000.sql.gz", strings.NewReader(content)); err != nil {
+		t.Fatalf("UploadStream returned error: %v", err)
+	}
+
+	if got := string(fake.objects["small-20230101T120000.sql.gz"]); got != content {
+		t.Errorf("Uploaded object = %q, want %q", got, content)
+	}
+}
+
+func TestUploadStream_Multipart(t *testing.T) {
+	fake := newFakeS3(t)
+	originalValues := setupTestEnv(map[string]string{
+		"S3_UPLOAD_PART_SIZE_MB": "5",
+		"S3_UPLOAD_CONCURRENCY":  "3",
+	})
+	defer restoreTestEnv(originalValues)
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), (12*1024*1024)/16+7)
+	if err := UploadStream("big-20230101T120000.sql.gz", bytes.NewReader(content)); err != nil {
+		t.Fatalf("UploadStream returned error: %v", err)
+	}
+
+	if got := fake.objects["big-20230101T120000.sql.gz"]; !bytes.Equal(got, content) {
+		t.Errorf("Uploaded object has %d bytes, want %d identical bytes", len(got), len(content))
+	}
+	if len(fake.uploads) != 0 {
+		t.Errorf("Expected no pending multipart uploads, got %d", len(fake.uploads))
+	}
+}
+
+func TestUploadStream_RetriesFailedPart(t *testing.T) {
+	fake := newFakeS3(t)
+	fake.failPart = 2
+	fake.failPartTimes = 1
+	originalValues := setupTestEnv(map[string]string{
+		"S3_UPLOAD_PART_SIZE_MB": "5",
+		"S3_UPLOAD_RETRIES":      "1",
+	})
+	defer restoreTestEnv(originalValues)
+
+	content := bytes.Repeat([]byte{'x'}, 11*1024*1024)
+	if err := UploadStream("retry.sql.gz", bytes.NewReader(content)); err != nil {
+		t.Fatalf("UploadStream returned error: %v", err)
+	}
+	if got := fake.objects["retry.sql.gz"]; !bytes.Equal(got, content) {
+		t.Errorf("Uploaded object has %d bytes, want %d", len(got), len(content))
+	}
+}
+
+func TestUploadStream_AbortsOnFailure(t *testing.T) {
+	fake := newFakeS3(t)
+	fake.failPart = 2
+	fake.failPartTimes = 10
+	originalValues := setupTestEnv(map[string]string{
+		"S3_UPLOAD_PART_SIZE_MB": "5",
+		"S3_UPLOAD_RETRIES":      "0",
+	})
+	defer restoreTestEnv(originalValues)
+
+	content := bytes.Repeat([]byte{'x'}, 11*1024*1024)
+	err := UploadStream("abort.sql.gz", bytes.NewReader(content))
+	if err == nil || !strings.Contains(err.Error(), "unable to upload part 2") {
+		t.Fatalf("Expected part 2 upload error, got %v", err)
+	}
+	if fake.aborted != 1 {
+		t.Errorf("Expected multipart upload to be aborted once, got %d", fake.aborted)
+	}
+	if _, ok := fake.objects["abort.sql.gz"]; ok {
+		t.Errorf("Object should not exist after a failed upload")
+	}
+}
+
+func TestUploadStream_AbortsOnReadError(t *testing.T) {
+	fake := newFakeS3(t)
+	originalValues := setupTestEnv(map[string]string{
+		"S3_UPLOAD_PART_SIZE_MB": "5",
+	})
+	defer restoreTestEnv(originalValues)
+
+	body := io.MultiReader(
+		bytes.NewReader(bytes.Repeat([]byte{'x'}, 6*1024*1024)),
+		iotest.ErrReader(fmt.Errorf("dump failed")),
+	)
+	err := UploadStream("broken.sql.gz", body)
+	if err == nil || !strings.Contains(err.Error(), "dump failed") {
+		t.Fatalf("Expected read error to be returned, got %v", err)
+	}
+	if fake.aborted != 1 {
+		t.Errorf("Expected multipart upload to be aborted once, got %d", fake.aborted)
+	}
+}
+
+func TestUploadStream_SharedConnectionLimit(t *testing.T) {
+	fake := newFakeS3(t)
+	originalValues := setupTestEnv(map[string]string{
+		"S3_UPLOAD_PART_SIZE_MB": "5",
+		"S3_UPLOAD_CONCURRENCY":  "4",
+		"S3_MAX_CONNECTIONS":     "1",
+	})
+	defer restoreTestEnv(originalValues)
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), (12*1024*1024)/16+7)
+	var wg sync.WaitGroup
+	errs := make([]error, 3)
+	for i := range errs {
+		wg.Go(func() {
+			key := fmt.Sprintf("db%d-20230101T120000.sql.gz", i)
+			errs[i] = UploadStream(key, bytes.NewReader(content))
+		})
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("UploadStream %d returned error: %v", i, err)
+		}
+		key := fmt.Sprintf("db%d-20230101T120000.sql.gz", i)
+		if got := fake.objects[key]; !bytes.Equal(got, content) {
+			t.Errorf("Object %s has %d bytes, want %d identical bytes", key, len(got), len(content))
+		}
+	}
+}
+
+// slowReader delays every read, so that a failed part is noticed while the
+// next part is still being read.
+type slowReader struct {
+	r     io.Reader
+	delay time.Duration
+}
+
+func (s slowReader) Read(p []byte) (int, error) {
+	time.Sleep(s.delay)
+	return s.r.Read(p)
+}
+
+func TestUpload_FailureReleasesSharedSlots(t *testing.T) {
+	fake := newFakeS3(t)
+	fake.failPart = 1
+	fake.failPartTimes = 1000
+
+	s3Client, err := newClient(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	opts := uploadOptions{partSize: 16, concurrency: 1, maxConnections: 4}
+	slots := sharedPartSlots(opts.maxConnections)
+
+	// Which of a ready buffer and the cancellation wins is random, so try
+	// often enough to hit both.
+	for i := range 20 {
+		body := io.MultiReader(
+			bytes.NewReader(bytes.Repeat([]byte{'x'}, 16)),
+			slowReader{r: bytes.NewReader(bytes.Repeat([]byte{'y'}, 16*3)), delay: 20 * time.Millisecond},
+		)
+		if _, err := upload(context.Background(), s3Client, "test-bucket", "cancelled.sql.gz", body, -1, opts); err == nil {
+			t.Fatalf("Upload %d: expected part 1 upload error", i)
+		}
+		if held := len(slots); held != 0 {
+			t.Fatalf("Upload %d left %d shared slots held", i, held)
+		}
+	}
+}
+
+func TestUploadOptionsFromEnv(t *testing.T) {
+	tests := []struct {
+		name        string
+		envVars     map[string]string
+		expected    uploadOptions
+		expectError bool
+	}{
+		{
+			name: "defaults",
+			envVars: map[string]string{
+				"S3_UPLOAD_PART_SIZE_MB": "",
+				"S3_UPLOAD_CONCURRENCY":  "",
+				"S3_UPLOAD_RETRIES":      "",
+				"S3_MAX_CONNECTIONS":     "",
+			},
+			expected: uploadOptions{partSize: 16 * 1024 * 1024, concurrency: 4, retries: 3},
+		},
+		{
+			name: "custom values",
+			envVars: map[string]string{
+				"S3_UPLOAD_PART_SIZE_MB": "64",
+				"S3_UPLOAD_CONCURRENCY":  "8",
+				"S3_UPLOAD_RETRIES":      "0",
+				"S3_MAX_CONNECTIONS":     "2",
+			},
+			expected: uploadOptions{partSize: 64 * 1024 * 1024, concurrency: 8, retries: 0, maxConnections: 2},
+		},
+		{
+			name:        "zero max connections",
+			envVars:     map[string]string{"S3_MAX_CONNECTIONS": "0"},
+			expectError: true,
+		},
+		{
+			name:        "part size below S3 minimum",
+			envVars:     map[string]string{"S3_UPLOAD_PART_SIZE_MB": "4"},
+			expectError: true,
+		},
+		{
+			name:        "zero concurrency",
+			envVars:     map[string]string{"S3_UPLOAD_CONCURRENCY": "0"},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originalValues := setupTestEnv(tt.envVars)
+			defer restoreTestEnv(originalValues)
+
+			opts, err := uploadOptionsFromEnv()
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if opts != tt.expected {
+				t.Errorf("uploadOptionsFromEnv() = %+v, want %+v", opts, tt.expected)
+			}
+		})
+	}
+}
+
+func TestPartSizeFor(t *testing.T) {
+	const mb = 1024 * 1024
+	if got := partSizeFor(100*mb, 16*mb); got != 16*mb {
+		t.Errorf("partSizeFor(100MiB) = %d, want %d", got, 16*mb)
+	}
+	size := int64(40 * 1024 * mb)
+	got := partSizeFor(size, 16*mb)
+	if got*maxParts < size {
+		t.Errorf("partSizeFor(40GiB) = %d, which needs more than %d parts", got, maxParts)
+	}
+	if got%mb != 0 {
+		t.Errorf("partSizeFor(40GiB) = %d, want a whole number of MiB", got)
+	}
+}
+
+func TestBackupID(t *testing.T) {
+	tests := []struct {
+		key      string
+		id       string
+		database string
+	}{
+		{"myapp-20230101T120000.sql.gz", "myapp-20230101T120000", "myapp"},
+		{"myapp-20230101T120000.metadata.json", "myapp-20230101T120000", "myapp"},
+		{"my-app-db-20230101T120000.sql.gz", "my-app-db-20230101T120000", "my-app-db"},
+		{"myapp-20230101T120000/users.sql.gz", "myapp-20230101T120000", "myapp"},
+		{"sanitized/myapp-20230101T120000.sql.gz", "sanitized/myapp-20230101T120000", "sanitized/myapp"},
+		{"sanitized/myapp-20230101T120000/users.sql.gz", "sanitized/myapp-20230101T120000", "sanitized/myapp"},
+		{"db=myapp/table=users/dt=2023-01-01/myapp-20230101T120000.parquet", "myapp-20230101T120000", "myapp"},
+		{"sanitized/db=myapp/table=users/dt=2023-01-01/myapp-20230101T120000.00001.parquet", "sanitized/myapp-20230101T120000", "sanitized/myapp"},
+		{"legacy.sql.gz", "legacy.sql.gz", "legacy.sql.gz"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			id, database := backupID(tt.key)
+			if id != tt.id || database != tt.database {
+				t.Errorf("backupID(%q) = (%q, %q), want (%q, %q)", tt.key, id, database, tt.id, tt.database)
+			}
+		})
+	}
+}
+
+func TestKeepOnlyNBackups_KeepsMetadataWithDump(t *testing.T) {
+	fake := newFakeS3(t)
+	originalValues := setupTestEnv(map[string]string{
+		"DB_DUMP_PATH": t.TempDir(),
+	})
+	defer restoreTestEnv(originalValues)
+
+	base := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	for day := range 3 {
+		name := fmt.Sprintf("myapp-202301%02dT120000", day+1)
+		modified := base.Add(time.Duration(day) * 24 * time.Hour)
+		fake.put(name+".sql.gz", []byte("dump"), modified)
+		fake.put(name+".metadata.json", []byte("{}"), modified.Add(time.Minute))
+	}
+	fake.put("other-20230101T120000.sql.gz", []byte("dump"), base)
+
+	if err := KeepOnlyNBackups("2"); err != nil {
+		t.Fatalf("KeepOnlyNBackups returned error: %v", err)
+	}
+
+	expected := []string{
+		"myapp-20230102T120000.metadata.json",
+		"myapp-20230102T120000.sql.gz",
+		"myapp-20230103T120000.metadata.json",
+		"myapp-20230103T120000.sql.gz",
+		"other-20230101T120000.sql.gz",
+	}
+	if got := fake.keys(); strings.Join(got, ",") != strings.Join(expected, ",") {
+		t.Errorf("Remaining objects = %v, want %v", got, expected)
+	}
+}
+
+func TestDownloadAndDelete(t *testing.T) {
+	fake := newFakeS3(t)
+	fake.put("checkpoints/nightly.json", []byte(`{"run_id":"nightly"}`), time.Now())
+
+	data, err := Download("checkpoints/nightly.json")
+	if err != nil {
+		t.Fatalf("Download returned error: %v", err)
+	}
+	if string(data) != `{"run_id":"nightly"}` {
+		t.Errorf("Download() = %q", data)
+	}
+
+	if err := Delete("checkpoints/nightly.json"); err != nil {
+		t.Fatalf("Delete returned error: %v", err)
+	}
+	if _, err := Download("checkpoints/nightly.json"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Download of a deleted key returned %v, want ErrNotFound", err)
+	}
+}
+
+func TestListAndOpen(t *testing.T) {
+	fake := newFakeS3(t)
+	modified := time.Date(2026, 10, 15, 13, 0, 0, 0, time.UTC)
+	fake.put("binlogs/mysql-bin.000001.gz", []byte("binlog one"), modified)
+	fake.put("myapp-20261015T120000.sql.gz", []byte("dump"), modified)
+
+	objects, err := List("binlogs/")
+	if err != nil {
+		t.Fatalf("List returned error: %v", err)
+	}
+	want := []Object{{Key: "binlogs/mysql-bin.000001.gz", Size: 10, LastModified: modified}}
+	if len(objects) != 1 || objects[0].Key != want[0].Key || objects[0].Size != want[0].Size || !objects[0].LastModified.Equal(modified) {
+		t.Errorf("List() = %+v, want %+v", objects, want)
+	}
+
+	body, err := Open("binlogs/mysql-bin.000001.gz")
+	if err != nil {
+		t.Fatalf("Open returned error: %v", err)
+	}
+	data, err := io.ReadAll(body)
+	body.Close()
+	if err != nil || string(data) != "binlog one" {
+		t.Errorf("Open() read %q, %v", data, err)
+	}
+
+	if _, err := Open("binlogs/mysql-bin.000002.gz"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Open of a missing key returned %v, want ErrNotFound", err)
+	}
+}
+
+func TestKeepOnlyNBackups_KeepsNeededBinlogs(t *testing.T) {
+	fake := newFakeS3(t)
+	originalValues := setupTestEnv(map[string]string{
+		"DB_DUMP_PATH":     t.TempDir(),
+		"DB_BINLOG_PREFIX": "",
+	})
+	defer restoreTestEnv(originalValues)
+
+	base := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	for day, file := range []string{"mysql-bin.000010", "mysql-bin.000012", "mysql-bin.000015"} {
+		name := fmt.Sprintf("myapp-202301%02dT120000", day+1)
+		modified := base.Add(time.Duration(day) * 24 * time.Hour)
+		fake.put(name+".sql.gz", []byte("dump"), modified)
+		fake.put(name+".metadata.json", []byte(`{"binlog":{"file":"`+file+`","position":4}}`), modified)
+	}
+	for seq := 9; seq <= 16; seq++ {
+		fake.put(fmt.Sprintf("binlogs/mysql-bin.%06d.gz", seq), []byte("binlog"), base)
+	}
+	fake.put("binlogs/other-bin.000001.gz", []byte("binlog"), base)
+
+	if err := KeepOnlyNBackups("2"); err != nil {
+		t.Fatalf("KeepOnlyNBackups returned error: %v", err)
+	}
+
+	var binlogs []string
+	for _, key := range fake.keys() {
+		if strings.HasPrefix(key, "binlogs/") {
+			binlogs = append(binlogs, key)
+		}
+	}
+	expected := []string{
+		"binlogs/mysql-bin.000012.gz",
+		"binlogs/mysql-bin.000013.gz",
+		"binlogs/mysql-bin.000014.gz",
+		"binlogs/mysql-bin.000015.gz",
+		"binlogs/mysql-bin.000016.gz",
+		"binlogs/other-bin.000001.gz",
+	}
+	if strings.Join(binlogs, ",") != strings.Join(expected, ",") {
+		t.Errorf("Remaining binlogs = %v, want %v", binlogs, expected)
+	}
+}
+
+func TestKeepOnlyNBackups_KeepsBinlogsOfAnotherPrefix(t *testing.T) {
+	fake := newFakeS3(t)
+	originalValues := setupTestEnv(map[string]string{
+		"DB_DUMP_PATH":     t.TempDir(),
+		"DB_BINLOG_PREFIX": "",
+	})
+	defer restoreTestEnv(originalValues)
+
+	base := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	fake.put("myapp-20230101T120000.sql.gz", []byte("dump"), base)
+	fake.put("myapp-20230101T120000.metadata.json", []byte(`{"binlog":{"file":"mysql-bin.000042","position":4}}`), base)
+	for seq := 40; seq <= 44; seq++ {
+		fake.put(fmt.Sprintf("wal/mysql-bin.%06d.gz", seq), []byte("binlog"), base.Add(time.Duration(seq)*time.Minute))
+	}
+
+	if err := KeepOnlyNBackups("1"); err != nil {
+		t.Fatalf("KeepOnlyNBackups returned error: %v", err)
+	}
+
+	expected := []string{
+		"myapp-20230101T120000.metadata.json",
+		"myapp-20230101T120000.sql.gz",
+		"wal/mysql-bin.000042.gz",
+		"wal/mysql-bin.000043.gz",
+		"wal/mysql-bin.000044.gz",
+	}
+	if keys := fake.keys(); strings.Join(keys, ",") != strings.Join(expected, ",") {
+		t.Errorf("Remaining keys = %v, want %v", keys, expected)
+	}
+}
+
+func TestBinlogName(t *testing.T) {
+	tests := []struct {
+		key    string
+		name   string
+		binlog bool
+	}{
+		{key: "binlogs/mysql-bin.000042.gz", name: "mysql-bin.000042", binlog: true},
+		{key: "wal/mysql-bin.000042.gz", name: "mysql-bin.000042", binlog: true},
+		{key: "mysql-bin.000042", name: "mysql-bin.000042", binlog: true},
+		{key: "myapp-20230101T120000.sql.gz"},
+		{key: "myapp-20230101T120000/users.00001.csv.gz"},
+		{key: "sanitized/myapp-20230101T120000.metadata.json"},
+		{key: "notes.txt"},
+	}
+	for _, tt := range tests {
+		name, binlog := binlogName(tt.key, "binlogs/")
+		if binlog != tt.binlog || (binlog && name != tt.name) {
+			t.Errorf("binlogName(%q) = %q, %v, want %q, %v", tt.key, name, binlog, tt.name, tt.binlog)
+		}
+	}
+}
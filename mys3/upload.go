@@ -0,0 +1,357 @@
+package mys3
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	// S3 rejects parts smaller than 5 MiB (except the last one) and uploads
+	// with more than 10000 parts.
+	minPartSize = 5 * 1024 * 1024
+	maxParts    = 10000
+
+	defaultPartSizeMB      = 16
+	defaultPartConcurrency = 4
+	defaultPartRetries     = 3
+)
+
+type uploadOptions struct {
+	partSize       int64
+	concurrency    int
+	retries        int
+	maxConnections int
+}
+
+func uploadOptionsFromEnv() (uploadOptions, error) {
+	opts := uploadOptions{
+		partSize:    defaultPartSizeMB * 1024 * 1024,
+		concurrency: defaultPartConcurrency,
+		retries:     defaultPartRetries,
+	}
+
+	if v := os.Getenv("S3_UPLOAD_PART_SIZE_MB"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || int64(n)*1024*1024 < minPartSize {
+			return opts, fmt.Errorf("invalid S3_UPLOAD_PART_SIZE_MB value %q: must be a number >= 5", v)
+		}
+		opts.partSize = int64(n) * 1024 * 1024
+	}
+
+	if v := os.Getenv("S3_UPLOAD_CONCURRENCY"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return opts, fmt.Errorf("invalid S3_UPLOAD_CONCURRENCY value %q: must be a number >= 1", v)
+		}
+		opts.concurrency = n
+	}
+
+	if v := os.Getenv("S3_UPLOAD_RETRIES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return opts, fmt.Errorf("invalid S3_UPLOAD_RETRIES value %q: must be a number >= 0", v)
+		}
+		opts.retries = n
+	}
+
+	maxConnections, err := maxConnectionsFromEnv()
+	if err != nil {
+		return opts, err
+	}
+	opts.maxConnections = maxConnections
+
+	return opts, nil
+}
+
+// maxConnectionsFromEnv reads S3_MAX_CONNECTIONS, the process-wide limit on
+// parts being buffered or uploaded at once. 0 means no limit beyond each
+// upload's own S3_UPLOAD_CONCURRENCY.
+func maxConnectionsFromEnv() (int, error) {
+	v := os.Getenv("S3_MAX_CONNECTIONS")
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid S3_MAX_CONNECTIONS value %q: must be a number >= 1", v)
+	}
+	return n, nil
+}
+
+var (
+	partSlotsMu sync.Mutex
+	partSlots   chan struct{}
+)
+
+// sharedPartSlots returns the semaphore shared by all uploads in the process
+// when a connection limit is set, so that parallel dumps together never hold
+// more than limit parts in memory or in flight.
+func sharedPartSlots(limit int) chan struct{} {
+	if limit <= 0 {
+		return nil
+	}
+	partSlotsMu.Lock()
+	defer partSlotsMu.Unlock()
+	if cap(partSlots) != limit {
+		partSlots = make(chan struct{}, limit)
+	}
+	return partSlots
+}
+
+// partSizeFor grows the configured part size when a body of known size would
+// otherwise need more parts than S3 allows.
+func partSizeFor(size int64, partSize int64) int64 {
+	if size <= partSize*maxParts {
+		return partSize
+	}
+	const mb = 1024 * 1024
+	needed := (size + maxParts - 1) / maxParts
+	return (needed + mb - 1) / mb * mb
+}
+
+// upload sends body to bucket/key and returns the number of parts used. A
+// body smaller than one part becomes a single PutObject; anything larger is
+// uploaded in parts with at most opts.concurrency parts in flight, so memory
+// use stays at (concurrency+1) * partSize regardless of the body size. Parts
+// are retried with backoff and the multipart upload is aborted on failure so
+// no orphaned parts are left behind. size is -1 when unknown.
+func upload(ctx context.Context, s3Client *s3.Client, bucket, key string, body io.Reader, size int64, opts uploadOptions) (int, error) {
+	partSize := opts.partSize
+	if size >= 0 {
+		partSize = partSizeFor(size, partSize)
+	}
+
+	// Every buffered part holds a slot of the shared semaphore until it is
+	// uploaded. With a shared limit the buffer is dropped rather than kept
+	// for reuse, so the limit also caps memory.
+	slots := sharedPartSlots(opts.maxConnections)
+	acquire := func(ctx context.Context) error {
+		if slots == nil {
+			return nil
+		}
+		select {
+		case slots <- struct{}{}:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	release := func() {
+		if slots != nil {
+			<-slots
+		}
+	}
+
+	buffers := make(chan []byte, opts.concurrency+1)
+	for range opts.concurrency + 1 {
+		buffers <- nil
+	}
+	recycle := func(buf []byte) {
+		if slots != nil {
+			buf = nil
+		}
+		buffers <- buf
+		release()
+	}
+
+	if err := acquire(ctx); err != nil {
+		return 0, err
+	}
+	buf := <-buffers
+	if buf == nil {
+		buf = make([]byte, partSize)
+	}
+	n, err := io.ReadFull(body, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		defer recycle(buf)
+		_, err = s3Client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+			Body:   bytes.NewReader(buf[:n]),
+			ACL:    types.ObjectCannedACLPrivate,
+		})
+		if err != nil {
+			return 0, err
+		}
+		return 1, nil
+	}
+	if err != nil {
+		recycle(buf)
+		return 0, fmt.Errorf("unable to read part 1: %w", err)
+	}
+
+	created, err := s3Client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:            aws.String(bucket),
+		Key:               aws.String(key),
+		ACL:               types.ObjectCannedACLPrivate,
+		ChecksumAlgorithm: types.ChecksumAlgorithmCrc32,
+	})
+	if err != nil {
+		recycle(buf)
+		return 0, fmt.Errorf("unable to start multipart upload: %w", err)
+	}
+
+	partCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var uploadErr error
+	var parts []types.CompletedPart
+
+	fail := func(err error) {
+		mu.Lock()
+		if uploadErr == nil {
+			uploadErr = err
+			cancel()
+		}
+		mu.Unlock()
+	}
+
+	for partNumber := int32(1); ; partNumber++ {
+		if partNumber > maxParts {
+			recycle(buf)
+			fail(fmt.Errorf("stream needs more than %d parts, increase S3_UPLOAD_PART_SIZE_MB", maxParts))
+			break
+		}
+
+		data := buf[:n]
+		wg.Go(func() {
+			defer recycle(data[:cap(data)])
+
+			part, err := uploadPart(partCtx, s3Client, bucket, key, created.UploadId, partNumber, data, opts.retries)
+			if err != nil {
+				fail(err)
+				return
+			}
+
+			mu.Lock()
+			parts = append(parts, types.CompletedPart{
+				ETag:          part.ETag,
+				ChecksumCRC32: part.ChecksumCRC32,
+				PartNumber:    aws.Int32(partNumber),
+			})
+			mu.Unlock()
+		})
+
+		if n < len(buf) {
+			break
+		}
+
+		if err := acquire(partCtx); err != nil {
+			break
+		}
+		cancelled := false
+		select {
+		case buf = <-buffers:
+			// A buffer and a cancellation can be ready at once, and the
+			// select may pick either, so the slot has to be handed back here
+			// too.
+			if partCtx.Err() != nil {
+				recycle(buf)
+				cancelled = true
+			}
+		case <-partCtx.Done():
+			release()
+			cancelled = true
+		}
+		if cancelled {
+			break
+		}
+		if buf == nil {
+			buf = make([]byte, partSize)
+		}
+
+		n, err = io.ReadFull(body, buf)
+		if err == io.EOF {
+			recycle(buf)
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			recycle(buf)
+			fail(fmt.Errorf("unable to read part %d: %w", partNumber+1, err))
+			break
+		}
+	}
+
+	wg.Wait()
+
+	if uploadErr == nil && ctx.Err() != nil {
+		uploadErr = ctx.Err()
+	}
+	if uploadErr != nil {
+		abortUpload(s3Client, bucket, key, created.UploadId)
+		return 0, uploadErr
+	}
+
+	sort.Slice(parts, func(i, j int) bool {
+		return *parts[i].PartNumber < *parts[j].PartNumber
+	})
+
+	_, err = s3Client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(bucket),
+		Key:             aws.String(key),
+		UploadId:        created.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		abortUpload(s3Client, bucket, key, created.UploadId)
+		return 0, fmt.Errorf("unable to complete multipart upload: %w", err)
+	}
+
+	return len(parts), nil
+}
+
+func uploadPart(ctx context.Context, s3Client *s3.Client, bucket, key string, uploadID *string, partNumber int32, data []byte, retries int) (*s3.UploadPartOutput, error) {
+	for attempt := 0; ; attempt++ {
+		part, err := s3Client.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:            aws.String(bucket),
+			Key:               aws.String(key),
+			UploadId:          uploadID,
+			PartNumber:        aws.Int32(partNumber),
+			Body:              bytes.NewReader(data),
+			ChecksumAlgorithm: types.ChecksumAlgorithmCrc32,
+		})
+		if err == nil {
+			return part, nil
+		}
+		if attempt >= retries || ctx.Err() != nil {
+			return nil, fmt.Errorf("unable to upload part %d: %w", partNumber, err)
+		}
+
+		backoff := time.Duration(1<<attempt) * time.Second
+		log.Printf("Retrying part %d of %s in %s after error: %v", partNumber, key, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("unable to upload part %d: %w", partNumber, ctx.Err())
+		}
+	}
+}
+
+// abortUpload uses its own context so that cleanup still happens when the
+// upload itself was cancelled.
+func abortUpload(s3Client *s3.Client, bucket, key string, uploadID *string) {
+	_, err := s3Client.AbortMultipartUpload(context.Background(), &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(key),
+		UploadId: uploadID,
+	})
+	if err != nil {
+		log.Printf("Failed to abort multipart upload of %s: %v", key, err)
+		return
+	}
+	log.Printf("Aborted multipart upload of %s", key)
+}